@@ -2,10 +2,66 @@ package api
 
 import (
 	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
 )
 
 var (
 	ANWeight = "v1.bmlb.l4/weight"
+	// ANProxyProtocol makes haproxy send PROXY protocol header to backends, value is v1 or v2
+	ANProxyProtocol = "v1.bmlb.l4/proxy-protocol"
+	// ANMode is the haproxy proxy mode of a service, value is tcp or http
+	ANMode = "v1.bmlb.l7/mode"
+	// ANPreserveClientIP makes lvs skip masquerading traffic of a service so that pods see real client addresses
+	ANPreserveClientIP = "v1.bmlb.l4/preserve-client-ip"
+	// ANSourceRanges is the same annotation cloud providers use to restrict source ranges if
+	// spec.loadBalancerSourceRanges is empty, value is comma separated cidrs
+	ANSourceRanges = "service.beta.kubernetes.io/load-balancer-source-ranges"
+	// ANScheduler is the ipvs scheduler of a service in lvs mode, value is one of Schedulers
+	ANScheduler = "v1.bmlb.l4/scheduler"
+	// ANForwardMethod is the ipvs forwarding method of a service in lvs mode, value is masq, dr or tunnel.
+	// Real servers of dr and tunnel services must have the VIP configured and reply to clients directly, so
+	// their endpoints must be hostNetwork pods or nodes running kube-bmlb in realserver mode which configures
+	// VIPs on them. Their target ports must be the same as ports as ipvs doesn't translate ports of them
+	ANForwardMethod = "v1.bmlb.l4/forward-method"
+	// ANFWMark makes lvs carry all ports of a service by a single fwmark virtual server instead of one virtual
+	// server per port, value is true or false. Real servers receive packets on the original destination port,
+	// so target ports must be the same as ports
+	ANFWMark = "v1.bmlb.l4/fwmark"
+	// ANPortRanges are extra port ranges of a service in lvs mode which implies ANFWMark, value is comma separated
+	// ports or port ranges like 8000-9000
+	ANPortRanges = "v1.bmlb.l4/port-ranges"
+	// ANIPFamilies are address families of the VIPs of a service, value is IPv4, IPv6 or both separated by comma.
+	// It is the same as spec.ipFamilies of newer kubernetes whose api the vendored one predates
+	ANIPFamilies = "v1.bmlb.l4/ip-families"
+)
+
+const (
+	IPv4 = "IPv4"
+	IPv6 = "IPv6"
+)
+
+// ProtocolSCTP is v1.ProtocolSCTP of newer kubernetes whose api the vendored one predates
+const ProtocolSCTP v1.Protocol = "SCTP"
+
+// Schedulers are the ipvs schedulers supported by kube-bmlb
+var Schedulers = []string{"rr", "wrr", "lc", "wlc", "sh", "dh", "mh"}
+
+const (
+	ProxyProtocolV1 = "v1"
+	ProxyProtocolV2 = "v2"
+
+	ModeTCP  = "tcp"
+	ModeHTTP = "http"
+
+	ForwardMasq   = "masq"
+	ForwardDR     = "dr"
+	ForwardTunnel = "tunnel"
 )
 
 type Weight map[int]uint
@@ -17,3 +73,179 @@ func DecodeL4Weight(weightStr string) (map[int]uint, error) {
 	}
 	return w, nil
 }
+
+func DecodeProxyProtocol(str string) (string, error) {
+	switch str {
+	case "", ProxyProtocolV1, ProxyProtocolV2:
+		return str, nil
+	}
+	return "", fmt.Errorf("invalid proxy protocol version %q, supports %s and %s", str, ProxyProtocolV1, ProxyProtocolV2)
+}
+
+func DecodeMode(str string) (string, error) {
+	switch str {
+	case "":
+		return ModeTCP, nil
+	case ModeTCP, ModeHTTP:
+		return str, nil
+	}
+	return "", fmt.Errorf("invalid mode %q, supports %s and %s", str, ModeTCP, ModeHTTP)
+}
+
+// DecodeScheduler returns the ipvs scheduler, rr by default
+func DecodeScheduler(str string) (string, error) {
+	if str == "" {
+		return Schedulers[0], nil
+	}
+	for _, sched := range Schedulers {
+		if str == sched {
+			return str, nil
+		}
+	}
+	return "", fmt.Errorf("invalid scheduler %q, supports %v", str, Schedulers)
+}
+
+// PortRange is an inclusive range of ports
+type PortRange struct {
+	From, To int32
+}
+
+func (r PortRange) String() string {
+	if r.From == r.To {
+		return strconv.Itoa(int(r.From))
+	}
+	return fmt.Sprintf("%d-%d", r.From, r.To)
+}
+
+// DecodePortRanges parses comma separated ports or port ranges like 80,8000-9000
+func DecodePortRanges(str string) ([]PortRange, error) {
+	var ranges []PortRange
+	for _, item := range strings.Split(str, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "-", 2)
+		var r PortRange
+		for i, part := range parts {
+			port, err := strconv.ParseUint(strings.TrimSpace(part), 10, 16)
+			if err != nil || port == 0 {
+				return nil, fmt.Errorf("invalid port range %q", item)
+			}
+			if i == 0 {
+				r.From, r.To = int32(port), int32(port)
+			} else {
+				r.To = int32(port)
+			}
+		}
+		if r.From > r.To {
+			return nil, fmt.Errorf("invalid port range %q", item)
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+// DecodeForwardMethod returns the ipvs forwarding method, masq by default
+func DecodeForwardMethod(str string) (string, error) {
+	switch str {
+	case "":
+		return ForwardMasq, nil
+	case ForwardMasq, ForwardDR, ForwardTunnel:
+		return str, nil
+	}
+	return "", fmt.Errorf("invalid forward method %q, supports %s, %s and %s", str, ForwardMasq, ForwardDR, ForwardTunnel)
+}
+
+// DecodeFWMark returns true if a service asks for a fwmark virtual server, false by default
+func DecodeFWMark(str string) (bool, error) {
+	if str == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(str)
+}
+
+func DecodePreserveClientIP(str string) (bool, error) {
+	if str == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(str)
+}
+
+// DecodeSourceRanges parses comma separated cidrs
+func DecodeSourceRanges(str string) ([]*net.IPNet, error) {
+	var ranges []*net.IPNet
+	for _, cidr := range strings.Split(str, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid source range %q: %v", cidr, err)
+		}
+		ranges = append(ranges, ipNet)
+	}
+	return ranges, nil
+}
+
+// GetSourceRanges returns allowed source ranges of a service from spec.loadBalancerSourceRanges
+// or ANSourceRanges annotation, empty result means all sources are allowed
+func GetSourceRanges(svc *v1.Service) ([]*net.IPNet, error) {
+	if len(svc.Spec.LoadBalancerSourceRanges) > 0 {
+		return DecodeSourceRanges(strings.Join(svc.Spec.LoadBalancerSourceRanges, ","))
+	}
+	return DecodeSourceRanges(svc.Annotations[ANSourceRanges])
+}
+
+// DecodeIPFamilies parses comma separated IPv4 and IPv6
+func DecodeIPFamilies(str string) ([]string, error) {
+	var families []string
+	for _, family := range strings.Split(str, ",") {
+		family = strings.TrimSpace(family)
+		if family == "" {
+			continue
+		}
+		if family != IPv4 && family != IPv6 {
+			return nil, fmt.Errorf("invalid ip family %q, supports %s and %s", family, IPv4, IPv6)
+		}
+		for _, f := range families {
+			if f == family {
+				return nil, fmt.Errorf("duplicated ip family %q", family)
+			}
+		}
+		families = append(families, family)
+	}
+	return families, nil
+}
+
+// GetIPFamilies returns address families of the VIPs of a service, a service is single stack of primary
+// if it doesn't ask for families
+func GetIPFamilies(svc *v1.Service, primary string) []string {
+	families, err := DecodeIPFamilies(svc.Annotations[ANIPFamilies])
+	if err != nil {
+		glog.Warningf("invalid annotation %s of svc %s/%s: %v", ANIPFamilies, svc.Namespace, svc.Name, err)
+	}
+	if len(families) == 0 {
+		return []string{primary}
+	}
+	return families
+}
+
+// HasIPFamily returns true if svc has a VIP of family
+func HasIPFamily(svc *v1.Service, family, primary string) bool {
+	for _, f := range GetIPFamilies(svc, primary) {
+		if f == family {
+			return true
+		}
+	}
+	return false
+}
+
+// IPFamilyOf returns IPv4 or IPv6
+func IPFamilyOf(ip net.IP) string {
+	if ip.To4() != nil {
+		return IPv4
+	}
+	return IPv6
+}
@@ -0,0 +1,69 @@
+package api
+
+import (
+	"fmt"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// annotationDecoders are the decoders adaptors parse annotations with, by annotation
+var annotationDecoders = []struct {
+	annotation string
+	decode     func(str string) error
+}{
+	{ANWeight, func(str string) error { _, err := DecodeL4Weight(str); return err }},
+	{ANProxyProtocol, func(str string) error { _, err := DecodeProxyProtocol(str); return err }},
+	{ANMode, func(str string) error { _, err := DecodeMode(str); return err }},
+	{ANPreserveClientIP, func(str string) error { _, err := DecodePreserveClientIP(str); return err }},
+	{ANSourceRanges, func(str string) error { _, err := DecodeSourceRanges(str); return err }},
+	{ANScheduler, func(str string) error { _, err := DecodeScheduler(str); return err }},
+	{ANForwardMethod, func(str string) error { _, err := DecodeForwardMethod(str); return err }},
+	{ANFWMark, func(str string) error { _, err := DecodeFWMark(str); return err }},
+	{ANPortRanges, func(str string) error { _, err := DecodePortRanges(str); return err }},
+	{ANIPFamilies, func(str string) error { _, err := DecodeIPFamilies(str); return err }},
+}
+
+// ValidateAnnotations returns errors of kube-bmlb annotations which adaptors can't parse, other annotations
+// are ignored
+func ValidateAnnotations(annotations map[string]string) field.ErrorList {
+	var errs field.ErrorList
+	path := field.NewPath("metadata", "annotations")
+	for _, d := range annotationDecoders {
+		value, ok := annotations[d.annotation]
+		if !ok {
+			continue
+		}
+		if err := d.decode(value); err != nil {
+			errs = append(errs, field.Invalid(path.Key(d.annotation), value, err.Error()))
+		}
+	}
+	return errs
+}
+
+// ValidateTargetPorts returns errors of ports whose target port differs from the port of a fwmark, dr or tunnel
+// service, ipvs doesn't translate ports of them. Named target ports are resolved by endpoints and checked
+// by adaptors.
+func ValidateTargetPorts(svc *v1.Service) field.ErrorList {
+	var kind string
+	if method, err := DecodeForwardMethod(svc.Annotations[ANForwardMethod]); err == nil && (method == ForwardDR || method == ForwardTunnel) {
+		kind = method
+	}
+	// port ranges imply fwmark
+	if fwmark, err := DecodeFWMark(svc.Annotations[ANFWMark]); err == nil && fwmark || svc.Annotations[ANPortRanges] != "" {
+		kind = "fwmark"
+	}
+	if kind == "" {
+		return nil
+	}
+	var errs field.ErrorList
+	path := field.NewPath("spec", "ports")
+	for i, port := range svc.Spec.Ports {
+		if port.TargetPort.Type != intstr.Int || port.TargetPort.IntVal == 0 || port.TargetPort.IntVal == port.Port {
+			continue
+		}
+		errs = append(errs, field.Invalid(path.Index(i).Child("targetPort"), port.TargetPort.IntVal, fmt.Sprintf("must be the same as port %d of a %s service", port.Port, kind)))
+	}
+	return errs
+}
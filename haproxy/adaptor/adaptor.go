@@ -3,27 +3,88 @@ package adaptor
 import (
 	"bytes"
 	"fmt"
+	"sort"
+	"strconv"
+	"sync"
 	"text/template"
 
+	"github.com/chenchun/kube-bmlb/api"
 	"github.com/chenchun/kube-bmlb/haproxy"
+	"github.com/golang/glog"
 	"k8s.io/api/core/v1"
 )
 
 type HAProxyAdaptor struct {
 	headerTplt, frontTplt, backTplt *template.Template
+	header                          haproxy.Header
+	// primaryFamily is the ip family of services which don't ask for families
+	primaryFamily string
+
+	// mu protects proxies
+	mu sync.Mutex
+	// proxies are services having a backend in the last config BuildChecked returns, they map haproxy stats
+	// back to services
+	proxies map[*v1.Service]*ServiceProxy
+}
+
+// ServiceProxy is the frontend and backend of a service in the config
+type ServiceProxy struct {
+	Namespace string           `json:"namespace"`
+	Name      string           `json:"name"`
+	Frontend  haproxy.Frontend `json:"frontend"`
+	Backend   haproxy.Backend  `json:"backend"`
 }
 
-func NewHAProxyAdaptor() *HAProxyAdaptor {
-	return &HAProxyAdaptor{
-		headerTplt: template.Must(template.New("header").Parse(haproxy.GetSampleTemplate())),
-		frontTplt:  template.Must(template.New("front").Parse(haproxy.GetFrontendTemplate())),
-		backTplt:   template.Must(template.New("back").Parse(haproxy.GetBackendTemplate())),
+// NewHAProxyAdaptor creates an adaptor which renders global and defaults sections by headerTemplate,
+// it uses haproxy.GetSampleTemplate if headerTemplate is empty
+func NewHAProxyAdaptor(headerTemplate string) (*HAProxyAdaptor, error) {
+	a := &HAProxyAdaptor{
+		frontTplt:     template.Must(template.New("front").Parse(haproxy.GetFrontendTemplate())),
+		backTplt:      template.Must(template.New("back").Parse(haproxy.GetBackendTemplate())),
+		primaryFamily: api.IPv4,
 	}
+	if err := a.SetHeaderTemplate(headerTemplate); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// SetHeaderTemplate sets the template of global and defaults sections, the sample template is used if it is
+// empty. The current template is kept if headerTemplate is invalid.
+func (a *HAProxyAdaptor) SetHeaderTemplate(headerTemplate string) error {
+	if headerTemplate == "" {
+		headerTemplate = haproxy.GetSampleTemplate()
+	}
+	headerTplt, err := template.New("header").Parse(headerTemplate)
+	if err != nil {
+		return fmt.Errorf("invalid header template: %v", err)
+	}
+	a.headerTplt = headerTplt
+	return nil
+}
+
+// SetHeader sets the data to render global and defaults sections
+func (a *HAProxyAdaptor) SetHeader(header haproxy.Header) {
+	a.header = header
+}
+
+// SetPrimaryFamily sets the ip family of services which don't ask for families, api.IPv4 by default
+func (a *HAProxyAdaptor) SetPrimaryFamily(family string) {
+	a.primaryFamily = family
 }
 
 func (a *HAProxyAdaptor) Build(lbSvcs []*v1.Service, endpoints []*v1.Endpoints) *bytes.Buffer {
+	buf, _ := a.build(lbSvcs, endpoints)
+	return buf
+}
+
+// build renders the config, proxies has each service having a backend
+func (a *HAProxyAdaptor) build(lbSvcs []*v1.Service, endpoints []*v1.Endpoints) (*bytes.Buffer, map[*v1.Service]*ServiceProxy) {
+	proxies := map[*v1.Service]*ServiceProxy{}
 	buf := &bytes.Buffer{}
-	a.headerTplt.Execute(buf, nil)
+	if err := a.headerTplt.Execute(buf, a.header); err != nil {
+		glog.Warningf("failed to render header template: %v", err)
+	}
 	endpointsMap := map[string]map[string][]*v1.Endpoints{} // Namespace->Name->Endpoints
 	for i := range lbSvcs {
 		svc := lbSvcs[i]
@@ -49,17 +110,54 @@ func (a *HAProxyAdaptor) Build(lbSvcs []*v1.Service, endpoints []*v1.Endpoints)
 		if len(endpoints) == 0 {
 			continue
 		}
+		mode, err := api.DecodeMode(svc.Annotations[api.ANMode])
+		if err != nil {
+			glog.Warningf("invalid annotation %s of svc %s/%s: %v", api.ANMode, svc.Namespace, svc.Name, err)
+			mode = api.ModeTCP
+		}
+		proxyProtocol, err := api.DecodeProxyProtocol(svc.Annotations[api.ANProxyProtocol])
+		if err != nil {
+			glog.Warningf("invalid annotation %s of svc %s/%s: %v", api.ANProxyProtocol, svc.Namespace, svc.Name, err)
+		}
+		var sourceRanges []string
+		if ranges, err := api.GetSourceRanges(svc); err != nil {
+			// reject all connections instead of opening to the world
+			glog.Warningf("invalid source ranges of svc %s/%s: %v", svc.Namespace, svc.Name, err)
+			sourceRanges = []string{"0.0.0.0/32"}
+		} else {
+			for _, ipNet := range ranges {
+				sourceRanges = append(sourceRanges, ipNet.String())
+			}
+		}
 		var binds []haproxy.Bind
-		for _, port := range svc.Spec.Ports {
-			//TODO concrete the IP once we defined HA
-			//TODO protocol
-			binds = append(binds, haproxy.Bind{IP: "0.0.0.0", Port: int(port.Port)})
+		for _, family := range api.GetIPFamilies(svc, a.primaryFamily) {
+			for _, port := range svc.Spec.Ports {
+				//TODO concrete the IP once we defined HA
+				if !supportedProtocol(port.Protocol) {
+					continue
+				}
+				// listeners are named by port to map their stats back
+				name := strconv.Itoa(int(port.Port))
+				if family == api.IPv6 {
+					binds = append(binds, haproxy.Bind{IP: "::", Port: int(port.Port), Name: name, V6Only: true})
+				} else {
+					binds = append(binds, haproxy.Bind{IP: "0.0.0.0", Port: int(port.Port), Name: name})
+				}
+			}
+		}
+		if len(binds) == 0 {
+			continue
 		}
-		a.frontTplt.Execute(buf, haproxy.Frontend{
-			Name:           svc.Name,
+		name := proxyName(svc.Namespace, svc.Name)
+		frontend := haproxy.Frontend{
+			Name:           name,
 			Binds:          binds,
-			DefaultBackend: svc.Name,
-		})
+			Mode:           mode,
+			DefaultBackend: name,
+			ForwardFor:     mode == api.ModeHTTP,
+			SourceRanges:   sourceRanges,
+		}
+		a.frontTplt.Execute(buf, frontend)
 		var servers []haproxy.Server
 		for _, edpt := range endpoints {
 			for _, subset := range edpt.Subsets {
@@ -74,10 +172,63 @@ func (a *HAProxyAdaptor) Build(lbSvcs []*v1.Service, endpoints []*v1.Endpoints)
 				}
 			}
 		}
-		a.backTplt.Execute(buf, haproxy.Backend{
-			Name:    svc.Name,
-			Servers: servers,
-		})
+		backend := haproxy.Backend{
+			Name:      name,
+			Servers:   servers,
+			Mode:      mode,
+			SendProxy: sendProxyOption(proxyProtocol),
+		}
+		a.backTplt.Execute(buf, backend)
+		proxies[svc] = &ServiceProxy{Namespace: svc.Namespace, Name: svc.Name, Frontend: frontend, Backend: backend}
 	}
-	return buf
+	return buf, proxies
+}
+
+// proxyName returns the name of the frontend and backend of a service. Namespaces and names can't contain
+// underscores, and haproxy doesn't allow slashes in proxy names.
+func proxyName(namespace, name string) string {
+	return namespace + "_" + name
+}
+
+// Proxies returns services of the last config BuildChecked returns sorted by namespace and name
+func (a *HAProxyAdaptor) Proxies() []*ServiceProxy {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var result []*ServiceProxy
+	for _, proxy := range a.proxies {
+		result = append(result, proxy)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Namespace != result[j].Namespace {
+			return result[i].Namespace < result[j].Namespace
+		}
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// UnsupportedPorts returns ports of svc which haproxy doesn't listen on as it only proxies tcp
+func UnsupportedPorts(svc *v1.Service) []v1.ServicePort {
+	var ports []v1.ServicePort
+	for _, port := range svc.Spec.Ports {
+		if !supportedProtocol(port.Protocol) {
+			ports = append(ports, port)
+		}
+	}
+	return ports
+}
+
+func supportedProtocol(protocol v1.Protocol) bool {
+	return protocol == "" || protocol == v1.ProtocolTCP
+}
+
+// sendProxyOption returns the haproxy server option for the PROXY protocol version
+func sendProxyOption(proxyProtocol string) string {
+	switch proxyProtocol {
+	case api.ProxyProtocolV1:
+		return "send-proxy"
+	case api.ProxyProtocolV2:
+		return "send-proxy-v2"
+	}
+	return ""
 }
@@ -0,0 +1,38 @@
+package adaptor
+
+import (
+	"strings"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestBuildUnsupportedProtocol(t *testing.T) {
+	s1 := &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "s1"}, Spec: v1.ServiceSpec{Ports: []v1.ServicePort{
+		{Name: "dns", Port: 53, Protocol: v1.ProtocolUDP}, {Name: "http", Port: 80, Protocol: v1.ProtocolTCP}}}}
+	s2 := &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "s2"}, Spec: v1.ServiceSpec{Ports: []v1.ServicePort{
+		{Name: "dns", Port: 5353, Protocol: v1.ProtocolUDP}}}}
+	var endpoints []*v1.Endpoints
+	for _, name := range []string{"s1", "s2"} {
+		endpoints = append(endpoints, &v1.Endpoints{ObjectMeta: metav1.ObjectMeta{Name: name}, Subsets: []v1.EndpointSubset{{
+			Addresses: []v1.EndpointAddress{{IP: "192.168.0.2"}},
+			Ports:     []v1.EndpointPort{{Port: 8080}},
+		}}})
+	}
+	a, err := NewHAProxyAdaptor("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := a.Build([]*v1.Service{s1, s2}, endpoints).String()
+	if !strings.Contains(conf, "bind\t0.0.0.0:80\tname\t80") || strings.Contains(conf, ":53\t") {
+		t.Fatal(conf)
+	}
+	// services without any tcp port have no frontend
+	if strings.Contains(conf, "frontend _s2") || strings.Contains(conf, "backend _s2") {
+		t.Fatal(conf)
+	}
+	if ports := UnsupportedPorts(s1); len(ports) != 1 || ports[0].Port != 53 {
+		t.Fatalf("unexpected unsupported ports %v", ports)
+	}
+}
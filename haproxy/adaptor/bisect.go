@@ -0,0 +1,60 @@
+package adaptor
+
+import (
+	"bytes"
+	"fmt"
+
+	"k8s.io/api/core/v1"
+)
+
+// CheckFunc checks whether haproxy accepts the config data, it returns the output of haproxy
+type CheckFunc func(data []byte) ([]byte, error)
+
+// BuildChecked is like Build but excludes services whose config is rejected by check. Rejected services
+// are found by bisecting the services, the returned map contains the haproxy output of each of them. The
+// returned config is accepted by check, an error is returned if haproxy rejects the config without services.
+func (a *HAProxyAdaptor) BuildChecked(lbSvcs []*v1.Service, endpoints []*v1.Endpoints, check CheckFunc) (*bytes.Buffer, map[*v1.Service]string, error) {
+	buf, proxies := a.build(lbSvcs, endpoints)
+	if _, err := check(buf.Bytes()); err == nil {
+		a.setProxies(proxies)
+		return buf, nil, nil
+	}
+	if output, err := check(a.Build(nil, nil).Bytes()); err != nil {
+		// the global and defaults sections are broken, no service is to blame
+		return nil, nil, fmt.Errorf("haproxy rejected global and defaults sections: %v: %s", err, output)
+	}
+	rejected := map[*v1.Service]string{}
+	accepted := map[*v1.Service]bool{}
+	for _, svc := range a.bisect(nil, lbSvcs, endpoints, check, rejected) {
+		accepted[svc] = true
+	}
+	// keep the original order so that the config is stable
+	var filtered []*v1.Service
+	for _, svc := range lbSvcs {
+		if accepted[svc] {
+			filtered = append(filtered, svc)
+		}
+	}
+	buf, proxies = a.build(filtered, endpoints)
+	a.setProxies(proxies)
+	return buf, rejected, nil
+}
+
+// bisect returns good services plus the services in candidates which are accepted together with them
+func (a *HAProxyAdaptor) bisect(good, candidates []*v1.Service, endpoints []*v1.Endpoints, check CheckFunc, rejected map[*v1.Service]string) []*v1.Service {
+	if len(candidates) == 0 {
+		return good
+	}
+	all := append(append([]*v1.Service{}, good...), candidates...)
+	out, err := check(a.Build(all, endpoints).Bytes())
+	if err == nil {
+		return all
+	}
+	if len(candidates) == 1 {
+		rejected[candidates[0]] = fmt.Sprintf("%v: %s", err, out)
+		return good
+	}
+	mid := len(candidates) / 2
+	good = a.bisect(good, candidates[:mid], endpoints, check, rejected)
+	return a.bisect(good, candidates[mid:], endpoints, check, rejected)
+}
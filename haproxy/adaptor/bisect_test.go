@@ -0,0 +1,75 @@
+package adaptor
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestBuildChecked(t *testing.T) {
+	var svcs []*v1.Service
+	var endpoints []*v1.Endpoints
+	for _, name := range []string{"s1", "bad1", "s2", "s3", "bad2", "s4"} {
+		svcs = append(svcs, &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: name}, Spec: v1.ServiceSpec{Ports: []v1.ServicePort{{Port: 80}}}})
+		endpoints = append(endpoints, &v1.Endpoints{ObjectMeta: metav1.ObjectMeta{Name: name}, Subsets: []v1.EndpointSubset{{
+			Addresses: []v1.EndpointAddress{{IP: "192.168.0.2"}},
+			Ports:     []v1.EndpointPort{{Port: 8080}},
+		}}})
+	}
+	check := func(data []byte) ([]byte, error) {
+		if bytes.Contains(data, []byte("frontend _bad")) {
+			return []byte("[ALERT] parsing error"), fmt.Errorf("exit status 1")
+		}
+		return nil, nil
+	}
+	a, err := NewHAProxyAdaptor("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, rejected, err := a.BuildChecked(svcs, endpoints, check)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rejected) != 2 {
+		t.Fatalf("expect 2 rejected services, got %v", rejected)
+	}
+	for svc, output := range rejected {
+		if svc.Name != "bad1" && svc.Name != "bad2" {
+			t.Fatalf("unexpected rejected svc %s", svc.Name)
+		}
+		if output != "exit status 1: [ALERT] parsing error" {
+			t.Fatal(output)
+		}
+	}
+	if expect := a.Build([]*v1.Service{svcs[0], svcs[2], svcs[3], svcs[5]}, endpoints); buf.String() != expect.String() {
+		t.Fatal(buf.String())
+	}
+	// rejected services are not in the config to run
+	var names []string
+	for _, proxy := range a.Proxies() {
+		names = append(names, proxy.Name)
+		if proxy.Frontend.DefaultBackend != proxy.Backend.Name || proxy.Backend.Name != "_"+proxy.Name || len(proxy.Backend.Servers) != 1 || proxy.Backend.Servers[0].Address() != "192.168.0.2:8080" {
+			t.Fatalf("unexpected proxy %+v", proxy)
+		}
+	}
+	if fmt.Sprint(names) != "[s1 s2 s3 s4]" {
+		t.Fatal(names)
+	}
+}
+
+func TestBuildCheckedBrokenHeader(t *testing.T) {
+	a, err := NewHAProxyAdaptor("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(data []byte) ([]byte, error) {
+		return []byte("[ALERT] unknown keyword"), fmt.Errorf("exit status 1")
+	}
+	svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "s1"}, Spec: v1.ServiceSpec{Ports: []v1.ServicePort{{Port: 80}}}}
+	if buf, _, err := a.BuildChecked([]*v1.Service{svc}, nil, check); err == nil || buf != nil {
+		t.Fatalf("expect an error, got %v", err)
+	}
+}
@@ -0,0 +1,29 @@
+package adaptor
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/api/core/v1"
+)
+
+var (
+	haproxyBackends = prometheus.NewGauge(prometheus.GaugeOpts{Name: "bmlb_haproxy_backends",
+		Help: "Number of haproxy backends of the last config."})
+	haproxyServers = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "bmlb_haproxy_servers",
+		Help: "Number of servers of the haproxy backend of a service."}, []string{"namespace", "service"})
+)
+
+func init() {
+	prometheus.MustRegister(haproxyBackends, haproxyServers)
+}
+
+// setProxies records proxies of the config to be run and replaces gauges with servers of each of them
+func (a *HAProxyAdaptor) setProxies(proxies map[*v1.Service]*ServiceProxy) {
+	a.mu.Lock()
+	a.proxies = proxies
+	a.mu.Unlock()
+	haproxyBackends.Set(float64(len(proxies)))
+	haproxyServers.Reset()
+	for svc, proxy := range proxies {
+		haproxyServers.WithLabelValues(svc.Namespace, svc.Name).Set(float64(len(proxy.Backend.Servers)))
+	}
+}
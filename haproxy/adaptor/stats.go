@@ -0,0 +1,207 @@
+package adaptor
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/chenchun/kube-bmlb/haproxy"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ServiceStats are haproxy stats of a service
+type ServiceStats struct {
+	Namespace string        `json:"namespace"`
+	Name      string        `json:"name"`
+	Frontend  *haproxy.Stat `json:"frontend,omitempty"`
+	// Ports are stats of listeners by service port, listeners of both families of a port are summed up
+	Ports   map[string]*haproxy.Stat `json:"ports,omitempty"`
+	Backend *haproxy.Stat            `json:"backend,omitempty"`
+	// Servers are stats of servers by endpoint ip:port
+	Servers map[string]*haproxy.Stat `json:"servers,omitempty"`
+}
+
+// ServiceStats maps rows of show stat back to services of the last config BuildChecked returns, rows of
+// other proxies, e.g. the stats page, are ignored. Result is sorted by namespace and name.
+func (a *HAProxyAdaptor) ServiceStats(stats []haproxy.Stat) []*ServiceStats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	byProxy := map[string]*ServiceStats{}
+	endpoints := map[string]map[string]string{} // proxy->server->endpoint
+	var result []*ServiceStats
+	for svc, proxy := range a.proxies {
+		svcStats := &ServiceStats{Namespace: svc.Namespace, Name: svc.Name}
+		// frontend and backend are both named by proxyName
+		name := proxyName(svc.Namespace, svc.Name)
+		byProxy[name] = svcStats
+		endpoints[name] = map[string]string{}
+		for _, server := range proxy.Backend.Servers {
+			endpoints[name][server.Name] = server.Address()
+		}
+		result = append(result, svcStats)
+	}
+	for i := range stats {
+		stat := stats[i]
+		svcStats, ok := byProxy[stat.ProxyName]
+		if !ok {
+			continue
+		}
+		switch stat.Type {
+		case haproxy.StatFrontend:
+			svcStats.Frontend = &stat
+		case haproxy.StatBackend:
+			svcStats.Backend = &stat
+		case haproxy.StatListener:
+			if svcStats.Ports == nil {
+				svcStats.Ports = map[string]*haproxy.Stat{}
+			}
+			if exist, ok := svcStats.Ports[stat.ServiceName]; ok {
+				addStat(exist, &stat)
+			} else {
+				svcStats.Ports[stat.ServiceName] = &stat
+			}
+		case haproxy.StatServer:
+			endpoint, ok := endpoints[stat.ProxyName][stat.ServiceName]
+			if !ok {
+				continue
+			}
+			if svcStats.Servers == nil {
+				svcStats.Servers = map[string]*haproxy.Stat{}
+			}
+			svcStats.Servers[endpoint] = &stat
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Namespace != result[j].Namespace {
+			return result[i].Namespace < result[j].Namespace
+		}
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// addStat adds counters of b to a
+func addStat(a, b *haproxy.Stat) {
+	a.CurrentQueue += b.CurrentQueue
+	a.CurrentSessions += b.CurrentSessions
+	a.TotalSessions += b.TotalSessions
+	a.BytesIn += b.BytesIn
+	a.BytesOut += b.BytesOut
+	for class, v := range b.HTTPResponses {
+		if a.HTTPResponses == nil {
+			a.HTTPResponses = map[string]uint64{}
+		}
+		a.HTTPResponses[class] += v
+	}
+}
+
+var (
+	serviceLabels       = []string{"namespace", "service"}
+	frontendPortLabels  = []string{"namespace", "service", "port"}
+	frontendBytesLabels = []string{"namespace", "service", "port", "direction"}
+	serverLabels        = []string{"namespace", "service", "endpoint"}
+	serverBytesLabels   = []string{"namespace", "service", "endpoint", "direction"}
+
+	frontendCurrentSessions = prometheus.NewDesc("bmlb_haproxy_frontend_current_sessions",
+		"Current sessions of frontend listeners of a service port.", frontendPortLabels, nil)
+	frontendSessions = prometheus.NewDesc("bmlb_haproxy_frontend_sessions_total",
+		"Sessions of frontend listeners of a service port.", frontendPortLabels, nil)
+	frontendBytes = prometheus.NewDesc("bmlb_haproxy_frontend_bytes_total",
+		"Bytes of frontend listeners of a service port by direction, in is from clients.", frontendBytesLabels, nil)
+	frontendResponses = prometheus.NewDesc("bmlb_haproxy_frontend_http_responses_total",
+		"HTTP responses of the frontend of a service by code class.", append(serviceLabels, "code"), nil)
+	backendCurrentQueue = prometheus.NewDesc("bmlb_haproxy_backend_current_queue",
+		"Requests of the backend of a service queued for no server available.", serviceLabels, nil)
+	backendUp = prometheus.NewDesc("bmlb_haproxy_backend_up",
+		"Whether the backend of a service has any server up.", serviceLabels, nil)
+	serverCurrentSessions = prometheus.NewDesc("bmlb_haproxy_server_current_sessions",
+		"Current sessions of a server of a service.", serverLabels, nil)
+	serverSessions = prometheus.NewDesc("bmlb_haproxy_server_sessions_total",
+		"Sessions of a server of a service.", serverLabels, nil)
+	serverBytes = prometheus.NewDesc("bmlb_haproxy_server_bytes_total",
+		"Bytes of a server of a service by direction, in is from clients.", serverBytesLabels, nil)
+	serverCurrentQueue = prometheus.NewDesc("bmlb_haproxy_server_current_queue",
+		"Requests queued for a server of a service.", serverLabels, nil)
+	serverUp = prometheus.NewDesc("bmlb_haproxy_server_up",
+		"Whether a server of a service passes health checks.", serverLabels, nil)
+	serverResponses = prometheus.NewDesc("bmlb_haproxy_server_http_responses_total",
+		"HTTP responses of a server of a service by code class.", append(serverLabels, "code"), nil)
+)
+
+// StatsCollector exports haproxy stats of services as metrics of sessions, bytes, http responses, queues and
+// health of frontends by port, backends and servers by endpoint on each scrape
+type StatsCollector struct {
+	// stats returns stats of services, nil if they can't be read
+	stats func() []*ServiceStats
+}
+
+func NewStatsCollector(stats func() []*ServiceStats) *StatsCollector {
+	return &StatsCollector{stats: stats}
+}
+
+// Describe implements prometheus.Collector
+func (c *StatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{frontendCurrentSessions, frontendSessions, frontendBytes, frontendResponses,
+		backendCurrentQueue, backendUp, serverCurrentSessions, serverSessions, serverBytes, serverCurrentQueue, serverUp, serverResponses} {
+		ch <- desc
+	}
+}
+
+// Collect implements prometheus.Collector
+func (c *StatsCollector) Collect(ch chan<- prometheus.Metric) {
+	metric := func(desc *prometheus.Desc, typ prometheus.ValueType, value uint64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, typ, float64(value), labels...)
+	}
+	for _, s := range c.stats() {
+		for _, port := range sortedKeys(s.Ports) {
+			stat := s.Ports[port]
+			metric(frontendCurrentSessions, prometheus.GaugeValue, stat.CurrentSessions, s.Namespace, s.Name, port)
+			metric(frontendSessions, prometheus.CounterValue, stat.TotalSessions, s.Namespace, s.Name, port)
+			metric(frontendBytes, prometheus.CounterValue, stat.BytesIn, s.Namespace, s.Name, port, "in")
+			metric(frontendBytes, prometheus.CounterValue, stat.BytesOut, s.Namespace, s.Name, port, "out")
+		}
+		if s.Frontend != nil {
+			collectResponses(ch, frontendResponses, s.Frontend, s.Namespace, s.Name)
+		}
+		if s.Backend != nil {
+			metric(backendCurrentQueue, prometheus.GaugeValue, s.Backend.CurrentQueue, s.Namespace, s.Name)
+			metric(backendUp, prometheus.GaugeValue, up(s.Backend), s.Namespace, s.Name)
+		}
+		for _, endpoint := range sortedKeys(s.Servers) {
+			stat := s.Servers[endpoint]
+			metric(serverCurrentSessions, prometheus.GaugeValue, stat.CurrentSessions, s.Namespace, s.Name, endpoint)
+			metric(serverSessions, prometheus.CounterValue, stat.TotalSessions, s.Namespace, s.Name, endpoint)
+			metric(serverBytes, prometheus.CounterValue, stat.BytesIn, s.Namespace, s.Name, endpoint, "in")
+			metric(serverBytes, prometheus.CounterValue, stat.BytesOut, s.Namespace, s.Name, endpoint, "out")
+			metric(serverCurrentQueue, prometheus.GaugeValue, stat.CurrentQueue, s.Namespace, s.Name, endpoint)
+			metric(serverUp, prometheus.GaugeValue, up(stat), s.Namespace, s.Name, endpoint)
+			collectResponses(ch, serverResponses, stat, s.Namespace, s.Name, endpoint)
+		}
+	}
+}
+
+func collectResponses(ch chan<- prometheus.Metric, desc *prometheus.Desc, stat *haproxy.Stat, labels ...string) {
+	for _, class := range haproxy.ResponseClasses {
+		v, ok := stat.HTTPResponses[class]
+		if !ok {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(v), append(labels[:len(labels):len(labels)], class)...)
+	}
+}
+
+// up returns 1 if status is UP or going down, e.g. "UP 1/3"
+func up(stat *haproxy.Stat) uint64 {
+	if strings.HasPrefix(stat.Status, "UP") {
+		return 1
+	}
+	return 0
+}
+
+func sortedKeys(m map[string]*haproxy.Stat) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,85 @@
+package adaptor
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/chenchun/kube-bmlb/api"
+	"github.com/chenchun/kube-bmlb/haproxy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestServiceStats(t *testing.T) {
+	svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "s1", Annotations: map[string]string{api.ANIPFamilies: "IPv4,IPv6"}},
+		Spec: v1.ServiceSpec{Ports: []v1.ServicePort{{Port: 80}}}}
+	endpoints := []*v1.Endpoints{{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "s1"}, Subsets: []v1.EndpointSubset{{
+		Addresses: []v1.EndpointAddress{{IP: "192.168.0.2"}, {IP: "192.168.0.3"}},
+		Ports:     []v1.EndpointPort{{Port: 8080}},
+	}}}}
+	// a service of the same name in another namespace
+	other := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "ns2", Name: "s1"}, Spec: v1.ServiceSpec{Ports: []v1.ServicePort{{Port: 81}}}}
+	endpoints = append(endpoints, &v1.Endpoints{ObjectMeta: metav1.ObjectMeta{Namespace: "ns2", Name: "s1"}, Subsets: []v1.EndpointSubset{{
+		Addresses: []v1.EndpointAddress{{IP: "192.168.0.4"}},
+		Ports:     []v1.EndpointPort{{Port: 8080}},
+	}}})
+	a, err := NewHAProxyAdaptor("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, _, _ := a.BuildChecked([]*v1.Service{svc, other}, endpoints, func([]byte) ([]byte, error) { return nil, nil })
+	if !strings.Contains(buf.String(), "bind	0.0.0.0:80	name	80\n	bind	[::]:80	name	80	v6only\n") {
+		t.Fatal(buf.String())
+	}
+	svcStats := a.ServiceStats([]haproxy.Stat{
+		{ProxyName: "stats", ServiceName: "FRONTEND", Type: haproxy.StatFrontend, TotalSessions: 1},
+		{ProxyName: "ns_s1", ServiceName: "FRONTEND", Type: haproxy.StatFrontend, TotalSessions: 5, HTTPResponses: map[string]uint64{"2xx": 4, "5xx": 1}},
+		{ProxyName: "ns_s1", ServiceName: "80", Type: haproxy.StatListener, TotalSessions: 3, BytesIn: 100},
+		{ProxyName: "ns_s1", ServiceName: "80", Type: haproxy.StatListener, TotalSessions: 2, BytesIn: 50},
+		{ProxyName: "ns_s1", ServiceName: "s1-0", Type: haproxy.StatServer, Status: "UP", TotalSessions: 5, CurrentQueue: 1},
+		{ProxyName: "ns_s1", ServiceName: "s1-1", Type: haproxy.StatServer, Status: "DOWN"},
+		{ProxyName: "ns_s1", ServiceName: "BACKEND", Type: haproxy.StatBackend, Status: "UP", CurrentQueue: 2},
+		{ProxyName: "ns2_s1", ServiceName: "81", Type: haproxy.StatListener, TotalSessions: 7},
+		{ProxyName: "ns2_s1", ServiceName: "s1-0", Type: haproxy.StatServer, Status: "UP", TotalSessions: 7},
+	})
+	if len(svcStats) != 2 || svcStats[0].Namespace != "ns" || svcStats[0].Name != "s1" || svcStats[1].Namespace != "ns2" {
+		t.Fatalf("unexpected %+v", svcStats)
+	}
+	if port := svcStats[1].Ports["81"]; port == nil || port.TotalSessions != 7 || svcStats[1].Servers["192.168.0.4:8080"] == nil || svcStats[1].Ports["80"] != nil {
+		t.Fatalf("unexpected stats of ns2/s1 %+v", svcStats[1])
+	}
+	// listeners of both families are summed up
+	if port := svcStats[0].Ports["80"]; port == nil || port.TotalSessions != 5 || port.BytesIn != 150 {
+		t.Fatalf("unexpected port stats %+v", port)
+	}
+	if len(svcStats[0].Servers) != 2 || svcStats[0].Servers["192.168.0.2:8080"].TotalSessions != 5 {
+		t.Fatalf("unexpected server stats %+v", svcStats[0].Servers)
+	}
+	r := prometheus.NewRegistry()
+	r.MustRegister(NewStatsCollector(func() []*ServiceStats { return svcStats }))
+	families, err := r.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := bytes.NewBuffer(nil)
+	for _, family := range families {
+		expfmt.MetricFamilyToText(out, family)
+	}
+	for _, line := range []string{
+		`bmlb_haproxy_frontend_sessions_total{namespace="ns",port="80",service="s1"} 5`,
+		`bmlb_haproxy_frontend_bytes_total{direction="in",namespace="ns",port="80",service="s1"} 150`,
+		`bmlb_haproxy_frontend_http_responses_total{code="5xx",namespace="ns",service="s1"} 1`,
+		`bmlb_haproxy_backend_current_queue{namespace="ns",service="s1"} 2`,
+		`bmlb_haproxy_backend_up{namespace="ns",service="s1"} 1`,
+		`bmlb_haproxy_server_current_queue{endpoint="192.168.0.2:8080",namespace="ns",service="s1"} 1`,
+		`bmlb_haproxy_server_up{endpoint="192.168.0.2:8080",namespace="ns",service="s1"} 1`,
+		`bmlb_haproxy_server_up{endpoint="192.168.0.3:8080",namespace="ns",service="s1"} 0`,
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Fatalf("expect %s in %s", line, out.String())
+		}
+	}
+}
@@ -9,27 +9,91 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/golang/glog"
 )
 
+// State is the state of the supervised haproxy master process
+type State string
+
+const (
+	StateStopped State = "stopped"
+	StateRunning State = "running"
+	// StateCrashed means haproxy master exited unexpectedly and is waiting to be restarted
+	StateCrashed State = "crashed"
+)
+
+const (
+	minRestartBackoff = time.Second
+	maxRestartBackoff = 30 * time.Second
+	// master which keeps running longer than stableDuration resets the restart backoff
+	stableDuration = time.Minute
+)
+
+// Status is a snapshot of the supervised haproxy master process
+type Status struct {
+	State State
+	// Pid is the pid of haproxy master, 0 if not running
+	Pid int
+	// Restarts is the number of times haproxy master is restarted after crashing
+	Restarts int
+}
+
 type Haproxy struct {
 	ConfigChan chan *bytes.Buffer
 	confFile   string
 	pidFile    string
 	cmdPath    string
 	lastConf   []byte
+	// lastGoodFile keeps a copy of the last checked config haproxy is started or reloaded with
+	lastGoodFile string
+	// pendingConf is the config written to confFile while master is crashed, master is restarted with it
+	// instead of the last good config
+	pendingConf []byte
+
+	mu        sync.Mutex
+	status    Status
+	master    *os.Process
+	startedAt time.Time
+	// exitChan receives the wait result of haproxy master
+	exitChan chan error
+	// backoff is the delay before restarting a crashed master
+	backoff time.Duration
+	// applied is the last config haproxy master is started or reloaded with successfully
+	applied []byte
 }
 
-func NewHaproxy() *Haproxy {
+func NewHaproxy(cmdPath, confFile, pidFile string) *Haproxy {
 	return &Haproxy{
-		ConfigChan: make(chan *bytes.Buffer),
-		confFile:   "/etc/haproxy/haproxy.cfg",
-		pidFile:    "/var/run/haproxy.pid",
-		cmdPath:    "/usr/local/sbin/haproxy",
+		ConfigChan:   make(chan *bytes.Buffer),
+		confFile:     confFile,
+		lastGoodFile: confFile + ".last-good",
+		pidFile:      pidFile,
+		cmdPath:      cmdPath,
+		status:       Status{State: StateStopped},
+		exitChan:     make(chan error, 1),
+		backoff:      minRestartBackoff,
 	}
 }
 
+// AppliedConfig returns the last config haproxy runs with, nil if haproxy never runs
+func (h *Haproxy) AppliedConfig() []byte {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.applied
+}
+
+// Status returns the status of haproxy master process
+func (h *Haproxy) Status() Status {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.status
+}
+
+// buildConf writes the config which is already checked by CheckConfig
 func (h *Haproxy) buildConf(data []byte) error {
 	h.lastConf = data
 	tmpFile := h.confFile + ".tmp"
@@ -39,15 +103,67 @@ func (h *Haproxy) buildConf(data []byte) error {
 	if err := ioutil.WriteFile(tmpFile, data, 0644); err != nil {
 		return fmt.Errorf("failed to write conf %s: %v", h.confFile, err)
 	}
-	if status, err := h.checkConfigs(tmpFile); err != nil {
-		return fmt.Errorf("haproxy config file is invalid, %s, err %v", string(status), err)
-	}
 	if err := os.Rename(tmpFile, h.confFile); err != nil {
 		return fmt.Errorf("can't rename %s to %s", tmpFile, h.confFile)
 	}
 	return nil
 }
 
+// CheckConfig checks whether haproxy accepts the config data, it returns the output of haproxy
+func (h *Haproxy) CheckConfig(data []byte) ([]byte, error) {
+	checkFile := h.confFile + ".check"
+	if err := os.MkdirAll(filepath.Dir(checkFile), 0755); err != nil {
+		return nil, fmt.Errorf("failed to mkdir for conf %s: %v", checkFile, err)
+	}
+	if err := ioutil.WriteFile(checkFile, data, 0644); err != nil {
+		return nil, fmt.Errorf("failed to write conf %s: %v", checkFile, err)
+	}
+	defer os.Remove(checkFile)
+	return h.checkConfigs(checkFile)
+}
+
+// setApplied records the config haproxy master is started or reloaded with successfully
+func (h *Haproxy) setApplied(data []byte) {
+	h.mu.Lock()
+	h.applied = data
+	h.mu.Unlock()
+}
+
+// saveLastGood keeps a copy of the config haproxy is about to run with. It is written before haproxy reads
+// confFile so that it is never older than the config master runs with.
+func (h *Haproxy) saveLastGood(data []byte) {
+	tmpFile := h.lastGoodFile + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, data, 0644); err != nil {
+		glog.Warningf("failed to write last good conf %s: %v", tmpFile, err)
+		return
+	}
+	if err := os.Rename(tmpFile, h.lastGoodFile); err != nil {
+		glog.Warningf("can't rename %s to %s: %v", tmpFile, h.lastGoodFile, err)
+	}
+}
+
+// restoreLastGood prepares confFile for restarting a crashed master and returns the config in it, nil if
+// unknown. Master always runs with confFile so that reloads read new configs, it is the config written while
+// master is crashed, otherwise the last good config is copied over it.
+func (h *Haproxy) restoreLastGood() []byte {
+	if h.pendingConf != nil {
+		h.saveLastGood(h.pendingConf)
+		return h.pendingConf
+	}
+	data, err := ioutil.ReadFile(h.lastGoodFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			glog.Warningf("failed to read last good conf %s: %v", h.lastGoodFile, err)
+		}
+		return nil
+	}
+	if err := h.buildConf(data); err != nil {
+		glog.Warningf("failed to restore last good conf: %v", err)
+		return nil
+	}
+	return data
+}
+
 func (h *Haproxy) readPids() (pids []string) {
 	data, err := ioutil.ReadFile(h.pidFile)
 	if err != nil && !os.IsNotExist(err) {
@@ -76,12 +192,13 @@ func (h *Haproxy) checkConfigs(file string) ([]byte, error) {
 	return cmd.CombinedOutput()
 }
 
-// Restart gracefully restarts haproxy by starting new haproxy with -sf [oldpids ...] option
-// refer: https://www.haproxy.org/download/1.7/doc/management.txt (4. Stopping and restarting HAProxy)
-func (h *Haproxy) restart() error {
-	cmd := exec.Cmd{
+// start starts haproxy in master-worker mode without daemonizing, so that the master can be supervised.
+// Old haproxy processes in the pid file, e.g. left by a previous bmlb, are asked to finish by -sf [oldpids ...]
+// refer: https://www.haproxy.org/download/1.8/doc/management.txt (4. Stopping and restarting HAProxy)
+func (h *Haproxy) start() error {
+	cmd := &exec.Cmd{
 		Path:   h.cmdPath,
-		Args:   append([]string{h.cmdPath, "-f", h.confFile, "-D", "-p", h.pidFile, "-sf"}, h.readPids()...),
+		Args:   append([]string{h.cmdPath, "-W", "-f", h.confFile, "-p", h.pidFile, "-sf"}, h.readPids()...),
 		Stdout: os.Stdout,
 		Stderr: os.Stderr,
 	}
@@ -89,14 +206,61 @@ func (h *Haproxy) restart() error {
 	if err := cmd.Start(); err != nil {
 		return fmt.Errorf("failed to start haproxy: %v", err)
 	}
-	if err := cmd.Wait(); err != nil {
-		return fmt.Errorf("failed to wait haproxy: %v", err)
+	h.mu.Lock()
+	h.master = cmd.Process
+	h.startedAt = time.Now()
+	h.status.State = StateRunning
+	h.status.Pid = cmd.Process.Pid
+	h.mu.Unlock()
+	go func() {
+		h.exitChan <- cmd.Wait()
+	}()
+	glog.Infof("haproxy master %d started", cmd.Process.Pid)
+	return nil
+}
+
+// restart starts haproxy master if it is not running, otherwise it asks the master to reload
+// configs by sending SIGUSR2. The master starts new workers and gracefully stops old ones.
+func (h *Haproxy) restart() error {
+	h.mu.Lock()
+	master := h.master
+	h.mu.Unlock()
+	if master == nil {
+		return h.start()
+	}
+	if err := master.Signal(syscall.SIGUSR2); err != nil {
+		return fmt.Errorf("failed to reload haproxy master %d: %v", master.Pid, err)
 	}
-	glog.Infof("haproxy restarted")
+	glog.Infof("haproxy master %d reloaded", master.Pid)
 	return nil
 }
 
+// onExit records the exit of haproxy master and returns the delay before restarting it
+func (h *Haproxy) onExit(err error) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	glog.Warningf("haproxy master %d exited: %v", h.status.Pid, err)
+	if time.Since(h.startedAt) > stableDuration {
+		h.backoff = minRestartBackoff
+	}
+	delay := h.backoff
+	h.backoff *= 2
+	if h.backoff > maxRestartBackoff {
+		h.backoff = maxRestartBackoff
+	}
+	h.master = nil
+	h.status.State = StateCrashed
+	h.status.Pid = 0
+	h.status.Restarts++
+	restarts.Inc()
+	// configs are rebuilt on next syncing even if they are unchanged
+	h.lastConf = nil
+	return delay
+}
+
 func (h *Haproxy) Run() {
+	// restartChan fires when a crashed master should be restarted
+	var restartChan <-chan time.Time
 	for {
 		select {
 		case buf := <-h.ConfigChan:
@@ -107,10 +271,43 @@ func (h *Haproxy) Run() {
 			}
 			if err := h.buildConf(data); err != nil {
 				glog.Warning(err)
+				reloads.WithLabelValues("failure").Inc()
+				h.lastConf = nil
+				break
+			}
+			if restartChan != nil {
+				// master crashed, it will be started with the new config soon
+				h.pendingConf = data
 				break
 			}
+			h.saveLastGood(data)
 			if err := h.restart(); err != nil {
 				glog.Warningf("haproxy fails to restart: %v", err)
+				reloads.WithLabelValues("failure").Inc()
+				h.lastConf = nil
+				break
+			}
+			reloads.WithLabelValues("success").Inc()
+			h.setApplied(data)
+		case err := <-h.exitChan:
+			delay := h.onExit(err)
+			glog.Infof("restarting haproxy in %v", delay)
+			restartChan = time.After(delay)
+		case <-restartChan:
+			restartChan = nil
+			data := h.restoreLastGood()
+			glog.Infof("restarting haproxy")
+			if err := h.start(); err != nil {
+				glog.Warningf("haproxy fails to restart: %v", err)
+				restartChan = time.After(h.onExit(err))
+				break
+			}
+			if h.pendingConf != nil {
+				reloads.WithLabelValues("success").Inc()
+				h.pendingConf = nil
+			}
+			if data != nil {
+				h.setApplied(data)
 			}
 		}
 	}
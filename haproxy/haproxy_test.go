@@ -0,0 +1,87 @@
+package haproxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSupervise(t *testing.T) {
+	dir, err := ioutil.TempDir("", "haproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// a fake haproxy master which crashes immediately
+	cmdPath := filepath.Join(dir, "haproxy")
+	if err := ioutil.WriteFile(cmdPath, []byte("#!/bin/sh\nexit 1\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	h := NewHaproxy(cmdPath, filepath.Join(dir, "haproxy.cfg"), filepath.Join(dir, "haproxy.pid"))
+	h.lastConf = []byte("global")
+	if err := h.start(); err != nil {
+		t.Fatal(err)
+	}
+	if status := h.Status(); status.State != StateRunning || status.Pid == 0 {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	select {
+	case err := <-h.exitChan:
+		if err == nil {
+			t.Fatal("expect exit error")
+		}
+		if delay := h.onExit(err); delay != minRestartBackoff {
+			t.Fatalf("expect delay %v, got %v", minRestartBackoff, delay)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting haproxy exit")
+	}
+	if status := h.Status(); status.State != StateCrashed || status.Pid != 0 || status.Restarts != 1 {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	if h.lastConf != nil {
+		t.Fatal("expect lastConf reset")
+	}
+	if h.backoff != 2*minRestartBackoff {
+		t.Fatalf("expect backoff doubled, got %v", h.backoff)
+	}
+}
+
+func TestRestoreLastGood(t *testing.T) {
+	dir, err := ioutil.TempDir("", "haproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	h := NewHaproxy("haproxy", filepath.Join(dir, "haproxy.cfg"), filepath.Join(dir, "haproxy.pid"))
+	if data := h.restoreLastGood(); data != nil {
+		t.Fatalf("expect nothing without a last good config, got %q", data)
+	}
+	h.saveLastGood([]byte("global"))
+	// master crashed with a config written after the last good one
+	if err := h.buildConf([]byte("global\n  nbthread 4")); err != nil {
+		t.Fatal(err)
+	}
+	// the last good config is copied over confFile which master always runs with
+	if data := h.restoreLastGood(); string(data) != "global" {
+		t.Fatalf("expect the last good config, got %q", data)
+	}
+	if data, _ := ioutil.ReadFile(h.confFile); string(data) != "global" {
+		t.Fatalf("expect the last good config in %s, got %q", h.confFile, data)
+	}
+	// a config written while master is crashed is newer than the last good one
+	if err := h.buildConf([]byte("global\n  maxconn 100")); err != nil {
+		t.Fatal(err)
+	}
+	h.pendingConf = h.lastConf
+	if data := h.restoreLastGood(); string(data) != "global\n  maxconn 100" {
+		t.Fatalf("expect the pending config, got %q", data)
+	}
+	for _, file := range []string{h.confFile, h.lastGoodFile} {
+		if data, _ := ioutil.ReadFile(file); string(data) != "global\n  maxconn 100" {
+			t.Fatalf("expect the pending config in %s, got %q", file, data)
+		}
+	}
+}
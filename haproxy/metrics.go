@@ -0,0 +1,14 @@
+package haproxy
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	reloads = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "bmlb_haproxy_reloads_total",
+		Help: "Config reloads of haproxy by result, success or failure."}, []string{"result"})
+	restarts = prometheus.NewCounter(prometheus.CounterOpts{Name: "bmlb_haproxy_restarts_total",
+		Help: "Restarts of haproxy master after it exited unexpectedly."})
+)
+
+func init() {
+	prometheus.MustRegister(reloads, restarts)
+}
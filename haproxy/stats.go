@@ -0,0 +1,135 @@
+package haproxy
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StatType is the type of a row of show stat
+type StatType int
+
+const (
+	StatFrontend StatType = 0
+	StatBackend  StatType = 1
+	StatServer   StatType = 2
+	// StatListener rows are sockets of frontends having option socket-stats
+	StatListener StatType = 3
+)
+
+// statsTimeout is the timeout of reading stats from the stats socket
+const statsTimeout = 5 * time.Second
+
+// Stat is a row of show stat, see 9.1 of https://www.haproxy.org/download/1.8/doc/management.txt.
+// Counters missing in a row, e.g. queue of frontends, are zero.
+type Stat struct {
+	// ProxyName is the name of the frontend or backend
+	ProxyName string `json:"pxname"`
+	// ServiceName is FRONTEND, BACKEND, name of a server or name of a listener
+	ServiceName string   `json:"svname"`
+	Type        StatType `json:"type"`
+	// Status is e.g. OPEN of frontends, UP or DOWN of backends and servers
+	Status string `json:"status,omitempty"`
+	// Address is ip:port of servers, haproxy 1.7 or later
+	Address         string `json:"addr,omitempty"`
+	CurrentQueue    uint64 `json:"qcur"`
+	CurrentSessions uint64 `json:"scur"`
+	TotalSessions   uint64 `json:"stot"`
+	BytesIn         uint64 `json:"bin"`
+	BytesOut        uint64 `json:"bout"`
+	// HTTPResponses are numbers of http responses by 1xx, 2xx, 3xx, 4xx, 5xx and other, only of http mode
+	HTTPResponses map[string]uint64 `json:"hrsp,omitempty"`
+	// CheckStatus is the status of the last health check of servers
+	CheckStatus string `json:"check_status,omitempty"`
+}
+
+// ResponseClasses are classes of http response codes in show stat
+var ResponseClasses = []string{"1xx", "2xx", "3xx", "4xx", "5xx", "other"}
+
+// ReadStats reads stats by show stat from the stats socket of haproxy
+func ReadStats(socket string) ([]Stat, error) {
+	conn, err := net.DialTimeout("unix", socket, statsTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to haproxy stats socket %s: %v", socket, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(statsTimeout))
+	if _, err := conn.Write([]byte("show stat\n")); err != nil {
+		return nil, fmt.Errorf("failed to write to haproxy stats socket %s: %v", socket, err)
+	}
+	return ParseStats(conn)
+}
+
+// ParseStats parses the csv output of show stat. Columns are looked up by the header line since haproxy
+// appends columns in new versions.
+func ParseStats(r io.Reader) ([]Stat, error) {
+	br := bufio.NewReader(r)
+	header, err := br.ReadString('\n')
+	if err != nil && header == "" {
+		return nil, fmt.Errorf("failed to read stats header: %v", err)
+	}
+	if !strings.HasPrefix(header, "# ") {
+		return nil, fmt.Errorf("invalid stats header %q", strings.TrimSpace(header))
+	}
+	columns := map[string]int{}
+	for i, name := range strings.Split(strings.TrimRight(strings.TrimPrefix(header, "# "), ",\n"), ",") {
+		columns[name] = i
+	}
+	reader := csv.NewReader(br)
+	reader.FieldsPerRecord = -1
+	var stats []Stat
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid stats: %v", err)
+		}
+		if len(record) == 1 && record[0] == "" {
+			continue
+		}
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return record[i]
+			}
+			return ""
+		}
+		counter := func(name string) uint64 {
+			v, _ := strconv.ParseUint(field(name), 10, 64)
+			return v
+		}
+		typ, err := strconv.Atoi(field("type"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid type of stats row %v", record)
+		}
+		stat := Stat{
+			ProxyName:       field("pxname"),
+			ServiceName:     field("svname"),
+			Type:            StatType(typ),
+			Status:          field("status"),
+			Address:         field("addr"),
+			CurrentQueue:    counter("qcur"),
+			CurrentSessions: counter("scur"),
+			TotalSessions:   counter("stot"),
+			BytesIn:         counter("bin"),
+			BytesOut:        counter("bout"),
+			CheckStatus:     field("check_status"),
+		}
+		for _, class := range ResponseClasses {
+			if v := field("hrsp_" + class); v != "" {
+				if stat.HTTPResponses == nil {
+					stat.HTTPResponses = map[string]uint64{}
+				}
+				stat.HTTPResponses[class] = counter("hrsp_" + class)
+			}
+		}
+		stats = append(stats, stat)
+	}
+	return stats, nil
+}
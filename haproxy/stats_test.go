@@ -0,0 +1,81 @@
+package haproxy
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// sampleStats is show stat output of haproxy 1.8 with columns after check_status trimmed
+const sampleStats = `# pxname,svname,qcur,qmax,scur,smax,slim,stot,bin,bout,dreq,dresp,ereq,econ,eresp,wretr,wredis,status,weight,act,bck,chkfail,chkdown,lastchg,downtime,qlimit,pid,iid,sid,throttle,lbtot,tracked,type,rate,rate_lim,rate_max,check_status,check_code,check_duration,hrsp_1xx,hrsp_2xx,hrsp_3xx,hrsp_4xx,hrsp_5xx,hrsp_other,hanafail,req_rate,req_rate_max,req_tot,cli_abrt,srv_abrt,comp_in,comp_out,comp_byp,comp_rsp,lastsess,last_chk,last_agt,qtime,ctime,rtime,ttime,agent_status,agent_code,agent_duration,check_desc,agent_desc,check_rise,check_fall,check_health,agent_rise,agent_fall,agent_health,addr,cookie,mode,algo,conn_rate,conn_rate_max,conn_tot,intercepted,dcon,dses,
+s1,FRONTEND,,,2,5,8000,120,10240,20480,0,0,3,,,,,OPEN,,,,,,,,,1,2,0,,,,0,1,0,4,,,,0,100,2,5,1,0,,1,4,108,,,0,0,0,0,,,,,,,,,,,,,,,,,,,,,http,,1,4,120,0,0,0,
+s1,80,,,2,5,8000,120,10240,20480,0,0,3,,,,,OPEN,,,,,,,,,1,2,1,,,,3,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,,http,,,,,,,,
+s1,s1-0,1,3,2,4,,118,10000,20000,,0,,0,0,0,0,UP,1,1,0,0,0,1000,0,,1,3,1,,118,,2,1,,4,L4OK,,0,0,98,2,5,1,0,0,,,,0,0,,,,,2,,,0,0,1,1,,,,Layer4 check passed,,2,3,4,,,,192.168.0.2:8080,,http,,,,,,,,
+s1,s1-1,0,0,0,0,,0,0,0,,0,,0,0,0,0,DOWN,1,1,0,1,1,60,60,,1,3,2,,0,,2,0,,0,L4CON,,0,0,0,0,0,0,0,0,,,,0,0,,,,,-1,,,0,0,0,0,,,,Layer4 connection problem,,2,3,0,,,,192.168.0.3:8080,,http,,,,,,,,
+s1,BACKEND,1,3,2,5,800,120,10240,20480,0,0,,0,0,0,0,UP,1,1,0,,0,1000,0,,1,3,0,,118,,1,1,,4,,,,0,100,2,5,1,0,,,,120,0,0,0,0,0,0,2,,,0,0,1,1,,,,,,,,,,,,,,http,roundrobin,,,,,,,
+
+`
+
+func TestParseStats(t *testing.T) {
+	stats, err := ParseStats(strings.NewReader(sampleStats))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 5 {
+		t.Fatalf("expect 5 rows, got %d: %+v", len(stats), stats)
+	}
+	expect := []Stat{
+		{ProxyName: "s1", ServiceName: "FRONTEND", Type: StatFrontend, Status: "OPEN", CurrentSessions: 2, TotalSessions: 120, BytesIn: 10240, BytesOut: 20480,
+			HTTPResponses: map[string]uint64{"1xx": 0, "2xx": 100, "3xx": 2, "4xx": 5, "5xx": 1, "other": 0}},
+		{ProxyName: "s1", ServiceName: "80", Type: StatListener, Status: "OPEN", CurrentSessions: 2, TotalSessions: 120, BytesIn: 10240, BytesOut: 20480},
+		{ProxyName: "s1", ServiceName: "s1-0", Type: StatServer, Status: "UP", Address: "192.168.0.2:8080", CurrentQueue: 1, CurrentSessions: 2, TotalSessions: 118, BytesIn: 10000, BytesOut: 20000,
+			HTTPResponses: map[string]uint64{"1xx": 0, "2xx": 98, "3xx": 2, "4xx": 5, "5xx": 1, "other": 0}, CheckStatus: "L4OK"},
+	}
+	for i := range expect {
+		if !reflect.DeepEqual(stats[i], expect[i]) {
+			t.Fatalf("expect %+v, got %+v", expect[i], stats[i])
+		}
+	}
+	if stats[3].Status != "DOWN" || stats[4].Type != StatBackend || stats[4].CurrentQueue != 1 {
+		t.Fatalf("unexpected %+v", stats[3:])
+	}
+	if _, err := ParseStats(strings.NewReader("Unknown command\n")); err == nil {
+		t.Fatal("expect error")
+	}
+}
+
+func TestReadStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "haproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "stats.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if cmd, _ := bufio.NewReader(conn).ReadString('\n'); cmd == "show stat\n" {
+			conn.Write([]byte(sampleStats))
+		}
+	}()
+	stats, err := ReadStats(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 5 {
+		t.Fatalf("expect 5 rows, got %d", len(stats))
+	}
+}
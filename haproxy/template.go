@@ -1,17 +1,36 @@
 package haproxy
 
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// statsAuthPattern matches stats auth lines of haproxy config
+var statsAuthPattern = regexp.MustCompile(`(?m)^(\s*stats\s+auth\s+)\S.*$`)
+
+// RedactConfig replaces credentials of stats auth lines in haproxy config so that it can be shown to users
+func RedactConfig(data []byte) []byte {
+	return statsAuthPattern.ReplaceAll(data, []byte("${1}<redacted>"))
+}
+
+// GetSampleTemplate returns the default template of global and defaults sections which renders Header.
+// Don't set daemon in global section since haproxy master is supervised by kube-bmlb. It uses threads
+// instead of processes so that the stats socket reports stats of all of them.
 func GetSampleTemplate() string {
 	return `# haproxy sample from kube-bmlb
 global
 	maxconn	20000
 	ulimit-n	16384
 	log	127.0.0.1	local0
-	uid	200
-	gid	200
-	chroot	/var/empty
-	nbproc	4
-	daemon
-
+{{if .UID}}	uid	{{.UID}}
+{{end}}{{if .GID}}	gid	{{.GID}}
+{{end}}{{if .Chroot}}	chroot	{{.Chroot}}
+{{end}}{{if .NbThread}}	nbthread	{{.NbThread}}
+{{end}}{{if .StatsSocket}}	stats	socket	{{.StatsSocket}}	mode	600	level	user
+{{end}}{{if .StatsAuth}}
 listen stats
 	bind	:8081
 	mode	http
@@ -19,20 +38,69 @@ listen stats
 	stats	hide-version
 	stats	realm Haproxy\ Statistics  # Title text for popup window
 	stats	uri /
-	stats	auth	admin:admin
-`
+	stats	auth	{{.StatsAuth.Username}}:{{.StatsAuth.Password}}
+{{end}}`
+}
+
+// Header is the data to render global and defaults sections of haproxy config
+type Header struct {
+	// StatsAuth is the credential of stats page, the page is disabled if it is nil
+	StatsAuth *StatsAuth
+	// StatsSocket is the path of the unix socket kube-bmlb reads stats from, no socket if empty
+	StatsSocket string
+	// UID and GID are the user and group haproxy workers run as, haproxy doesn't change them if 0
+	UID int
+	GID int
+	// Chroot is the directory haproxy workers chroot to, no chroot if empty
+	Chroot string
+	// NbThread is the number of threads of haproxy workers, haproxy decides it if 0
+	NbThread int
+}
+
+type StatsAuth struct {
+	Username string
+	Password string
+}
+
+// Validate returns an error if the credential can't be written as a haproxy config word. Spaces separate
+// words, # starts a comment and backslashes and quotes are unquoted by haproxy, the username is followed by a
+// colon.
+func (a *StatsAuth) Validate() error {
+	if a.Username == "" || a.Password == "" {
+		return fmt.Errorf("username and password should not be empty")
+	}
+	if strings.IndexFunc(a.Username, invalidWordRune) >= 0 || strings.Contains(a.Username, ":") {
+		return fmt.Errorf("username should not contain spaces, control characters, colons or any of %s", specialChars)
+	}
+	if strings.IndexFunc(a.Password, invalidWordRune) >= 0 {
+		return fmt.Errorf("password should not contain spaces, control characters or any of %s", specialChars)
+	}
+	return nil
+}
+
+// specialChars are characters of special meaning in haproxy config words
+const specialChars = `#\"'`
+
+func invalidWordRune(r rune) bool {
+	return r <= ' ' || r == 0x7f || strings.ContainsRune(specialChars, r)
 }
 
 func GetFrontendTemplate() string {
 	return `
 frontend {{.Name}}{{range .Binds}}
-	bind	{{.IP}}:{{.Port}}{{end}}
-{{if ne .Mode ""}}	Mode	{{.Mode}}{{end}}
-	log	global
+	bind	{{.Address}}{{if .Name}}	name	{{.Name}}{{end}}{{if .V6Only}}	v6only{{end}}{{end}}
+{{if ne .Mode ""}}	mode	{{.Mode}}
+{{end}}{{if .ForwardFor}}	option	forwardfor
+	http-request	set-header	X-Forwarded-Proto	https	if	{ ssl_fc }
+	http-request	set-header	X-Forwarded-Proto	http	if	!{ ssl_fc }
+{{end}}{{if .SourceRanges}}	acl	allowed_src	src{{range .SourceRanges}}	{{.}}{{end}}
+	tcp-request	connection	reject	if	!allowed_src
+{{end}}	log	global
 	option	httplog
 	option	dontlognull
 	option	nolinger
 	option	http_proxy
+	option	socket-stats
 	maxconn	8000
 	timeout	client	30s
 	default_backend	{{.DefaultBackend}}
@@ -40,27 +108,47 @@ frontend {{.Name}}{{range .Binds}}
 }
 
 type Frontend struct {
-	Name           string
-	Binds          []Bind
-	Mode           string
-	DefaultBackend string
+	Name           string `json:"name"`
+	Binds          []Bind `json:"binds"`
+	Mode           string `json:"mode,omitempty"`
+	DefaultBackend string `json:"defaultBackend"`
+	// ForwardFor inserts X-Forwarded-For and X-Forwarded-Proto headers, only works in http mode
+	ForwardFor bool `json:"forwardFor,omitempty"`
+	// SourceRanges rejects connections from sources not in the cidrs if not empty
+	SourceRanges []string `json:"sourceRanges,omitempty"`
 }
 
 type Bind struct {
-	IP   string
-	Port int
+	IP   string `json:"ip"`
+	Port int    `json:"port"`
+	// Name is the name of the listener in stats
+	Name string `json:"name,omitempty"`
+	// V6Only keeps an IPv6 wildcard bind from accepting IPv4 connections of the IPv4 wildcard bind
+	V6Only bool `json:"v6only,omitempty"`
+}
+
+// Address returns ip:port, IPv6 addresses are enclosed in square brackets
+func (b Bind) Address() string {
+	return net.JoinHostPort(b.IP, strconv.Itoa(b.Port))
 }
 
 type Backend struct {
-	Name    string
-	Servers []Server
-	Mode    string
+	Name    string   `json:"name"`
+	Servers []Server `json:"servers"`
+	Mode    string   `json:"mode,omitempty"`
+	// SendProxy is the server option to send PROXY protocol header, send-proxy or send-proxy-v2
+	SendProxy string `json:"sendProxy,omitempty"`
 }
 
 type Server struct {
-	Name string
-	IP   string
-	Port int
+	Name string `json:"name"`
+	IP   string `json:"ip"`
+	Port int    `json:"port"`
+}
+
+// Address returns ip:port, IPv6 addresses are enclosed in square brackets
+func (s Server) Address() string {
+	return net.JoinHostPort(s.IP, strconv.Itoa(s.Port))
 }
 
 func GetBackendTemplate() string {
@@ -71,6 +159,6 @@ backend {{.Name}}{{if ne .Mode ""}}
 	timeout	server	5s
 	retries	2
 	balance	roundrobin{{range .Servers}}
-	server	{{.Name}}	{{.IP}}:{{.Port}}	check{{end}}
+	server	{{.Name}}	{{.Address}}	check{{if ne $.SendProxy ""}}	{{$.SendProxy}}{{end}}{{end}}
 `
 }
@@ -31,3 +31,110 @@ backend test-proxy-srv
 	server	pod2	10.0.0.2:80	check
 `, buf.String())
 }
+
+func TestGetFrontendTemplate(t *testing.T) {
+	tplt := template.Must(template.New("letter").Parse(GetFrontendTemplate()))
+	frontend := Frontend{
+		Name:           "test-proxy-srv",
+		Binds:          []Bind{{IP: "0.0.0.0", Port: 80}},
+		Mode:           "http",
+		DefaultBackend: "test-proxy-srv",
+		ForwardFor:     true,
+	}
+	buf := &bytes.Buffer{}
+	tplt.Execute(buf, frontend)
+	assert.Equal(t, `
+frontend test-proxy-srv
+	bind	0.0.0.0:80
+	mode	http
+	option	forwardfor
+	http-request	set-header	X-Forwarded-Proto	https	if	{ ssl_fc }
+	http-request	set-header	X-Forwarded-Proto	http	if	!{ ssl_fc }
+	log	global
+	option	httplog
+	option	dontlognull
+	option	nolinger
+	option	http_proxy
+	option	socket-stats
+	maxconn	8000
+	timeout	client	30s
+	default_backend	test-proxy-srv
+`, buf.String())
+}
+
+func TestGetBackendTemplateSendProxy(t *testing.T) {
+	tplt := template.Must(template.New("letter").Parse(GetBackendTemplate()))
+	backend := Backend{
+		Name:      "test-proxy-srv",
+		SendProxy: "send-proxy-v2",
+		Servers: []Server{
+			{Name: "pod1", IP: "10.0.0.1", Port: 80},
+		},
+	}
+	buf := &bytes.Buffer{}
+	tplt.Execute(buf, backend)
+	assert.Equal(t, `
+backend test-proxy-srv
+	timeout	connect	5s
+	timeout	server	5s
+	retries	2
+	balance	roundrobin
+	server	pod1	10.0.0.1:80	check	send-proxy-v2
+`, buf.String())
+}
+
+func TestGetSampleTemplate(t *testing.T) {
+	tplt := template.Must(template.New("letter").Parse(GetSampleTemplate()))
+	buf := &bytes.Buffer{}
+	tplt.Execute(buf, Header{})
+	assert.NotContains(t, buf.String(), "listen stats")
+	assert.NotContains(t, buf.String(), "stats	socket")
+	assert.NotContains(t, buf.String(), "chroot")
+	buf.Reset()
+	tplt.Execute(buf, Header{UID: 99, GID: 98, Chroot: "/var/empty", NbThread: 2})
+	assert.Contains(t, buf.String(), "	uid	99\n	gid	98\n	chroot	/var/empty\n	nbthread	2\n")
+	buf.Reset()
+	tplt.Execute(buf, Header{StatsSocket: "/var/run/haproxy-stats.sock"})
+	assert.Contains(t, buf.String(), "	stats	socket	/var/run/haproxy-stats.sock	mode	600	level	user\n")
+	buf.Reset()
+	tplt.Execute(buf, Header{StatsAuth: &StatsAuth{Username: "user", Password: "secret"}})
+	assert.Contains(t, buf.String(), "listen stats")
+	assert.Contains(t, buf.String(), "	stats	auth	user:secret\n")
+}
+
+func TestStatsAuthValidate(t *testing.T) {
+	assert.NoError(t, (&StatsAuth{Username: "admin", Password: "p@ss:w0rd!"}).Validate())
+	for _, auth := range []StatsAuth{
+		{Username: "admin"},
+		{Username: "ad:min", Password: "secret"},
+		{Username: "admin", Password: "sec ret"},
+		{Username: "admin", Password: "secret#1"},
+		{Username: "admin", Password: "secret\n"},
+		{Username: "admin", Password: `"secret"`},
+		{Username: `ad\min`, Password: "secret"},
+	} {
+		assert.Error(t, auth.Validate(), "%+v", auth)
+	}
+}
+
+func TestRedactConfig(t *testing.T) {
+	config := "listen stats\n\tstats\tenable\n\tstats\tauth\tuser:secret\n  stats auth admin:pass # comment\n"
+	assert.Equal(t, "listen stats\n\tstats\tenable\n\tstats\tauth\t<redacted>\n  stats auth <redacted>\n", string(RedactConfig([]byte(config))))
+}
+
+func TestTemplateIPv6(t *testing.T) {
+	tplt := template.Must(template.New("letter").Parse(GetFrontendTemplate()))
+	buf := &bytes.Buffer{}
+	tplt.Execute(buf, Frontend{
+		Name:  "test-proxy-srv",
+		Binds: []Bind{{IP: "0.0.0.0", Port: 80, Name: "80"}, {IP: "::", Port: 80, Name: "80", V6Only: true}},
+	})
+	assert.Contains(t, buf.String(), "\n	bind	0.0.0.0:80	name	80\n	bind	[::]:80	name	80	v6only\n")
+	tplt = template.Must(template.New("letter").Parse(GetBackendTemplate()))
+	buf.Reset()
+	tplt.Execute(buf, Backend{
+		Name:    "test-proxy-srv",
+		Servers: []Server{{Name: "pod1", IP: "fd00::1", Port: 80}},
+	})
+	assert.Contains(t, buf.String(), "	server	pod1	[fd00::1]:80	check\n")
+}
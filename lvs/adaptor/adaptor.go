@@ -3,57 +3,239 @@ package adaptor
 import (
 	"fmt"
 	"net"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/chenchun/kube-bmlb/api"
 	"github.com/chenchun/kube-bmlb/lvs"
+	"github.com/chenchun/kube-bmlb/utils/conntrack"
 	"github.com/chenchun/kube-bmlb/utils/dbus"
 	"github.com/chenchun/kube-bmlb/utils/ipset"
 	"github.com/chenchun/kube-bmlb/utils/iptables"
+	"github.com/chenchun/kube-bmlb/utils/nftables"
 	"github.com/chenchun/kube-bmlb/utils/sysctl"
 	"github.com/docker/libnetwork/ipvs"
 	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
 	"k8s.io/api/core/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/utils/exec"
 )
 
 type LVSAdaptor struct {
 	lvsHandler           lvs.Interface
-	iptHandler           iptables.Interface
-	ipsetHandler         ipset.Interface
+	dataPath             dataPath
 	virtualServerAddress net.IP
+	// dataPathKind is DataPathIptables or DataPathNftables of dataPath
+	dataPathKind string
+	// schedulers are the ipvs schedulers kernel supports, nil if unknown
+	schedulers sets.String
+	// probeSchedulers gets schedulers kernel supports again when services ask for a missing one, nil to not probe
+	probeSchedulers func() (sets.String, error)
+	// lastProbe is when schedulers were probed last time
+	lastProbe time.Time
+	// owned are virtual servers created by kube-bmlb, others are never touched
+	owned *ownership
+	// conntrack deletes udp flows to removed real servers
+	conntrack conntrack.Interface
+	// reported are namespace/name of services whose metrics are reported
+	reported sets.String
+
+	// mu protects fields below and serializes Build with rebuilding the data path after firewalld reloads
+	mu sync.Mutex
+	// lastServiceMap and lastFWMarkMap are services of the last Build to rebuild the data path, nil before Build
+	lastServiceMap map[v1.Protocol]map[int32][]*v1.Service
+	lastFWMarkMap  map[uint32]*v1.Service
+	// lastEndpointsMap is namespace:name:endpoints of services of the last Build
+	lastEndpointsMap map[string]map[string][]*v1.Endpoints
+	// errs are errors of the running Build
+	errs []error
+	// staleFlows select conntrack entries of flows to removed real servers of the running Build, they are
+	// deleted together at the end of Build
+	staleFlows []conntrack.Filter
+}
+
+// verifyPeriod is the interval to verify data path rules are not changed by others
+const verifyPeriod = 10 * time.Second
+
+// probeSchedulersPeriod is the min interval to probe schedulers again, probing walks the module directory
+const probeSchedulersPeriod = time.Minute
+
+// Options are options of LVSAdaptor
+type Options struct {
+	// OwnershipFile records virtual servers created by kube-bmlb
+	OwnershipFile string
+	// IPSetBackend is ipset.BackendExec or ipset.BackendNetlink
+	IPSetBackend string
+	// DataPath is DataPathAuto, DataPathIptables or DataPathNftables
+	DataPath string
 }
 
-func NewLVSAdaptor(virtualServerAddress net.IP) *LVSAdaptor {
-	return &LVSAdaptor{
+// NewLVSAdaptor creates a LVSAdaptor which records virtual servers it owns in opts.OwnershipFile.
+// It only handles virtual servers of the address family of virtualServerAddress, dual-stack needs one of each family.
+func NewLVSAdaptor(virtualServerAddress net.IP, opts Options) *LVSAdaptor {
+	schedulers, err := lvs.GetAvailableSchedulers()
+	if err != nil {
+		glog.Warningf("failed to get available ipvs schedulers: %v", err)
+	}
+	a := &LVSAdaptor{
 		lvsHandler:           lvs.New(),
-		iptHandler:           iptables.New(exec.New(), dbus.New(), iptables.ProtocolIpv4),
-		ipsetHandler:         ipset.New(exec.New()),
-		virtualServerAddress: virtualServerAddress}
+		virtualServerAddress: virtualServerAddress,
+		schedulers:           schedulers,
+		probeSchedulers:      lvs.GetAvailableSchedulers,
+		lastProbe:            time.Now(),
+		owned:                newOwnership(opts.OwnershipFile),
+		conntrack:            conntrack.NewDefault(exec.New())}
+	kind := opts.DataPath
+	if kind == DataPathAuto || kind == "" {
+		kind = detectDataPath(exec.New())
+	}
+	if kind == DataPathNftables {
+		a.dataPath = newNftablesDataPath(virtualServerAddress, nftables.New(exec.New()))
+	} else {
+		if kind != DataPathIptables {
+			glog.Warningf("unknown data path %s, using %s", kind, DataPathIptables)
+			kind = DataPathIptables
+		}
+		ipsetHandler, err := ipset.NewBackend(opts.IPSetBackend, exec.New())
+		if err != nil {
+			glog.Warningf("failed to use ipset backend %s, falling back to %s: %v", opts.IPSetBackend, ipset.BackendExec, err)
+			ipsetHandler = ipset.New(exec.New())
+		}
+		protocol := iptables.ProtocolIpv4
+		if isIPv6(virtualServerAddress) {
+			protocol = iptables.ProtocolIpv6
+		}
+		iptHandler := iptables.New(exec.New(), dbus.New(), protocol)
+		// firewalld flushes all rules when reloading
+		iptHandler.AddReloadFunc(a.rebuildDataPath)
+		a.dataPath = newIptablesDataPath(virtualServerAddress, iptHandler, ipsetHandler)
+	}
+	a.dataPathKind = kind
+	glog.Infof("lvs data path of %s is %s", virtualServerAddress, kind)
+	prometheus.MustRegister(newStatsCollector(a))
+	return a
+}
+
+// Run verifies data path rules periodically and rebuilds them if they were changed by others
+func (a *LVSAdaptor) Run() {
+	wait.Forever(a.verifyDataPath, verifyPeriod)
+}
+
+func (a *LVSAdaptor) verifyDataPath() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.lastServiceMap == nil {
+		return
+	}
+	changed, err := a.dataPath.changed(a.lastFWMarkMap)
+	if err != nil {
+		glog.Warningf("failed to verify data path rules: %v", err)
+		lvsErrors.WithLabelValues("verify_data_path").Inc()
+		return
+	}
+	if changed {
+		glog.Warningf("data path rules of kube-bmlb were changed by others, rebuilding")
+		if err := a.dataPath.sync(a.lastServiceMap, a.lastFWMarkMap); err != nil {
+			glog.Warning(err)
+			lvsErrors.WithLabelValues("sync_data_path").Inc()
+		}
+	}
+}
+
+// rebuildDataPath rebuilds data path rules of the last Build
+func (a *LVSAdaptor) rebuildDataPath() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.lastServiceMap == nil {
+		return
+	}
+	glog.Infof("rebuilding %s rules after firewalld reloaded", a.dataPathKind)
+	if err := a.dataPath.sync(a.lastServiceMap, a.lastFWMarkMap); err != nil {
+		glog.Warning(err)
+		lvsErrors.WithLabelValues("sync_data_path").Inc()
+	}
 }
 
 func (a *LVSAdaptor) checkSysctl() {
+	// ipvs sysctls are under ipv4 for both families
 	if err := sysctl.EnsureSysctl("net/ipv4/vs/conntrack", 1); err != nil {
 		glog.Warningf("failed to ensure net/ipv4/vs/conntrack: %v", err)
 	}
+	// ipvs drops packets of connections to removed real servers instead of holding them until they expire
+	if err := sysctl.EnsureSysctl("net/ipv4/vs/expire_nodest_conn", 1); err != nil {
+		glog.Warningf("failed to ensure net/ipv4/vs/expire_nodest_conn: %v", err)
+	}
+	if isIPv6(a.virtualServerAddress) {
+		// masquerading IPv6 virtual servers forwards packets to real servers, IPv6 forwarding is off by default
+		if err := sysctl.EnsureSysctl("net/ipv6/conf/all/forwarding", 1); err != nil {
+			glog.Warningf("failed to ensure net/ipv6/conf/all/forwarding: %v", err)
+		}
+	}
 }
 
-func (a *LVSAdaptor) Build(lbSvcs []*v1.Service, endpoints []*v1.Endpoints) {
+// Build syncs virtual servers, real servers and the data path of lbSvcs. Failed operations don't stop
+// the others, the returned error has all of them and they are retried on next Build.
+func (a *LVSAdaptor) Build(lbSvcs []*v1.Service, endpoints []*v1.Endpoints) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.errs = nil
+	a.build(lbSvcs, endpoints)
+	a.deleteStaleFlows()
+	return utilerrors.NewAggregate(a.errs)
+}
+
+func (a *LVSAdaptor) build(lbSvcs []*v1.Service, endpoints []*v1.Endpoints) {
 	a.checkSysctl()
+	a.checkSchedulers(lbSvcs)
 	endpointsMap := map[string]map[string][]*v1.Endpoints{} // Namespace->Name->Endpoints
 	// virtual server is like 10.0.0.2:8080, service has allocated ports in annotation
 	// so build a map which maps ports to service
-	portServiceMap := []map[int32][]*v1.Service{{}, {}} //protocol port:service array
+	portServiceMap := map[v1.Protocol]map[int32][]*v1.Service{} //protocol:port:services
+	// services using fwmark virtual servers carry all their ports by a single virtual server
+	fwmarkMap := fwmarkServices(lbSvcs, a.lastFWMarkMap, a.owned.fwmarks())
+	fwmarkSvcs := map[*v1.Service]bool{}
+	for _, svc := range fwmarkMap {
+		fwmarkSvcs[svc] = true
+	}
 	for i := range lbSvcs {
 		svc := lbSvcs[i]
 		if _, ok := endpointsMap[svc.Namespace]; !ok {
 			endpointsMap[svc.Namespace] = map[string][]*v1.Endpoints{}
 		}
 		endpointsMap[svc.Namespace][svc.Name] = []*v1.Endpoints{}
+		if fwmarkSvcs[svc] {
+			continue
+		}
 		for _, port := range svc.Spec.Ports {
-			protocolMap := portServiceMap[protolcolIndex(port.Protocol)]
-			protocolMap[port.Port] = append(protocolMap[port.Port], svc)
+			protocol := port.Protocol
+			if protocol == "" {
+				protocol = v1.ProtocolTCP
+			}
+			if _, ok := portServiceMap[protocol]; !ok {
+				portServiceMap[protocol] = map[int32][]*v1.Service{}
+			}
+			portServiceMap[protocol][port.Port] = append(portServiceMap[protocol][port.Port], svc)
+		}
+	}
+	if err := a.dataPath.sync(portServiceMap, fwmarkMap); err != nil {
+		a.syncError("sync_data_path", err)
+	}
+	// both maps are consumed below
+	a.lastServiceMap = map[v1.Protocol]map[int32][]*v1.Service{}
+	for protocol, ports := range portServiceMap {
+		a.lastServiceMap[protocol] = map[int32][]*v1.Service{}
+		for port, svcs := range ports {
+			a.lastServiceMap[protocol][port] = svcs
 		}
 	}
-	a.buildIptables(portServiceMap)
+	a.lastFWMarkMap = map[uint32]*v1.Service{}
+	for mark, svc := range fwmarkMap {
+		a.lastFWMarkMap[mark] = svc
+	}
 	for i := range endpoints {
 		enp := endpoints[i]
 		if _, exist := endpointsMap[enp.Namespace]; !exist {
@@ -65,104 +247,344 @@ func (a *LVSAdaptor) Build(lbSvcs []*v1.Service, endpoints []*v1.Endpoints) {
 		}
 		nameMap[enp.Name] = append(nameMap[enp.Name], enp)
 	}
-	vss, err := a.lvsHandler.GetVirtualServers()
+	a.lastEndpointsMap = endpointsMap
+	a.reportServices(lbSvcs, fwmarkSvcs, endpointsMap)
+	vss, err := a.getVirtualServers()
 	if err != nil {
-		glog.Errorf("failed to get virtual servers: %v", err)
+		a.syncError("get_virtual_servers", fmt.Errorf("failed to get virtual servers: %v", err))
 		return
 	}
+	a.owned.retain(vss)
+	defer func() {
+		if err := a.owned.save(); err != nil {
+			glog.Warningf("failed to save owned virtual servers: %v", err)
+		}
+	}()
 	// check existing virtual services
 	for i := range vss {
 		vs := vss[i]
-		var index = 0
-		if vs.Protocol == "UDP" {
-			index = 1
-		}
-		if !vs.Address.Equal(a.virtualServerAddress) {
-			//TODO should we delete this virtual server in case changing a.virtualServerAddress or just continue in order to not delete user customer lvs
-			// lvs doesn't support comment
-			if err := a.lvsHandler.DeleteVirtualServer(vs); err != nil {
-				// raise a warning instead of error as we will retry later
-				glog.Warningf("failed to delete virtual server %s: %v", vs.String(), err)
+		if vs.FWMark != 0 {
+			svc, ok := fwmarkMap[vs.FWMark]
+			if !ok {
+				if a.owned.has(vs) {
+					a.deleteVirtualServer(vs)
+				}
+				continue
 			}
+			a.owned.insert(vs)
+			delete(fwmarkMap, vs.FWMark)
+			vs = a.ensureScheduler(vs, []*v1.Service{svc})
+			a.syncRealServers(vs, a.fwmarkExpectRSs(svc, endpointsMap, vs))
 			continue
 		}
-		if svcs, ok := portServiceMap[index][int32(vs.Port)]; !ok {
-			// service not exists, but virtual server exists
-			if err := a.lvsHandler.DeleteVirtualServer(vs); err != nil {
-				// raise a warning instead of error as we will retry later
-				glog.Warningf("failed to delete virtual server %s: %v", vs.String(), err)
-			}
-		} else {
-			delete(portServiceMap[index], int32(vs.Port))
-			// syncing real servers
-			expectRSs := getExpectRSs(svcs, endpointsMap, vs)
-			rss, err := a.lvsHandler.GetRealServers(vs)
-			if err != nil {
-				glog.Warningf("failed to get real servers for virtual server %s: %v", vs.String(), err)
+		svcs, ok := portServiceMap[v1.Protocol(vs.Protocol)][int32(vs.Port)]
+		if !vs.Address.Equal(a.virtualServerAddress) || !ok {
+			// service not exists or bind address changed, but virtual server exists
+			if !a.owned.has(vs) {
+				glog.V(4).Infof("skip virtual server %s not owned by kube-bmlb", vs.String())
 				continue
 			}
-			for j := range rss {
-				rs := rss[j]
-				rsStr := fmt.Sprintf("%s:%d", rs.Address.String(), rs.Port)
-				if _, ok := expectRSs[rsStr]; !ok {
-					if err := a.lvsHandler.DeleteRealServer(vs, rs); err != nil {
-						glog.Warningf("failed to del real server %s: %v", rs.String(), err)
-					}
-				} else {
-					delete(expectRSs, rsStr)
-				}
-			}
-			// add new real servers
-			a.addRealServers(vs, expectRSs)
+			a.deleteVirtualServer(vs)
+		} else {
+			// adopt virtual servers of our services, they may be created before the ownership record is saved
+			a.owned.insert(vs)
+			delete(portServiceMap[v1.Protocol(vs.Protocol)], int32(vs.Port))
+			vs = a.ensureScheduler(vs, svcs)
+			a.syncRealServers(vs, a.expectRSs(svcs, endpointsMap, vs))
 		}
 	}
 
 	// create not exist virtual services and real servers
-	for i := 0; i < len(portServiceMap); i++ {
-		protocol := "TCP"
-		if i == 1 {
-			protocol = "UDP"
-		}
-		for port, svcs := range portServiceMap[i] {
-			vs := &lvs.VirtualServer{Address: a.virtualServerAddress, Port: uint16(port), Protocol: protocol, Scheduler: ipvs.RoundRobin}
+	for protocol, ports := range portServiceMap {
+		for port, svcs := range ports {
+			vs := &lvs.VirtualServer{Address: a.virtualServerAddress, Port: uint16(port), Protocol: string(protocol), Scheduler: a.scheduler(svcs)}
 			if err := a.lvsHandler.AddVirtualServer(vs); err != nil {
-				// raise a warning instead of error as we will retry later
-				glog.Warningf("failed to add virtual server %s: %v", vs.String(), err)
+				a.syncError("add_virtual_server", fmt.Errorf("failed to add virtual server %s: %v", vs.String(), err))
 				continue
 			}
-			a.addRealServers(vs, getExpectRSs(svcs, endpointsMap, vs))
+			a.owned.insert(vs)
+			a.addRealServers(vs, a.expectRSs(svcs, endpointsMap, vs))
+		}
+	}
+	for mark, svc := range fwmarkMap {
+		vs := &lvs.VirtualServer{Address: net.IPv4zero, FWMark: mark, Scheduler: a.scheduler([]*v1.Service{svc})}
+		if isIPv6(a.virtualServerAddress) {
+			vs.Address = net.IPv6zero
+		}
+		if err := a.lvsHandler.AddVirtualServer(vs); err != nil {
+			a.syncError("add_virtual_server", fmt.Errorf("failed to add virtual server %s for svc %s: %v", vs.String(), svcKey(svc), err))
+			continue
+		}
+		a.owned.insert(vs)
+		a.addRealServers(vs, a.fwmarkExpectRSs(svc, endpointsMap, vs))
+	}
+}
+
+// Ping returns an error if ipvs of the node can't be reached
+func (a *LVSAdaptor) Ping() error {
+	if _, err := a.lvsHandler.GetVirtualServers(); err != nil {
+		return fmt.Errorf("failed to get virtual servers: %v", err)
+	}
+	return nil
+}
+
+// getVirtualServers returns virtual servers of the address family of virtualServerAddress
+func (a *LVSAdaptor) getVirtualServers() ([]*lvs.VirtualServer, error) {
+	vss, err := a.lvsHandler.GetVirtualServers()
+	if err != nil {
+		return nil, err
+	}
+	var filtered []*lvs.VirtualServer
+	for _, vs := range vss {
+		if isIPv6(vs.Address) == isIPv6(a.virtualServerAddress) {
+			filtered = append(filtered, vs)
+		}
+	}
+	return filtered, nil
+}
+
+// ensureScheduler updates scheduler of vs if it is not the one services ask for
+func (a *LVSAdaptor) ensureScheduler(vs *lvs.VirtualServer, svcs []*v1.Service) *lvs.VirtualServer {
+	sched := a.scheduler(svcs)
+	if vs.Scheduler == sched {
+		return vs
+	}
+	updated := *vs
+	updated.Scheduler = sched
+	if err := a.lvsHandler.UpdateVirtualServer(&updated); err != nil {
+		a.syncError("update_virtual_server", fmt.Errorf("failed to update scheduler of virtual server %s to %s: %v", vs.String(), sched, err))
+		return vs
+	}
+	return &updated
+}
+
+// syncRealServers deletes unexpected real servers of vs and adds missing ones
+func (a *LVSAdaptor) syncRealServers(vs *lvs.VirtualServer, expectRSs map[string]lvs.RealServer) {
+	rss, err := a.lvsHandler.GetRealServers(vs)
+	if err != nil {
+		a.syncError("get_real_servers", fmt.Errorf("failed to get real servers for virtual server %s: %v", vs.String(), err))
+		return
+	}
+	for j := range rss {
+		rs := rss[j]
+		rsStr := fmt.Sprintf("%s:%d", rs.Address.String(), rs.Port)
+		expectRS, ok := expectRSs[rsStr]
+		if !ok {
+			if err := a.lvsHandler.DeleteRealServer(vs, rs); err != nil {
+				a.syncError("delete_real_server", fmt.Errorf("failed to del real server %s: %v", rs.String(), err))
+			} else {
+				a.deleteUDPFlows(vs, rs)
+			}
+			continue
+		}
+		delete(expectRSs, rsStr)
+		if expectRS.ForwardMethod != rs.ForwardMethod {
+			// connections to the real server are kept
+			if err := a.lvsHandler.UpdateRealServer(vs, &expectRS); err != nil {
+				a.syncError("update_real_server", fmt.Errorf("failed to update forwarding method of real server %s to %s: %v", rs.String(), expectRS.ForwardMethod, err))
+			}
 		}
 	}
+	// add new real servers
+	a.addRealServers(vs, expectRSs)
+}
+
+func (a *LVSAdaptor) deleteVirtualServer(vs *lvs.VirtualServer) {
+	var rss []*lvs.RealServer
+	if vs.FWMark != 0 {
+		// flows of fwmark virtual servers are selected by their real servers
+		rss, _ = a.lvsHandler.GetRealServers(vs)
+	}
+	if err := a.lvsHandler.DeleteVirtualServer(vs); err != nil {
+		a.syncError("delete_virtual_server", fmt.Errorf("failed to delete virtual server %s: %v", vs.String(), err))
+		return
+	}
+	a.owned.delete(vs)
+	if vs.FWMark == 0 {
+		a.deleteUDPFlows(vs, nil)
+	}
+	for _, rs := range rss {
+		a.deleteUDPFlows(vs, rs)
+	}
+}
+
+// deleteUDPFlows queues deleting conntrack entries of udp flows of vs to rs or to all real servers if rs is
+// nil, otherwise datagrams of these flows keep going to removed real servers until entries expire. Flows to
+// direct routing and tunnel real servers can't be told apart by the reply tuple, all udp flows of vs are
+// deleted and ipvs schedules them again.
+func (a *LVSAdaptor) deleteUDPFlows(vs *lvs.VirtualServer, rs *lvs.RealServer) {
+	filter := conntrack.Filter{Protocol: conntrack.ProtocolUDP, VIP: vs.Address, Port: vs.Port}
+	if vs.FWMark != 0 {
+		// fwmark virtual servers carry ports which aren't known here, flows to the bind address are only
+		// selected by masquerading real servers which are their reply source. Flows to direct routing and
+		// tunnel real servers are left to expire_nodest_conn instead of deleting all udp flows to the node.
+		if rs == nil || rs.ForwardMethod != lvs.ForwardMasq {
+			return
+		}
+		filter.VIP, filter.Port = a.virtualServerAddress, 0
+	} else if vs.Protocol != string(v1.ProtocolUDP) {
+		return
+	}
+	if rs != nil && rs.ForwardMethod == lvs.ForwardMasq {
+		filter.RealServer, filter.RealPort = rs.Address, rs.Port
+	}
+	a.staleFlows = append(a.staleFlows, filter)
+}
+
+// deleteStaleFlows deletes conntrack entries queued by deleteUDPFlows in one pass
+func (a *LVSAdaptor) deleteStaleFlows() {
+	if len(a.staleFlows) == 0 {
+		return
+	}
+	filters := a.staleFlows
+	a.staleFlows = nil
+	n, err := a.conntrack.DeleteFlows(filters...)
+	if err != nil {
+		a.syncError("delete_conntrack", fmt.Errorf("failed to delete conntrack entries of %v: %v", filters, err))
+		return
+	}
+	glog.V(4).Infof("deleted %d conntrack entries of %v", n, filters)
+}
+
+// syncError logs and counts a failed operation of op, it is also an error of the running Build
+func (a *LVSAdaptor) syncError(op string, err error) {
+	// raise a warning instead of error as we will retry later
+	glog.Warning(err)
+	lvsErrors.WithLabelValues(op).Inc()
+	a.errs = append(a.errs, err)
+}
+
+// Cleanup deletes virtual servers and data path rules created by kube-bmlb
+func (a *LVSAdaptor) Cleanup() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	vss, err := a.getVirtualServers()
+	if err != nil {
+		return fmt.Errorf("failed to get virtual servers: %v", err)
+	}
+	for _, vs := range vss {
+		if a.owned.has(vs) {
+			a.deleteVirtualServer(vs)
+		}
+	}
+	a.deleteStaleFlows()
+	a.dataPath.cleanup()
+	a.owned.retain(vss)
+	if a.owned.owned.Len() > 0 {
+		if err := a.owned.save(); err != nil {
+			glog.Warningf("failed to save owned virtual servers: %v", err)
+		}
+		return fmt.Errorf("failed to delete virtual servers %v", a.owned.owned.List())
+	}
+	return a.owned.remove()
+}
+
+// checkSchedulers probes schedulers kernel supports again at most once per probeSchedulersPeriod if svcs ask
+// for a missing one as scheduler modules may be installed after start, schedulers which are still missing
+// are errors of the running Build
+func (a *LVSAdaptor) checkSchedulers(svcs []*v1.Service) {
+	// missing are schedulers kernel doesn't support by namespace/name of services
+	missing := map[string]string{}
+	for _, svc := range svcs {
+		str := svc.Annotations[api.ANScheduler]
+		if str == "" {
+			continue
+		}
+		sched, err := api.DecodeScheduler(str)
+		if err != nil || a.schedulers.Has(sched) {
+			continue
+		}
+		missing[svcKey(svc)] = sched
+	}
+	if len(missing) == 0 {
+		return
+	}
+	if a.probeSchedulers != nil && time.Since(a.lastProbe) >= probeSchedulersPeriod {
+		a.lastProbe = time.Now()
+		schedulers, err := a.probeSchedulers()
+		if err != nil {
+			glog.Warningf("failed to get available ipvs schedulers: %v", err)
+		} else {
+			a.schedulers = schedulers
+		}
+	}
+	if a.schedulers == nil {
+		// schedulers of services are used as they are
+		return
+	}
+	for _, key := range sets.StringKeySet(missing).List() {
+		if sched := missing[key]; !a.schedulers.Has(sched) {
+			a.syncError("scheduler", fmt.Errorf("scheduler %s of svc %s is not supported by kernel, it is ignored", sched, key))
+		}
+	}
+}
+
+// scheduler returns the ipvs scheduler in annotation of services sharing the same virtual server,
+// it falls back to rr if none of them specifies a valid scheduler which kernel supports
+func (a *LVSAdaptor) scheduler(svcs []*v1.Service) string {
+	for _, svc := range svcs {
+		str := svc.Annotations[api.ANScheduler]
+		if str == "" {
+			continue
+		}
+		sched, err := api.DecodeScheduler(str)
+		if err != nil {
+			glog.Warningf("invalid annotation %s of svc %s/%s: %v", api.ANScheduler, svc.Namespace, svc.Name, err)
+			continue
+		}
+		if a.schedulers != nil && !a.schedulers.Has(sched) {
+			// reported by checkSchedulers
+			continue
+		}
+		return sched
+	}
+	return ipvs.RoundRobin
 }
 
 func (a *LVSAdaptor) addRealServers(vs *lvs.VirtualServer, expectRSs map[string]lvs.RealServer) {
 	for str := range expectRSs {
 		expectRS := expectRSs[str]
 		if err := a.lvsHandler.AddRealServer(vs, &expectRS); err != nil {
-			glog.Warningf("failed to add real server %s: %v", expectRS.String(), err)
+			a.syncError("add_real_server", fmt.Errorf("failed to add real server %s: %v", expectRS.String(), err))
 		}
 	}
 }
 
-func getExpectRSs(svcs []*v1.Service, endpointsMap map[string]map[string][]*v1.Endpoints, vs *lvs.VirtualServer) map[string]lvs.RealServer {
+// expectRSs returns real servers of vs, real servers skipped by getExpectRSs are errors of the running Build
+func (a *LVSAdaptor) expectRSs(svcs []*v1.Service, endpointsMap map[string]map[string][]*v1.Endpoints, vs *lvs.VirtualServer) map[string]lvs.RealServer {
+	expectRSs, errs := getExpectRSs(svcs, endpointsMap, vs)
+	for _, err := range errs {
+		a.syncError("target_port", err)
+	}
+	return expectRSs
+}
+
+func getExpectRSs(svcs []*v1.Service, endpointsMap map[string]map[string][]*v1.Endpoints, vs *lvs.VirtualServer) (map[string]lvs.RealServer, []error) {
 	expectRSs := map[string]lvs.RealServer{}
+	var errs []error
 	// syncing real servers
 	for _, svc := range svcs {
 		edpts := endpointsMap[svc.Namespace][svc.Name]
 		if len(edpts) == 0 {
 			continue
 		}
-		addExpectRS(expectRSs, edpts, vs, svc)
+		if err := addExpectRS(expectRSs, edpts, vs, svc); err != nil {
+			errs = append(errs, err)
+		}
 	}
-	return expectRSs
+	return expectRSs, errs
 }
 
-func addExpectRS(expectRS map[string]lvs.RealServer, edpts []*v1.Endpoints, vs *lvs.VirtualServer, svc *v1.Service) {
-	targetPort := getTargetPort(int32(vs.Port), svc)
+// addExpectRS adds endpoints of svc to expectRS, dr and tunnel don't translate the destination port, so
+// endpoints whose port differs from the port of vs are skipped and returned as an error
+func addExpectRS(expectRS map[string]lvs.RealServer, edpts []*v1.Endpoints, vs *lvs.VirtualServer, svc *v1.Service) error {
+	targetPort := getTargetPort(int32(vs.Port), v1.Protocol(vs.Protocol), svc)
 	if targetPort == nil {
 		// should never happen
-		return
+		return nil
 	}
+	method := forwardMethod(svc)
+	var mismatched []string
 	for _, edpt := range edpts {
 		for _, subset := range edpt.Subsets {
 			port := getTargetIntPort(targetPort, &subset)
@@ -170,19 +592,53 @@ func addExpectRS(expectRS map[string]lvs.RealServer, edpts []*v1.Endpoints, vs *
 				// endpoints may not have been synced
 				continue
 			}
+			if method != lvs.ForwardMasq && port != int32(vs.Port) {
+				for _, addr := range subset.Addresses {
+					mismatched = append(mismatched, fmt.Sprintf("%s:%d", addr.IP, port))
+				}
+				continue
+			}
 			for _, addr := range subset.Addresses {
-				expectRS[fmt.Sprintf("%s:%d", addr.IP, port)] = lvs.RealServer{Address: net.ParseIP(addr.IP), Port: uint16(port), Weight: 1}
+				ip := net.ParseIP(addr.IP)
+				if ip == nil || isIPv6(ip) != isIPv6(vs.Address) {
+					// ipvs doesn't forward across address families
+					continue
+				}
+				expectRS[fmt.Sprintf("%s:%d", addr.IP, port)] = lvs.RealServer{Address: ip, Port: uint16(port), Weight: 1, ForwardMethod: method}
 			}
 		}
 	}
-	return
+	if len(mismatched) > 0 {
+		return fmt.Errorf("skipped endpoints %s of svc %s, %s forwarding requires target port to be the same as port %d", strings.Join(mismatched, ","), svcKey(svc), svc.Annotations[api.ANForwardMethod], vs.Port)
+	}
+	return nil
+}
+
+// forwardMethod returns the ipvs forwarding method in annotation of svc, masq if it is invalid
+func forwardMethod(svc *v1.Service) lvs.ForwardMethod {
+	str := svc.Annotations[api.ANForwardMethod]
+	method, err := api.DecodeForwardMethod(str)
+	if err != nil {
+		glog.Warningf("invalid annotation %s of svc %s/%s: %v", api.ANForwardMethod, svc.Namespace, svc.Name, err)
+	}
+	switch method {
+	case api.ForwardDR:
+		return lvs.ForwardDirectRoute
+	case api.ForwardTunnel:
+		return lvs.ForwardTunnel
+	}
+	return lvs.ForwardMasq
 }
 
-func getTargetPort(port int32, svc *v1.Service) *v1.ServicePort {
+// getTargetPort returns the port of svc, a service may have ports of different protocols with the same number
+func getTargetPort(port int32, protocol v1.Protocol, svc *v1.Service) *v1.ServicePort {
 	var targetPort *v1.ServicePort
 	for i := range svc.Spec.Ports {
 		svcPort := svc.Spec.Ports[i]
-		if svcPort.Port == port {
+		if svcPort.Protocol == "" {
+			svcPort.Protocol = v1.ProtocolTCP
+		}
+		if svcPort.Port == port && svcPort.Protocol == protocol {
 			targetPort = &svcPort
 			break
 		}
@@ -199,16 +655,6 @@ func getTargetIntPort(targetPort *v1.ServicePort, subset *v1.EndpointSubset) int
 	return 0
 }
 
-func protolcolIndex(protocol v1.Protocol) int {
-	if protocol == v1.ProtocolUDP {
-		return 1
-	}
-	return 0
-}
-
-func protolcol(i int) v1.Protocol {
-	if i == 1 {
-		return v1.ProtocolUDP
-	}
-	return v1.ProtocolTCP
+func isIPv6(ip net.IP) bool {
+	return ip.To4() == nil
 }
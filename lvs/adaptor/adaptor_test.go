@@ -2,22 +2,39 @@ package adaptor
 
 import (
 	"bytes"
+	"encoding/json"
+	"fmt"
 	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/chenchun/kube-bmlb/api"
 	"github.com/chenchun/kube-bmlb/lvs"
 	lvstesting "github.com/chenchun/kube-bmlb/lvs/testing"
+	"github.com/chenchun/kube-bmlb/utils/conntrack"
+	conntracktesting "github.com/chenchun/kube-bmlb/utils/conntrack/testing"
 	ipsettesting "github.com/chenchun/kube-bmlb/utils/ipset/testing"
 	"github.com/chenchun/kube-bmlb/utils/iptables"
 	ipttesting "github.com/chenchun/kube-bmlb/utils/iptables/testing"
+	"github.com/chenchun/kube-bmlb/utils/nftables"
+	nfttesting "github.com/chenchun/kube-bmlb/utils/nftables/testing"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
 	"k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
 )
 
 func TestBuild(t *testing.T) {
 	fake := lvstesting.NewFake()
 	vsAddr, noneVsAddr, rsAddr1, rsAddr2 := net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.3"), net.ParseIP("192.168.0.2"), net.ParseIP("192.168.0.3")
+	// 10.0.0.3:80 was created by kube-bmlb before changing bind address, 10.0.0.4:80 is created by others
+	foreignVs := &lvs.VirtualServer{Address: net.ParseIP("10.0.0.4"), Port: 80, Protocol: "TCP"}
 	for _, existVs := range []struct {
 		vs  *lvs.VirtualServer
 		rss []*lvs.RealServer
@@ -30,6 +47,10 @@ func TestBuild(t *testing.T) {
 			vs:  &lvs.VirtualServer{Address: noneVsAddr, Port: 80, Protocol: "TCP"},
 			rss: []*lvs.RealServer{{Address: rsAddr1, Port: 81}},
 		},
+		{
+			vs:  foreignVs,
+			rss: []*lvs.RealServer{{Address: rsAddr1, Port: 81}},
+		},
 	} {
 		if err := fake.AddVirtualServer(existVs.vs); err != nil {
 			t.Fatal(err)
@@ -50,6 +71,9 @@ func TestBuild(t *testing.T) {
 
 10.0.0.3:80/TCP
   -> 192.168.0.2:81
+
+10.0.0.4:80/TCP
+  -> 192.168.0.2:81
 ` {
 		t.Fatal(str)
 	}
@@ -62,8 +86,11 @@ func TestBuild(t *testing.T) {
 		endpoint("s2", rsAddr1.String(), 9000),
 		endpoint("s2", rsAddr2.String(), 9001),
 	}
-	a := &LVSAdaptor{lvsHandler: fake, virtualServerAddress: vsAddr, iptHandler: ipttesting.NewFakeIPTables(), ipsetHandler: ipsettesting.NewFake("")}
-	a.Build(services, endpoints)
+	a := newTestAdaptor(vsAddr, withLVS(fake))
+	a.owned.insert(&lvs.VirtualServer{Address: noneVsAddr, Port: 80, Protocol: "TCP"})
+	if err := a.Build(services, endpoints); err != nil {
+		t.Fatal(err)
+	}
 	str, err = lvs.Dump(fake)
 	if err != nil {
 		t.Fatal(err)
@@ -77,29 +104,38 @@ func TestBuild(t *testing.T) {
 10.0.0.2:8080/UDP
   -> 192.168.0.2:9000
   -> 192.168.0.3:9001
+
+10.0.0.4:80/TCP
+  -> 192.168.0.2:81
 ` {
 		t.Fatal(str)
 	}
 
 	// check iptables and ipset
 	buf := bytes.NewBuffer(nil)
-	if err := a.iptHandler.SaveInto(iptables.TableNAT, buf); err != nil {
+	if err := iptPath(a).iptHandler.SaveInto(iptables.TableNAT, buf); err != nil {
 		t.Fatal(err)
 	} else {
 		if buf.String() != `*nat
+:BMLB-OUTPUT - [0:0]
+:BMLB-POSTROUTING - [0:0]
+:BMLB-PREROUTING - [0:0]
 :INPUT - [0:0]
 :OUTPUT - [0:0]
 :POSTROUTING - [0:0]
 :PREROUTING - [0:0]
--A OUTPUT -p all -m set --match-set bmlb-vip-vport dst,dst -j MARK --set-xmark 0x4000/0x4000
--A POSTROUTING -m mark --mark 0x4000/0x4000 -j MASQUERADE
--A PREROUTING -p all -m set --match-set bmlb-vip-vport dst,dst -j MARK --set-xmark 0x4000/0x4000
+-A BMLB-OUTPUT -m set --match-set bmlb-vip-vport dst,dst -j MARK --set-xmark 0x4000/0x4000
+-A BMLB-POSTROUTING -m mark --mark 0x4000/0x4000 -j MASQUERADE
+-A BMLB-PREROUTING -m set --match-set bmlb-vip-vport dst,dst -j MARK --set-xmark 0x4000/0x4000
+-A OUTPUT -m comment --comment kube-bmlb -j BMLB-OUTPUT
+-A POSTROUTING -m comment --comment kube-bmlb -j BMLB-POSTROUTING
+-A PREROUTING -m comment --comment kube-bmlb -j BMLB-PREROUTING
 COMMIT
 ` {
 			t.Fatal(buf.String())
 		}
 	}
-	if data, err := a.ipsetHandler.SaveAllSets(); err != nil {
+	if data, err := iptPath(a).ipsetHandler.SaveAllSets(); err != nil {
 		t.Fatal(err)
 	} else {
 		if string(data) != `Name: bmlb-vip-vport
@@ -108,24 +144,982 @@ Members:
 10.0.0.2,tcp:70
 10.0.0.2,tcp:80
 10.0.0.2,udp:8080
+
+Name: bmlb-vip-vport-src
+Type: hash:ip,port
+Members:
+
+Name: bmlb-vip-vport-src-net
+Type: hash:ip,port,net
+Members:
 ` {
 			t.Fatal(string(data))
 		}
 	}
 }
 
+func TestCleanup(t *testing.T) {
+	fake := lvstesting.NewFake()
+	vsAddr, rsAddr := net.ParseIP("10.0.0.2"), net.ParseIP("192.168.0.2")
+	foreignVs := &lvs.VirtualServer{Address: vsAddr, Port: 90, Protocol: "TCP"}
+	if err := fake.AddVirtualServer(foreignVs); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "owned")
+	a := newTestAdaptor(vsAddr, withLVS(fake), func(a *LVSAdaptor) { a.owned = newOwnership(file) })
+	a.Build([]*v1.Service{service("s1", v1.ProtocolTCP, 80)}, []*v1.Endpoints{endpoint("s1", rsAddr.String(), 81)})
+	// ownership survives restarting
+	if owned := newOwnership(file).owned.List(); len(owned) != 1 || owned[0] != "10.0.0.2:80/TCP" {
+		t.Fatal(owned)
+	}
+	a.owned = newOwnership(file)
+	if err := a.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	str, err := lvs.Dump(fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if str != "10.0.0.2:90/TCP\n" {
+		t.Fatal(str)
+	}
+	if sets, err := iptPath(a).ipsetHandler.ListSets(); err != nil || len(sets) != 0 {
+		t.Fatal(sets, err)
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := iptPath(a).iptHandler.SaveInto(iptables.TableNAT, buf); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "-A") || strings.Contains(buf.String(), "BMLB") {
+		t.Fatal(buf.String())
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+}
+
+func TestBuildDeleteLegacyRules(t *testing.T) {
+	ipt := ipttesting.NewFakeIPTables()
+	for _, rule := range legacyRules {
+		if _, err := ipt.EnsureRule(iptables.Prepend, rule.table, rule.chain, rule.rules...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a chain left by a previous version
+	if _, err := ipt.EnsureChain(iptables.TableNAT, "BMLB-STALE"); err != nil {
+		t.Fatal(err)
+	}
+	a := newTestAdaptor(net.ParseIP("10.0.0.2"), func(a *LVSAdaptor) {
+		a.dataPath = newIptablesDataPath(a.virtualServerAddress, ipt, ipsettesting.NewFake(""))
+	})
+	a.Build(nil, nil)
+	for _, table := range tables {
+		buf := bytes.NewBuffer(nil)
+		if err := ipt.SaveInto(table, buf); err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range strings.Split(buf.String(), "\n") {
+			// every rule in builtin chains is a jump rule
+			if strings.HasPrefix(line, "-A") && !strings.HasPrefix(line, "-A BMLB-") && !strings.Contains(line, "--comment kube-bmlb -j BMLB-") {
+				t.Fatalf("unexpected rule %s", line)
+			}
+			if strings.Contains(line, "BMLB-STALE") {
+				t.Fatalf("unexpected chain %s", line)
+			}
+		}
+	}
+}
+
+func TestBuildPreserveClientIP(t *testing.T) {
+	vsAddr, rsAddr := net.ParseIP("10.0.0.2"), net.ParseIP("192.168.0.2")
+	s1, s2 := service("s1", v1.ProtocolTCP, 80), service("s2", v1.ProtocolTCP, 90)
+	s2.Annotations = map[string]string{api.ANPreserveClientIP: "true"}
+	endpoints := []*v1.Endpoints{endpoint("s1", rsAddr.String(), 81), endpoint("s2", rsAddr.String(), 91)}
+	a := newTestAdaptor(vsAddr)
+	a.Build([]*v1.Service{s1, s2}, endpoints)
+	str, err := lvs.Dump(a.lvsHandler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if str != `10.0.0.2:80/TCP
+  -> 192.168.0.2:81
+
+10.0.0.2:90/TCP
+  -> 192.168.0.2:91
+` {
+		t.Fatal(str)
+	}
+	// only masquerade traffic of s1
+	entries, err := iptPath(a).ipsetHandler.ListEntries(ipsetName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0] != "10.0.0.2,tcp:80" {
+		t.Fatal(entries)
+	}
+}
+
+func TestBuildSourceRanges(t *testing.T) {
+	vsAddr, rsAddr := net.ParseIP("10.0.0.2"), net.ParseIP("192.168.0.2")
+	s1, s2 := service("s1", v1.ProtocolTCP, 80), service("s2", v1.ProtocolTCP, 90)
+	s1.Spec.LoadBalancerSourceRanges = []string{"172.16.0.0/16", "10.1.1.1/32"}
+	endpoints := []*v1.Endpoints{endpoint("s1", rsAddr.String(), 81), endpoint("s2", rsAddr.String(), 91)}
+	a := newTestAdaptor(vsAddr)
+	a.Build([]*v1.Service{s1, s2}, endpoints)
+	buf := bytes.NewBuffer(nil)
+	if err := iptPath(a).iptHandler.SaveInto(iptables.TableFilter, buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != `*filter
+:BMLB-INPUT - [0:0]
+:FORWARD - [0:0]
+:INPUT - [0:0]
+:OUTPUT - [0:0]
+-A BMLB-INPUT -m set --match-set bmlb-vip-vport-src dst,dst -m set ! --match-set bmlb-vip-vport-src-net dst,dst,src -j DROP
+-A INPUT -m comment --comment kube-bmlb -j BMLB-INPUT
+COMMIT
+` {
+		t.Fatal(buf.String())
+	}
+	data, err := iptPath(a).ipsetHandler.SaveAllSets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `Name: bmlb-vip-vport
+Type: hash:ip,port
+Members:
+10.0.0.2,tcp:80
+10.0.0.2,tcp:90
+
+Name: bmlb-vip-vport-src
+Type: hash:ip,port
+Members:
+10.0.0.2,tcp:80
+
+Name: bmlb-vip-vport-src-net
+Type: hash:ip,port,net
+Members:
+10.0.0.2,tcp:80,10.1.1.1
+10.0.0.2,tcp:80,172.16.0.0/16
+` {
+		t.Fatal(string(data))
+	}
+}
+
+func TestBuildScheduler(t *testing.T) {
+	fake := lvstesting.NewFake()
+	vsAddr, rsAddr := net.ParseIP("10.0.0.2"), net.ParseIP("192.168.0.2")
+	existVs := &lvs.VirtualServer{Address: vsAddr, Port: 80, Protocol: "TCP", Scheduler: "rr"}
+	if err := fake.AddVirtualServer(existVs); err != nil {
+		t.Fatal(err)
+	}
+	s1, s2 := service("s1", v1.ProtocolTCP, 80), service("s2", v1.ProtocolTCP, 90)
+	s1.Annotations = map[string]string{api.ANScheduler: "wlc"}
+	// mh is not supported by kernel
+	s2.Annotations = map[string]string{api.ANScheduler: "mh"}
+	endpoints := []*v1.Endpoints{endpoint("s1", rsAddr.String(), 81), endpoint("s2", rsAddr.String(), 91)}
+	a := newTestAdaptor(vsAddr, withLVS(fake), func(a *LVSAdaptor) { a.schedulers = sets.NewString("rr", "wlc") })
+	probes := 0
+	a.probeSchedulers = func() (sets.String, error) {
+		probes++
+		return sets.NewString("rr", "wlc"), nil
+	}
+	check := func(expect map[uint16]string) {
+		for port, sched := range expect {
+			vs, err := fake.GetVirtualServer(&lvs.VirtualServer{Address: vsAddr, Port: port, Protocol: "TCP"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if vs.Scheduler != sched {
+				t.Fatalf("expect scheduler %s for port %d, got %s", sched, port, vs.Scheduler)
+			}
+		}
+	}
+	err := a.Build([]*v1.Service{s1, s2}, endpoints)
+	if err == nil || err.Error() != "scheduler mh of svc /s2 is not supported by kernel, it is ignored" || probes != 1 {
+		t.Fatalf("unexpected error %v after %d probes", err, probes)
+	}
+	check(map[uint16]string{80: "wlc", 90: "rr"})
+	// schedulers are not probed again within probeSchedulersPeriod
+	a.Build([]*v1.Service{s1, s2}, endpoints)
+	if probes != 1 {
+		t.Fatalf("expect 1 probe, got %d", probes)
+	}
+	// real servers are kept after updating scheduler
+	str, err := lvs.Dump(fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if str != `10.0.0.2:80/TCP
+  -> 192.168.0.2:81
+
+10.0.0.2:90/TCP
+  -> 192.168.0.2:91
+` {
+		t.Fatal(str)
+	}
+	// the module of mh is loaded later
+	a.lastProbe = time.Now().Add(-probeSchedulersPeriod)
+	a.probeSchedulers = func() (sets.String, error) {
+		probes++
+		return sets.NewString("rr", "wlc", "mh"), nil
+	}
+	if err := a.Build([]*v1.Service{s1, s2}, endpoints); err != nil {
+		t.Fatal(err)
+	}
+	check(map[uint16]string{80: "wlc", 90: "mh"})
+	// schedulers are not probed again once all of them are supported
+	a.Build([]*v1.Service{s1, s2}, endpoints)
+	if probes != 2 {
+		t.Fatalf("expect 2 probes, got %d", probes)
+	}
+}
+
+func TestBuildForwardMethod(t *testing.T) {
+	vsAddr, rsAddr := net.ParseIP("10.0.0.2"), net.ParseIP("192.168.0.2")
+	s1, s2 := service("s1", v1.ProtocolTCP, 80), service("s2", v1.ProtocolTCP, 90)
+	s1.Annotations = map[string]string{api.ANForwardMethod: api.ForwardDR}
+	s2.Annotations = map[string]string{api.ANForwardMethod: api.ForwardTunnel}
+	endpoints := []*v1.Endpoints{endpoint("s1", rsAddr.String(), 80), endpoint("s2", rsAddr.String(), 90)}
+	fake := lvstesting.NewFake()
+	a := newTestAdaptor(vsAddr, withLVS(fake))
+	check := func(expect map[uint16]lvs.ForwardMethod, masqEntries int) {
+		for port, method := range expect {
+			rss, err := a.lvsHandler.GetRealServers(&lvs.VirtualServer{Address: vsAddr, Port: port, Protocol: "TCP"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rss) != 1 || rss[0].ForwardMethod != method {
+				t.Fatalf("expect one real server of port %d with forward method %s, got %v", port, method, rss)
+			}
+		}
+		entries, err := iptPath(a).ipsetHandler.ListEntries(ipsetName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != masqEntries {
+			t.Fatal(entries)
+		}
+	}
+	a.Build([]*v1.Service{s1, s2}, endpoints)
+	// dr and tunnel traffic are not masqueraded
+	check(map[uint16]lvs.ForwardMethod{80: lvs.ForwardDirectRoute, 90: lvs.ForwardTunnel}, 0)
+	rss, _ := a.lvsHandler.GetRealServers(&lvs.VirtualServer{Address: vsAddr, Port: 80, Protocol: "TCP"})
+	fake.SetRealServerStats(&lvs.VirtualServer{Address: vsAddr, Port: 80, Protocol: "TCP"}, rss[0], lvs.Stats{Connections: 1})
+	// switching back to masq updates real servers in place
+	s1.Annotations = nil
+	a.Build([]*v1.Service{s1, s2}, endpoints)
+	check(map[uint16]lvs.ForwardMethod{80: lvs.ForwardMasq, 90: lvs.ForwardTunnel}, 1)
+	if rss, _ = a.lvsHandler.GetRealServers(&lvs.VirtualServer{Address: vsAddr, Port: 80, Protocol: "TCP"}); rss[0].Stats.Connections != 1 {
+		t.Fatalf("expect the real server to be kept, got %+v", rss[0])
+	}
+}
+
+func TestBuildForwardMethodTargetPort(t *testing.T) {
+	vsAddr := net.ParseIP("10.0.0.2")
+	s1 := service("s1", v1.ProtocolTCP, 80)
+	s1.Annotations = map[string]string{api.ANForwardMethod: api.ForwardDR}
+	endpoints := []*v1.Endpoints{endpoint("s1", "192.168.0.2", 8080)}
+	a := newTestAdaptor(vsAddr)
+	check := func(expectRSs int) {
+		rss, err := a.lvsHandler.GetRealServers(&lvs.VirtualServer{Address: vsAddr, Port: 80, Protocol: "TCP"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rss) != expectRSs {
+			t.Fatalf("expect %d real servers, got %v", expectRSs, rss)
+		}
+	}
+	// dr doesn't translate ports, endpoints on another port are skipped
+	err := a.Build([]*v1.Service{s1}, endpoints)
+	if err == nil || !strings.Contains(err.Error(), "skipped endpoints 192.168.0.2:8080 of svc /s1, dr forwarding requires target port to be the same as port 80") {
+		t.Fatalf("unexpected error %v", err)
+	}
+	check(0)
+	s1.Annotations = nil
+	if err := a.Build([]*v1.Service{s1}, endpoints); err != nil {
+		t.Fatal(err)
+	}
+	check(1)
+}
+
+func TestFWMarkServices(t *testing.T) {
+	s1, s2, s3 := service("s1", v1.ProtocolTCP, 80), service("s2", v1.ProtocolTCP, 90), service("s3", v1.ProtocolTCP, 100)
+	for _, svc := range []*v1.Service{s1, s2, s3} {
+		svc.Annotations = map[string]string{api.ANFWMark: "true"}
+	}
+	next := func(id uint32) uint32 { return id%fwmarkMask + 1 }
+	h2, h3 := hashFWMark(s2), hashFWMark(s3)
+	// s1 keeps its mark of the last Build even if s2 hashes to it
+	marks := fwmarkServices([]*v1.Service{s1, s2}, map[uint32]*v1.Service{h2: s1}, nil)
+	if len(marks) != 2 || marks[h2] != s1 || marks[next(h2)] != s2 {
+		t.Fatal(marks)
+	}
+	// s3 takes its hash reserved by an existing virtual server
+	marks = fwmarkServices([]*v1.Service{s3}, nil, map[uint32]bool{h3: true})
+	if len(marks) != 1 || marks[h3] != s3 {
+		t.Fatal(marks)
+	}
+	// probing skips reserved marks
+	marks = fwmarkServices([]*v1.Service{s1, s3}, map[uint32]*v1.Service{h3: s1}, map[uint32]bool{next(h3): true})
+	if len(marks) != 2 || marks[h3] != s1 || marks[next(next(h3))] != s3 {
+		t.Fatal(marks)
+	}
+}
+
+func TestBuildFWMark(t *testing.T) {
+	vsAddr, rsAddr := net.ParseIP("10.0.0.2"), net.ParseIP("192.168.0.2")
+	s1, s2 := service("s1", v1.ProtocolTCP, 80, 443), service("s2", v1.ProtocolTCP, 90)
+	s1.Annotations = map[string]string{api.ANPortRanges: "8000-9000"}
+	endpoints := []*v1.Endpoints{endpoint("s1", rsAddr.String(), 80, 443), endpoint("s2", rsAddr.String(), 91)}
+	a := newTestAdaptor(vsAddr)
+	a.Build([]*v1.Service{s1, s2}, endpoints)
+	var mark uint32
+	for m := range a.lastFWMarkMap {
+		mark = m
+	}
+	if mark&^fwmarkMask != 0 {
+		t.Fatalf("expect no masquerade bit in mark 0x%x", mark)
+	}
+	str, err := lvs.Dump(a.lvsHandler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if str != fmt.Sprintf(`10.0.0.2:90/TCP
+  -> 192.168.0.2:91
+
+fwmark:%d
+  -> 192.168.0.2:0
+`, mark) {
+		t.Fatal(str)
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := iptPath(a).iptHandler.SaveInto(iptables.TableMangle, buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, rule := range []string{
+		"-A PREROUTING -m comment --comment kube-bmlb -j BMLB-FWMARK",
+		"-A OUTPUT -m comment --comment kube-bmlb -j BMLB-FWMARK",
+		fmt.Sprintf("-A BMLB-FWMARK -d 10.0.0.2/32 -p tcp -m multiport --dports 8000:9000,80,443 -m comment --comment /s1 -j MARK --set-xmark 0x%x/0x7fff", mark),
+	} {
+		if !strings.Contains(buf.String(), rule+"\n") {
+			t.Fatalf("expect rule %q in %s", rule, buf.String())
+		}
+	}
+	// ports of fwmark services are not in masquerade ipset
+	entries, err := iptPath(a).ipsetHandler.ListEntries(ipsetName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0] != "10.0.0.2,tcp:90" {
+		t.Fatal(entries)
+	}
+	// packets of s1 are masqueraded by its fwmark
+	masqRule := fmt.Sprintf("-A BMLB-POSTROUTING -m mark --mark 0x%x/0x3fff -m comment --comment /s1 -j MASQUERADE\n", mark)
+	buf.Reset()
+	if err := iptPath(a).iptHandler.SaveInto(iptables.TableNAT, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), masqRule) {
+		t.Fatalf("expect rule %q in %s", masqRule, buf.String())
+	}
+	// preserving client ip keeps the fwmark virtual server and its real servers
+	s1.Annotations[api.ANPreserveClientIP] = "true"
+	if err := a.Build([]*v1.Service{s1, s2}, endpoints); err != nil {
+		t.Fatal(err)
+	}
+	if a.lastFWMarkMap[mark] != s1 {
+		t.Fatalf("expect mark 0x%x of s1, got %v", mark, a.lastFWMarkMap)
+	}
+	if str2, err := lvs.Dump(a.lvsHandler); err != nil || str2 != str {
+		t.Fatal(str2, err)
+	}
+	buf.Reset()
+	if err := iptPath(a).iptHandler.SaveInto(iptables.TableNAT, buf); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), masqRule) {
+		t.Fatal(buf.String())
+	}
+	// switching back deletes the fwmark virtual server and its rules
+	s1.Annotations = nil
+	a.Build([]*v1.Service{s1, s2}, endpoints)
+	if str, err = lvs.Dump(a.lvsHandler); err != nil || strings.Contains(str, "fwmark") {
+		t.Fatal(str, err)
+	}
+	buf.Reset()
+	if err := iptPath(a).iptHandler.SaveInto(iptables.TableMangle, buf); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "-A BMLB-FWMARK") {
+		t.Fatal(buf.String())
+	}
+}
+
+func TestBuildFWMarkTargetPort(t *testing.T) {
+	vsAddr := net.ParseIP("10.0.0.2")
+	s1 := service("s1", v1.ProtocolTCP, 80, 443)
+	s1.Annotations = map[string]string{api.ANPortRanges: "8000-9000"}
+	// 192.168.0.3 listens on another port, fwmark real servers receive packets on the original port
+	good, bad := endpoint("s1", "192.168.0.2", 80, 443), endpoint("s1", "192.168.0.3", 80, 8443)
+	a := newTestAdaptor(vsAddr)
+	err := a.Build([]*v1.Service{s1}, []*v1.Endpoints{good, bad})
+	if err == nil || err.Error() != "skipped endpoints 192.168.0.3:8443 of svc /s1, fwmark virtual servers require target ports to be the same as ports" {
+		t.Fatalf("unexpected error %v", err)
+	}
+	str, err := lvs.Dump(a.lvsHandler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(str, "\n  -> 192.168.0.2:0\n") {
+		t.Fatal(str)
+	}
+}
+
+func TestMultiportGroups(t *testing.T) {
+	var ports []string
+	for i := 1; i <= 14; i++ {
+		ports = append(ports, fmt.Sprintf("%d", i))
+	}
+	ports = append(ports, "100:200", "300")
+	groups := multiportGroups(ports)
+	if len(groups) != 2 || groups[1] != "100:200,300" {
+		t.Fatal(groups)
+	}
+}
+
+func TestVerifyIptables(t *testing.T) {
+	vsAddr, rsAddr := net.ParseIP("10.0.0.2"), net.ParseIP("192.168.0.2")
+	s1, s2 := service("s1", v1.ProtocolTCP, 80), service("s2", v1.ProtocolTCP, 90)
+	s2.Annotations = map[string]string{api.ANFWMark: "true"}
+	s2.Spec.LoadBalancerSourceRanges = []string{"10.1.1.1/32", "172.16.0.0/16"}
+	endpoints := []*v1.Endpoints{endpoint("s1", rsAddr.String(), 81), endpoint("s2", rsAddr.String(), 90)}
+	a := newTestAdaptor(vsAddr)
+	a.Build([]*v1.Service{s1, s2}, endpoints)
+	if changed, err := a.dataPath.changed(a.lastFWMarkMap); err != nil || changed {
+		t.Fatal(changed, err)
+	}
+	// someone deletes a jump rule and flushes a chain
+	if err := iptPath(a).iptHandler.DeleteRule(iptables.TableNAT, "POSTROUTING", jumpRule(postroutingChain)...); err != nil {
+		t.Fatal(err)
+	}
+	if err := iptPath(a).iptHandler.FlushChain(iptables.TableMangle, fwmarkChain); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := a.dataPath.changed(a.lastFWMarkMap); err != nil || !changed {
+		t.Fatal(changed, err)
+	}
+	a.verifyDataPath()
+	if changed, err := a.dataPath.changed(a.lastFWMarkMap); err != nil || changed {
+		t.Fatal(changed, err)
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := iptPath(a).iptHandler.SaveInto(iptables.TableMangle, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "-A BMLB-FWMARK -s 10.1.1.1/32 -d 10.0.0.2/32 -p tcp") {
+		t.Fatal(buf.String())
+	}
+}
+
+func TestBuildNftables(t *testing.T) {
+	vsAddr, rsAddr := net.ParseIP("10.0.0.2"), net.ParseIP("192.168.0.2")
+	s1, s2, s3 := service("s1", v1.ProtocolTCP, 80), service("s2", v1.ProtocolUDP, 53), service("s3", v1.ProtocolTCP, 443)
+	s1.Spec.LoadBalancerSourceRanges = []string{"172.16.0.0/16", "10.1.1.1/32"}
+	s2.Annotations = map[string]string{api.ANPreserveClientIP: "true"}
+	s3.Annotations = map[string]string{api.ANPortRanges: "8000-9000"}
+	s3.Spec.LoadBalancerSourceRanges = []string{"10.1.1.1/32"}
+	endpoints := []*v1.Endpoints{endpoint("s1", rsAddr.String(), 81), endpoint("s2", rsAddr.String(), 53), endpoint("s3", rsAddr.String(), 443)}
+	nft := nfttesting.NewFake()
+	a := newTestAdaptor(vsAddr, func(a *LVSAdaptor) { a.dataPath = newNftablesDataPath(vsAddr, nft) })
+	a.Build([]*v1.Service{s1, s2, s3}, endpoints)
+	var mark uint32
+	for m := range a.lastFWMarkMap {
+		mark = m
+	}
+	data, exist, err := nft.ListTable(nftables.FamilyIPv4, nftTable)
+	if err != nil || !exist {
+		t.Fatal(exist, err)
+	}
+	if string(data) != fmt.Sprintf(`table ip kube-bmlb {
+	set vip-vport {
+		type ipv4_addr . inet_proto . inet_service
+		elements = { 10.0.0.2 . tcp . 80 }
+	}
+	set vip-vport-src {
+		type ipv4_addr . inet_proto . inet_service
+		elements = { 10.0.0.2 . tcp . 80 }
+	}
+	set vip-vport-src-net {
+		type ipv4_addr . inet_proto . inet_service . ipv4_addr
+		flags interval
+		elements = { 10.0.0.2 . tcp . 80 . 10.1.1.1, 10.0.0.2 . tcp . 80 . 172.16.0.0/16 }
+	}
+	chain fwmark {
+		ip daddr 10.0.0.2 ip saddr { 10.1.1.1 } tcp dport { 8000-9000, 443 } meta mark set meta mark & 0xffff8000 | 0x%x comment "/s3"
+	}
+	chain mangle-prerouting {
+		type filter hook prerouting priority -150; policy accept;
+		jump fwmark
+	}
+	chain mangle-output {
+		type route hook output priority -150; policy accept;
+		jump fwmark
+	}
+	chain nat-prerouting {
+		type nat hook prerouting priority -100; policy accept;
+		ip daddr . meta l4proto . th dport @vip-vport meta mark set meta mark | 0x4000
+	}
+	chain nat-output {
+		type nat hook output priority -100; policy accept;
+		ip daddr . meta l4proto . th dport @vip-vport meta mark set meta mark | 0x4000
+	}
+	chain nat-postrouting {
+		type nat hook postrouting priority 100; policy accept;
+		meta mark & 0x4000 == 0x4000 masquerade
+		meta mark & 0x3fff == 0x%x masquerade comment "/s3"
+	}
+	chain filter-input {
+		type filter hook input priority 0; policy accept;
+		ip daddr . meta l4proto . th dport @vip-vport-src ip daddr . meta l4proto . th dport . ip saddr != @vip-vport-src-net drop
+	}
+}
+`, mark, mark) {
+		t.Fatal(string(data))
+	}
+	if changed, err := a.dataPath.changed(a.lastFWMarkMap); err != nil || changed {
+		t.Fatal(changed, err)
+	}
+	// someone deletes the table
+	if err := nft.Apply([]byte("delete table ip kube-bmlb\n")); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := a.dataPath.changed(a.lastFWMarkMap); err != nil || !changed {
+		t.Fatal(changed, err)
+	}
+	a.verifyDataPath()
+	if changed, err := a.dataPath.changed(a.lastFWMarkMap); err != nil || changed {
+		t.Fatal(changed, err)
+	}
+	if err := a.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if len(nft.Tables) != 0 {
+		t.Fatal(nft.Tables)
+	}
+}
+
+func TestBuildMixedProtocols(t *testing.T) {
+	vsAddr, rsAddr := net.ParseIP("10.0.0.2"), net.ParseIP("192.168.0.2")
+	s1, s2, s3 := service("s1", v1.ProtocolTCP, 80), service("s2", v1.ProtocolUDP, 80), service("s3", api.ProtocolSCTP, 80)
+	// a service of both tcp and udp ports
+	s4 := service("s4", v1.ProtocolTCP, 53)
+	s4.Spec.Ports = append(s4.Spec.Ports, v1.ServicePort{Name: "p1", Protocol: v1.ProtocolUDP, Port: 53})
+	endpoints := []*v1.Endpoints{
+		endpoint("s1", rsAddr.String(), 81), endpoint("s2", rsAddr.String(), 82), endpoint("s3", rsAddr.String(), 83),
+		endpoint("s4", rsAddr.String(), 5353, 5354),
+	}
+	a := newTestAdaptor(vsAddr)
+	a.Build([]*v1.Service{s1, s2, s3, s4}, endpoints)
+	str, err := lvs.Dump(a.lvsHandler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if str != `10.0.0.2:53/TCP
+  -> 192.168.0.2:5353
+
+10.0.0.2:53/UDP
+  -> 192.168.0.2:5354
+
+10.0.0.2:80/SCTP
+  -> 192.168.0.2:83
+
+10.0.0.2:80/TCP
+  -> 192.168.0.2:81
+
+10.0.0.2:80/UDP
+  -> 192.168.0.2:82
+` {
+		t.Fatal(str)
+	}
+	entries, err := iptPath(a).ipsetHandler.ListEntries(ipsetName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(entries)
+	if strings.Join(entries, " ") != "10.0.0.2,sctp:80 10.0.0.2,tcp:53 10.0.0.2,tcp:80 10.0.0.2,udp:53 10.0.0.2,udp:80" {
+		t.Fatal(entries)
+	}
+	// deleting the sctp service only deletes the sctp virtual server
+	a.Build([]*v1.Service{s1, s2, s4}, endpoints)
+	if str, err = lvs.Dump(a.lvsHandler); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(str, "SCTP") || strings.Count(str, "10.0.0.2:") != 4 {
+		t.Fatal(str)
+	}
+	if entries, err = iptPath(a).ipsetHandler.ListEntries(ipsetName); err != nil || len(entries) != 4 {
+		t.Fatal(entries, err)
+	}
+}
+
+func TestBuildDeleteUDPFlows(t *testing.T) {
+	vsAddr, rsAddr1, rsAddr2, client := net.ParseIP("10.0.0.2"), net.ParseIP("192.168.0.2"), net.ParseIP("192.168.0.3"), net.ParseIP("172.16.0.1")
+	s1, s2 := service("s1", v1.ProtocolTCP, 53), service("s2", v1.ProtocolUDP, 53)
+	flow := func(protocol string, rs net.IP) conntrack.Flow {
+		return conntrack.Flow{Protocol: protocol, Src: client, SrcPort: 40000, VIP: vsAddr, Port: 53, RealServer: rs, RealPort: 5353}
+	}
+	ct := conntracktesting.NewFake(flow(conntrack.ProtocolUDP, rsAddr1), flow(conntrack.ProtocolUDP, rsAddr2), flow(conntrack.ProtocolTCP, rsAddr1))
+	a := newTestAdaptor(vsAddr, withConntrack(ct))
+	a.Build([]*v1.Service{s1, s2}, []*v1.Endpoints{
+		endpoint("s1", rsAddr1.String(), 5353), endpoint("s2", rsAddr1.String(), 5353), endpoint("s2", rsAddr2.String(), 5353),
+	})
+	if len(ct.Flows) != 3 {
+		t.Fatal(ct.Flows)
+	}
+	// tcp flows are left alone as tcp connections to removed real servers are reset
+	a.Build([]*v1.Service{s1, s2}, []*v1.Endpoints{endpoint("s1", rsAddr2.String(), 5353), endpoint("s2", rsAddr2.String(), 5353)})
+	if len(ct.Flows) != 2 {
+		t.Fatal(ct.Flows)
+	}
+	for _, f := range ct.Flows {
+		if f.Protocol == conntrack.ProtocolUDP && !f.RealServer.Equal(rsAddr2) {
+			t.Fatal(ct.Flows)
+		}
+	}
+	// deleting the virtual server deletes all its udp flows
+	a.Build([]*v1.Service{s1}, []*v1.Endpoints{endpoint("s1", rsAddr2.String(), 5353)})
+	if len(ct.Flows) != 1 || ct.Flows[0].Protocol != conntrack.ProtocolTCP {
+		t.Fatal(ct.Flows)
+	}
+	if ct.Calls != 2 {
+		t.Fatalf("expect a DeleteFlows call of each Build removing real servers, got %d", ct.Calls)
+	}
+}
+
+func TestBuildDeleteUDPFlowsBatched(t *testing.T) {
+	vsAddr, rsAddr1, rsAddr2, client := net.ParseIP("10.0.0.2"), net.ParseIP("192.168.0.2"), net.ParseIP("192.168.0.3"), net.ParseIP("172.16.0.1")
+	masq, dr := service("s1", v1.ProtocolUDP, 53), service("s2", v1.ProtocolUDP, 54)
+	dr.Annotations = map[string]string{api.ANForwardMethod: api.ForwardDR}
+	ct := conntracktesting.NewFake(
+		conntrack.Flow{Protocol: conntrack.ProtocolUDP, Src: client, SrcPort: 40000, VIP: vsAddr, Port: 53, RealServer: rsAddr1, RealPort: 53},
+		conntrack.Flow{Protocol: conntrack.ProtocolUDP, Src: client, SrcPort: 40000, VIP: vsAddr, Port: 53, RealServer: rsAddr2, RealPort: 53},
+		// replies of dr real servers don't pass ipvs, the reply source is the vip
+		conntrack.Flow{Protocol: conntrack.ProtocolUDP, Src: client, SrcPort: 40001, VIP: vsAddr, Port: 54, RealServer: vsAddr, RealPort: 54},
+	)
+	a := newTestAdaptor(vsAddr, withConntrack(ct))
+	a.Build([]*v1.Service{masq, dr}, []*v1.Endpoints{
+		endpoint("s1", rsAddr1.String(), 53), endpoint("s1", rsAddr2.String(), 53), endpoint("s2", rsAddr1.String(), 54), endpoint("s2", rsAddr2.String(), 54),
+	})
+	a.Build([]*v1.Service{masq, dr}, []*v1.Endpoints{endpoint("s1", rsAddr2.String(), 53), endpoint("s2", rsAddr2.String(), 54)})
+	if ct.Calls != 1 || len(ct.Filters) != 2 {
+		t.Fatalf("expect a DeleteFlows call of both removed real servers, got %d calls of %v", ct.Calls, ct.Filters)
+	}
+	if len(ct.Flows) != 1 || !ct.Flows[0].RealServer.Equal(rsAddr2) || ct.Flows[0].Port != 53 {
+		t.Fatal(ct.Flows)
+	}
+}
+
+func TestBuildDeleteFWMarkUDPFlows(t *testing.T) {
+	vsAddr, rsAddr1, rsAddr2, client := net.ParseIP("10.0.0.2"), net.ParseIP("192.168.0.2"), net.ParseIP("192.168.0.3"), net.ParseIP("172.16.0.1")
+	masq, dr := service("s1", v1.ProtocolUDP, 53), service("s2", v1.ProtocolTCP, 80)
+	masq.Annotations = map[string]string{api.ANFWMark: "true"}
+	dr.Annotations = map[string]string{api.ANFWMark: "true", api.ANForwardMethod: api.ForwardDR}
+	// host is a udp flow to the node which isn't load balanced
+	host := conntrack.Flow{Protocol: conntrack.ProtocolUDP, Src: client, SrcPort: 40002, VIP: vsAddr, Port: 123, RealServer: vsAddr, RealPort: 123}
+	ct := conntracktesting.NewFake(
+		conntrack.Flow{Protocol: conntrack.ProtocolUDP, Src: client, SrcPort: 40000, VIP: vsAddr, Port: 53, RealServer: rsAddr1, RealPort: 53},
+		conntrack.Flow{Protocol: conntrack.ProtocolUDP, Src: client, SrcPort: 40001, VIP: vsAddr, Port: 53, RealServer: rsAddr2, RealPort: 53},
+		host,
+	)
+	a := newTestAdaptor(vsAddr, withConntrack(ct))
+	a.Build([]*v1.Service{masq, dr}, []*v1.Endpoints{
+		endpoint("s1", rsAddr1.String(), 53), endpoint("s1", rsAddr2.String(), 53), endpoint("s2", rsAddr1.String(), 80), endpoint("s2", rsAddr2.String(), 80),
+	})
+	// removing real servers only deletes flows of removed masquerading real servers
+	a.Build([]*v1.Service{masq, dr}, []*v1.Endpoints{endpoint("s1", rsAddr2.String(), 53), endpoint("s2", rsAddr2.String(), 80)})
+	if len(ct.Flows) != 2 || !ct.Flows[0].RealServer.Equal(rsAddr2) {
+		t.Fatal(ct.Flows)
+	}
+	// deleting fwmark virtual servers leaves flows to the node alone
+	a.Build(nil, nil)
+	if len(ct.Flows) != 1 || ct.Flows[0].Port != host.Port {
+		t.Fatal(ct.Flows)
+	}
+}
+
+func TestBuildReportServices(t *testing.T) {
+	vsAddr := net.ParseIP("10.0.0.2")
+	s1, s2 := service("metrics-s1", v1.ProtocolTCP, 80, 443), service("metrics-s2", v1.ProtocolUDP, 53)
+	s2.Annotations = map[string]string{api.ANFWMark: "true"}
+	endpoints := []*v1.Endpoints{endpoint("metrics-s1", "192.168.0.2", 80, 443), endpoint("metrics-s1", "192.168.0.3", 80, 443), endpoint("metrics-s2", "192.168.0.2", 53)}
+	a := newTestAdaptor(vsAddr)
+	a.Build([]*v1.Service{s1, s2}, endpoints)
+	out := gatherText(t, prometheus.DefaultGatherer)
+	for _, line := range []string{
+		`bmlb_lvs_virtual_servers{family="IPv4",namespace="",service="metrics-s1"} 2`,
+		`bmlb_lvs_real_servers{family="IPv4",namespace="",service="metrics-s1"} 4`,
+		`bmlb_lvs_virtual_servers{family="IPv4",namespace="",service="metrics-s2"} 1`,
+		`bmlb_lvs_real_servers{family="IPv4",namespace="",service="metrics-s2"} 1`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Fatalf("expect %s in %s", line, out)
+		}
+	}
+	a.Build([]*v1.Service{s1}, endpoints)
+	if out = gatherText(t, prometheus.DefaultGatherer); strings.Contains(out, "metrics-s2") {
+		t.Fatal(out)
+	}
+}
+
+// gatherText returns metrics of g in the text exposition format
+func gatherText(t *testing.T, g prometheus.Gatherer) string {
+	families, err := g.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.NewBuffer(nil)
+	for _, family := range families {
+		expfmt.MetricFamilyToText(buf, family)
+	}
+	return buf.String()
+}
+
+func TestCollectStats(t *testing.T) {
+	vsAddr := net.ParseIP("10.0.0.2")
+	s1, s2 := service("s1", v1.ProtocolTCP, 80), service("s2", v1.ProtocolUDP, 53)
+	s2.Annotations = map[string]string{api.ANFWMark: "true"}
+	endpoints := []*v1.Endpoints{endpoint("s1", "192.168.0.2", 8080), endpoint("s2", "192.168.0.3", 53)}
+	fake := lvstesting.NewFake()
+	a := newTestAdaptor(vsAddr, withLVS(fake))
+	// collectors of adaptors of both families are registered together
+	a6 := &LVSAdaptor{lvsHandler: lvstesting.NewFake(), virtualServerAddress: net.ParseIP("fd00::2")}
+	r := prometheus.NewRegistry()
+	r.MustRegister(newStatsCollector(a), newStatsCollector(a6))
+	a.Build([]*v1.Service{s1, s2}, endpoints)
+	vss, _ := fake.GetVirtualServers()
+	for _, vs := range vss {
+		fake.SetVirtualServerStats(vs, lvs.Stats{Connections: 3, BytesIn: 1024, PPSOut: 10})
+		rss, _ := fake.GetRealServers(vs)
+		for _, rs := range rss {
+			fake.SetRealServerStats(vs, rs, lvs.Stats{Connections: 1, PacketsOut: 7})
+		}
+	}
+	out := gatherText(t, r)
+	for _, line := range []string{
+		`bmlb_lvs_service_connections_total{family="IPv4",namespace="",port="80",protocol="TCP",service="s1"} 3`,
+		`bmlb_lvs_service_bytes_total{direction="in",family="IPv4",namespace="",port="80",protocol="TCP",service="s1"} 1024`,
+		`bmlb_lvs_service_packets_per_second{direction="out",family="IPv4",namespace="",port="80",protocol="TCP",service="s1"} 10`,
+		`bmlb_lvs_service_connections_total{family="IPv4",namespace="",port="",protocol="",service="s2"} 3`,
+		`bmlb_lvs_endpoint_connections_total{endpoint="192.168.0.2:8080",family="IPv4",namespace="",port="80",protocol="TCP",service="s1"} 1`,
+		`bmlb_lvs_endpoint_packets_total{direction="out",endpoint="192.168.0.2:8080",family="IPv4",namespace="",port="80",protocol="TCP",service="s1"} 7`,
+		`bmlb_lvs_endpoint_connections_total{endpoint="192.168.0.3:0",family="IPv4",namespace="",port="",protocol="",service="s2"} 1`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Fatalf("expect %s in %s", line, out)
+		}
+	}
+}
+
+// failingLVS fails adding virtual servers
+type failingLVS struct {
+	lvs.Interface
+}
+
+func (f failingLVS) AddVirtualServer(vs *lvs.VirtualServer) error {
+	return fmt.Errorf("no space")
+}
+
+func TestBuildError(t *testing.T) {
+	vsAddr := net.ParseIP("10.0.0.2")
+	a := newTestAdaptor(vsAddr, withLVS(failingLVS{lvstesting.NewFake()}))
+	err := a.Build([]*v1.Service{service("s1", v1.ProtocolTCP, 80, 90)}, nil)
+	if err == nil || !strings.Contains(err.Error(), "failed to add virtual server 10.0.0.2:80/TCP: no space") ||
+		!strings.Contains(err.Error(), "failed to add virtual server 10.0.0.2:90/TCP: no space") {
+		t.Fatalf("unexpected error %v", err)
+	}
+	// errors of the last Build are not kept
+	if err := a.Build(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDesired(t *testing.T) {
+	vsAddr := net.ParseIP("10.0.0.2")
+	s1, s2, s3 := service("s1", v1.ProtocolTCP, 80), service("s2", v1.ProtocolTCP, 80), service("s3", v1.ProtocolUDP, 53)
+	s1.Namespace, s2.Namespace, s3.Namespace = "b", "a", "a"
+	s3.Annotations = map[string]string{api.ANFWMark: "true", api.ANForwardMethod: "dr"}
+	endpoints := []*v1.Endpoints{endpoint("s1", "192.168.0.2", 8080), endpoint("s2", "192.168.0.3", 8080), endpoint("s3", "192.168.0.4", 53)}
+	endpoints[0].Namespace, endpoints[1].Namespace, endpoints[2].Namespace = "b", "a", "a"
+	fake := lvstesting.NewFake()
+	a := newTestAdaptor(vsAddr, withLVS(fake))
+	if a.Desired() != nil {
+		t.Fatal("expect nothing desired before Build")
+	}
+	if err := a.Build([]*v1.Service{s1, s2, s3}, endpoints); err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(a.Desired())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// s1 and s2 share the virtual server of port 80
+	expect := `[{"namespace":"a","name":"s2","virtualServers":[{"virtualServer":"10.0.0.2:80/TCP","scheduler":"rr","realServers":[{"address":"192.168.0.2:8080","forwardMethod":"Masq"},{"address":"192.168.0.3:8080","forwardMethod":"Masq"}]}]},` +
+		`{"namespace":"a","name":"s3","virtualServers":[{"virtualServer":"fwmark:` + strconv.Itoa(int(fwmarkOf(t, a, s3))) + `","scheduler":"rr","realServers":[{"address":"192.168.0.4:0","forwardMethod":"Route"}]}]},` +
+		`{"namespace":"b","name":"s1","virtualServers":[{"virtualServer":"10.0.0.2:80/TCP","scheduler":"rr","realServers":[{"address":"192.168.0.2:8080","forwardMethod":"Masq"},{"address":"192.168.0.3:8080","forwardMethod":"Masq"}]}]}]`
+	if string(data) != expect {
+		t.Fatalf("expect %s, got %s", expect, string(data))
+	}
+	sets, err := a.DumpSets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(sets), "bmlb-vip-vport\n  10.0.0.2,tcp:80\n") {
+		t.Fatal(string(sets))
+	}
+}
+
+func fwmarkOf(t *testing.T, a *LVSAdaptor, svc *v1.Service) uint32 {
+	for mark, s := range a.lastFWMarkMap {
+		if s == svc {
+			return mark
+		}
+	}
+	t.Fatalf("no fwmark of %s", svcKey(svc))
+	return 0
+}
+
+func TestBuildDualStack(t *testing.T) {
+	fake := lvstesting.NewFake()
+	vip4, vip6 := net.ParseIP("10.0.0.2"), net.ParseIP("fd00::2")
+	s1, s2 := service("s1", v1.ProtocolTCP, 80), service("s2", v1.ProtocolTCP, 90)
+	s1.Spec.LoadBalancerSourceRanges = []string{"10.1.0.0/16", "fd01::/64"}
+	s2.Annotations = map[string]string{api.ANFWMark: "true"}
+	s2.Spec.LoadBalancerSourceRanges = []string{"10.1.0.0/16"}
+	endpoints := []*v1.Endpoints{
+		endpoint("s1", "192.168.0.2", 81), endpoint("s1", "fd02::2", 81),
+		endpoint("s2", "192.168.0.2", 90), endpoint("s2", "fd02::2", 90),
+	}
+	a4 := newTestAdaptor(vip4, withLVS(fake))
+	a6 := newTestAdaptor(vip6, withLVS(fake))
+	svcs := []*v1.Service{s1, s2}
+	a4.Build(svcs, endpoints)
+	a6.Build(svcs, endpoints)
+	// virtual servers of the other family are left alone
+	a4.Build(svcs, endpoints)
+	var mark uint32
+	for m := range a4.lastFWMarkMap {
+		mark = m
+	}
+	vss, err := fake.GetVirtualServers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var strs []string
+	for _, vs := range vss {
+		rss, err := fake.GetRealServers(vs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, rs := range rss {
+			strs = append(strs, fmt.Sprintf("%s %s -> %s", api.IPFamilyOf(vs.Address), vs.String(), rs.String()))
+		}
+	}
+	sort.Strings(strs)
+	expect := []string{
+		"IPv4 10.0.0.2:80/TCP -> 192.168.0.2:81",
+		fmt.Sprintf("IPv4 fwmark:%d -> 192.168.0.2:0", mark),
+		"IPv6 [fd00::2]:80/TCP -> [fd02::2]:81",
+		fmt.Sprintf("IPv6 fwmark:%d -> [fd02::2]:0", mark),
+	}
+	if strings.Join(strs, "\n") != strings.Join(expect, "\n") {
+		t.Fatal(strs)
+	}
+	p6 := iptPath(a6)
+	for name, expect := range map[string][]string{
+		ipsetName + ipv6SetSuffix:              {"fd00::2,tcp:80"},
+		srcRestrictedIPSetName + ipv6SetSuffix: {"fd00::2,tcp:80"},
+		srcRangesIPSetName + ipv6SetSuffix:     {"fd00::2,tcp:80,fd01::/64"},
+	} {
+		entries, err := p6.ipsetHandler.ListEntries(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(entries, ",") != strings.Join(expect, ",") {
+			t.Fatalf("set %s expect %v, got %v", name, expect, entries)
+		}
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := p6.iptHandler.SaveInto(iptables.TableNAT, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "-A BMLB-PREROUTING -m set --match-set bmlb-vip-vport-v6 dst,dst") {
+		t.Fatal(buf.String())
+	}
+	// s2 only allows IPv4 sources, no IPv6 packet is marked
+	buf.Reset()
+	if err := p6.iptHandler.SaveInto(iptables.TableMangle, buf); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "-A BMLB-FWMARK") {
+		t.Fatal(buf.String())
+	}
+	buf.Reset()
+	if err := iptPath(a4).iptHandler.SaveInto(iptables.TableMangle, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "-A BMLB-FWMARK -s 10.1.0.0/16 -d 10.0.0.2/32 -p tcp") {
+		t.Fatal(buf.String())
+	}
+	s2.Spec.LoadBalancerSourceRanges = []string{"fd01::1/128"}
+	a6.Build(svcs, endpoints)
+	buf.Reset()
+	if err := p6.iptHandler.SaveInto(iptables.TableMangle, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "-A BMLB-FWMARK -s fd01::1/128 -d fd00::2/128 -p tcp") {
+		t.Fatal(buf.String())
+	}
+	script := string(newNftablesDataPath(vip6, nfttesting.NewFake()).script(a6.lastServiceMap, a6.lastFWMarkMap))
+	for _, line := range []string{
+		"table ip6 kube-bmlb {",
+		"		type ipv6_addr . inet_proto . inet_service . ipv6_addr",
+		"		elements = { fd00::2 . tcp . 80 . fd01::/64 }",
+		fmt.Sprintf("		ip6 daddr fd00::2 ip6 saddr { fd01::1 } tcp dport { 90 } meta mark set meta mark & 0xffff8000 | 0x%x comment \"/s2\"", mark),
+		"		ip6 daddr . meta l4proto . th dport @vip-vport meta mark set meta mark | 0x4000",
+	} {
+		if !strings.Contains(script, line+"\n") {
+			t.Fatalf("expect %q in %s", line, script)
+		}
+	}
+}
+
+func iptPath(a *LVSAdaptor) *iptablesDataPath {
+	return a.dataPath.(*iptablesDataPath)
+}
+
+// newTestAdaptor returns an adaptor of vsAddr with fake handlers and an iptables data path, opts change it
+func newTestAdaptor(vsAddr net.IP, opts ...func(a *LVSAdaptor)) *LVSAdaptor {
+	a := &LVSAdaptor{lvsHandler: lvstesting.NewFake(), virtualServerAddress: vsAddr, dataPath: newIptablesDataPath(vsAddr, ipttesting.NewFakeIPTables(), ipsettesting.NewFake("")), owned: newOwnership(""), conntrack: conntracktesting.NewFake()}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
+}
+
+func withLVS(handler lvs.Interface) func(a *LVSAdaptor) {
+	return func(a *LVSAdaptor) { a.lvsHandler = handler }
+}
+
+func withConntrack(ct conntrack.Interface) func(a *LVSAdaptor) {
+	return func(a *LVSAdaptor) { a.conntrack = ct }
+}
+
 func service(name string, proto v1.Protocol, ports ...int) *v1.Service {
 	svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: name}}
-	portMap := map[int32]int32{}
-	for _, port := range ports {
-		portMap[int32(port)] = int32(port)
-		svc.Spec.Ports = append(svc.Spec.Ports, v1.ServicePort{Protocol: proto})
-	}
-	protocolPorts := []map[int32]int32{portMap, {}}
-	if proto == v1.ProtocolUDP {
-		protocolPorts = []map[int32]int32{{}, portMap}
+	for i, port := range ports {
+		svc.Spec.Ports = append(svc.Spec.Ports, v1.ServicePort{Name: fmt.Sprintf("p%d", i), Protocol: proto, Port: int32(port)})
 	}
-	svc.Annotations = map[string]string{api.ANStatusBindedPort: api.EncodeL4Ports(protocolPorts)}
 	return svc
 }
 
@@ -133,8 +1127,8 @@ func endpoint(name string, ip string, ports ...int32) *v1.Endpoints {
 	ep := &v1.Endpoints{ObjectMeta: metav1.ObjectMeta{Name: name}, Subsets: []v1.EndpointSubset{
 		{Addresses: []v1.EndpointAddress{{IP: ip}}},
 	}}
-	for _, p := range ports {
-		ep.Subsets[0].Ports = append(ep.Subsets[0].Ports, v1.EndpointPort{Port: p})
+	for i, p := range ports {
+		ep.Subsets[0].Ports = append(ep.Subsets[0].Ports, v1.EndpointPort{Name: fmt.Sprintf("p%d", i), Port: p})
 	}
 	return ep
 }
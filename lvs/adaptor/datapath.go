@@ -0,0 +1,46 @@
+package adaptor
+
+import (
+	"strings"
+
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+	utilexec "k8s.io/utils/exec"
+)
+
+const (
+	// DataPathAuto picks nftables if iptables is missing or is the nf_tables variant, iptables otherwise
+	DataPathAuto     = "auto"
+	DataPathIptables = "iptables"
+	DataPathNftables = "nftables"
+)
+
+// dataPath programs packet marks, masquerade and source allowlists of virtual servers which ipvs alone
+// can't do
+type dataPath interface {
+	// sync programs rules of services, serviceMap is protocol:port:services and fwmarkMap is mark:service
+	sync(serviceMap map[v1.Protocol]map[int32][]*v1.Service, fwmarkMap map[uint32]*v1.Service) error
+	// changed returns true if rules were deleted or changed by others since the last sync
+	changed(fwmarkMap map[uint32]*v1.Service) (bool, error)
+	// cleanup deletes everything sync created
+	cleanup()
+	// dump returns a listing of sets sync created and their entries
+	dump() ([]byte, error)
+}
+
+// detectDataPath returns nftables if iptables is missing or translates rules to nftables, rules of legacy
+// iptables and nftables conflict without being visible to each other's tools
+func detectDataPath(exec utilexec.Interface) string {
+	if _, err := exec.LookPath("nft"); err != nil {
+		return DataPathIptables
+	}
+	out, err := exec.Command("iptables", "--version").CombinedOutput()
+	if err != nil {
+		glog.V(2).Infof("iptables unavailable, using nftables: %v", err)
+		return DataPathNftables
+	}
+	if strings.Contains(string(out), "nf_tables") {
+		return DataPathNftables
+	}
+	return DataPathIptables
+}
@@ -0,0 +1,103 @@
+package adaptor
+
+import (
+	"net"
+	"sort"
+
+	"github.com/chenchun/kube-bmlb/lvs"
+	"k8s.io/api/core/v1"
+)
+
+// DesiredService is what the last Build expects ipvs to have for a service
+type DesiredService struct {
+	Namespace      string                 `json:"namespace"`
+	Name           string                 `json:"name"`
+	VirtualServers []DesiredVirtualServer `json:"virtualServers"`
+}
+
+// DesiredVirtualServer is a virtual server of a service and its real servers, a virtual server shared by
+// services of the same port is listed in each of them
+type DesiredVirtualServer struct {
+	VirtualServer string              `json:"virtualServer"`
+	Scheduler     string              `json:"scheduler"`
+	RealServers   []DesiredRealServer `json:"realServers"`
+}
+
+type DesiredRealServer struct {
+	Address       string `json:"address"`
+	ForwardMethod string `json:"forwardMethod"`
+}
+
+// Desired returns virtual servers and real servers the last Build expects, sorted by namespace and name of
+// services. It is nil before the first Build.
+func (a *LVSAdaptor) Desired() []*DesiredService {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.lastServiceMap == nil {
+		return nil
+	}
+	bySvc := map[*v1.Service]*DesiredService{}
+	var result []*DesiredService
+	add := func(svc *v1.Service, vs *lvs.VirtualServer, expectRSs map[string]lvs.RealServer) {
+		desired, ok := bySvc[svc]
+		if !ok {
+			desired = &DesiredService{Namespace: svc.Namespace, Name: svc.Name}
+			bySvc[svc] = desired
+			result = append(result, desired)
+		}
+		dvs := DesiredVirtualServer{VirtualServer: vs.String(), Scheduler: vs.Scheduler, RealServers: []DesiredRealServer{}}
+		for _, key := range sortedRSKeys(expectRSs) {
+			dvs.RealServers = append(dvs.RealServers, DesiredRealServer{Address: key, ForwardMethod: expectRSs[key].ForwardMethod.String()})
+		}
+		desired.VirtualServers = append(desired.VirtualServers, dvs)
+	}
+	for protocol, ports := range a.lastServiceMap {
+		for port, svcs := range ports {
+			vs := &lvs.VirtualServer{Address: a.virtualServerAddress, Port: uint16(port), Protocol: string(protocol), Scheduler: a.scheduler(svcs)}
+			expectRSs, _ := getExpectRSs(svcs, a.lastEndpointsMap, vs)
+			for _, svc := range svcs {
+				add(svc, vs, expectRSs)
+			}
+		}
+	}
+	for mark, svc := range a.lastFWMarkMap {
+		vs := &lvs.VirtualServer{Address: net.IPv4zero, FWMark: mark, Scheduler: a.scheduler([]*v1.Service{svc})}
+		if isIPv6(a.virtualServerAddress) {
+			vs.Address = net.IPv6zero
+		}
+		expectRSs, _ := getFWMarkExpectRSs(svc, a.lastEndpointsMap, vs)
+		add(svc, vs, expectRSs)
+	}
+	for _, desired := range result {
+		vss := desired.VirtualServers
+		sort.Slice(vss, func(i, j int) bool { return vss[i].VirtualServer < vss[j].VirtualServer })
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Namespace != result[j].Namespace {
+			return result[i].Namespace < result[j].Namespace
+		}
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// DumpIPVS lists all virtual servers and real servers in ipvs, including ones not owned by kube-bmlb
+func (a *LVSAdaptor) DumpIPVS() (string, error) {
+	return lvs.Dump(a.lvsHandler)
+}
+
+// DumpSets lists sets of the data path and their entries
+func (a *LVSAdaptor) DumpSets() ([]byte, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.dataPath.dump()
+}
+
+func sortedRSKeys(rss map[string]lvs.RealServer) []string {
+	keys := make([]string, 0, len(rss))
+	for key := range rss {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,271 @@
+package adaptor
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/chenchun/kube-bmlb/api"
+	"github.com/chenchun/kube-bmlb/lvs"
+	"github.com/chenchun/kube-bmlb/utils/iptables"
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+)
+
+const (
+	// fwmarkChain in mangle table marks packets of fwmark services before ipvs looks up virtual servers
+	fwmarkChain iptables.Chain = "BMLB-FWMARK"
+	// fwmarkMask are the bits of fwmark ids, ids never overlap the masquerade mark 0x4000
+	fwmarkMask = 0x3fff
+	// masqMark is set on packets of non fwmark virtual servers needing masquerade
+	masqMark = 0x4000
+	// multiportMax is the max number of ports iptables multiport match accepts, a range counts as two
+	multiportMax = 15
+)
+
+// useFWMark returns true if svc asks for a fwmark virtual server
+func useFWMark(svc *v1.Service) bool {
+	if svc.Annotations[api.ANPortRanges] != "" {
+		return true
+	}
+	if str := svc.Annotations[api.ANFWMark]; str != "" {
+		use, err := api.DecodeFWMark(str)
+		if err != nil {
+			glog.Warningf("invalid annotation %s of svc %s/%s: %v", api.ANFWMark, svc.Namespace, svc.Name, err)
+		}
+		return use
+	}
+	return false
+}
+
+// fwmarkServices allocates fwmarks for services using fwmark virtual servers. A fwmark is the ipvs key of a
+// virtual server, so a service keeps its fwmark in last, the fwmarkMap of the last Build. Others take the
+// hash of namespace/name if it is free, falling back to probing ids which are neither used nor reserved by
+// existing virtual servers. Whether a service needs masquerade is never part of its fwmark, see masqMarks.
+func fwmarkServices(svcs []*v1.Service, last map[uint32]*v1.Service, reserved map[uint32]bool) map[uint32]*v1.Service {
+	lastMarks := map[string]uint32{}
+	for mark, svc := range last {
+		lastMarks[svcKey(svc)] = mark
+	}
+	var fwSvcs []*v1.Service
+	marks := map[uint32]*v1.Service{}
+	for _, svc := range svcs {
+		if !useFWMark(svc) {
+			continue
+		}
+		if mark, ok := lastMarks[svcKey(svc)]; ok {
+			marks[mark] = svc
+			continue
+		}
+		fwSvcs = append(fwSvcs, svc)
+	}
+	sort.Slice(fwSvcs, func(i, j int) bool {
+		return svcKey(fwSvcs[i]) < svcKey(fwSvcs[j])
+	})
+	// a reserved id is most likely of a virtual server created for the service hashing to it before restarting
+	var probing []*v1.Service
+	for _, svc := range fwSvcs {
+		if id := hashFWMark(svc); marks[id] == nil {
+			marks[id] = svc
+			continue
+		}
+		probing = append(probing, svc)
+	}
+	for _, svc := range probing {
+		id := hashFWMark(svc)
+		for n := 0; marks[id] != nil || (reserved[id] && n < fwmarkMask); n++ {
+			id = id%fwmarkMask + 1
+		}
+		marks[id] = svc
+	}
+	return marks
+}
+
+// hashFWMark returns the fwmark id derived from namespace/name of svc
+func hashFWMark(svc *v1.Service) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(svcKey(svc)))
+	return h.Sum32()%fwmarkMask + 1
+}
+
+// masqMarks returns fwmarks of services needing masquerade in ascending order. ipvs matches the whole mark
+// of packets, so masqMark is never set for fwmark services and their packets are masqueraded by fwmarks.
+func masqMarks(marks map[uint32]*v1.Service) []uint32 {
+	var masq []uint32
+	for _, mark := range sortedMarks(marks) {
+		if needMasquerade([]*v1.Service{marks[mark]}) {
+			masq = append(masq, mark)
+		}
+	}
+	return masq
+}
+
+func svcKey(svc *v1.Service) string {
+	return svc.Namespace + "/" + svc.Name
+}
+
+// fwmarkMatch is what packets of a fwmark service match
+type fwmarkMatch struct {
+	// protocols are in the order of service ports
+	protocols []string
+	// ports are ports of each protocol, extra port ranges come first
+	ports map[string][]api.PortRange
+	// sources are allowed source networks, nil if all sources are allowed
+	sources []string
+}
+
+// fwmarkMatchOf returns what packets of svc to a VIP of the ipv6 or IPv4 family match, ok is false if no source
+// is allowed
+func fwmarkMatchOf(svc *v1.Service, ipv6 bool) (m fwmarkMatch, ok bool) {
+	extra, err := api.DecodePortRanges(svc.Annotations[api.ANPortRanges])
+	if err != nil {
+		glog.Warningf("invalid annotation %s of svc %s/%s: %v", api.ANPortRanges, svc.Namespace, svc.Name, err)
+	}
+	m.ports = map[string][]api.PortRange{}
+	for _, port := range svc.Spec.Ports {
+		proto := strings.ToLower(string(port.Protocol))
+		if _, ok := m.ports[proto]; !ok {
+			m.protocols = append(m.protocols, proto)
+			m.ports[proto] = append(m.ports[proto], extra...)
+		}
+		m.ports[proto] = append(m.ports[proto], api.PortRange{From: port.Port, To: port.Port})
+	}
+	if ranges, restricted := sourceRanges([]*v1.Service{svc}, ipv6); restricted {
+		if len(ranges) == 0 {
+			return m, false
+		}
+		m.sources = ranges
+	}
+	return m, true
+}
+
+// sortedMarks returns marks in ascending order
+func sortedMarks(marks map[uint32]*v1.Service) []uint32 {
+	var markList []uint32
+	for mark := range marks {
+		markList = append(markList, mark)
+	}
+	sort.Slice(markList, func(i, j int) bool { return markList[i] < markList[j] })
+	return markList
+}
+
+// fwmarkChainRules returns rules of fwmarkChain marking packets of fwmark services
+func (p *iptablesDataPath) fwmarkChainRules(marks map[uint32]*v1.Service) [][]string {
+	var rules [][]string
+	for _, mark := range sortedMarks(marks) {
+		rules = append(rules, p.fwmarkRules(marks[mark], mark)...)
+	}
+	return rules
+}
+
+// fwmarkRules returns rules marking packets to ports of svc. Packets from sources not allowed are not marked,
+// so they never reach real servers.
+func (p *iptablesDataPath) fwmarkRules(svc *v1.Service, mark uint32) [][]string {
+	m, ok := fwmarkMatchOf(svc, p.ipv6)
+	if !ok {
+		return nil
+	}
+	sources := []string{""}
+	if m.sources != nil {
+		sources = m.sources
+	}
+	var rules [][]string
+	for _, proto := range m.protocols {
+		var ports []string
+		for _, r := range m.ports[proto] {
+			ports = append(ports, strings.Replace(r.String(), "-", ":", 1))
+		}
+		for _, group := range multiportGroups(ports) {
+			for _, src := range sources {
+				// keep the order and format of iptables-save so that verifying rules is a string comparison
+				var rule []string
+				if src != "" {
+					if !strings.Contains(src, "/") {
+						src += p.hostMask()
+					}
+					rule = append(rule, "-s", src)
+				}
+				rule = append(rule, "-d", p.virtualServerAddress.String()+p.hostMask(), "-p", proto, "-m", "multiport", "--dports", group,
+					"-m", "comment", "--comment", svcKey(svc),
+					"-j", "MARK", "--set-xmark", fmt.Sprintf("0x%x/0x%x", mark, fwmarkMask|masqMark))
+				rules = append(rules, rule)
+			}
+		}
+	}
+	return rules
+}
+
+// multiportGroups splits ports into comma separated groups which multiport match accepts
+func multiportGroups(ports []string) []string {
+	var groups []string
+	var group []string
+	var size int
+	for _, port := range ports {
+		n := 1
+		if strings.Contains(port, ":") {
+			n = 2
+		}
+		if size+n > multiportMax {
+			groups = append(groups, strings.Join(group, ","))
+			group, size = nil, 0
+		}
+		group = append(group, port)
+		size += n
+	}
+	if len(group) > 0 {
+		groups = append(groups, strings.Join(group, ","))
+	}
+	return groups
+}
+
+// fwmarkExpectRSs returns real servers of a fwmark virtual server, real servers skipped by getFWMarkExpectRSs
+// are errors of the running Build
+func (a *LVSAdaptor) fwmarkExpectRSs(svc *v1.Service, endpointsMap map[string]map[string][]*v1.Endpoints, vs *lvs.VirtualServer) map[string]lvs.RealServer {
+	expectRSs, err := getFWMarkExpectRSs(svc, endpointsMap, vs)
+	if err != nil {
+		a.syncError("target_port", err)
+	}
+	return expectRSs
+}
+
+// getFWMarkExpectRSs returns real servers of a fwmark virtual server, their port is zero to keep the
+// destination port of packets. Endpoints whose ports differ from ports of svc are skipped and returned as
+// an error.
+func getFWMarkExpectRSs(svc *v1.Service, endpointsMap map[string]map[string][]*v1.Endpoints, vs *lvs.VirtualServer) (map[string]lvs.RealServer, error) {
+	expectRSs := map[string]lvs.RealServer{}
+	method := forwardMethod(svc)
+	var mismatched []string
+	for _, edpt := range endpointsMap[svc.Namespace][svc.Name] {
+		for _, subset := range edpt.Subsets {
+			if port := mismatchedPort(svc, &subset); port != 0 {
+				for _, addr := range subset.Addresses {
+					mismatched = append(mismatched, fmt.Sprintf("%s:%d", addr.IP, port))
+				}
+				continue
+			}
+			for _, addr := range subset.Addresses {
+				ip := net.ParseIP(addr.IP)
+				if ip == nil || isIPv6(ip) != isIPv6(vs.Address) {
+					continue
+				}
+				expectRSs[fmt.Sprintf("%s:%d", addr.IP, 0)] = lvs.RealServer{Address: ip, Weight: 1, ForwardMethod: method}
+			}
+		}
+	}
+	if len(mismatched) > 0 {
+		return expectRSs, fmt.Errorf("skipped endpoints %s of svc %s, fwmark virtual servers require target ports to be the same as ports", strings.Join(mismatched, ","), svcKey(svc))
+	}
+	return expectRSs, nil
+}
+
+// mismatchedPort returns the first endpoint port of subset which differs from its service port, 0 if none
+func mismatchedPort(svc *v1.Service, subset *v1.EndpointSubset) int32 {
+	for i := range svc.Spec.Ports {
+		if port := getTargetIntPort(&svc.Spec.Ports[i], subset); port != 0 && port != svc.Spec.Ports[i].Port {
+			return port
+		}
+	}
+	return 0
+}
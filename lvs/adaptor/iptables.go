@@ -1,76 +1,418 @@
 package adaptor
 
 import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
 	"strings"
 
+	"github.com/chenchun/kube-bmlb/api"
+	"github.com/chenchun/kube-bmlb/lvs"
 	"github.com/chenchun/kube-bmlb/utils/ipset"
 	"github.com/chenchun/kube-bmlb/utils/iptables"
 	"github.com/golang/glog"
 	"k8s.io/api/core/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/apimachinery/pkg/util/sets"
 )
 
 const (
 	ipsetName = "bmlb-vip-vport"
-	mark      = "0x4000/0x4000"
+	// srcRestrictedIPSetName contains vip:vport which only allows source ranges in srcRangesIPSetName
+	srcRestrictedIPSetName = "bmlb-vip-vport-src"
+	// srcRangesIPSetName contains vip:vport,cidr entries of allowed sources
+	srcRangesIPSetName = "bmlb-vip-vport-src-net"
+	mark               = "0x4000/0x4000"
+	// ipv6SetSuffix is the suffix of sets of IPv6 VIPs, sets of both families share the same namespace
+	ipv6SetSuffix = "-v6"
+)
+
+const (
+	// chains owned by kube-bmlb, builtin chains only have a jump rule to each of them and everything else
+	// is programmed in one iptables-restore transaction
+	preroutingChain  iptables.Chain = "BMLB-PREROUTING"
+	outputChain      iptables.Chain = "BMLB-OUTPUT"
+	postroutingChain iptables.Chain = "BMLB-POSTROUTING"
+	inputChain       iptables.Chain = "BMLB-INPUT"
+	// chainPrefix is the prefix of all chains owned by kube-bmlb
+	chainPrefix = "BMLB-"
 )
 
 var (
-	constRules = []struct {
-		position iptables.RulePosition
-		table    iptables.Table
-		chain    iptables.Chain
-		rules    []string
+	jumpRules = []struct {
+		table  iptables.Table
+		chain  iptables.Chain
+		target iptables.Chain
+	}{
+		{table: iptables.TableNAT, chain: "PREROUTING", target: preroutingChain},
+		{table: iptables.TableNAT, chain: "OUTPUT", target: outputChain},
+		{table: iptables.TableNAT, chain: "POSTROUTING", target: postroutingChain},
+		// ipvs hooks LOCAL_IN after filter INPUT, so dropping here works for virtual servers
+		{table: iptables.TableFilter, chain: "INPUT", target: inputChain},
+		{table: iptables.TableMangle, chain: "PREROUTING", target: fwmarkChain},
+		{table: iptables.TableMangle, chain: "OUTPUT", target: fwmarkChain},
+	}
+
+	tables = []iptables.Table{iptables.TableMangle, iptables.TableNAT, iptables.TableFilter}
+
+	// legacyRules were prepended to builtin chains by previous versions, they are deleted after upgrading
+	legacyRules = []struct {
+		table iptables.Table
+		chain iptables.Chain
+		rules []string
 	}{
-		//TODO add comment
-		//-A POSTROUTING -m mark --mark 0x4000/0x4000 -j MASQUERADE
-		{position: iptables.Prepend, table: iptables.TableNAT, chain: "OUTPUT", rules: []string{"-p", "all", "-m", "set", "--match-set", ipsetName, "dst,dst", "-j", "MARK", "--set-xmark", mark}},
-		{position: iptables.Prepend, table: iptables.TableNAT, chain: "PREROUTING", rules: []string{"-p", "all", "-m", "set", "--match-set", ipsetName, "dst,dst", "-j", "MARK", "--set-xmark", mark}},
-		{position: iptables.Prepend, table: iptables.TableNAT, chain: "POSTROUTING", rules: []string{"-m", "mark", "--mark", mark, "-j", "MASQUERADE"}},
+		{table: iptables.TableNAT, chain: "OUTPUT", rules: []string{"-p", "all", "-m", "set", "--match-set", ipsetName, "dst,dst", "-j", "MARK", "--set-xmark", mark}},
+		{table: iptables.TableNAT, chain: "PREROUTING", rules: []string{"-p", "all", "-m", "set", "--match-set", ipsetName, "dst,dst", "-j", "MARK", "--set-xmark", mark}},
+		{table: iptables.TableNAT, chain: "POSTROUTING", rules: []string{"-m", "mark", "--mark", mark, "-j", "MASQUERADE"}},
+		{table: iptables.TableFilter, chain: "INPUT", rules: []string{"-m", "set", "--match-set", srcRestrictedIPSetName, "dst,dst", "-m", "set", "!", "--match-set", srcRangesIPSetName, "dst,dst,src", "-j", "DROP"}},
 	}
 )
 
-// buildIptables builds iptables and ipsets for input services
-// serviceMap //protocol port:service, removeOldVS bool
-func (a *LVSAdaptor) buildIptables(serviceMap []map[int32][]*v1.Service) {
-	set := &ipset.IPSet{Name: ipsetName, SetType: ipset.HashIPPort}
-	if err := a.ipsetHandler.CreateSet(set, true); err != nil {
-		glog.Warningf("failed to create ipset %v: %v", set, err)
-		return
+func jumpRule(target iptables.Chain) []string {
+	return []string{"-m", "comment", "--comment", "kube-bmlb", "-j", string(target)}
+}
+
+// iptablesDataPath programs marks, masquerade and source allowlists of virtual servers by iptables rules
+// matching ipsets
+type iptablesDataPath struct {
+	iptHandler           iptables.Interface
+	ipsetHandler         ipset.Interface
+	virtualServerAddress net.IP
+	// ipv6 is true if virtualServerAddress is IPv6, iptHandler must be ip6tables then
+	ipv6 bool
+	// legacyRulesDeleted is true once rules of previous versions are deleted
+	legacyRulesDeleted bool
+}
+
+func newIptablesDataPath(virtualServerAddress net.IP, iptHandler iptables.Interface, ipsetHandler ipset.Interface) *iptablesDataPath {
+	ipv6 := isIPv6(virtualServerAddress)
+	// previous versions only supported IPv4
+	return &iptablesDataPath{iptHandler: iptHandler, ipsetHandler: ipsetHandler, virtualServerAddress: virtualServerAddress,
+		ipv6: ipv6, legacyRulesDeleted: ipv6}
+}
+
+// sync builds iptables and ipsets for input services
+// serviceMap protocol:port:services, fwmarkMap mark:service
+func (p *iptablesDataPath) sync(serviceMap map[v1.Protocol]map[int32][]*v1.Service, fwmarkMap map[uint32]*v1.Service) error {
+	family := ipset.ProtocolFamilyIPV4
+	if p.ipv6 {
+		family = ipset.ProtocolFamilyIPV6
+	}
+	set := &ipset.IPSet{Name: p.setName(ipsetName), SetType: ipset.HashIPPort, HashFamily: family}
+	restrictedSet := &ipset.IPSet{Name: p.setName(srcRestrictedIPSetName), SetType: ipset.HashIPPort, HashFamily: family}
+	rangesSet := &ipset.IPSet{Name: p.setName(srcRangesIPSetName), SetType: ipset.HashIPPortNet, HashFamily: family}
+	expectEntries, restrictedEntries, rangesEntries := sets.String{}, sets.String{}, sets.String{}
+	for proto, ports := range serviceMap {
+		protocol := strings.ToLower(string(proto))
+		for port, svcs := range ports {
+			entry := &ipset.Entry{IP: p.virtualServerAddress.String(), Port: int(port), Protocol: protocol, SetType: set.SetType}
+			if needMasquerade(svcs) {
+				expectEntries.Insert(entry.String())
+			}
+			if ranges, restricted := sourceRanges(svcs, p.ipv6); restricted {
+				restrictedEntries.Insert(entry.String())
+				for _, ipNet := range ranges {
+					rangesEntries.Insert((&ipset.Entry{IP: entry.IP, Port: entry.Port, Protocol: protocol, Net: ipNet, SetType: rangesSet.SetType}).String())
+				}
+			}
+		}
 	}
-	for _, rule := range constRules {
-		if _, err := a.iptHandler.EnsureRule(rule.position, rule.table, rule.chain, rule.rules...); err != nil {
-			glog.Warningf("failed to add iptables rule %s: %v", strings.Join(append([]string{"-t", string(rule.table), string(rule.position), string(rule.chain)}, rule.rules...), " "))
+	// add allowed sources before restricting vip:vport and remove restriction before removing allowed sources,
+	// sets are replaced atomically by a single ipset restore which also creates them before rules reference them
+	script := &ipset.RestoreScript{}
+	script.Add(rangesSet, rangesEntries.List())
+	script.Replace(restrictedSet, restrictedEntries.List())
+	script.Replace(set, expectEntries.List())
+	script.Replace(rangesSet, rangesEntries.List())
+	data, err := script.Bytes()
+	if err == nil {
+		err = p.ipsetHandler.Restore(data)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to sync ipsets: %v", err)
+	}
+	if !p.legacyRulesDeleted {
+		p.deleteLegacyRules()
+		p.legacyRulesDeleted = true
+	}
+	var errs []error
+	if err := p.syncChains(fwmarkMap); err != nil {
+		errs = append(errs, fmt.Errorf("failed to sync iptables chains: %v", err))
+	}
+	errs = append(errs, p.ensureJumpRules()...)
+	return utilerrors.NewAggregate(errs)
+}
+
+// syncChains writes rules of chains owned by kube-bmlb in one iptables-restore transaction and deletes
+// chains which are no longer used
+func (p *iptablesDataPath) syncChains(fwmarkMap map[uint32]*v1.Service) error {
+	expect := p.expectChains(fwmarkMap)
+	buf := bytes.NewBuffer(nil)
+	for _, table := range tables {
+		existChains, err := p.ownedChains(table)
+		if err != nil {
+			return err
+		}
+		var chains []string
+		for chain := range expect[table] {
+			chains = append(chains, string(chain))
+		}
+		sort.Strings(chains)
+		buf.WriteString(fmt.Sprintf("*%s\n", table))
+		for _, chain := range chains {
+			buf.WriteString(iptables.MakeChainLine(iptables.Chain(chain)) + "\n")
+		}
+		for _, chain := range chains {
+			for _, rule := range expect[table][iptables.Chain(chain)] {
+				buf.WriteString(fmt.Sprintf("-A %s %s\n", chain, strings.Join(rule, " ")))
+			}
+		}
+		for _, chain := range existChains {
+			if _, ok := expect[table][chain]; !ok {
+				buf.WriteString(iptables.MakeChainLine(chain) + "\n")
+				buf.WriteString(fmt.Sprintf("-X %s\n", chain))
+			}
 		}
+		buf.WriteString("COMMIT\n")
+	}
+	return p.iptHandler.RestoreAll(buf.Bytes(), iptables.NoFlushTables, iptables.RestoreCounters)
+}
+
+// expectChains returns rules of chains owned by kube-bmlb
+func (p *iptablesDataPath) expectChains(fwmarkMap map[uint32]*v1.Service) map[iptables.Table]map[iptables.Chain][][]string {
+	return map[iptables.Table]map[iptables.Chain][][]string{
+		iptables.TableNAT: {
+			preroutingChain:  {{"-m", "set", "--match-set", p.setName(ipsetName), "dst,dst", "-j", "MARK", "--set-xmark", mark}},
+			outputChain:      {{"-m", "set", "--match-set", p.setName(ipsetName), "dst,dst", "-j", "MARK", "--set-xmark", mark}},
+			postroutingChain: p.postroutingRules(fwmarkMap),
+		},
+		iptables.TableFilter: {
+			inputChain: {{"-m", "set", "--match-set", p.setName(srcRestrictedIPSetName), "dst,dst", "-m", "set", "!", "--match-set", p.setName(srcRangesIPSetName), "dst,dst,src", "-j", "DROP"}},
+		},
+		iptables.TableMangle: {
+			fwmarkChain: p.fwmarkChainRules(fwmarkMap),
+		},
+	}
+}
+
+// postroutingRules returns rules of postroutingChain masquerading packets marked with masqMark and packets
+// of fwmark services needing masquerade
+func (p *iptablesDataPath) postroutingRules(fwmarkMap map[uint32]*v1.Service) [][]string {
+	rules := [][]string{{"-m", "mark", "--mark", mark, "-j", "MASQUERADE"}}
+	for _, fwmark := range masqMarks(fwmarkMap) {
+		rules = append(rules, []string{"-m", "mark", "--mark", fmt.Sprintf("0x%x/0x%x", fwmark, fwmarkMask),
+			"-m", "comment", "--comment", svcKey(fwmarkMap[fwmark]), "-j", "MASQUERADE"})
 	}
-	expectEntries := sets.String{}
-	for i := range serviceMap {
-		protocol := "tcp"
-		if i == 1 {
-			protocol = "udp"
+	return rules
+}
+
+// changed returns true if rules of kube-bmlb were deleted or changed by others, e.g. firewalld
+// reloading without notifying us or administrators flushing tables
+func (p *iptablesDataPath) changed(fwmarkMap map[uint32]*v1.Service) (bool, error) {
+	expect := p.expectChains(fwmarkMap)
+	for _, table := range tables {
+		expectLines := sets.NewString()
+		for chain, rules := range expect[table] {
+			for _, rule := range rules {
+				expectLines.Insert(fmt.Sprintf("-A %s %s", chain, strings.Join(rule, " ")))
+			}
+		}
+		for _, jump := range jumpRules {
+			if jump.table == table {
+				expectLines.Insert(fmt.Sprintf("-A %s %s", jump.chain, strings.Join(jumpRule(jump.target), " ")))
+			}
+		}
+		buf := bytes.NewBuffer(nil)
+		if err := p.iptHandler.SaveInto(table, buf); err != nil {
+			return false, fmt.Errorf("failed to save table %s: %v", table, err)
 		}
-		for p := range serviceMap[i] {
-			expectEntries.Insert((&ipset.Entry{IP: a.virtualServerAddress.String(), Port: int(p), Protocol: protocol, SetType: set.SetType}).String())
+		existLines := sets.NewString()
+		for _, line := range strings.Split(buf.String(), "\n") {
+			// rules in our chains and jump rules to them
+			if strings.HasPrefix(line, "-A "+chainPrefix) || strings.Contains(line, " -j "+chainPrefix) {
+				existLines.Insert(line)
+			}
+		}
+		if !existLines.Equal(expectLines) {
+			glog.V(4).Infof("iptables table %s expect %v, got %v", table, expectLines.List(), existLines.List())
+			return true, nil
 		}
 	}
-	existEntries, err := a.ipsetHandler.ListEntries(ipsetName)
+	return false, nil
+}
+
+// ownedChains returns existing chains of table owned by kube-bmlb
+func (p *iptablesDataPath) ownedChains(table iptables.Table) ([]iptables.Chain, error) {
+	buf := bytes.NewBuffer(nil)
+	if err := p.iptHandler.SaveInto(table, buf); err != nil {
+		return nil, fmt.Errorf("failed to save table %s: %v", table, err)
+	}
+	var chains []iptables.Chain
+	for chain := range iptables.GetChainLines(table, buf.Bytes()) {
+		if strings.HasPrefix(string(chain), chainPrefix) {
+			chains = append(chains, chain)
+		}
+	}
+	sort.Slice(chains, func(i, j int) bool { return chains[i] < chains[j] })
+	return chains, nil
+}
+
+func (p *iptablesDataPath) ensureJumpRules() []error {
+	var errs []error
+	for _, jump := range jumpRules {
+		if _, err := p.iptHandler.EnsureRule(iptables.Prepend, jump.table, jump.chain, jumpRule(jump.target)...); err != nil {
+			errs = append(errs, fmt.Errorf("failed to add jump rule from %s/%s to %s: %v", jump.table, jump.chain, jump.target, err))
+		}
+	}
+	return errs
+}
+
+func (p *iptablesDataPath) deleteLegacyRules() {
+	for _, rule := range legacyRules {
+		if err := p.iptHandler.DeleteRule(rule.table, rule.chain, rule.rules...); err != nil {
+			glog.Warningf("failed to delete legacy iptables rule %s: %v", strings.Join(append([]string{"-t", string(rule.table), "-D", string(rule.chain)}, rule.rules...), " "), err)
+		}
+	}
+}
+
+// cleanup deletes iptables rules, chains and ipsets created by kube-bmlb
+func (p *iptablesDataPath) cleanup() {
+	for _, jump := range jumpRules {
+		if err := p.iptHandler.DeleteRule(jump.table, jump.chain, jumpRule(jump.target)...); err != nil {
+			glog.Warningf("failed to delete jump rule from %s/%s to %s: %v", jump.table, jump.chain, jump.target, err)
+		}
+	}
+	if !p.ipv6 {
+		p.deleteLegacyRules()
+	}
+	buf := bytes.NewBuffer(nil)
+	for _, table := range tables {
+		chains, err := p.ownedChains(table)
+		if err != nil {
+			glog.Warningf("failed to list chains: %v", err)
+			return
+		}
+		buf.WriteString(fmt.Sprintf("*%s\n", table))
+		for _, chain := range chains {
+			buf.WriteString(iptables.MakeChainLine(chain) + "\n")
+		}
+		for _, chain := range chains {
+			buf.WriteString(fmt.Sprintf("-X %s\n", chain))
+		}
+		buf.WriteString("COMMIT\n")
+	}
+	if err := p.iptHandler.RestoreAll(buf.Bytes(), iptables.NoFlushTables, iptables.RestoreCounters); err != nil {
+		glog.Warningf("failed to delete chains: %v", err)
+		return
+	}
+	// rules referencing sets must be deleted before destroying sets
+	exist, err := p.ipsetHandler.ListSets()
 	if err != nil {
-		glog.Warningf("failed to list ipset entries: %v", err)
+		glog.Warningf("failed to list ipsets: %v", err)
 		return
-	} else {
-		for _, existEntry := range existEntries {
-			if !expectEntries.Has(existEntry) {
-				if err := a.ipsetHandler.DelEntry(existEntry, ipsetName); err != nil {
-					glog.Warningf("failed to del ipset entry %s: %v", existEntry, err)
-				}
+	}
+	for _, name := range []string{ipsetName, srcRestrictedIPSetName, srcRangesIPSetName} {
+		name = p.setName(name)
+		if !sets.NewString(exist...).Has(name) {
+			continue
+		}
+		if err := p.ipsetHandler.DestroySet(name); err != nil {
+			glog.Warningf("failed to destroy ipset %s: %v", name, err)
+		}
+	}
+}
+
+// dump lists entries of ipsets, sets which don't exist are omitted
+func (p *iptablesDataPath) dump() ([]byte, error) {
+	exist, err := p.ipsetHandler.ListSets()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list ipsets: %v", err)
+	}
+	buf := bytes.NewBuffer(nil)
+	for _, name := range []string{ipsetName, srcRestrictedIPSetName, srcRangesIPSetName} {
+		name = p.setName(name)
+		if !sets.NewString(exist...).Has(name) {
+			continue
+		}
+		entries, err := p.ipsetHandler.ListEntries(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list entries of ipset %s: %v", name, err)
+		}
+		sort.Strings(entries)
+		fmt.Fprintf(buf, "%s\n", name)
+		for _, entry := range entries {
+			fmt.Fprintf(buf, "  %s\n", entry)
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// setName returns the name of set of the family of virtualServerAddress
+func (p *iptablesDataPath) setName(name string) string {
+	if p.ipv6 {
+		return name + ipv6SetSuffix
+	}
+	return name
+}
+
+// hostMask is the prefix length iptables-save prints for host addresses
+func (p *iptablesDataPath) hostMask() string {
+	if p.ipv6 {
+		return "/128"
+	}
+	return "/32"
+}
+
+// sourceRanges returns the union of allowed source ranges of the ipv6 or IPv4 family of services sharing the
+// same virtual server, restricted is false if any of them is open to all sources. Invalid source ranges or
+// ranges of the other family only allow nothing instead of opening to the world.
+func sourceRanges(svcs []*v1.Service, ipv6 bool) (ranges []string, restricted bool) {
+	union := sets.String{}
+	for _, svc := range svcs {
+		ipNets, err := api.GetSourceRanges(svc)
+		if err != nil {
+			glog.Warningf("invalid source ranges of svc %s/%s: %v", svc.Namespace, svc.Name, err)
+			continue
+		}
+		if len(ipNets) == 0 {
+			return nil, false
+		}
+		for _, ipNet := range ipNets {
+			if isIPv6(ipNet.IP) != ipv6 {
+				continue
+			}
+			ones, bits := ipNet.Mask.Size()
+			if ones == 0 {
+				// ipset can't store network with zero prefix size, it means all sources anyway
+				return nil, false
+			}
+			if ones == bits {
+				// ipset lists host networks without prefix
+				union.Insert(ipNet.IP.String())
 			} else {
-				delete(expectEntries, existEntry)
+				union.Insert(ipNet.String())
 			}
 		}
 	}
-	for _, expectEntry := range expectEntries.List() {
-		if err := a.ipsetHandler.AddEntry(expectEntry, set, true); err != nil {
-			glog.Warningf("failed to add ipset entry %s: %v", expectEntry, err)
+	return union.List(), true
+}
+
+// needMasquerade returns false if all services sharing the same virtual server opt out of masquerading
+// or forward packets in dr or tunnel mode in which replies don't come back through lvs
+func needMasquerade(svcs []*v1.Service) bool {
+	for _, svc := range svcs {
+		if forwardMethod(svc) != lvs.ForwardMasq {
+			continue
+		}
+		preserve, err := api.DecodePreserveClientIP(svc.Annotations[api.ANPreserveClientIP])
+		if err != nil {
+			glog.Warningf("invalid annotation %s of svc %s/%s: %v", api.ANPreserveClientIP, svc.Namespace, svc.Name, err)
+			return true
+		}
+		if !preserve {
+			return true
 		}
 	}
+	return false
 }
@@ -0,0 +1,191 @@
+package adaptor
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/chenchun/kube-bmlb/api"
+	"github.com/chenchun/kube-bmlb/lvs"
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+var (
+	lvsErrors = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "bmlb_lvs_errors_total",
+		Help: "Errors of lvs operations, they are retried on next sync."}, []string{"operation"})
+	lvsVirtualServers = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "bmlb_lvs_virtual_servers",
+		Help: "Number of virtual servers carrying a service."}, []string{"family", "namespace", "service"})
+	lvsRealServers = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "bmlb_lvs_real_servers",
+		Help: "Number of real servers of all virtual servers of a service."}, []string{"family", "namespace", "service"})
+)
+
+func init() {
+	prometheus.MustRegister(lvsErrors, lvsVirtualServers, lvsRealServers)
+}
+
+// reportServices sets gauges of services and deletes gauges of services which are gone
+func (a *LVSAdaptor) reportServices(svcs []*v1.Service, fwmarkSvcs map[*v1.Service]bool, endpointsMap map[string]map[string][]*v1.Endpoints) {
+	family := api.IPFamilyOf(a.virtualServerAddress)
+	reported := sets.NewString()
+	for _, svc := range svcs {
+		var vsCount, rsCount int
+		if fwmarkSvcs[svc] {
+			vsCount = 1
+			expectRSs, _ := getFWMarkExpectRSs(svc, endpointsMap, &lvs.VirtualServer{Address: a.virtualServerAddress})
+			rsCount = len(expectRSs)
+		} else {
+			for _, port := range svc.Spec.Ports {
+				protocol := port.Protocol
+				if protocol == "" {
+					protocol = v1.ProtocolTCP
+				}
+				vs := &lvs.VirtualServer{Address: a.virtualServerAddress, Port: uint16(port.Port), Protocol: string(protocol)}
+				vsCount++
+				expectRSs, _ := getExpectRSs([]*v1.Service{svc}, endpointsMap, vs)
+				rsCount += len(expectRSs)
+			}
+		}
+		lvsVirtualServers.WithLabelValues(family, svc.Namespace, svc.Name).Set(float64(vsCount))
+		lvsRealServers.WithLabelValues(family, svc.Namespace, svc.Name).Set(float64(rsCount))
+		reported.Insert(svcKey(svc))
+	}
+	for _, key := range a.reported.Difference(reported).List() {
+		parts := strings.SplitN(key, "/", 2)
+		lvsVirtualServers.DeleteLabelValues(family, parts[0], parts[1])
+		lvsRealServers.DeleteLabelValues(family, parts[0], parts[1])
+	}
+	a.reported = reported
+}
+
+// statsField is a metric of ipvs stats of virtual servers or real servers
+type statsField struct {
+	desc      *prometheus.Desc
+	typ       prometheus.ValueType
+	direction string
+	value     func(lvs.Stats) uint64
+}
+
+// newStatsFields returns counters and rates of stats, object is what stats belong to in help texts. Metrics
+// of directions have a direction label after labels.
+func newStatsFields(prefix, object string, labels []string, family string) []statsField {
+	constLabels := prometheus.Labels{"family": family}
+	withDirection := append(labels[:len(labels):len(labels)], "direction")
+	desc := func(suffix, help string, labels []string) *prometheus.Desc {
+		return prometheus.NewDesc(prefix+suffix, fmt.Sprintf(help, object), labels, constLabels)
+	}
+	connections := desc("_connections_total", "Connections scheduled to %s.", labels)
+	packets := desc("_packets_total", "Packets of %s by direction.", withDirection)
+	bytes := desc("_bytes_total", "Bytes of %s by direction.", withDirection)
+	cps := desc("_connections_per_second", "Connection rate of %s estimated by kernel.", labels)
+	pps := desc("_packets_per_second", "Packet rate of %s by direction estimated by kernel.", withDirection)
+	bps := desc("_bytes_per_second", "Byte rate of %s by direction estimated by kernel.", withDirection)
+	return []statsField{
+		{connections, prometheus.CounterValue, "", func(s lvs.Stats) uint64 { return s.Connections }},
+		{packets, prometheus.CounterValue, "in", func(s lvs.Stats) uint64 { return s.PacketsIn }},
+		{packets, prometheus.CounterValue, "out", func(s lvs.Stats) uint64 { return s.PacketsOut }},
+		{bytes, prometheus.CounterValue, "in", func(s lvs.Stats) uint64 { return s.BytesIn }},
+		{bytes, prometheus.CounterValue, "out", func(s lvs.Stats) uint64 { return s.BytesOut }},
+		{cps, prometheus.GaugeValue, "", func(s lvs.Stats) uint64 { return s.CPS }},
+		{pps, prometheus.GaugeValue, "in", func(s lvs.Stats) uint64 { return s.PPSIn }},
+		{pps, prometheus.GaugeValue, "out", func(s lvs.Stats) uint64 { return s.PPSOut }},
+		{bps, prometheus.GaugeValue, "in", func(s lvs.Stats) uint64 { return s.BPSIn }},
+		{bps, prometheus.GaugeValue, "out", func(s lvs.Stats) uint64 { return s.BPSOut }},
+	}
+}
+
+// statsCollector reads stats of virtual servers and real servers of services from ipvs on each scrape. Labels
+// of virtual servers are namespace, service, protocol and port, protocol and port are empty for fwmark virtual
+// servers. Real servers are labeled by endpoint ip:port in addition. Metrics of adaptors of both families are
+// told apart by the family label.
+type statsCollector struct {
+	a        *LVSAdaptor
+	vsFields []statsField
+	rsFields []statsField
+}
+
+func newStatsCollector(a *LVSAdaptor) *statsCollector {
+	family := api.IPFamilyOf(a.virtualServerAddress)
+	vsLabels := []string{"namespace", "service", "protocol", "port"}
+	return &statsCollector{
+		a:        a,
+		vsFields: newStatsFields("bmlb_lvs_service", "virtual servers", vsLabels, family),
+		rsFields: newStatsFields("bmlb_lvs_endpoint", "real servers", append(vsLabels, "endpoint"), family),
+	}
+}
+
+// Describe implements prometheus.Collector
+func (c *statsCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, fields := range [][]statsField{c.vsFields, c.rsFields} {
+		for _, f := range fields {
+			if f.direction != "out" {
+				ch <- f.desc
+			}
+		}
+	}
+}
+
+// Collect implements prometheus.Collector
+func (c *statsCollector) Collect(ch chan<- prometheus.Metric) {
+	a := c.a
+	// Build replaces the maps instead of changing them, dumps don't block Build
+	a.mu.Lock()
+	serviceMap, fwmarkMap := a.lastServiceMap, a.lastFWMarkMap
+	a.mu.Unlock()
+	if serviceMap == nil {
+		return
+	}
+	vss, err := a.getVirtualServers()
+	if err != nil {
+		glog.Warningf("failed to get virtual servers: %v", err)
+		lvsErrors.WithLabelValues("get_stats").Inc()
+		return
+	}
+	for _, vs := range vss {
+		svc := a.serviceOf(vs, serviceMap, fwmarkMap)
+		if svc == nil {
+			continue
+		}
+		var protocol, port string
+		if vs.FWMark == 0 {
+			protocol, port = vs.Protocol, strconv.Itoa(int(vs.Port))
+		}
+		labels := []string{svc.Namespace, svc.Name, protocol, port}
+		collectStats(ch, c.vsFields, vs.Stats, labels)
+		rss, err := a.lvsHandler.GetRealServers(vs)
+		if err != nil {
+			glog.Warningf("failed to get real servers of %s: %v", vs.String(), err)
+			lvsErrors.WithLabelValues("get_stats").Inc()
+			continue
+		}
+		for _, rs := range rss {
+			collectStats(ch, c.rsFields, rs.Stats, append(labels[:len(labels):len(labels)], rs.String()))
+		}
+	}
+}
+
+func collectStats(ch chan<- prometheus.Metric, fields []statsField, stats lvs.Stats, labels []string) {
+	for _, f := range fields {
+		values := labels
+		if f.direction != "" {
+			values = append(labels[:len(labels):len(labels)], f.direction)
+		}
+		ch <- prometheus.MustNewConstMetric(f.desc, f.typ, float64(f.value(stats)), values...)
+	}
+}
+
+// serviceOf returns the service of a virtual server in services of a Build, the first one if services share it
+func (a *LVSAdaptor) serviceOf(vs *lvs.VirtualServer, serviceMap map[v1.Protocol]map[int32][]*v1.Service, fwmarkMap map[uint32]*v1.Service) *v1.Service {
+	if vs.FWMark != 0 {
+		return fwmarkMap[vs.FWMark]
+	}
+	if !vs.Address.Equal(a.virtualServerAddress) {
+		return nil
+	}
+	if svcs := serviceMap[v1.Protocol(vs.Protocol)][int32(vs.Port)]; len(svcs) > 0 {
+		return svcs[0]
+	}
+	return nil
+}
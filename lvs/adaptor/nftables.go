@@ -0,0 +1,195 @@
+package adaptor
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/chenchun/kube-bmlb/utils/nftables"
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+const (
+	// nftTable has all sets and chains of kube-bmlb in nftables mode, it is replaced atomically
+	nftTable = "kube-bmlb"
+	// nftMasqSet contains vip . proto . vport which are masqueraded
+	nftMasqSet = "vip-vport"
+	// nftRestrictedSet contains vip . proto . vport which only allows sources in nftRangesSet
+	nftRestrictedSet = "vip-vport-src"
+	// nftRangesSet contains vip . proto . vport . cidr of allowed sources
+	nftRangesSet = "vip-vport-src-net"
+	// nftFWMarkChain is jumped to from both mangle prerouting and output base chains
+	nftFWMarkChain = "fwmark"
+)
+
+// nftablesDataPath programs the same rules as iptablesDataPath in a single nftables table using nft sets
+// instead of ipsets. Concatenated sets with intervals require nft 0.9.4 and kernel 5.6.
+type nftablesDataPath struct {
+	nft                  nftables.Interface
+	virtualServerAddress net.IP
+	// family is the table family of virtualServerAddress, it is also the keyword of address matches
+	family nftables.Family
+	// applied is the listing of the table after the last sync, nil if the last sync failed
+	applied []byte
+}
+
+func newNftablesDataPath(virtualServerAddress net.IP, nft nftables.Interface) *nftablesDataPath {
+	family := nftables.FamilyIPv4
+	if isIPv6(virtualServerAddress) {
+		family = nftables.FamilyIPv6
+	}
+	return &nftablesDataPath{nft: nft, virtualServerAddress: virtualServerAddress, family: family}
+}
+
+// sync replaces the table in one transaction
+func (p *nftablesDataPath) sync(serviceMap map[v1.Protocol]map[int32][]*v1.Service, fwmarkMap map[uint32]*v1.Service) error {
+	p.applied = nil
+	if err := p.nft.Apply(p.script(serviceMap, fwmarkMap)); err != nil {
+		return fmt.Errorf("failed to sync nftables: %v", err)
+	}
+	data, _, err := p.nft.ListTable(p.family, nftTable)
+	if err != nil {
+		// the next verification rebuilds the table
+		glog.Warningf("failed to list nftables table %s: %v", nftTable, err)
+		return nil
+	}
+	p.applied = data
+	return nil
+}
+
+// changed compares the table with the listing right after the last sync
+func (p *nftablesDataPath) changed(fwmarkMap map[uint32]*v1.Service) (bool, error) {
+	data, exist, err := p.nft.ListTable(p.family, nftTable)
+	if err != nil {
+		return false, err
+	}
+	if !exist || !bytes.Equal(data, p.applied) {
+		glog.V(4).Infof("nftables table %s expect %s, got %s", nftTable, string(p.applied), string(data))
+		return true, nil
+	}
+	return false, nil
+}
+
+// cleanup deletes the table
+func (p *nftablesDataPath) cleanup() {
+	_, exist, err := p.nft.ListTable(p.family, nftTable)
+	if err != nil {
+		glog.Warningf("failed to list nftables table %s: %v", nftTable, err)
+		return
+	}
+	if !exist {
+		return
+	}
+	if err := p.nft.Apply([]byte(fmt.Sprintf("delete table %s %s\n", p.family, nftTable))); err != nil {
+		glog.Warningf("failed to delete nftables table %s: %v", nftTable, err)
+	}
+	p.applied = nil
+}
+
+// dump lists the table, it has sets as well as chains
+func (p *nftablesDataPath) dump() ([]byte, error) {
+	data, _, err := p.nft.ListTable(p.family, nftTable)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list nftables table %s: %v", nftTable, err)
+	}
+	return data, nil
+}
+
+// script returns a nft script replacing the table, adding the table first makes deleting never fail
+func (p *nftablesDataPath) script(serviceMap map[v1.Protocol]map[int32][]*v1.Service, fwmarkMap map[uint32]*v1.Service) []byte {
+	masqElems, restrictedElems, rangesElems := sets.String{}, sets.String{}, sets.String{}
+	vip := p.virtualServerAddress.String()
+	for proto, ports := range serviceMap {
+		protocol := strings.ToLower(string(proto))
+		for port, svcs := range ports {
+			elem := fmt.Sprintf("%s . %s . %d", vip, protocol, port)
+			if needMasquerade(svcs) {
+				masqElems.Insert(elem)
+			}
+			if ranges, restricted := sourceRanges(svcs, p.family == nftables.FamilyIPv6); restricted {
+				restrictedElems.Insert(elem)
+				for _, ipNet := range ranges {
+					rangesElems.Insert(fmt.Sprintf("%s . %s", elem, ipNet))
+				}
+			}
+		}
+	}
+	buf := bytes.NewBuffer(nil)
+	family, addrType := p.family, "ipv4_addr"
+	if family == nftables.FamilyIPv6 {
+		addrType = "ipv6_addr"
+	}
+	fmt.Fprintf(buf, "add table %s %s\n", family, nftTable)
+	fmt.Fprintf(buf, "delete table %s %s\n", family, nftTable)
+	fmt.Fprintf(buf, "table %s %s {\n", family, nftTable)
+	writeSet(buf, nftMasqSet, addrType+" . inet_proto . inet_service", false, masqElems.List())
+	writeSet(buf, nftRestrictedSet, addrType+" . inet_proto . inet_service", false, restrictedElems.List())
+	writeSet(buf, nftRangesSet, addrType+" . inet_proto . inet_service . "+addrType, true, rangesElems.List())
+	writeChain(buf, nftFWMarkChain, "", p.fwmarkRules(fwmarkMap))
+	jump := []string{"jump " + nftFWMarkChain}
+	writeChain(buf, "mangle-prerouting", "type filter hook prerouting priority -150; policy accept;", jump)
+	writeChain(buf, "mangle-output", "type route hook output priority -150; policy accept;", jump)
+	masq := []string{fmt.Sprintf("%s daddr . meta l4proto . th dport @%s meta mark set meta mark | 0x%x", family, nftMasqSet, masqMark)}
+	writeChain(buf, "nat-prerouting", "type nat hook prerouting priority -100; policy accept;", masq)
+	writeChain(buf, "nat-output", "type nat hook output priority -100; policy accept;", masq)
+	postrouting := []string{fmt.Sprintf("meta mark & 0x%x == 0x%x masquerade", masqMark, masqMark)}
+	for _, mark := range masqMarks(fwmarkMap) {
+		postrouting = append(postrouting, fmt.Sprintf("meta mark & 0x%x == 0x%x masquerade comment %q", fwmarkMask, mark, svcKey(fwmarkMap[mark])))
+	}
+	writeChain(buf, "nat-postrouting", "type nat hook postrouting priority 100; policy accept;", postrouting)
+	// ipvs hooks LOCAL_IN after filter input, so dropping here works for virtual servers
+	writeChain(buf, "filter-input", "type filter hook input priority 0; policy accept;",
+		[]string{fmt.Sprintf("%[1]s daddr . meta l4proto . th dport @%[2]s %[1]s daddr . meta l4proto . th dport . %[1]s saddr != @%[3]s drop", family, nftRestrictedSet, nftRangesSet)})
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
+
+// fwmarkRules returns rules marking packets of fwmark services, packets from sources not allowed are not marked
+func (p *nftablesDataPath) fwmarkRules(marks map[uint32]*v1.Service) []string {
+	var rules []string
+	for _, mark := range sortedMarks(marks) {
+		svc := marks[mark]
+		m, ok := fwmarkMatchOf(svc, p.family == nftables.FamilyIPv6)
+		if !ok {
+			continue
+		}
+		src := ""
+		if m.sources != nil {
+			src = fmt.Sprintf(" %s saddr { %s }", p.family, strings.Join(m.sources, ", "))
+		}
+		for _, proto := range m.protocols {
+			var ports []string
+			for _, r := range m.ports[proto] {
+				ports = append(ports, r.String())
+			}
+			rules = append(rules, fmt.Sprintf("%s daddr %s%s %s dport { %s } meta mark set meta mark & 0x%x | 0x%x comment %q",
+				p.family, p.virtualServerAddress.String(), src, proto, strings.Join(ports, ", "), ^uint32(fwmarkMask|masqMark), mark, svcKey(svc)))
+		}
+	}
+	return rules
+}
+
+func writeSet(buf *bytes.Buffer, name, typ string, interval bool, elems []string) {
+	fmt.Fprintf(buf, "\tset %s {\n\t\ttype %s\n", name, typ)
+	if interval {
+		buf.WriteString("\t\tflags interval\n")
+	}
+	if len(elems) > 0 {
+		fmt.Fprintf(buf, "\t\telements = { %s }\n", strings.Join(elems, ", "))
+	}
+	buf.WriteString("\t}\n")
+}
+
+func writeChain(buf *bytes.Buffer, name, hook string, rules []string) {
+	fmt.Fprintf(buf, "\tchain %s {\n", name)
+	if hook != "" {
+		fmt.Fprintf(buf, "\t\t%s\n", hook)
+	}
+	for _, rule := range rules {
+		fmt.Fprintf(buf, "\t\t%s\n", rule)
+	}
+	buf.WriteString("\t}\n")
+}
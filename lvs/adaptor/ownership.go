@@ -0,0 +1,121 @@
+package adaptor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/chenchun/kube-bmlb/lvs"
+	"github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// DefaultOwnershipFile is where kube-bmlb records virtual servers it creates
+const DefaultOwnershipFile = "/var/lib/kube-bmlb/ipvs-virtual-servers"
+
+// ownership records virtual servers created by kube-bmlb. ipvs doesn't support comments, so the
+// record is persisted in a file in order to leave virtual servers of kube-proxy or ipvsadm alone
+// and still be able to remove our own ones after restarting or changing the bind address.
+type ownership struct {
+	// file is the path of the record, it is kept in memory only if empty
+	file string
+	// owned is the set of VirtualServer.String()
+	owned   sets.String
+	changed bool
+}
+
+func newOwnership(file string) *ownership {
+	o := &ownership{file: file, owned: sets.NewString()}
+	if file == "" {
+		return o
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			glog.Warningf("failed to read ownership file %s: %v", file, err)
+		}
+		return o
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			o.owned.Insert(line)
+		}
+	}
+	return o
+}
+
+func (o *ownership) has(vs *lvs.VirtualServer) bool {
+	return o.owned.Has(vs.String())
+}
+
+func (o *ownership) insert(vs *lvs.VirtualServer) {
+	if key := vs.String(); !o.owned.Has(key) {
+		o.owned.Insert(key)
+		o.changed = true
+	}
+}
+
+func (o *ownership) delete(vs *lvs.VirtualServer) {
+	if key := vs.String(); o.owned.Has(key) {
+		o.owned.Delete(key)
+		o.changed = true
+	}
+}
+
+// fwmarks returns fwmark ids of owned fwmark virtual servers
+func (o *ownership) fwmarks() map[uint32]bool {
+	marks := map[uint32]bool{}
+	for key := range o.owned {
+		var mark uint32
+		if _, err := fmt.Sscanf(key, "fwmark:%d", &mark); err == nil {
+			marks[mark&fwmarkMask] = true
+		}
+	}
+	return marks
+}
+
+// retain forgets virtual servers which no longer exist in kernel
+func (o *ownership) retain(vss []*lvs.VirtualServer) {
+	exist := sets.NewString()
+	for _, vs := range vss {
+		exist.Insert(vs.String())
+	}
+	if gone := o.owned.Difference(exist); gone.Len() > 0 {
+		o.owned = o.owned.Intersection(exist)
+		o.changed = true
+	}
+}
+
+// save writes the record if it changed, the file is replaced atomically
+func (o *ownership) save() error {
+	if o.file == "" || !o.changed {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(o.file), 0755); err != nil {
+		return err
+	}
+	tmp := o.file + ".tmp"
+	data := strings.Join(o.owned.List(), "\n")
+	if err := ioutil.WriteFile(tmp, []byte(data+"\n"), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, o.file); err != nil {
+		return err
+	}
+	o.changed = false
+	return nil
+}
+
+// remove deletes the record file
+func (o *ownership) remove() error {
+	o.owned, o.changed = sets.NewString(), false
+	if o.file == "" {
+		return nil
+	}
+	if err := os.Remove(o.file); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
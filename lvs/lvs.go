@@ -9,6 +9,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 
 	"github.com/docker/libnetwork/ipvs"
@@ -32,6 +33,9 @@ type Interface interface {
 	AddRealServer(*VirtualServer, *RealServer) error
 	// GetRealServers returns all real servers for the specified virtual server.
 	GetRealServers(*VirtualServer) ([]*RealServer, error)
+	// UpdateRealServer updates the weight and forwarding method of an already existing real server, its
+	// connections are kept.
+	UpdateRealServer(*VirtualServer, *RealServer) error
 	// DeleteRealServer deletes the specified real server from the specified virtual server.
 	DeleteRealServer(*VirtualServer, *RealServer) error
 }
@@ -44,6 +48,29 @@ type VirtualServer struct {
 	Scheduler string
 	Flags     ServiceFlags
 	Timeout   uint32
+	// FWMark is the firewall mark of packets the virtual server accepts, address, protocol and port are
+	// ignored if it is not zero
+	FWMark uint32
+	// Stats are read from kernel and ignored when creating or comparing virtual servers
+	Stats Stats
+}
+
+// Stats are traffic statistics of a virtual server or a real server since it is created, rates are
+// estimated by kernel every two seconds
+type Stats struct {
+	Connections uint64
+	PacketsIn   uint64
+	PacketsOut  uint64
+	BytesIn     uint64
+	BytesOut    uint64
+	// CPS is connections per second
+	CPS uint64
+	// PPSIn and PPSOut are packets per second
+	PPSIn  uint64
+	PPSOut uint64
+	// BPSIn and BPSOut are bytes per second
+	BPSIn  uint64
+	BPSOut uint64
 }
 
 // ServiceFlags is used to specify session affinity, ip hash etc.
@@ -64,10 +91,14 @@ func (svc *VirtualServer) Equal(other *VirtualServer) bool {
 		svc.Port == other.Port &&
 		svc.Scheduler == other.Scheduler &&
 		svc.Flags == other.Flags &&
-		svc.Timeout == other.Timeout
+		svc.Timeout == other.Timeout &&
+		svc.FWMark == other.FWMark
 }
 
 func (svc *VirtualServer) String() string {
+	if svc.FWMark != 0 {
+		return fmt.Sprintf("fwmark:%d", svc.FWMark)
+	}
 	return net.JoinHostPort(svc.Address.String(), strconv.Itoa(int(svc.Port))) + "/" + svc.Protocol
 }
 
@@ -76,6 +107,35 @@ type RealServer struct {
 	Address net.IP
 	Port    uint16
 	Weight  int
+	// ForwardMethod is how IPVS forwards packets to the real server, defaults to masquerading
+	ForwardMethod ForwardMethod
+	// Stats are read from kernel and ignored when creating or comparing real servers
+	Stats Stats
+}
+
+// ForwardMethod is the IPVS packet forwarding method of a real server
+type ForwardMethod uint32
+
+const (
+	// ForwardMasq rewrites destination of packets to the real server and reply packets come back through IPVS
+	ForwardMasq ForwardMethod = ipvs.ConnectionFlagMasq
+	// ForwardTunnel encapsulates packets in IPIP to the real server which replies to clients directly
+	ForwardTunnel ForwardMethod = ipvs.ConnectionFlagTunnel
+	// ForwardDirectRoute forwards packets to the real server by rewriting mac address, real server must
+	// be in the same L2 network and replies to clients directly
+	ForwardDirectRoute ForwardMethod = ipvs.ConnectionFlagDirectRoute
+)
+
+func (m ForwardMethod) String() string {
+	switch m {
+	case ForwardMasq:
+		return "Masq"
+	case ForwardTunnel:
+		return "Tunnel"
+	case ForwardDirectRoute:
+		return "Route"
+	}
+	return fmt.Sprintf("Unknown(%d)", uint32(m))
 }
 
 func (rs *RealServer) String() string {
@@ -87,12 +147,17 @@ func (rs *RealServer) String() string {
 func (rs *RealServer) Equal(other *RealServer) bool {
 	return rs.Address.Equal(other.Address) &&
 		rs.Port == other.Port &&
-		rs.Weight == other.Weight
+		rs.Weight == other.Weight &&
+		rs.ForwardMethod == other.ForwardMethod
 }
 
 // runner implements Interface.
 type runner struct {
+	// mu serializes requests on ipvsHandle, its netlink socket drops replies of concurrent requests
+	mu         sync.Mutex
 	ipvsHandle *ipvs.Handle
+	// genlFamily is the generic netlink family id of ipvs to list real servers with stats
+	genlFamily int
 }
 
 // New returns a new Interface which will call ipvs APIs.
@@ -102,13 +167,20 @@ func New() Interface {
 		glog.Errorf("IPVS interface can't be initialized, error: %v", err)
 		return nil
 	}
+	genlFamily, err := getGenlFamily()
+	if err != nil {
+		glog.Errorf("failed to get generic netlink family of ipvs, real servers are listed without stats: %v", err)
+	}
 	return &runner{
 		ipvsHandle: ihandle,
+		genlFamily: genlFamily,
 	}
 }
 
 // AddVirtualServer is part of Interface.
 func (runner *runner) AddVirtualServer(vs *VirtualServer) error {
+	runner.mu.Lock()
+	defer runner.mu.Unlock()
 	eSvc, err := toBackendService(vs)
 	if err != nil {
 		return err
@@ -119,6 +191,8 @@ func (runner *runner) AddVirtualServer(vs *VirtualServer) error {
 
 // UpdateVirtualServer is part of Interface.
 func (runner *runner) UpdateVirtualServer(vs *VirtualServer) error {
+	runner.mu.Lock()
+	defer runner.mu.Unlock()
 	bSvc, err := toBackendService(vs)
 	if err != nil {
 		return err
@@ -128,6 +202,8 @@ func (runner *runner) UpdateVirtualServer(vs *VirtualServer) error {
 
 // DeleteVirtualServer is part of Interface.
 func (runner *runner) DeleteVirtualServer(vs *VirtualServer) error {
+	runner.mu.Lock()
+	defer runner.mu.Unlock()
 	bSvc, err := toBackendService(vs)
 	if err != nil {
 		return err
@@ -138,6 +214,8 @@ func (runner *runner) DeleteVirtualServer(vs *VirtualServer) error {
 
 // GetVirtualServer is part of Interface.
 func (runner *runner) GetVirtualServer(vs *VirtualServer) (*VirtualServer, error) {
+	runner.mu.Lock()
+	defer runner.mu.Unlock()
 	bSvc, err := toBackendService(vs)
 	if err != nil {
 		return nil, err
@@ -155,6 +233,8 @@ func (runner *runner) GetVirtualServer(vs *VirtualServer) (*VirtualServer, error
 
 // GetVirtualServers is part of Interface.
 func (runner *runner) GetVirtualServers() ([]*VirtualServer, error) {
+	runner.mu.Lock()
+	defer runner.mu.Unlock()
 	ipvsServices, err := runner.ipvsHandle.GetServices()
 	if err != nil {
 		return nil, err
@@ -172,11 +252,15 @@ func (runner *runner) GetVirtualServers() ([]*VirtualServer, error) {
 
 // Flush is part of Interface.  Currently we delete IPVS services one by one
 func (runner *runner) Flush() error {
+	runner.mu.Lock()
+	defer runner.mu.Unlock()
 	return runner.ipvsHandle.Flush()
 }
 
 // AddRealServer is part of Interface.
 func (runner *runner) AddRealServer(vs *VirtualServer, rs *RealServer) error {
+	runner.mu.Lock()
+	defer runner.mu.Unlock()
 	bSvc, err := toBackendService(vs)
 	if err != nil {
 		return err
@@ -189,8 +273,26 @@ func (runner *runner) AddRealServer(vs *VirtualServer, rs *RealServer) error {
 	return runner.ipvsHandle.NewDestination(bSvc, bDst)
 }
 
+// UpdateRealServer is part of Interface.
+func (runner *runner) UpdateRealServer(vs *VirtualServer, rs *RealServer) error {
+	runner.mu.Lock()
+	defer runner.mu.Unlock()
+	bSvc, err := toBackendService(vs)
+	if err != nil {
+		return err
+	}
+	bDst, err := toBackendDestination(rs)
+	if err != nil {
+		return err
+	}
+	glog.V(5).Infof("UpdateRealServer vs %s rs %s", vs.String(), rs.String())
+	return runner.ipvsHandle.UpdateDestination(bSvc, bDst)
+}
+
 // DeleteRealServer is part of Interface.
 func (runner *runner) DeleteRealServer(vs *VirtualServer, rs *RealServer) error {
+	runner.mu.Lock()
+	defer runner.mu.Unlock()
 	bSvc, err := toBackendService(vs)
 	if err != nil {
 		return err
@@ -205,22 +307,26 @@ func (runner *runner) DeleteRealServer(vs *VirtualServer, rs *RealServer) error
 
 // GetRealServers is part of Interface.
 func (runner *runner) GetRealServers(vs *VirtualServer) ([]*RealServer, error) {
+	if vs == nil {
+		return nil, errors.New("virtual server should not be empty")
+	}
+	if runner.genlFamily != 0 {
+		return getDestinations(runner.genlFamily, vs)
+	}
+	// libnetwork lists real servers without stats
 	bSvc, err := toBackendService(vs)
 	if err != nil {
 		return nil, err
 	}
+	runner.mu.Lock()
 	bDestinations, err := runner.ipvsHandle.GetDestinations(bSvc)
+	runner.mu.Unlock()
 	if err != nil {
 		return nil, err
 	}
-	realServers := make([]*RealServer, 0)
+	realServers := make([]*RealServer, 0, len(bDestinations))
 	for _, dest := range bDestinations {
-		dst, err := toRealServer(dest)
-		// TODO: aggregate errors?
-		if err != nil {
-			return nil, err
-		}
-		realServers = append(realServers, dst)
+		realServers = append(realServers, toRealServer(dest))
 	}
 	return realServers, nil
 }
@@ -236,6 +342,19 @@ func toVirtualServer(svc *ipvs.Service) (*VirtualServer, error) {
 		Scheduler: svc.SchedName,
 		Protocol:  protocolNumbeToString(ProtoType(svc.Protocol)),
 		Timeout:   svc.Timeout,
+		FWMark:    svc.FWMark,
+		Stats: Stats{
+			Connections: uint64(svc.Stats.Connections),
+			PacketsIn:   uint64(svc.Stats.PacketsIn),
+			PacketsOut:  uint64(svc.Stats.PacketsOut),
+			BytesIn:     svc.Stats.BytesIn,
+			BytesOut:    svc.Stats.BytesOut,
+			CPS:         uint64(svc.Stats.CPS),
+			PPSIn:       uint64(svc.Stats.PPSIn),
+			PPSOut:      uint64(svc.Stats.PPSOut),
+			BPSIn:       uint64(svc.Stats.BPSIn),
+			BPSOut:      uint64(svc.Stats.BPSOut),
+		},
 	}
 
 	// Test Flags >= 0x2, valid Flags ranges [0x2, 0x3]
@@ -256,16 +375,14 @@ func toVirtualServer(svc *ipvs.Service) (*VirtualServer, error) {
 	return vs, nil
 }
 
-// toRealServer converts an IPVS destination representation to the equivalent real server structure.
-func toRealServer(dst *ipvs.Destination) (*RealServer, error) {
-	if dst == nil {
-		return nil, errors.New("ipvs destination should not be empty")
-	}
+// toRealServer converts an IPVS destination without stats to the equivalent real server structure.
+func toRealServer(dst *ipvs.Destination) *RealServer {
 	return &RealServer{
-		Address: dst.Address,
-		Port:    dst.Port,
-		Weight:  dst.Weight,
-	}, nil
+		Address:       dst.Address,
+		Port:          dst.Port,
+		Weight:        dst.Weight,
+		ForwardMethod: ForwardMethod(dst.ConnectionFlags & ipvs.ConnectionFlagFwdMask),
+	}
 }
 
 // toBackendService converts an IPVS real server representation to the equivalent "backend" service structure.
@@ -280,6 +397,7 @@ func toBackendService(vs *VirtualServer) (*ipvs.Service, error) {
 		SchedName: vs.Scheduler,
 		Flags:     uint32(vs.Flags),
 		Timeout:   vs.Timeout,
+		FWMark:    vs.FWMark,
 	}
 
 	if ip4 := vs.Address.To4(); ip4 != nil {
@@ -298,9 +416,10 @@ func toBackendDestination(rs *RealServer) (*ipvs.Destination, error) {
 		return nil, errors.New("real server should not be empty")
 	}
 	return &ipvs.Destination{
-		Address: rs.Address,
-		Port:    rs.Port,
-		Weight:  rs.Weight,
+		Address:         rs.Address,
+		Port:            rs.Port,
+		Weight:          rs.Weight,
+		ConnectionFlags: uint32(rs.ForwardMethod),
 	}, nil
 }
 
@@ -311,6 +430,8 @@ func stringToProtocolNumber(protocol string) uint16 {
 		return uint16(syscall.IPPROTO_TCP)
 	case "udp":
 		return uint16(syscall.IPPROTO_UDP)
+	case "sctp":
+		return uint16(syscall.IPPROTO_SCTP)
 	}
 	return uint16(0)
 }
@@ -322,6 +443,8 @@ func protocolNumbeToString(proto ProtoType) string {
 		return "TCP"
 	case syscall.IPPROTO_UDP:
 		return "UDP"
+	case syscall.IPPROTO_SCTP:
+		return "SCTP"
 	}
 	return ""
 }
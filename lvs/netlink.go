@@ -0,0 +1,203 @@
+package lvs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/chenchun/kube-bmlb/utils/nlattr"
+	"github.com/docker/libnetwork/ipvs"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// ipvs generic netlink protocol, see include/uapi/linux/ip_vs.h of linux
+const (
+	ipvsGenlName    = "IPVS"
+	ipvsGenlVersion = 1
+	ipvsCmdGetDest  = 8
+
+	ipvsCmdAttrService = 1
+	ipvsCmdAttrDest    = 2
+
+	ipvsSvcAttrAddressFamily = 1
+	ipvsSvcAttrProtocol      = 2
+	ipvsSvcAttrAddress       = 3
+	ipvsSvcAttrPort          = 4
+	ipvsSvcAttrFWMark        = 5
+
+	ipvsDestAttrAddress          = 1
+	ipvsDestAttrPort             = 2
+	ipvsDestAttrForwardingMethod = 3
+	ipvsDestAttrWeight           = 4
+	ipvsDestAttrStats            = 10
+	ipvsDestAttrAddressFamily    = 11
+	ipvsDestAttrStats64          = 12
+
+	ipvsStatsConns    = 1
+	ipvsStatsPktsIn   = 2
+	ipvsStatsPktsOut  = 3
+	ipvsStatsBytesIn  = 4
+	ipvsStatsBytesOut = 5
+	ipvsStatsCPS      = 6
+	ipvsStatsPPSIn    = 7
+	ipvsStatsPPSOut   = 8
+	ipvsStatsBPSIn    = 9
+	ipvsStatsBPSOut   = 10
+)
+
+// getGenlFamily returns the generic netlink family id of ipvs
+func getGenlFamily() (int, error) {
+	req := nl.NewNetlinkRequest(nl.GENL_ID_CTRL, 0)
+	req.AddRawData(genlHeader(nl.GENL_CTRL_CMD_GETFAMILY, nl.GENL_CTRL_VERSION))
+	req.AddRawData(nl.NewRtAttr(nl.GENL_CTRL_ATTR_FAMILY_NAME, nl.ZeroTerminated(ipvsGenlName)).Serialize())
+	msgs, err := req.Execute(syscall.NETLINK_GENERIC, 0)
+	if err != nil {
+		return 0, err
+	}
+	for _, msg := range msgs {
+		if len(msg) < nl.SizeofGenlmsg {
+			continue
+		}
+		attrs, err := nlattr.ParseMap(msg[nl.SizeofGenlmsg:])
+		if err != nil {
+			return 0, err
+		}
+		if id := attrs[nl.GENL_CTRL_ATTR_FAMILY_ID]; len(id) >= 2 {
+			return int(nl.NativeEndian().Uint16(id)), nil
+		}
+	}
+	return 0, fmt.Errorf("no family id of %s in the netlink response", ipvsGenlName)
+}
+
+// getDestinations dumps real servers of vs together with their stats. Unlike libnetwork it parses stats of
+// destinations and addresses of ipv6 destinations.
+func getDestinations(genlFamily int, vs *VirtualServer) ([]*RealServer, error) {
+	if genlFamily == 0 {
+		return nil, fmt.Errorf("unknown generic netlink family of %s", ipvsGenlName)
+	}
+	svc, err := toBackendService(vs)
+	if err != nil {
+		return nil, err
+	}
+	svcAttr := nl.NewRtAttr(ipvsCmdAttrService, nil)
+	nl.NewRtAttrChild(svcAttr, ipvsSvcAttrAddressFamily, nl.Uint16Attr(svc.AddressFamily))
+	if svc.FWMark != 0 {
+		nl.NewRtAttrChild(svcAttr, ipvsSvcAttrFWMark, nl.Uint32Attr(svc.FWMark))
+	} else {
+		addr := svc.Address.To4()
+		if svc.AddressFamily == syscall.AF_INET6 {
+			addr = svc.Address.To16()
+		}
+		port := make([]byte, 2)
+		binary.BigEndian.PutUint16(port, svc.Port)
+		nl.NewRtAttrChild(svcAttr, ipvsSvcAttrProtocol, nl.Uint16Attr(svc.Protocol))
+		nl.NewRtAttrChild(svcAttr, ipvsSvcAttrAddress, addr)
+		nl.NewRtAttrChild(svcAttr, ipvsSvcAttrPort, port)
+	}
+	req := nl.NewNetlinkRequest(genlFamily, syscall.NLM_F_DUMP)
+	req.AddRawData(genlHeader(ipvsCmdGetDest, ipvsGenlVersion))
+	req.AddRawData(svcAttr.Serialize())
+	msgs, err := req.Execute(syscall.NETLINK_GENERIC, 0)
+	if err != nil {
+		return nil, err
+	}
+	realServers := make([]*RealServer, 0, len(msgs))
+	for _, msg := range msgs {
+		rs, err := parseDestination(msg, svc.AddressFamily)
+		if err != nil {
+			return nil, err
+		}
+		realServers = append(realServers, rs)
+	}
+	return realServers, nil
+}
+
+// parseDestination parses a destination message, family is used if the kernel is too old to tell the
+// address family of the destination
+func parseDestination(msg []byte, family uint16) (*RealServer, error) {
+	if len(msg) < nl.SizeofGenlmsg {
+		return nil, fmt.Errorf("short destination message of %d bytes", len(msg))
+	}
+	cmdAttrs, err := nlattr.ParseMap(msg[nl.SizeofGenlmsg:])
+	if err != nil {
+		return nil, err
+	}
+	if cmdAttrs[ipvsCmdAttrDest] == nil {
+		return nil, fmt.Errorf("missing destination attribute")
+	}
+	attrs, err := nlattr.ParseMap(cmdAttrs[ipvsCmdAttrDest])
+	if err != nil {
+		return nil, err
+	}
+	native := nl.NativeEndian()
+	if af := attrs[ipvsDestAttrAddressFamily]; len(af) == 2 {
+		family = native.Uint16(af)
+	}
+	addr := attrs[ipvsDestAttrAddress]
+	rs := &RealServer{}
+	switch {
+	case family == syscall.AF_INET && len(addr) >= net.IPv4len:
+		rs.Address = net.IP(addr[:net.IPv4len])
+	case family == syscall.AF_INET6 && len(addr) >= net.IPv6len:
+		rs.Address = net.IP(addr[:net.IPv6len])
+	default:
+		return nil, fmt.Errorf("invalid destination address %v of family %d", addr, family)
+	}
+	if port := attrs[ipvsDestAttrPort]; len(port) == 2 {
+		rs.Port = binary.BigEndian.Uint16(port)
+	}
+	if weight := attrs[ipvsDestAttrWeight]; len(weight) == 4 {
+		rs.Weight = int(native.Uint32(weight))
+	}
+	if method := attrs[ipvsDestAttrForwardingMethod]; len(method) == 4 {
+		rs.ForwardMethod = ForwardMethod(native.Uint32(method) & ipvs.ConnectionFlagFwdMask)
+	}
+	stats := attrs[ipvsDestAttrStats64]
+	if stats == nil {
+		// kernels before 4.7 only have 32 bits counters of packets
+		stats = attrs[ipvsDestAttrStats]
+	}
+	if stats != nil {
+		if rs.Stats, err = parseStats(stats); err != nil {
+			return nil, err
+		}
+	}
+	return rs, nil
+}
+
+// parseStats parses both 32 and 64 bits ipvs stats
+func parseStats(b []byte) (Stats, error) {
+	attrs, err := nlattr.ParseMap(b)
+	if err != nil {
+		return Stats{}, err
+	}
+	native := nl.NativeEndian()
+	value := func(attrType uint16) uint64 {
+		v := attrs[attrType]
+		switch len(v) {
+		case 8:
+			return native.Uint64(v)
+		case 4:
+			return uint64(native.Uint32(v))
+		}
+		return 0
+	}
+	return Stats{
+		Connections: value(ipvsStatsConns),
+		PacketsIn:   value(ipvsStatsPktsIn),
+		PacketsOut:  value(ipvsStatsPktsOut),
+		BytesIn:     value(ipvsStatsBytesIn),
+		BytesOut:    value(ipvsStatsBytesOut),
+		CPS:         value(ipvsStatsCPS),
+		PPSIn:       value(ipvsStatsPPSIn),
+		PPSOut:      value(ipvsStatsPPSOut),
+		BPSIn:       value(ipvsStatsBPSIn),
+		BPSOut:      value(ipvsStatsBPSOut),
+	}, nil
+}
+
+// genlHeader is the generic netlink header of cmd
+func genlHeader(cmd, version uint8) []byte {
+	return []byte{cmd, version, 0, 0}
+}
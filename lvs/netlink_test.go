@@ -0,0 +1,81 @@
+package lvs
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/docker/libnetwork/ipvs"
+	"github.com/vishvananda/netlink/nl"
+)
+
+func destinationMsg(ip string, port uint16, family uint16, stats64 bool) []byte {
+	addr := make([]byte, net.IPv6len)
+	copy(addr, net.ParseIP(ip).To4())
+	if family == syscall.AF_INET6 {
+		copy(addr, net.ParseIP(ip).To16())
+	}
+	portBytes := make([]byte, 2)
+	binary.BigEndian.PutUint16(portBytes, port)
+	dest := nl.NewRtAttr(ipvsCmdAttrDest, nil)
+	nl.NewRtAttrChild(dest, ipvsDestAttrAddress, addr)
+	nl.NewRtAttrChild(dest, ipvsDestAttrPort, portBytes)
+	nl.NewRtAttrChild(dest, ipvsDestAttrForwardingMethod, nl.Uint32Attr(uint32(ForwardDirectRoute)))
+	nl.NewRtAttrChild(dest, ipvsDestAttrWeight, nl.Uint32Attr(3))
+	if stats64 {
+		nl.NewRtAttrChild(dest, ipvsDestAttrAddressFamily, nl.Uint16Attr(family))
+		stats := nl.NewRtAttrChild(dest, ipvsDestAttrStats64, nil)
+		nl.NewRtAttrChild(stats, ipvsStatsConns, nl.Uint64Attr(5))
+		nl.NewRtAttrChild(stats, ipvsStatsPktsIn, nl.Uint64Attr(1<<33))
+		nl.NewRtAttrChild(stats, ipvsStatsBytesOut, nl.Uint64Attr(4096))
+		nl.NewRtAttrChild(stats, ipvsStatsBPSIn, nl.Uint64Attr(100))
+	} else {
+		stats := nl.NewRtAttrChild(dest, ipvsDestAttrStats, nil)
+		nl.NewRtAttrChild(stats, ipvsStatsConns, nl.Uint32Attr(5))
+		nl.NewRtAttrChild(stats, ipvsStatsPktsIn, nl.Uint32Attr(7))
+		nl.NewRtAttrChild(stats, ipvsStatsBytesOut, nl.Uint64Attr(4096))
+		nl.NewRtAttrChild(stats, ipvsStatsBPSIn, nl.Uint32Attr(100))
+	}
+	return append(genlHeader(ipvsCmdGetDest, ipvsGenlVersion), dest.Serialize()...)
+}
+
+func TestParseDestination(t *testing.T) {
+	for _, c := range []struct {
+		ip      string
+		family  uint16
+		stats64 bool
+		pktsIn  uint64
+	}{
+		{ip: "192.168.0.2", family: syscall.AF_INET, stats64: true, pktsIn: 1 << 33},
+		{ip: "192.168.0.2", family: syscall.AF_INET, pktsIn: 7},
+		{ip: "fd00::2", family: syscall.AF_INET6, stats64: true, pktsIn: 1 << 33},
+		// old kernels don't tell the address family of destinations
+		{ip: "fd00::2", family: syscall.AF_INET6, pktsIn: 7},
+	} {
+		rs, err := parseDestination(destinationMsg(c.ip, 8080, c.family, c.stats64), c.family)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect := &RealServer{Address: net.ParseIP(c.ip), Port: 8080, Weight: 3, ForwardMethod: ForwardDirectRoute}
+		if !rs.Equal(expect) {
+			t.Fatalf("expect %v, got %v", expect, rs)
+		}
+		if (rs.Stats != Stats{Connections: 5, PacketsIn: c.pktsIn, BytesOut: 4096, BPSIn: 100}) {
+			t.Fatalf("unexpected stats %+v", rs.Stats)
+		}
+	}
+}
+
+func TestParseDestinationMissingAttr(t *testing.T) {
+	if _, err := parseDestination(genlHeader(ipvsCmdGetDest, ipvsGenlVersion), syscall.AF_INET); err == nil {
+		t.Fatal("expect an error of missing destination attribute")
+	}
+}
+
+func TestToRealServer(t *testing.T) {
+	rs := toRealServer(&ipvs.Destination{Address: net.ParseIP("192.168.0.2"), Port: 8080, Weight: 3, ConnectionFlags: uint32(ForwardTunnel)})
+	if expect := (&RealServer{Address: net.ParseIP("192.168.0.2"), Port: 8080, Weight: 3, ForwardMethod: ForwardTunnel}); !rs.Equal(expect) {
+		t.Fatalf("expect %v, got %v", expect, rs)
+	}
+}
@@ -0,0 +1,190 @@
+// Package realserver prepares nodes which receive traffic forwarded by lvs in dr or tunnel mode.
+// Packets arrive with the VIP as destination, so the VIP must be a local address of the real server
+// which must neither answer arp requests of the VIP nor use it as source of arp requests. IPv6 neighbor
+// discovery only answers addresses of the incoming interface, so IPv6 VIPs on the dummy device are never
+// announced without sysctls.
+package realserver
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/chenchun/kube-bmlb/utils/sysctl"
+	"github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/util/sets"
+	utilexec "k8s.io/utils/exec"
+)
+
+const (
+	// DefaultDevice is the dummy interface holding VIPs
+	DefaultDevice = "bmlb-dr"
+	// tunnelDevice is created by kernel when ipip module is loaded
+	tunnelDevice = "tunl0"
+	// tunnelDevice6 is created by kernel when ip6_tunnel module is loaded, it decapsulates ipv6 in ipv6
+	// packets of ipv6 tunnel real servers
+	tunnelDevice6 = "ip6tnl0"
+	ipCmd         = "ip"
+)
+
+type RealServer struct {
+	exec   utilexec.Interface
+	device string
+}
+
+func New(exec utilexec.Interface, device string) *RealServer {
+	return &RealServer{exec: exec, device: device}
+}
+
+// EnsureVIPs configures vips of both families on the dummy device and removes vips not expected. If tunnel
+// is true, it also brings up tunnel devices of families of vips to decapsulate packets of tunnel mode.
+func (r *RealServer) EnsureVIPs(vips []net.IP, tunnel bool) error {
+	if err := r.ensureDevice(); err != nil {
+		return err
+	}
+	r.ensureSysctls(r.device)
+	expect := sets.NewString()
+	var hasV4, hasV6 bool
+	for _, vip := range vips {
+		expect.Insert(vip.String())
+		if vip.To4() != nil {
+			hasV4 = true
+		} else {
+			hasV6 = true
+		}
+	}
+	if tunnel && hasV4 {
+		if err := r.ensureTunnel(); err != nil {
+			return err
+		}
+	}
+	if tunnel && hasV6 {
+		if err := r.ensureTunnel6(); err != nil {
+			return err
+		}
+	}
+	exist, err := r.listVIPs()
+	if err != nil {
+		return err
+	}
+	for _, vip := range expect.Difference(exist).List() {
+		args := []string{"addr", "replace", vipPrefix(vip), "dev", r.device}
+		if net.ParseIP(vip).To4() == nil {
+			// the vip is on other real servers too, duplicate address detection would disable it
+			args = append(args, "nodad")
+		}
+		if out, err := r.exec.Command(ipCmd, args...).CombinedOutput(); err != nil {
+			glog.Warningf("failed to add vip %s to %s: %v, %s", vip, r.device, err, string(out))
+		}
+	}
+	for _, vip := range exist.Difference(expect).List() {
+		if out, err := r.exec.Command(ipCmd, "addr", "del", vipPrefix(vip), "dev", r.device).CombinedOutput(); err != nil {
+			glog.Warningf("failed to del vip %s from %s: %v, %s", vip, r.device, err, string(out))
+		}
+	}
+	return nil
+}
+
+// Cleanup deletes the dummy device and vips on it
+func (r *RealServer) Cleanup() error {
+	if _, err := r.exec.Command(ipCmd, "link", "show", r.device).CombinedOutput(); err != nil {
+		return nil
+	}
+	if out, err := r.exec.Command(ipCmd, "link", "del", r.device).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to delete device %s: %v, %s", r.device, err, string(out))
+	}
+	return nil
+}
+
+func (r *RealServer) ensureDevice() error {
+	if _, err := r.exec.Command(ipCmd, "link", "show", r.device).CombinedOutput(); err != nil {
+		if out, err := r.exec.Command(ipCmd, "link", "add", r.device, "type", "dummy").CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to create dummy device %s: %v, %s", r.device, err, string(out))
+		}
+		glog.Infof("created dummy device %s", r.device)
+	}
+	if out, err := r.exec.Command(ipCmd, "link", "set", r.device, "up").CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to set up device %s: %v, %s", r.device, err, string(out))
+	}
+	return nil
+}
+
+func (r *RealServer) ensureTunnel() error {
+	if _, err := r.exec.Command(ipCmd, "link", "show", tunnelDevice).CombinedOutput(); err != nil {
+		if out, err := r.exec.Command("modprobe", "ipip").CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to load ipip module: %v, %s", err, string(out))
+		}
+	}
+	if out, err := r.exec.Command(ipCmd, "link", "set", tunnelDevice, "up").CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to set up device %s: %v, %s", tunnelDevice, err, string(out))
+	}
+	r.ensureSysctls(tunnelDevice)
+	// decapsulated packets come from tunl0 with client source addresses which fails reverse path filtering
+	for _, dev := range []string{"all", tunnelDevice} {
+		if err := sysctl.EnsureSysctl(fmt.Sprintf("net/ipv4/conf/%s/rp_filter", dev), 0); err != nil {
+			glog.Warningf("failed to disable rp_filter of %s: %v", dev, err)
+		}
+	}
+	return nil
+}
+
+func (r *RealServer) ensureTunnel6() error {
+	if _, err := r.exec.Command(ipCmd, "link", "show", tunnelDevice6).CombinedOutput(); err != nil {
+		if out, err := r.exec.Command("modprobe", "ip6_tunnel").CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to load ip6_tunnel module: %v, %s", err, string(out))
+		}
+	}
+	if out, err := r.exec.Command(ipCmd, "link", "set", tunnelDevice6, "up").CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to set up device %s: %v, %s", tunnelDevice6, err, string(out))
+	}
+	return nil
+}
+
+// vipPrefix returns the host prefix of vip, /32 for ipv4 and /128 for ipv6
+func vipPrefix(vip string) string {
+	if ip := net.ParseIP(vip); ip != nil && ip.To4() == nil {
+		return vip + "/128"
+	}
+	return vip + "/32"
+}
+
+// ensureSysctls makes kernel only answer arp requests for addresses of the incoming interface and
+// use the best local address as arp source so that real servers never announce vips
+func (r *RealServer) ensureSysctls(device string) {
+	for _, dev := range []string{"all", device} {
+		if err := sysctl.EnsureSysctl(fmt.Sprintf("net/ipv4/conf/%s/arp_ignore", dev), 1); err != nil {
+			glog.Warningf("failed to set arp_ignore of %s: %v", dev, err)
+		}
+		if err := sysctl.EnsureSysctl(fmt.Sprintf("net/ipv4/conf/%s/arp_announce", dev), 2); err != nil {
+			glog.Warningf("failed to set arp_announce of %s: %v", dev, err)
+		}
+	}
+}
+
+// listVIPs parses output of `ip -o addr show dev <device>` which is similar to
+// 5: bmlb-dr    inet 10.0.0.2/32 scope global bmlb-dr\       valid_lft forever preferred_lft forever
+// 5: bmlb-dr    inet6 fd00::2/128 scope global nodad \       valid_lft forever preferred_lft forever
+func (r *RealServer) listVIPs() (sets.String, error) {
+	out, err := r.exec.Command(ipCmd, "-o", "addr", "show", "dev", r.device).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list address of %s: %v, %s", r.device, err, string(out))
+	}
+	return parseAddrs(string(out)), nil
+}
+
+// parseAddrs returns addresses of both families except ipv6 link local addresses the kernel adds to the device
+func parseAddrs(out string) sets.String {
+	vips := sets.NewString()
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		for i := 0; i+1 < len(fields); i++ {
+			if fields[i] != "inet" && fields[i] != "inet6" {
+				continue
+			}
+			if ip, _, err := net.ParseCIDR(fields[i+1]); err == nil && !ip.IsLinkLocalUnicast() {
+				vips.Insert(ip.String())
+			}
+		}
+	}
+	return vips
+}
@@ -0,0 +1,28 @@
+package realserver
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseAddrs(t *testing.T) {
+	out := `5: bmlb-dr    inet 10.0.0.2/32 scope global bmlb-dr\       valid_lft forever preferred_lft forever
+5: bmlb-dr    inet 10.0.0.3/32 scope global bmlb-dr\       valid_lft forever preferred_lft forever
+5: bmlb-dr    inet6 fd00::2/128 scope global nodad \       valid_lft forever preferred_lft forever
+5: bmlb-dr    inet6 fe80::8c2e:7dff:fe55:1/64 scope link \       valid_lft forever preferred_lft forever
+`
+	if vips := parseAddrs(out).List(); !reflect.DeepEqual(vips, []string{"10.0.0.2", "10.0.0.3", "fd00::2"}) {
+		t.Fatalf("unexpected vips %v", vips)
+	}
+	if vips := parseAddrs(""); vips.Len() != 0 {
+		t.Fatalf("expect no vip, got %v", vips.List())
+	}
+}
+
+func TestVIPPrefix(t *testing.T) {
+	for vip, expect := range map[string]string{"10.0.0.2": "10.0.0.2/32", "fd00::2": "fd00::2/128", "::ffff:10.0.0.2": "::ffff:10.0.0.2/32"} {
+		if prefix := vipPrefix(vip); prefix != expect {
+			t.Errorf("expect %s, got %s", expect, prefix)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package lvs
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// IPVS schedulers which are not defined in libnetwork
+const (
+	// WeightedRoundRobin distributes jobs amongst real servers in proportion of their weights.
+	WeightedRoundRobin = "wrr"
+	// WeightedLeastConnection assigns more jobs to real servers with fewer active jobs relative to their weights.
+	WeightedLeastConnection = "wlc"
+	// MaglevHashing assigns jobs to real servers through looking up a maglev hash table by source IP addresses.
+	MaglevHashing = "mh"
+)
+
+const (
+	procModules  = "/proc/modules"
+	osRelease    = "/proc/sys/kernel/osrelease"
+	modulesDir   = "/lib/modules"
+	schedModPref = "ip_vs_"
+)
+
+// GetAvailableSchedulers returns the schedulers which kernel can use. A scheduler is available if its module
+// is loaded, builtin, or exists in the module directory so that IPVS can load it on demand. The result may
+// contain other ip_vs modules like ftp which are never used as schedulers. It returns nil if the module
+// directory of the running kernel doesn't exist, e.g. /lib/modules is not mounted into the container, since
+// schedulers which can be loaded on demand are unknown then.
+func GetAvailableSchedulers() (sets.String, error) {
+	release, err := ioutil.ReadFile(osRelease)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", osRelease, err)
+	}
+	dir := filepath.Join(modulesDir, strings.TrimSpace(string(release)))
+	if _, err := os.Stat(dir); err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	available := sets.NewString()
+	modules, err := ioutil.ReadFile(procModules)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", procModules, err)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(modules))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 0 && strings.HasPrefix(fields[0], schedModPref) {
+			available.Insert(strings.TrimPrefix(fields[0], schedModPref))
+		}
+	}
+	if builtin, err := ioutil.ReadFile(filepath.Join(dir, "modules.builtin")); err == nil {
+		for _, line := range strings.Split(string(builtin), "\n") {
+			insertSchedulerModule(available, line)
+		}
+	}
+	filepath.Walk(filepath.Join(dir, "kernel/net/netfilter/ipvs"), func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			insertSchedulerModule(available, path)
+		}
+		return nil
+	})
+	return available, nil
+}
+
+// insertSchedulerModule inserts scheduler of module file path like kernel/net/netfilter/ipvs/ip_vs_rr.ko.xz
+func insertSchedulerModule(available sets.String, path string) {
+	name := filepath.Base(path)
+	if !strings.HasPrefix(name, schedModPref) {
+		return
+	}
+	if i := strings.Index(name, ".ko"); i > 0 {
+		available.Insert(strings.TrimPrefix(name[:i], schedModPref))
+	}
+}
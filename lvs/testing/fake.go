@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"net"
 	"strconv"
+	"sync"
 
 	utilipvs "github.com/chenchun/kube-bmlb/lvs"
 	"github.com/golang/glog"
@@ -27,6 +28,8 @@ import (
 
 //FakeIPVS no-op implementation of ipvs Interface
 type FakeIPVS struct {
+	// mu makes FakeIPVS goroutine-safe as Interface requires
+	mu           sync.Mutex
 	Scheduler    string
 	Services     map[serviceKey]*utilipvs.VirtualServer
 	Destinations map[serviceKey][]*utilipvs.RealServer
@@ -36,6 +39,7 @@ type serviceKey struct {
 	IP       string
 	Port     uint16
 	Protocol string
+	FWMark   uint32
 }
 
 func (s *serviceKey) String() string {
@@ -64,6 +68,7 @@ func toServiceKey(serv *utilipvs.VirtualServer) serviceKey {
 		IP:       serv.Address.String(),
 		Port:     serv.Port,
 		Protocol: serv.Protocol,
+		FWMark:   serv.FWMark,
 	}
 }
 
@@ -76,6 +81,8 @@ func toRealServerKey(rs *utilipvs.RealServer) *realServerKey {
 
 //AddVirtualServer is a fake implementation, it simply adds the VirtualServer into the cache store.
 func (f *FakeIPVS) AddVirtualServer(serv *utilipvs.VirtualServer) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	if serv == nil {
 		return fmt.Errorf("Failed to add virtual server, error: virtual server can't be nil")
 	}
@@ -89,16 +96,26 @@ func (f *FakeIPVS) AddVirtualServer(serv *utilipvs.VirtualServer) error {
 
 //UpdateVirtualServer is a fake implementation, it updates the VirtualServer in the cache store.
 func (f *FakeIPVS) UpdateVirtualServer(serv *utilipvs.VirtualServer) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	if serv == nil {
 		return fmt.Errorf("Failed to update service, service can't be nil")
 	}
 	key := toServiceKey(serv)
+	if old, ok := f.Services[key]; ok {
+		// kernel keeps stats of updated virtual servers
+		updated := *serv
+		updated.Stats = old.Stats
+		serv = &updated
+	}
 	f.Services[key] = serv
 	return nil
 }
 
 //DeleteVirtualServer is a fake implementation, it simply deletes the VirtualServer from the cache store.
 func (f *FakeIPVS) DeleteVirtualServer(serv *utilipvs.VirtualServer) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	if serv == nil {
 		return fmt.Errorf("Failed to delete service: service can't be nil")
 	}
@@ -112,6 +129,8 @@ func (f *FakeIPVS) DeleteVirtualServer(serv *utilipvs.VirtualServer) error {
 
 //GetVirtualServer is a fake implementation, it tries to find a specific VirtualServer from the cache store.
 func (f *FakeIPVS) GetVirtualServer(serv *utilipvs.VirtualServer) (*utilipvs.VirtualServer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	if serv == nil {
 		return nil, fmt.Errorf("Failed to get service: service can't be nil")
 	}
@@ -125,6 +144,8 @@ func (f *FakeIPVS) GetVirtualServer(serv *utilipvs.VirtualServer) (*utilipvs.Vir
 
 //GetVirtualServers is a fake implementation, it simply returns all VirtualServers in the cache store.
 func (f *FakeIPVS) GetVirtualServers() ([]*utilipvs.VirtualServer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	res := make([]*utilipvs.VirtualServer, 0)
 	for _, svc := range f.Services {
 		res = append(res, svc)
@@ -134,6 +155,8 @@ func (f *FakeIPVS) GetVirtualServers() ([]*utilipvs.VirtualServer, error) {
 
 //Flush is a fake implementation, it simply clears the cache store.
 func (f *FakeIPVS) Flush() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	// directly drop old data
 	f.Services = nil
 	f.Destinations = nil
@@ -142,6 +165,8 @@ func (f *FakeIPVS) Flush() error {
 
 //AddRealServer is a fake implementation, it simply creates a RealServer for a VirtualServer in the cache store.
 func (f *FakeIPVS) AddRealServer(serv *utilipvs.VirtualServer, dest *utilipvs.RealServer) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	if serv == nil || dest == nil {
 		return fmt.Errorf("Failed to add destination for service, neither service nor destination shouldn't be nil")
 	}
@@ -161,6 +186,8 @@ func (f *FakeIPVS) AddRealServer(serv *utilipvs.VirtualServer, dest *utilipvs.Re
 
 //GetRealServers is a fake implementation, it simply returns all RealServers in the cache store.
 func (f *FakeIPVS) GetRealServers(serv *utilipvs.VirtualServer) ([]*utilipvs.RealServer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	if serv == nil {
 		return nil, fmt.Errorf("Failed to get destination for nil service")
 	}
@@ -171,8 +198,33 @@ func (f *FakeIPVS) GetRealServers(serv *utilipvs.VirtualServer) ([]*utilipvs.Rea
 	return f.Destinations[key], nil
 }
 
+//UpdateRealServer is a fake implementation, it replaces the real server in the cache store.
+func (f *FakeIPVS) UpdateRealServer(serv *utilipvs.VirtualServer, dest *utilipvs.RealServer) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if serv == nil || dest == nil {
+		return fmt.Errorf("Failed to update destination, neither service nor destination can't be nil")
+	}
+	glog.V(5).Infof("UpdateRealServer vs %s rs %s", serv.String(), dest.String())
+	key := toServiceKey(serv)
+	if _, ok := f.Services[key]; !ok {
+		return fmt.Errorf("Failed to update destination for service %v, service not found", key.String())
+	}
+	for i, rs := range f.Destinations[key] {
+		if toRealServerKey(rs).String() == toRealServerKey(dest).String() {
+			updated := *dest
+			updated.Stats = rs.Stats
+			f.Destinations[key][i] = &updated
+			return nil
+		}
+	}
+	return fmt.Errorf("Failed to update real server for service %v, real server not found", key.String())
+}
+
 //DeleteRealServer is a fake implementation, it deletes the real server in the cache store.
 func (f *FakeIPVS) DeleteRealServer(serv *utilipvs.VirtualServer, dest *utilipvs.RealServer) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	if serv == nil || dest == nil {
 		return fmt.Errorf("Failed to delete destination, neither service nor destination can't be nil")
 	}
@@ -198,4 +250,31 @@ func (f *FakeIPVS) DeleteRealServer(serv *utilipvs.VirtualServer, dest *utilipvs
 	return nil
 }
 
+//SetVirtualServerStats sets stats of a virtual server in the cache store as if kernel counted its traffic.
+func (f *FakeIPVS) SetVirtualServerStats(serv *utilipvs.VirtualServer, stats utilipvs.Stats) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := toServiceKey(serv)
+	svc, ok := f.Services[key]
+	if !ok {
+		return fmt.Errorf("Failed to set stats of service %v, service not found", key.String())
+	}
+	svc.Stats = stats
+	return nil
+}
+
+//SetRealServerStats sets stats of a real server of a virtual server in the cache store.
+func (f *FakeIPVS) SetRealServerStats(serv *utilipvs.VirtualServer, dest *utilipvs.RealServer, stats utilipvs.Stats) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := toServiceKey(serv)
+	for _, rs := range f.Destinations[key] {
+		if toRealServerKey(rs).String() == toRealServerKey(dest).String() {
+			rs.Stats = stats
+			return nil
+		}
+	}
+	return fmt.Errorf("Failed to set stats of real server %v for service %v, real server not found", dest.String(), key.String())
+}
+
 var _ = utilipvs.Interface(&FakeIPVS{})
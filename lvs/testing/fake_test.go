@@ -114,9 +114,9 @@ func TestRealServer(t *testing.T) {
 		Protocol: string("TCP"),
 	}
 	rss := []*utilipvs.RealServer{
-		{net.ParseIP("172.16.2.1"), 8080, 1},
-		{net.ParseIP("172.16.2.2"), 8080, 2},
-		{net.ParseIP("172.16.2.3"), 8080, 3},
+		{Address: net.ParseIP("172.16.2.1"), Port: 8080, Weight: 1},
+		{Address: net.ParseIP("172.16.2.2"), Port: 8080, Weight: 2},
+		{Address: net.ParseIP("172.16.2.3"), Port: 8080, Weight: 3},
 	}
 	err := fake.AddVirtualServer(vs)
 	if err != nil {
@@ -177,3 +177,42 @@ func TestRealServer(t *testing.T) {
 		t.Errorf("Expect error, got nil")
 	}
 }
+
+func TestStats(t *testing.T) {
+	fake := NewFake()
+	vs := &utilipvs.VirtualServer{Address: net.ParseIP("10.20.30.40"), Port: uint16(80), Protocol: "TCP"}
+	rs := &utilipvs.RealServer{Address: net.ParseIP("172.16.2.1"), Port: 8080, Weight: 1}
+	if err := fake.SetVirtualServerStats(vs, utilipvs.Stats{Connections: 1}); err == nil {
+		t.Errorf("Expect error setting stats of virtual server that not exist, got nil")
+	}
+	if err := fake.AddVirtualServer(vs); err != nil {
+		t.Fatalf("Fail to add virtual server, error: %v", err)
+	}
+	if err := fake.AddRealServer(vs, rs); err != nil {
+		t.Fatalf("Fail to add real server, error: %v", err)
+	}
+	if err := fake.SetVirtualServerStats(vs, utilipvs.Stats{Connections: 2, BytesIn: 100}); err != nil {
+		t.Fatalf("Fail to set stats of virtual server, error: %v", err)
+	}
+	if err := fake.SetRealServerStats(vs, &utilipvs.RealServer{Address: net.ParseIP("172.16.2.1"), Port: 8080}, utilipvs.Stats{Connections: 1}); err != nil {
+		t.Fatalf("Fail to set stats of real server, error: %v", err)
+	}
+	// stats are kept after updating the virtual server
+	if err := fake.UpdateVirtualServer(&utilipvs.VirtualServer{Address: net.ParseIP("10.20.30.40"), Port: uint16(80), Protocol: "TCP", Scheduler: "wrr"}); err != nil {
+		t.Fatalf("Fail to update virtual server, error: %v", err)
+	}
+	got, err := fake.GetVirtualServer(vs)
+	if err != nil {
+		t.Fatalf("Fail to get virtual server, error: %v", err)
+	}
+	if (got.Stats != utilipvs.Stats{Connections: 2, BytesIn: 100}) {
+		t.Errorf("Unexpected stats of virtual server %+v", got.Stats)
+	}
+	rss, err := fake.GetRealServers(vs)
+	if err != nil {
+		t.Fatalf("Fail to get real servers, error: %v", err)
+	}
+	if len(rss) != 1 || (rss[0].Stats != utilipvs.Stats{Connections: 1}) {
+		t.Errorf("Unexpected real servers %v", rss)
+	}
+}
@@ -1,15 +1,22 @@
 package bmlb
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/chenchun/kube-bmlb/api"
 	"github.com/chenchun/kube-bmlb/server/flags"
+	"github.com/chenchun/kube-bmlb/server/webhook"
+	"github.com/chenchun/kube-bmlb/utils/event"
 	"github.com/chenchun/kube-bmlb/watch"
 	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/pflag"
 	"k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/util/wait"
@@ -24,6 +31,30 @@ type Server struct {
 	Client           *kubernetes.Clientset
 	lb               LoadBalance
 	syncChan         chan struct{}
+	recorder         event.Recorder
+	// binds are parsed Bind addresses, the first one is of the primary family
+	binds []net.IP
+
+	// syncMu protects lastSync and heartbeat
+	syncMu   sync.Mutex
+	lastSync syncStatus
+	// heartbeat is the time the sync loop last finished an iteration
+	heartbeat time.Time
+
+	// problems and conditions are only used by the sync loop
+	problems *problemReporter
+	// conditions are the last conditions patched to services by service key
+	conditions map[string]serviceCondition
+
+	flagSet *pflag.FlagSet
+	// flagOptions are options before applying the config file
+	flagOptions flags.ServerRunOptions
+	// configData is the content of the config file last loaded, only used by watchConfig after startup
+	configData []byte
+	// configMu protects reloaded
+	configMu sync.Mutex
+	// reloaded are options of a changed config file waiting for the sync loop
+	reloaded *flags.ServerRunOptions
 }
 
 func NewServer() *Server {
@@ -36,27 +67,61 @@ func NewServer() *Server {
 func (s *Server) AddFlags(fs *pflag.FlagSet) {
 	// Add the generic flags.
 	s.ServerRunOptions.AddFlags(fs)
+	s.flagSet = fs
 }
 
 func (s *Server) Init() {
-	ip := net.ParseIP(s.Bind)
-	if ip == nil {
-		glog.Fatal("bind address is invalid: %s", s.Bind)
+	binds, err := parseBinds(s.Bind)
+	if err != nil {
+		glog.Fatalf("bind address is invalid: %v", err)
+	}
+	s.binds = binds
+	s.lb = NewLoadBalance(s.ServerRunOptions, binds, s.Client, s.recorder)
+}
+
+// parseBinds parses comma separated bind addresses, at most one of each family
+func parseBinds(str string) ([]net.IP, error) {
+	var binds []net.IP
+	for _, addr := range strings.Split(str, ",") {
+		ip := net.ParseIP(strings.TrimSpace(addr))
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ip %q", addr)
+		}
+		for _, bind := range binds {
+			if api.IPFamilyOf(bind) == api.IPFamilyOf(ip) {
+				return nil, fmt.Errorf("more than one %s address %s and %s", api.IPFamilyOf(ip), bind, ip)
+			}
+		}
+		binds = append(binds, ip)
 	}
-	s.lb = NewLoadBalance(s.LBType, ip)
+	return binds, nil
 }
 
 func (s *Server) Start() {
+	s.loadConfig()
+	if s.Cleanup {
+		s.Init()
+		if err := s.lb.Cleanup(); err != nil {
+			glog.Fatalf("failed to cleanup: %v", err)
+		}
+		glog.Infof("cleanup done")
+		return
+	}
+	s.initClient()
 	s.Init()
 	s.startWatcher()
 	go s.lb.Run(struct{}{})
 	go s.syncing()
+	go s.watchConfig()
+	if s.WebhookPort != 0 {
+		go s.launchWebhook()
+	}
 	if err := s.launchServer(); err != nil {
 		glog.Fatalf("failed to start server: %v", err)
 	}
 }
 
-func (s *Server) startWatcher() {
+func (s *Server) initClient() {
 	glog.Infof("connecting to kube-apiserver with master %q, kubeconf %q", s.Master, s.KubeConf)
 	clientConfig, err := clientcmd.BuildConfigFromFlags(s.Master, s.KubeConf)
 	if err != nil {
@@ -75,55 +140,136 @@ func (s *Server) startWatcher() {
 	}
 	glog.Infof("Running in Kubernetes Cluster version v%v.%v (%v) - git (%v) commit %v - platform %v",
 		v.Major, v.Minor, v.GitVersion, v.GitTreeState, v.GitCommit, v.Platform)
+	s.recorder = event.NewRecorder(s.Client.CoreV1())
+}
+
+func (s *Server) startWatcher() {
 	s.serviceWatcher = watch.StartServiceWatcher(s.Client, 0, s)
 	s.endpointsWatcher = watch.StartEndpointsWatcher(s.Client, 0, s)
 }
 
 func (s *Server) launchServer() error {
 	glog.Infof("starting http server")
+	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/healthz", s.serveHealthz)
+	http.HandleFunc("/readyz", s.serveReadyz)
+	http.HandleFunc("/debug/sync", s.serveSyncStatus)
+	if lb, ok := s.lb.(debugger); ok {
+		for path, handler := range lb.debugHandlers() {
+			http.HandleFunc(path, handler)
+		}
+	}
 	return http.ListenAndServe(fmt.Sprintf(":%d", s.Port), nil)
 }
 
+// launchWebhook serves the validating admission webhook over https. The webhook is optional, load balancing
+// goes on without it if its certificate can't be loaded or the server fails.
+func (s *Server) launchWebhook() {
+	cert, err := tls.LoadX509KeyPair(s.WebhookCertFile, s.WebhookKeyFile)
+	if err != nil {
+		glog.Warningf("not serving webhook, failed to load its certificate: %v", err)
+		return
+	}
+	glog.Infof("starting webhook server on port %d", s.WebhookPort)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/validate", webhook.ServeValidate)
+	server := &http.Server{Addr: fmt.Sprintf(":%d", s.WebhookPort), Handler: mux, TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}}}
+	if err := server.ListenAndServeTLS("", ""); err != nil {
+		glog.Warningf("webhook server stopped: %v", err)
+	}
+}
+
 func (s *Server) syncing() {
 	wait.PollInfinite(time.Second, func() (done bool, err error) {
 		glog.V(3).Infof("waiting for syncing service/endpoints")
 		return s.serviceWatcher.HasSynced() && s.endpointsWatcher.HasSynced(), nil
 	})
+	s.problems = newProblemReporter(s.recorder)
+	s.conditions = map[string]serviceCondition{}
 	s.syncChan = make(chan struct{}, 2)
 	s.syncChan <- struct{}{}
 	tick := time.Tick(time.Minute)
 	for {
+		s.beat()
 		select {
 		case <-s.syncChan:
 		case <-tick:
 		}
-		//TODO incremental
-		filtered, needsUpdate := s.filter(s.serviceWatcher.List())
-		s.lb.Build(filtered, s.endpointsWatcher.List())
-		s.updateSvcs(needsUpdate)
+		s.applyReload()
+		s.syncOnce()
+	}
+}
+
+// syncOnce builds the load balance of all services and advertises bind addresses in their status
+func (s *Server) syncOnce() {
+	//TODO incremental
+	start := time.Now()
+	filtered := s.filter(s.serviceWatcher.List())
+	endpoints := s.endpointsWatcher.List()
+	err := s.lb.Build(filtered, endpoints)
+	if err != nil {
+		glog.Warningf("failed to build %s load balance: %v", s.LBType, err)
+		syncErrors.WithLabelValues("build").Inc()
+	}
+	s.setSyncStatus(start, len(filtered), err)
+	s.reportProblems(filtered, endpoints)
+	syncDuration.WithLabelValues(s.LBType).Observe(time.Since(start).Seconds())
+	syncedServices.WithLabelValues(s.LBType).Set(float64(len(filtered)))
+	// a node which isn't ready withdraws itself from service status, it is advertised again on the first
+	// sync after ready
+	var failed map[*v1.Service]bool
+	if err := s.ready(); err != nil {
+		glog.V(3).Infof("withdrawing bind addresses from service status: %v", err)
+		failed = s.withdraw(filtered, err)
+	} else {
+		failed = s.updateSvcs(s.advertise(filtered))
 	}
+	s.updateConditions(filtered, failed)
 }
 
-func (s *Server) filter(svcs []*v1.Service) ([]*v1.Service, []*v1.Service) {
+// filter returns load balancer services
+func (s *Server) filter(svcs []*v1.Service) []*v1.Service {
+	var filtered []*v1.Service
+	for i := range svcs {
+		if svcs[i].Spec.Type == v1.ServiceTypeLoadBalancer {
+			filtered = append(filtered, svcs[i])
+		}
+	}
+	return filtered
+}
+
+// advertise adds bind addresses to ingress of svcs, it returns the added addresses of services whose status
+// needs update
+func (s *Server) advertise(svcs []*v1.Service) map[*v1.Service][]string {
+	if s.LBType == "realserver" {
+		// real servers are not load balancers and must not be advertised
+		return nil
+	}
 	// keep in mind we may add or del services ports
-	var filtered, needsUpdate []*v1.Service
+	needsUpdate := map[*v1.Service][]string{}
 	for i := range svcs {
 		svc := svcs[i]
-		if svc.Spec.Type != v1.ServiceTypeLoadBalancer {
-			continue
-		}
-		filtered = append(filtered, svc)
-		findLBIP := false
-		for _, ingress := range svc.Status.LoadBalancer.Ingress {
-			if ingress.IP == s.Bind {
-				findLBIP = true
-				break
+		primary := api.IPFamilyOf(s.binds[0])
+		var added []string
+		for _, bind := range s.binds {
+			if !api.HasIPFamily(svc, api.IPFamilyOf(bind), primary) {
+				continue
+			}
+			findLBIP := false
+			for _, ingress := range svc.Status.LoadBalancer.Ingress {
+				if ingress.IP == bind.String() {
+					findLBIP = true
+					break
+				}
+			}
+			if !findLBIP {
+				added = append(added, bind.String())
+				svc.Status.LoadBalancer.Ingress = append(svc.Status.LoadBalancer.Ingress, v1.LoadBalancerIngress{IP: bind.String()})
 			}
 		}
-		if !findLBIP {
-			needsUpdate = append(needsUpdate, svc)
-			svc.Status.LoadBalancer.Ingress = append(svc.Status.LoadBalancer.Ingress, v1.LoadBalancerIngress{IP: s.Bind})
+		if len(added) > 0 {
+			needsUpdate[svc] = added
 		}
 	}
-	return filtered, needsUpdate
+	return needsUpdate
 }
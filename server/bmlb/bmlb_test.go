@@ -0,0 +1,70 @@
+package bmlb
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/chenchun/kube-bmlb/api"
+	"k8s.io/api/core/v1"
+)
+
+func TestParseBinds(t *testing.T) {
+	binds, err := parseBinds("10.0.0.2, fd00::2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := []net.IP{net.ParseIP("10.0.0.2"), net.ParseIP("fd00::2")}; !reflect.DeepEqual(binds, expect) {
+		t.Fatalf("expect %v, got %v", expect, binds)
+	}
+	for str, expect := range map[string]string{
+		"10.0.0.2,10.0.0.3": "more than one IPv4 address",
+		"fd00::2,fd00::3":   "more than one IPv6 address",
+		"10.0.0.2,":         "invalid ip",
+		"10.0.0.256":        "invalid ip",
+	} {
+		if _, err := parseBinds(str); err == nil || !strings.Contains(err.Error(), expect) {
+			t.Errorf("%s: expect error %q, got %v", str, expect, err)
+		}
+	}
+}
+
+func TestAdvertise(t *testing.T) {
+	s := newTestServer(t, &fakeLB{}, "lvs", nil, nil, nil)
+	s.binds = []net.IP{net.ParseIP("10.0.0.2"), net.ParseIP("fd00::2")}
+	primary := lbService("default", "primary", 80)
+	dual := lbService("default", "dual", 80)
+	dual.Annotations = map[string]string{api.ANIPFamilies: "IPv6,IPv4"}
+	v6 := lbService("default", "v6", 80)
+	v6.Annotations = map[string]string{api.ANIPFamilies: "IPv6"}
+	advertised := lbService("default", "advertised", 80)
+	advertised.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{IP: "10.0.0.2"}}
+	updates := s.advertise([]*v1.Service{primary, dual, v6, advertised})
+	for svc, expect := range map[*v1.Service][]string{
+		primary: {"10.0.0.2"},
+		dual:    {"10.0.0.2", "fd00::2"},
+		v6:      {"fd00::2"},
+	} {
+		if !reflect.DeepEqual(updates[svc], expect) {
+			t.Errorf("svc %s: expect %v, got %v", svc.Name, expect, updates[svc])
+		}
+		if len(svc.Status.LoadBalancer.Ingress) != len(expect) {
+			t.Errorf("svc %s: unexpected ingress %v", svc.Name, svc.Status.LoadBalancer.Ingress)
+		}
+	}
+	if _, ok := updates[advertised]; ok || len(updates) != 3 {
+		t.Errorf("unexpected updates %v", updates)
+	}
+	s.LBType = "realserver"
+	if updates := s.advertise([]*v1.Service{lbService("default", "rs", 80)}); updates != nil {
+		t.Errorf("real servers must not advertise, got %v", updates)
+	}
+}
+
+func TestLaunchWebhookWithoutCert(t *testing.T) {
+	s := newTestServer(t, &fakeLB{}, "lvs", nil, nil, nil)
+	s.WebhookPort, s.WebhookCertFile, s.WebhookKeyFile = 9443, "/nonexistent/tls.crt", "/nonexistent/tls.key"
+	// returns instead of exiting so that load balancing goes on
+	s.launchWebhook()
+}
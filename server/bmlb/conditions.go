@@ -0,0 +1,86 @@
+package bmlb
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// conditionLoadBalancerProgrammed tells on how many nodes the load balancer of a service is programmed
+const conditionLoadBalancerProgrammed = "LoadBalancerProgrammed"
+
+// serviceCondition is metav1.Condition in status.conditions of services of kubernetes 1.20 or later, the
+// vendored api doesn't have the field so it is written by patches. Older apiservers drop it.
+type serviceCondition struct {
+	Type               string      `json:"type"`
+	Status             string      `json:"status"`
+	ObservedGeneration int64       `json:"observedGeneration,omitempty"`
+	LastTransitionTime metav1.Time `json:"lastTransitionTime"`
+	Reason             string      `json:"reason"`
+	Message            string      `json:"message"`
+}
+
+// programmedCondition summarizes ingress of svc. Only nodes which are ready advertise themselves in ingress,
+// a dual-stack node has an ip of each family.
+func programmedCondition(svc *v1.Service) serviceCondition {
+	var ips []string
+	for _, ingress := range svc.Status.LoadBalancer.Ingress {
+		if ingress.IP != "" {
+			ips = append(ips, ingress.IP)
+		}
+	}
+	if len(ips) == 0 {
+		return serviceCondition{Type: conditionLoadBalancerProgrammed, Status: string(v1.ConditionFalse),
+			ObservedGeneration: svc.Generation, Reason: "NoNodes", Message: "load balancer is not programmed on any node"}
+	}
+	return serviceCondition{Type: conditionLoadBalancerProgrammed, Status: string(v1.ConditionTrue),
+		ObservedGeneration: svc.Generation, Reason: "Programmed",
+		Message: fmt.Sprintf("load balancer is programmed on nodes of %d ingress ip(s): %s", len(ips), strings.Join(ips, ", "))}
+}
+
+// updateConditions patches the programmed condition of svcs if it changed since the last patch of this node.
+// Services whose status update failed keep their condition until their ingress is updated.
+func (s *Server) updateConditions(svcs []*v1.Service, failed map[*v1.Service]bool) {
+	if s.LBType == "realserver" {
+		return
+	}
+	keep := map[string]bool{}
+	for _, svc := range svcs {
+		key := objectKey(&svc.ObjectMeta)
+		keep[key] = true
+		if failed[svc] {
+			continue
+		}
+		cond := programmedCondition(svc)
+		last, ok := s.conditions[key]
+		if ok && last.Status == cond.Status && last.Message == cond.Message && last.ObservedGeneration == cond.ObservedGeneration {
+			continue
+		}
+		cond.LastTransitionTime = metav1.Now()
+		if ok && last.Status == cond.Status {
+			cond.LastTransitionTime = last.LastTransitionTime
+		}
+		// conditions are merged by type, other conditions of the service are kept
+		data, err := json.Marshal(map[string]interface{}{"status": map[string]interface{}{"conditions": []serviceCondition{cond}}})
+		if err != nil {
+			glog.Warningf("failed to marshal conditions of svc %s: %v", key, err)
+			continue
+		}
+		if _, err := s.Client.CoreV1().Services(svc.Namespace).Patch(svc.Name, types.StrategicMergePatchType, data, "status"); err != nil {
+			glog.Warningf("failed to patch conditions of svc %s: %v", key, err)
+			syncErrors.WithLabelValues("conditions").Inc()
+			continue
+		}
+		s.conditions[key] = cond
+	}
+	for key := range s.conditions {
+		if !keep[key] {
+			delete(s.conditions, key)
+		}
+	}
+}
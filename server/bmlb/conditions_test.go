@@ -0,0 +1,65 @@
+package bmlb
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chenchun/kube-bmlb/utils/event"
+	"k8s.io/api/core/v1"
+)
+
+func TestProgrammedCondition(t *testing.T) {
+	svc := lbService("default", "web", 80)
+	svc.Generation = 2
+	cond := programmedCondition(svc)
+	if cond.Status != string(v1.ConditionFalse) || cond.Reason != "NoNodes" || cond.ObservedGeneration != 2 {
+		t.Fatalf("unexpected condition %+v", cond)
+	}
+	svc.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{IP: "10.0.0.2"}, {Hostname: "lb.example.com"}, {IP: "fd00::2"}}
+	cond = programmedCondition(svc)
+	if cond.Status != string(v1.ConditionTrue) || cond.Reason != "Programmed" ||
+		cond.Message != "load balancer is programmed on nodes of 2 ingress ip(s): 10.0.0.2, fd00::2" {
+		t.Fatalf("unexpected condition %+v", cond)
+	}
+}
+
+func TestUpdateConditionsAfterStatusUpdate(t *testing.T) {
+	interval, timeout := statusUpdateInterval, statusUpdateTimeout
+	statusUpdateInterval, statusUpdateTimeout = time.Millisecond, 10*time.Millisecond
+	defer func() {
+		statusUpdateInterval, statusUpdateTimeout = interval, timeout
+	}()
+	apiserver := newFakeAPIServer()
+	defer apiserver.Close()
+	apiserver.failStatus = true
+	svc := lbService("default", "web", 80)
+	s := newTestServer(t, &fakeLB{}, "lvs", apiserver, []*v1.Service{svc}, nil)
+	recorder := event.NewFakeRecorder(100)
+	s.recorder = recorder
+	s.syncOnce()
+	if events := drain(recorder, reasonStatusUpdateFailed); len(events) != 1 {
+		t.Fatalf("expect a status update failure, got %v", events)
+	}
+	// the condition isn't computed from an ingress which isn't saved
+	if len(apiserver.patches) != 0 || len(s.conditions) != 0 {
+		t.Fatalf("expect no condition, got %v", apiserver.patches)
+	}
+	if len(svc.Status.LoadBalancer.Ingress) != 0 {
+		t.Fatalf("expect ingress to be rolled back, got %v", svc.Status.LoadBalancer.Ingress)
+	}
+	apiserver.failStatus = false
+	s.syncOnce()
+	if saved := apiserver.statuses["default/web"]; saved == nil || len(saved.Status.LoadBalancer.Ingress) != 1 {
+		t.Fatalf("expect ingress of the bind address, got %+v", saved)
+	}
+	patches := apiserver.patches["default/web"]
+	if len(patches) != 1 || !strings.Contains(patches[0], `"status":"True"`) {
+		t.Fatalf("expect a programmed condition patch, got %v", patches)
+	}
+	// an unchanged condition isn't patched again
+	s.syncOnce()
+	if len(apiserver.patches["default/web"]) != 1 {
+		t.Fatalf("expect no more patch, got %v", apiserver.patches)
+	}
+}
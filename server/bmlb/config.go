@@ -0,0 +1,113 @@
+package bmlb
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/chenchun/kube-bmlb/server/flags"
+	"github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// configPollPeriod is how often the config file is checked for changes
+const configPollPeriod = 10 * time.Second
+
+// reloader is implemented by load balances which apply reloadable options at runtime
+type reloader interface {
+	reload(opts *flags.ServerRunOptions) error
+}
+
+// flagChanged returns true if the flag is set on command line
+func (s *Server) flagChanged(name string) bool {
+	return s.flagSet != nil && s.flagSet.Changed(name)
+}
+
+// loadConfig applies the config file to options which are not set on command line and validates options.
+// A missing config file is ignored unless --config is set.
+func (s *Server) loadConfig() {
+	// options of flags, reloads start from them so that removing an option from the file restores the flag
+	s.flagOptions = *s.ServerRunOptions
+	data, err := ioutil.ReadFile(flags.JsonConfigPath)
+	if err != nil && (!os.IsNotExist(err) || s.flagChanged("config")) {
+		glog.Fatalf("failed to read config file: %v", err)
+	}
+	if err == nil {
+		config, err := flags.ParseConfig(data)
+		if err != nil {
+			glog.Fatalf("invalid config file %s: %v", flags.JsonConfigPath, err)
+		}
+		applied := config.Apply(s.ServerRunOptions, s.flagChanged)
+		glog.Infof("loaded config file %s, options %s are set by it", flags.JsonConfigPath, strings.Join(applied, ", "))
+		s.configData = data
+	} else {
+		glog.Infof("config file %s doesn't exist, using flags", flags.JsonConfigPath)
+	}
+	if err := s.Validate(); err != nil {
+		glog.Fatalf("invalid options: %v", err)
+	}
+}
+
+// watchConfig polls the config file and hands reloadable options of a changed file to the sync loop
+func (s *Server) watchConfig() {
+	// current are the options known to this goroutine, the sync loop owns s.ServerRunOptions
+	current := *s.ServerRunOptions
+	wait.Forever(func() {
+		data, err := ioutil.ReadFile(flags.JsonConfigPath)
+		if err != nil && !os.IsNotExist(err) {
+			glog.Warningf("failed to read config file: %v", err)
+			return
+		}
+		if bytes.Equal(data, s.configData) {
+			return
+		}
+		s.configData = data
+		options := s.flagOptions
+		if len(data) > 0 {
+			config, err := flags.ParseConfig(data)
+			if err != nil {
+				glog.Warningf("invalid config file %s, keep using the last options: %v", flags.JsonConfigPath, err)
+				configReloads.WithLabelValues("failure").Inc()
+				return
+			}
+			config.Apply(&options, s.flagChanged)
+		}
+		if err := options.Validate(); err != nil {
+			glog.Warningf("invalid options of config file %s, keep using the last options: %v", flags.JsonConfigPath, err)
+			configReloads.WithLabelValues("failure").Inc()
+			return
+		}
+		if keys := flags.RestartRequired(&current, &options); len(keys) > 0 {
+			glog.Warningf("options %s of config file %s take effect after restarting kube-bmlb", strings.Join(keys, ", "), flags.JsonConfigPath)
+		}
+		flags.CopyReloadable(&current, &options)
+		reloaded := current
+		s.configMu.Lock()
+		s.reloaded = &reloaded
+		s.configMu.Unlock()
+		glog.Infof("config file %s changed, reloading", flags.JsonConfigPath)
+		s.maybeSync()
+	}, configPollPeriod)
+}
+
+// applyReload applies options reloaded by watchConfig if any, it is called by the sync loop
+func (s *Server) applyReload() {
+	s.configMu.Lock()
+	reloaded := s.reloaded
+	s.reloaded = nil
+	s.configMu.Unlock()
+	if reloaded == nil {
+		return
+	}
+	if lb, ok := s.lb.(reloader); ok {
+		if err := lb.reload(reloaded); err != nil {
+			glog.Warningf("failed to reload options: %v", err)
+			configReloads.WithLabelValues("failure").Inc()
+			return
+		}
+	}
+	flags.CopyReloadable(s.ServerRunOptions, reloaded)
+	configReloads.WithLabelValues("success").Inc()
+}
@@ -0,0 +1,56 @@
+package bmlb
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// debugger is implemented by load balances having read-only debug endpoints of their state
+type debugger interface {
+	// debugHandlers returns handlers by path
+	debugHandlers() map[string]http.HandlerFunc
+}
+
+// syncStatus is the result of the last sync
+type syncStatus struct {
+	Time     time.Time `json:"time"`
+	Duration string    `json:"duration"`
+	Services int       `json:"services"`
+	// Error is the error of building load balance, empty if it succeeded
+	Error string `json:"error,omitempty"`
+	// LastSuccess is the time of the last sync without errors, nil if no sync succeeded
+	LastSuccess *time.Time `json:"lastSuccess,omitempty"`
+}
+
+// setSyncStatus records the result of a sync started at start
+func (s *Server) setSyncStatus(start time.Time, services int, err error) {
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+	status := syncStatus{Time: start, Duration: time.Since(start).String(), Services: services, LastSuccess: s.lastSync.LastSuccess}
+	if err != nil {
+		status.Error = err.Error()
+	} else {
+		status.LastSuccess = &start
+	}
+	s.lastSync = status
+}
+
+func (s *Server) serveSyncStatus(w http.ResponseWriter, r *http.Request) {
+	s.syncMu.Lock()
+	status := s.lastSync
+	s.syncMu.Unlock()
+	writeJSON(w, status)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v)
+}
+
+func writeText(w http.ResponseWriter, data []byte) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(data)
+}
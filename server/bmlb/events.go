@@ -0,0 +1,191 @@
+package bmlb
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/chenchun/kube-bmlb/api"
+	haproxyAdaptor "github.com/chenchun/kube-bmlb/haproxy/adaptor"
+	"github.com/chenchun/kube-bmlb/utils/event"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// reasons of events on services, HaproxyConfigRejected is recorded by HaproxyLB
+const (
+	reasonVIPAllocated        = "VIPAllocated"
+	reasonVIPWithdrawn        = "VIPWithdrawn"
+	reasonPortConflict        = "PortConflict"
+	reasonNoEndpoints         = "NoEndpoints"
+	reasonStatusUpdateFailed  = "StatusUpdateFailed"
+	reasonUnsupportedProtocol = "UnsupportedProtocol"
+)
+
+// problemReporter records a warning event when a problem of a service appears or its message changes
+// instead of on every sync
+type problemReporter struct {
+	recorder event.Recorder
+	// reported is the message of problems by service key and reason of the last sync
+	reported map[string]string
+	// seen are problems reported during the current sync
+	seen map[string]bool
+}
+
+func newProblemReporter(recorder event.Recorder) *problemReporter {
+	return &problemReporter{recorder: recorder, reported: map[string]string{}, seen: map[string]bool{}}
+}
+
+func (r *problemReporter) report(svc *v1.Service, reason, message string) {
+	key := objectKey(&svc.ObjectMeta) + "/" + reason
+	r.seen[key] = true
+	if r.reported[key] == message {
+		return
+	}
+	r.reported[key] = message
+	r.recorder.Event(svc, v1.EventTypeWarning, reason, message)
+}
+
+// flush forgets problems which are gone during the current sync so that they are reported again if they
+// come back
+func (r *problemReporter) flush() {
+	for key := range r.reported {
+		if !r.seen[key] {
+			delete(r.reported, key)
+		}
+	}
+	r.seen = map[string]bool{}
+}
+
+// portChecker is implemented by load balances which can't carry some ports of services
+type portChecker interface {
+	unsupportedPorts(svc *v1.Service) []v1.ServicePort
+}
+
+func (h *HaproxyLB) unsupportedPorts(svc *v1.Service) []v1.ServicePort {
+	return haproxyAdaptor.UnsupportedPorts(svc)
+}
+
+// reportProblems records events of services sharing ports, having no endpoints or ports the load balance
+// can't carry
+func (s *Server) reportProblems(svcs []*v1.Service, endpoints []*v1.Endpoints) {
+	defer s.problems.flush()
+	if s.LBType == "realserver" {
+		return
+	}
+	primary := api.IPFamilyOf(s.binds[0])
+	var uses []portUse
+	for _, svc := range svcs {
+		uses = append(uses, s.portUses(svc, primary)...)
+	}
+	// conflicts are descriptions of conflicting ports by service, a service has one event of all of them
+	conflicts := map[*v1.Service][]string{}
+	// others are the other services sharing each port or port range by service
+	others := map[*v1.Service]map[string][]string{}
+	for i := range uses {
+		for j := range uses {
+			if uses[i].svc == uses[j].svc || !uses[i].overlaps(uses[j]) {
+				continue
+			}
+			if others[uses[i].svc] == nil {
+				others[uses[i].svc] = map[string][]string{}
+			}
+			key := uses[i].overlap(uses[j])
+			others[uses[i].svc][key] = append(others[uses[i].svc][key], uses[j].svc.Namespace+"/"+uses[j].svc.Name)
+		}
+	}
+	for svc, byKey := range others {
+		for key, names := range byKey {
+			names = sets.NewString(names...).List()
+			conflicts[svc] = append(conflicts[svc], fmt.Sprintf("%s with %s", key, strings.Join(names, ", ")))
+		}
+	}
+	for svc, ports := range conflicts {
+		sort.Strings(ports)
+		s.problems.report(svc, reasonPortConflict, fmt.Sprintf("ports are shared with other services on this node: %s", strings.Join(ports, "; ")))
+	}
+	ready := map[string]bool{}
+	for _, ep := range endpoints {
+		for _, subset := range ep.Subsets {
+			if len(subset.Addresses) > 0 {
+				ready[ep.Namespace+"/"+ep.Name] = true
+			}
+		}
+	}
+	checker, _ := s.lb.(portChecker)
+	for _, svc := range svcs {
+		if !ready[svc.Namespace+"/"+svc.Name] {
+			s.problems.report(svc, reasonNoEndpoints, "service has no ready endpoints, connections to it are rejected")
+		}
+		if checker == nil {
+			continue
+		}
+		var ports []string
+		for _, port := range checker.unsupportedPorts(svc) {
+			ports = append(ports, fmt.Sprintf("%s/%d", protocolOf(port), port.Port))
+		}
+		if len(ports) > 0 {
+			s.problems.report(svc, reasonUnsupportedProtocol, fmt.Sprintf("%s doesn't support ports %s, they are not load balanced", s.LBType, strings.Join(ports, ", ")))
+		}
+	}
+}
+
+// portUse is a port or a port range of a service on VIPs of a family
+type portUse struct {
+	svc      *v1.Service
+	family   string
+	protocol v1.Protocol
+	from, to int32
+}
+
+func (u portUse) overlaps(o portUse) bool {
+	return u.family == o.family && u.protocol == o.protocol && u.from <= o.to && o.from <= u.to
+}
+
+// overlap describes the ports u and o both use
+func (u portUse) overlap(o portUse) string {
+	from, to := u.from, u.to
+	if o.from > from {
+		from = o.from
+	}
+	if o.to < to {
+		to = o.to
+	}
+	if from == to {
+		return fmt.Sprintf("%s/%s/%d", u.family, u.protocol, from)
+	}
+	return fmt.Sprintf("%s/%s/%d-%d", u.family, u.protocol, from, to)
+}
+
+// portUses returns ports of svc, port ranges of fwmark services in lvs mode apply to every protocol of
+// their ports
+func (s *Server) portUses(svc *v1.Service, primary string) []portUse {
+	var ranges []api.PortRange
+	if s.LBType == "lvs" {
+		// invalid port ranges are warned by adaptors
+		ranges, _ = api.DecodePortRanges(svc.Annotations[api.ANPortRanges])
+	}
+	var uses []portUse
+	for _, family := range api.GetIPFamilies(svc, primary) {
+		protocols := map[v1.Protocol]bool{}
+		for _, port := range svc.Spec.Ports {
+			protocol := protocolOf(port)
+			uses = append(uses, portUse{svc: svc, family: family, protocol: protocol, from: port.Port, to: port.Port})
+			if protocols[protocol] {
+				continue
+			}
+			protocols[protocol] = true
+			for _, r := range ranges {
+				uses = append(uses, portUse{svc: svc, family: family, protocol: protocol, from: r.From, to: r.To})
+			}
+		}
+	}
+	return uses
+}
+
+func protocolOf(port v1.ServicePort) v1.Protocol {
+	if port.Protocol == "" {
+		return v1.ProtocolTCP
+	}
+	return port.Protocol
+}
@@ -0,0 +1,119 @@
+package bmlb
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/chenchun/kube-bmlb/api"
+	"github.com/chenchun/kube-bmlb/utils/event"
+	"k8s.io/api/core/v1"
+)
+
+// drain returns events recorded by r so far whose reason is reason, sorted
+func drain(r *event.FakeRecorder, reason string) []string {
+	var events []string
+	for {
+		select {
+		case e := <-r.Events:
+			if strings.Contains(e, " "+reason+" ") {
+				events = append(events, e)
+			}
+		default:
+			sort.Strings(events)
+			return events
+		}
+	}
+}
+
+func TestProblemReporter(t *testing.T) {
+	recorder := event.NewFakeRecorder(100)
+	r := newProblemReporter(recorder)
+	svc := lbService("default", "web", 80)
+	r.report(svc, reasonNoEndpoints, "no endpoints")
+	r.flush()
+	// an unchanged problem is not reported again
+	r.report(svc, reasonNoEndpoints, "no endpoints")
+	r.flush()
+	if events := drain(recorder, reasonNoEndpoints); len(events) != 1 {
+		t.Fatalf("expect one event, got %v", events)
+	}
+	r.report(svc, reasonNoEndpoints, "still no endpoints")
+	r.flush()
+	if events := drain(recorder, reasonNoEndpoints); !reflect.DeepEqual(events, []string{"Warning NoEndpoints still no endpoints"}) {
+		t.Fatalf("expect an event of the changed message, got %v", events)
+	}
+	// a problem which is gone is reported again when it comes back
+	r.flush()
+	r.report(svc, reasonNoEndpoints, "still no endpoints")
+	if events := drain(recorder, reasonNoEndpoints); len(events) != 1 {
+		t.Fatalf("expect one event, got %v", events)
+	}
+}
+
+func TestReportPortConflicts(t *testing.T) {
+	a := lbService("default", "a", 80, 8080)
+	b := lbService("default", "b", 80)
+	c := lbService("default", "c", 9000)
+	c.Annotations = map[string]string{api.ANPortRanges: "8000-8100"}
+	d := lbService("default", "d", 80)
+	d.Spec.Ports[0].Protocol = v1.ProtocolUDP
+	e := lbService("default", "e", 9000)
+	e.Annotations = map[string]string{api.ANIPFamilies: "IPv6"}
+	svcs := []*v1.Service{a, b, c, d, e}
+	for _, test := range []struct {
+		lbType string
+		expect []string
+	}{
+		{
+			lbType: "lvs",
+			expect: []string{
+				"Warning PortConflict ports are shared with other services on this node: IPv4/TCP/80 with default/b; IPv4/TCP/8080 with default/c",
+				"Warning PortConflict ports are shared with other services on this node: IPv4/TCP/80 with default/a",
+				"Warning PortConflict ports are shared with other services on this node: IPv4/TCP/8080 with default/a",
+			},
+		},
+		{
+			// port ranges are lvs only
+			lbType: "haproxy",
+			expect: []string{
+				"Warning PortConflict ports are shared with other services on this node: IPv4/TCP/80 with default/a",
+				"Warning PortConflict ports are shared with other services on this node: IPv4/TCP/80 with default/b",
+			},
+		},
+	} {
+		s := newTestServer(t, &fakeLB{}, test.lbType, nil, nil, nil)
+		recorder := event.NewFakeRecorder(100)
+		s.problems = newProblemReporter(recorder)
+		s.reportProblems(svcs, nil)
+		sort.Strings(test.expect)
+		if events := drain(recorder, reasonPortConflict); !reflect.DeepEqual(events, test.expect) {
+			t.Errorf("%s: expect %v, got %v", test.lbType, test.expect, events)
+		}
+	}
+}
+
+func TestPortUseOverlap(t *testing.T) {
+	u := portUse{family: api.IPv4, protocol: v1.ProtocolTCP, from: 8000, to: 8100}
+	for _, test := range []struct {
+		o       portUse
+		overlap string
+	}{
+		{portUse{family: api.IPv4, protocol: v1.ProtocolTCP, from: 8100, to: 8100}, "IPv4/TCP/8100"},
+		{portUse{family: api.IPv4, protocol: v1.ProtocolTCP, from: 7000, to: 8050}, "IPv4/TCP/8000-8050"},
+		{portUse{family: api.IPv4, protocol: v1.ProtocolTCP, from: 8101, to: 9000}, ""},
+		{portUse{family: api.IPv4, protocol: v1.ProtocolUDP, from: 8000, to: 8000}, ""},
+		{portUse{family: api.IPv6, protocol: v1.ProtocolTCP, from: 8000, to: 8000}, ""},
+	} {
+		if !u.overlaps(test.o) {
+			if test.overlap != "" {
+				t.Errorf("expect %+v overlaps %+v", test.o, u)
+			}
+			continue
+		}
+		if overlap := u.overlap(test.o); overlap != test.overlap {
+			t.Errorf("expect overlap %s of %+v, got %s", test.overlap, test.o, overlap)
+		}
+	}
+}
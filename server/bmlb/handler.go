@@ -3,6 +3,7 @@ package bmlb
 import (
 	"fmt"
 	"reflect"
+	"strings"
 	"sync"
 	"time"
 
@@ -14,10 +15,12 @@ import (
 
 func (s *Server) AddService(svc *v1.Service) {
 	glog.V(5).Infof("add svc %s", objectKey(&svc.ObjectMeta))
+	watchEvents.WithLabelValues("service", "add").Inc()
 	s.maybeSync()
 }
 
 func (s *Server) UpdateService(oldSvc, newSvc *v1.Service) {
+	watchEvents.WithLabelValues("service", "update").Inc()
 	if s.skipServiceUpdate(oldSvc, newSvc) {
 		return
 	}
@@ -44,21 +47,25 @@ func (s *Server) skipServiceUpdate(old, new *v1.Service) bool {
 
 func (s *Server) DeleteService(svc *v1.Service) {
 	glog.V(5).Infof("delete svc %s", objectKey(&svc.ObjectMeta))
+	watchEvents.WithLabelValues("service", "delete").Inc()
 	s.maybeSync()
 }
 
 func (s *Server) AddEndpoints(ep *v1.Endpoints) {
 	glog.V(5).Infof("add endpoints %s", objectKey(&ep.ObjectMeta))
+	watchEvents.WithLabelValues("endpoints", "add").Inc()
 	s.maybeSync()
 }
 
 func (s *Server) UpdateEndpoints(oldEp, newEp *v1.Endpoints) {
 	glog.V(5).Infof("update endpoints %s", objectKey(&newEp.ObjectMeta))
+	watchEvents.WithLabelValues("endpoints", "update").Inc()
 	s.maybeSync()
 }
 
 func (s *Server) DeleteEndpoints(ep *v1.Endpoints) {
 	glog.V(5).Infof("delete endpoints %s", objectKey(&ep.ObjectMeta))
+	watchEvents.WithLabelValues("endpoints", "delete").Inc()
 	s.maybeSync()
 }
 
@@ -76,27 +83,115 @@ func objectKey(om *metav1.ObjectMeta) string {
 	return fmt.Sprintf("%s_%s", om.Name, om.Namespace)
 }
 
-func (s *Server) updateSvcs(svcs []*v1.Service) {
+// statusUpdateInterval and statusUpdateTimeout are how often and how long a status update is retried
+var (
+	statusUpdateInterval = time.Second
+	statusUpdateTimeout  = 2 * time.Minute
+)
+
+// updateSvcs updates status of services, added are the bind addresses added to their ingress. It returns
+// services whose update failed, the added addresses are removed from their ingress so that they are
+// advertised again on the next sync.
+func (s *Server) updateSvcs(svcs map[*v1.Service][]string) map[*v1.Service]bool {
 	if len(svcs) > 0 {
 		glog.V(3).Infof("updating svc %v", svcs)
 	}
-	var wg sync.WaitGroup
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed = map[*v1.Service]bool{}
+	)
+	for svc, added := range svcs {
+		wg.Add(1)
+		go func(svc *v1.Service, added []string) {
+			defer wg.Done()
+			if err := s.updateStatus(svc); err != nil {
+				glog.Errorf("failed to update svc %s: %v", objectKey(&svc.ObjectMeta), err)
+				syncErrors.WithLabelValues("status").Inc()
+				s.recorder.Eventf(svc, v1.EventTypeWarning, reasonStatusUpdateFailed, "failed to add load balancer ip %s to status: %v", strings.Join(added, ", "), err)
+				// advertise appends the added addresses to the end of ingress
+				ingress := svc.Status.LoadBalancer.Ingress
+				svc.Status.LoadBalancer.Ingress = ingress[:len(ingress)-len(added)]
+				mu.Lock()
+				failed[svc] = true
+				mu.Unlock()
+				return
+			}
+			s.recorder.Eventf(svc, v1.EventTypeNormal, reasonVIPAllocated, "allocated load balancer ip %s", strings.Join(added, ", "))
+		}(svc, added)
+	}
+	wg.Wait()
+	return failed
+}
+
+// withdraw removes bind addresses from ingress of svcs while the node is not ready, so that clients stop
+// using it until it becomes ready and advertises itself again. Addresses are kept in ingress if the update
+// fails, it is retried on the next sync. It returns services whose update failed.
+func (s *Server) withdraw(svcs []*v1.Service, reason error) map[*v1.Service]bool {
+	if s.LBType == "realserver" {
+		return nil
+	}
+	binds := map[string]bool{}
+	for _, bind := range s.binds {
+		binds[bind.String()] = true
+	}
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed = map[*v1.Service]bool{}
+	)
 	for i := range svcs {
+		svc := svcs[i]
+		ingress := svc.Status.LoadBalancer.Ingress
+		var kept []v1.LoadBalancerIngress
+		var removed []string
+		for _, in := range ingress {
+			if binds[in.IP] {
+				removed = append(removed, in.IP)
+				continue
+			}
+			kept = append(kept, in)
+		}
+		if len(removed) == 0 {
+			continue
+		}
+		svc.Status.LoadBalancer.Ingress = kept
 		wg.Add(1)
-		go func(svc *v1.Service) {
+		go func(svc *v1.Service, ingress []v1.LoadBalancerIngress, removed []string) {
 			defer wg.Done()
-			if err := wait.PollImmediate(time.Second, 2*time.Minute, func() (bool, error) {
-				_, err := s.Client.CoreV1().Services(svc.Namespace).UpdateStatus(svc)
-				if err != nil {
-					glog.Warningf("failed to update svc %s: %v", objectKey(&svc.ObjectMeta), err)
-					return false, nil
-				}
-				glog.V(3).Infof("updated loadbalance address %v for svc %s", svc.Status.LoadBalancer.Ingress, objectKey(&svc.ObjectMeta))
-				return true, nil
-			}); err != nil {
+			if err := s.updateStatus(svc); err != nil {
 				glog.Errorf("failed to update svc %s: %v", objectKey(&svc.ObjectMeta), err)
+				syncErrors.WithLabelValues("status").Inc()
+				s.recorder.Eventf(svc, v1.EventTypeWarning, reasonStatusUpdateFailed, "failed to remove load balancer ip %s from status: %v", strings.Join(removed, ", "), err)
+				svc.Status.LoadBalancer.Ingress = ingress
+				mu.Lock()
+				failed[svc] = true
+				mu.Unlock()
+				return
 			}
-		}(svcs[i])
+			s.recorder.Eventf(svc, v1.EventTypeWarning, reasonVIPWithdrawn, "withdrew load balancer ip %s as the node is not ready: %v", strings.Join(removed, ", "), reason)
+		}(svc, ingress, removed)
 	}
 	wg.Wait()
+	return failed
+}
+
+// updateStatus updates status of svc, it retries until statusUpdateTimeout and returns the last error
+func (s *Server) updateStatus(svc *v1.Service) error {
+	// lastErr is reported instead of the timeout error of polling
+	var lastErr error
+	if err := wait.PollImmediate(statusUpdateInterval, statusUpdateTimeout, func() (bool, error) {
+		_, err := s.Client.CoreV1().Services(svc.Namespace).UpdateStatus(svc)
+		if err != nil {
+			lastErr = err
+			glog.Warningf("failed to update svc %s: %v", objectKey(&svc.ObjectMeta), err)
+			statusUpdateRetries.Inc()
+			return false, nil
+		}
+		glog.V(3).Infof("updated loadbalance address %v for svc %s", svc.Status.LoadBalancer.Ingress, objectKey(&svc.ObjectMeta))
+		return true, nil
+	}); err != nil {
+		return lastErr
+	}
+	return nil
 }
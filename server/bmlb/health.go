@@ -0,0 +1,75 @@
+package bmlb
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// syncStallTimeout is how long the sync loop may go without finishing an iteration before the process is
+// considered unhealthy, the loop iterates at least once a minute
+const syncStallTimeout = 5 * time.Minute
+
+// readinessChecker is implemented by load balances which depend on something to be ready, e.g. haproxy
+type readinessChecker interface {
+	ready() error
+}
+
+// healthy returns an error if watchers stopped or the sync loop is stuck
+func (s *Server) healthy() error {
+	if s.serviceWatcher != nil && !s.serviceWatcher.Running() {
+		return fmt.Errorf("service watcher stopped")
+	}
+	if s.endpointsWatcher != nil && !s.endpointsWatcher.Running() {
+		return fmt.Errorf("endpoints watcher stopped")
+	}
+	s.syncMu.Lock()
+	heartbeat := s.heartbeat
+	s.syncMu.Unlock()
+	// the loop doesn't beat before informers are synced
+	if !heartbeat.IsZero() && time.Since(heartbeat) > syncStallTimeout {
+		return fmt.Errorf("sync loop is stuck since %s", heartbeat.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// ready returns an error unless informers are synced, a Build completed and the load balance is ready. Errors
+// of Build don't make the node unready as they may be of a single service, they are in /debug/sync.
+func (s *Server) ready() error {
+	if s.serviceWatcher == nil || !s.serviceWatcher.HasSynced() || !s.endpointsWatcher.HasSynced() {
+		return fmt.Errorf("informers are not synced")
+	}
+	s.syncMu.Lock()
+	lastSync := s.lastSync
+	s.syncMu.Unlock()
+	if lastSync.Time.IsZero() {
+		return fmt.Errorf("no build completed yet")
+	}
+	if lb, ok := s.lb.(readinessChecker); ok {
+		return lb.ready()
+	}
+	return nil
+}
+
+// beat records that the sync loop is alive
+func (s *Server) beat() {
+	s.syncMu.Lock()
+	s.heartbeat = time.Now()
+	s.syncMu.Unlock()
+}
+
+func (s *Server) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	serveCheck(w, s.healthy(), http.StatusInternalServerError)
+}
+
+func (s *Server) serveReadyz(w http.ResponseWriter, r *http.Request) {
+	serveCheck(w, s.ready(), http.StatusServiceUnavailable)
+}
+
+func serveCheck(w http.ResponseWriter, err error, failureCode int) {
+	if err != nil {
+		http.Error(w, err.Error(), failureCode)
+		return
+	}
+	writeText(w, []byte("ok"))
+}
@@ -0,0 +1,199 @@
+package bmlb
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/chenchun/kube-bmlb/server/flags"
+	"github.com/chenchun/kube-bmlb/utils/event"
+	"github.com/chenchun/kube-bmlb/watch"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+)
+
+type fakeController struct {
+	synced bool
+}
+
+func (c *fakeController) Run(stopCh <-chan struct{})      {}
+func (c *fakeController) HasSynced() bool                 { return c.synced }
+func (c *fakeController) LastSyncResourceVersion() string { return "" }
+
+// fakeLB is a load balance whose Build and readiness results are set by tests
+type fakeLB struct {
+	buildErr error
+	readyErr error
+	builds   int
+}
+
+func (f *fakeLB) Build(lbSvcs []*v1.Service, endpoints []*v1.Endpoints) error {
+	f.builds++
+	return f.buildErr
+}
+func (f *fakeLB) Run(stop struct{}) {}
+func (f *fakeLB) Cleanup() error    { return nil }
+func (f *fakeLB) ready() error      { return f.readyErr }
+
+// fakeAPIServer records status updates and patches of services
+type fakeAPIServer struct {
+	*httptest.Server
+	mu sync.Mutex
+	// requests are "method path" of requests
+	requests []string
+	// statuses are status updates by namespace/name
+	statuses map[string]*v1.Service
+	// patches are bodies of status patches by namespace/name
+	patches map[string][]string
+	// failStatus makes status updates conflict
+	failStatus bool
+}
+
+func newFakeAPIServer() *fakeAPIServer {
+	f := &fakeAPIServer{statuses: map[string]*v1.Service{}, patches: map[string][]string{}}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+func (f *fakeAPIServer) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+	// /api/v1/namespaces/{namespace}/services/{name}/status
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) != 7 || parts[4] != "services" || parts[6] != "status" {
+		http.NotFound(w, r)
+		return
+	}
+	key := parts[3] + "/" + parts[5]
+	body, _ := ioutil.ReadAll(r.Body)
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case http.MethodPut:
+		if f.failStatus {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprintf(w, `{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"Conflict","code":409}`)
+			return
+		}
+		svc := &v1.Service{}
+		json.Unmarshal(body, svc)
+		f.statuses[key] = svc
+		w.Write(body)
+	case http.MethodPatch:
+		f.patches[key] = append(f.patches[key], string(body))
+		fmt.Fprintf(w, `{"kind":"Service","apiVersion":"v1","metadata":{"namespace":%q,"name":%q}}`, parts[3], parts[5])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// newTestServer returns a Server of the lbtype with informers of svcs and endpoints, it talks to apiserver
+func newTestServer(t *testing.T, lb LoadBalance, lbType string, apiserver *fakeAPIServer, svcs []*v1.Service, endpoints []*v1.Endpoints) *Server {
+	services := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, svc := range svcs {
+		services.Add(svc)
+	}
+	eps := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, ep := range endpoints {
+		eps.Add(ep)
+	}
+	s := &Server{
+		ServerRunOptions: flags.NewServerRunOptions(),
+		serviceWatcher:   &watch.ServiceWatcher{ServiceController: &fakeController{synced: true}, ServiceLister: services},
+		endpointsWatcher: &watch.EndpointsWatcher{EndpointsController: &fakeController{synced: true}, EndpointsLister: eps},
+		lb:               lb,
+		recorder:         event.NewFakeRecorder(100),
+		binds:            []net.IP{net.ParseIP("10.0.0.2")},
+		problems:         newProblemReporter(event.NewFakeRecorder(100)),
+		conditions:       map[string]serviceCondition{},
+	}
+	s.LBType = lbType
+	if apiserver != nil {
+		client, err := kubernetes.NewForConfig(&rest.Config{Host: apiserver.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Client = client
+	}
+	return s
+}
+
+func lbService(namespace, name string, ports ...int32) *v1.Service {
+	svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name}, Spec: v1.ServiceSpec{Type: v1.ServiceTypeLoadBalancer}}
+	for _, port := range ports {
+		svc.Spec.Ports = append(svc.Spec.Ports, v1.ServicePort{Port: port, Protocol: v1.ProtocolTCP})
+	}
+	return svc
+}
+
+func TestReady(t *testing.T) {
+	lb := &fakeLB{buildErr: fmt.Errorf("failed to add real server of svc default/broken")}
+	s := newTestServer(t, lb, "lvs", nil, nil, nil)
+	s.serviceWatcher.ServiceController.(*fakeController).synced = false
+	if err := s.ready(); err == nil || !strings.Contains(err.Error(), "not synced") {
+		t.Fatalf("expect not synced, got %v", err)
+	}
+	s.serviceWatcher.ServiceController.(*fakeController).synced = true
+	if err := s.ready(); err == nil || !strings.Contains(err.Error(), "no build completed") {
+		t.Fatalf("expect no build, got %v", err)
+	}
+	// errors of a service don't make the node unready
+	s.syncOnce()
+	if err := s.ready(); err != nil {
+		t.Fatalf("expect ready, got %v", err)
+	}
+	if s.lastSync.LastSuccess != nil || s.lastSync.Error == "" {
+		t.Fatalf("expect the build error in sync status, got %+v", s.lastSync)
+	}
+	lb.readyErr = fmt.Errorf("haproxy is crashed")
+	if err := s.ready(); err != lb.readyErr {
+		t.Fatalf("expect %v, got %v", lb.readyErr, err)
+	}
+	w := httptest.NewRecorder()
+	s.serveReadyz(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expect 503, got %d", w.Code)
+	}
+}
+
+func TestAdvertiseOnlyWhenReady(t *testing.T) {
+	apiserver := newFakeAPIServer()
+	defer apiserver.Close()
+	lb := &fakeLB{readyErr: fmt.Errorf("haproxy is stopped")}
+	s := newTestServer(t, lb, "haproxy", apiserver, []*v1.Service{lbService("default", "web", 80)}, nil)
+	s.syncOnce()
+	if lb.builds != 1 {
+		t.Fatalf("expect a build, got %d", lb.builds)
+	}
+	if len(apiserver.statuses) != 0 {
+		t.Fatalf("expect no status update before ready, got %v", apiserver.requests)
+	}
+	lb.readyErr = nil
+	s.syncOnce()
+	svc := apiserver.statuses["default/web"]
+	if svc == nil || len(svc.Status.LoadBalancer.Ingress) != 1 || svc.Status.LoadBalancer.Ingress[0].IP != "10.0.0.2" {
+		t.Fatalf("expect ingress of the bind address, got %+v", svc)
+	}
+	if patches := apiserver.patches["default/web"]; len(patches) != 2 || !strings.Contains(patches[1], `"status":"True"`) {
+		t.Fatalf("expect a programmed condition patch, got %v", patches)
+	}
+	// the node withdraws itself once it isn't ready
+	lb.readyErr = fmt.Errorf("haproxy is crashed")
+	s.syncOnce()
+	svc = apiserver.statuses["default/web"]
+	if svc == nil || len(svc.Status.LoadBalancer.Ingress) != 0 {
+		t.Fatalf("expect no ingress, got %+v", svc)
+	}
+	if patches := apiserver.patches["default/web"]; len(patches) != 3 || !strings.Contains(patches[2], `"status":"False"`) {
+		t.Fatalf("expect a not programmed condition patch, got %v", patches)
+	}
+}
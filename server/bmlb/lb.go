@@ -1,56 +1,427 @@
 package bmlb
 
 import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/chenchun/kube-bmlb/api"
 	"github.com/chenchun/kube-bmlb/haproxy"
 	haproxyAdaptor "github.com/chenchun/kube-bmlb/haproxy/adaptor"
 	lvsAdaptor "github.com/chenchun/kube-bmlb/lvs/adaptor"
+	"github.com/chenchun/kube-bmlb/lvs/realserver"
+	"github.com/chenchun/kube-bmlb/server/flags"
+	"github.com/chenchun/kube-bmlb/utils/diff"
+	"github.com/chenchun/kube-bmlb/utils/event"
 	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
 	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/utils/exec"
 )
 
-func NewLoadBalance(lbtype string, ip net.IP) LoadBalance {
-	switch lbtype {
+// NewLoadBalance creates the load balance of opts.LBType, binds has at most one address of each family and
+// the family of the first one is the primary family
+func NewLoadBalance(opts *flags.ServerRunOptions, binds []net.IP, client kubernetes.Interface, recorder event.Recorder) LoadBalance {
+	switch opts.LBType {
 	case "haproxy":
-		return &HaproxyLB{
-			haproxy: haproxy.NewHaproxy(),
-			adaptor: haproxyAdaptor.NewHAProxyAdaptor()}
+		headerTemplate, err := readHeaderTemplate(opts.HaproxyTemplate)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		adaptor, err := haproxyAdaptor.NewHAProxyAdaptor(headerTemplate)
+		if err != nil {
+			glog.Fatalf("failed to load haproxy template %s: %v", opts.HaproxyTemplate, err)
+		}
+		adaptor.SetPrimaryFamily(api.IPFamilyOf(binds[0]))
+		lb := &HaproxyLB{
+			haproxy:     haproxy.NewHaproxy(opts.HaproxyBin, opts.HaproxyConfig, opts.HaproxyPidFile),
+			adaptor:     adaptor,
+			recorder:    recorder,
+			rejected:    map[string]string{},
+			client:      client,
+			header:      headerOf(opts),
+			statsSecret: opts.HaproxyStatsSecret,
+			statsSocket: opts.HaproxyStatsSocket}
+		lb.setHeader()
+		if lb.statsSocket != "" {
+			prometheus.MustRegister(haproxyAdaptor.NewStatsCollector(lb.collectStats))
+		}
+		return lb
 	case "lvs":
-		return &LVSLB{adaptor: lvsAdaptor.NewLVSAdaptor(ip)}
+		lb := &LVSLB{primary: api.IPFamilyOf(binds[0])}
+		for _, ip := range binds {
+			ownershipFile := opts.LVSOwnershipFile
+			if ownershipFile != "" && ip.To4() == nil {
+				// virtual servers of both families may have the same fwmark
+				ownershipFile += "-ipv6"
+			}
+			lb.adaptors = append(lb.adaptors, lvsAdaptor.NewLVSAdaptor(ip, lvsAdaptor.Options{
+				OwnershipFile: ownershipFile,
+				IPSetBackend:  opts.IPSetBackend,
+				DataPath:      opts.LVSDataPath}))
+			lb.families = append(lb.families, api.IPFamilyOf(ip))
+		}
+		return lb
+	case "realserver":
+		return &RealServerLB{realServer: realserver.New(exec.New(), realserver.DefaultDevice)}
 	default:
-		glog.Fatal("unsupport lbtype: %s", lbtype)
+		glog.Fatalf("unsupport lbtype: %s", opts.LBType)
 	}
 	return nil
 }
 
+// readHeaderTemplate reads the haproxy template file, it returns an empty template if path is empty
+func readHeaderTemplate(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read haproxy template %s: %v", path, err)
+	}
+	return string(data), nil
+}
+
+// headerOf returns the haproxy header of opts without the stats credential
+func headerOf(opts *flags.ServerRunOptions) haproxy.Header {
+	return haproxy.Header{
+		StatsSocket: opts.HaproxyStatsSocket,
+		UID:         opts.HaproxyUID,
+		GID:         opts.HaproxyGID,
+		Chroot:      opts.HaproxyChroot,
+		NbThread:    opts.HaproxyNbThread}
+}
+
 type LoadBalance interface {
-	Build(lbSvcs []*v1.Service, endpoints []*v1.Endpoints)
+	// Build syncs the load balance of lbSvcs, errors don't stop syncing other services and they are
+	// retried on next Build
+	Build(lbSvcs []*v1.Service, endpoints []*v1.Endpoints) error
 	Run(stop struct{})
+	// Cleanup removes what the load balance created on the node
+	Cleanup() error
 }
 
 type HaproxyLB struct {
-	haproxy *haproxy.Haproxy
-	adaptor *haproxyAdaptor.HAProxyAdaptor
+	haproxy  *haproxy.Haproxy
+	adaptor  *haproxyAdaptor.HAProxyAdaptor
+	recorder event.Recorder
+	// rejected is the haproxy output of services whose config is rejected by the last Build, used to avoid
+	// flooding events
+	rejected map[string]string
+	client   kubernetes.Interface
+	// header is the haproxy header of options, statsAuth is added to it
+	header haproxy.Header
+	// statsSecret is the namespace/name of the secret of stats page credential
+	statsSecret      string
+	statsSecretFetch time.Time
+	// statsAuth is the credential of the stats page, the page is disabled if nil
+	statsAuth *haproxy.StatsAuth
+	// statsSocket is the path of haproxy stats socket, stats are disabled if empty
+	statsSocket string
+
+	// mu protects desired, rejected and statsFailing
+	mu sync.Mutex
+	// statsFailing is true if the last scrape failed to read haproxy stats
+	statsFailing bool
+	// desired is the config of the last Build
+	desired []byte
+}
+
+// refreshStatsAuth reads the credential of stats page from statsSecret at most once per minute
+func (h *HaproxyLB) refreshStatsAuth() {
+	if h.statsSecret == "" || time.Since(h.statsSecretFetch) < time.Minute {
+		return
+	}
+	h.statsSecretFetch = time.Now()
+	namespace, name, err := cache.SplitMetaNamespaceKey(h.statsSecret)
+	if err != nil {
+		glog.Warningf("invalid haproxy stats secret %s: %v", h.statsSecret, err)
+		return
+	}
+	secret, err := h.client.CoreV1().Secrets(namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		// keep using the last credential
+		glog.Warningf("failed to get haproxy stats secret %s: %v", h.statsSecret, err)
+		return
+	}
+	auth := &haproxy.StatsAuth{Username: string(secret.Data[v1.BasicAuthUsernameKey]), Password: string(secret.Data[v1.BasicAuthPasswordKey])}
+	if err := auth.Validate(); err != nil {
+		// keep using the last credential
+		glog.Warningf("invalid %s and %s of haproxy stats secret %s: %v", v1.BasicAuthUsernameKey, v1.BasicAuthPasswordKey, h.statsSecret, err)
+		return
+	}
+	h.statsAuth = auth
+	h.setHeader()
+}
+
+func (h *HaproxyLB) setHeader() {
+	header := h.header
+	header.StatsAuth = h.statsAuth
+	h.adaptor.SetHeader(header)
+}
+
+// reload applies reloadable options, the template file is read again even if its path is unchanged
+func (h *HaproxyLB) reload(opts *flags.ServerRunOptions) error {
+	headerTemplate, err := readHeaderTemplate(opts.HaproxyTemplate)
+	if err != nil {
+		return err
+	}
+	if err := h.adaptor.SetHeaderTemplate(headerTemplate); err != nil {
+		return fmt.Errorf("failed to load haproxy template %s: %v", opts.HaproxyTemplate, err)
+	}
+	h.header = headerOf(opts)
+	if h.statsSecret != opts.HaproxyStatsSecret {
+		h.statsSecret = opts.HaproxyStatsSecret
+		// fetch the new secret on next Build, stats page is disabled if there is no secret
+		h.statsSecretFetch = time.Time{}
+		h.statsAuth = nil
+	}
+	h.setHeader()
+	return nil
 }
 
-func (h *HaproxyLB) Build(lbSvcs []*v1.Service, endpoints []*v1.Endpoints) {
-	buf := h.adaptor.Build(lbSvcs, endpoints)
+func (h *HaproxyLB) Build(lbSvcs []*v1.Service, endpoints []*v1.Endpoints) error {
+	h.refreshStatsAuth()
+	buf, rejected, err := h.adaptor.BuildChecked(lbSvcs, endpoints, h.haproxy.CheckConfig)
+	if err != nil {
+		// haproxy keeps running with the last config
+		return err
+	}
+	reported := map[string]string{}
+	for svc, output := range rejected {
+		key := objectKey(&svc.ObjectMeta)
+		reported[key] = output
+		glog.Warningf("haproxy rejected config of svc %s, excluded it from haproxy: %s", key, output)
+		if h.rejected[key] != output {
+			h.recorder.Eventf(svc, v1.EventTypeWarning, "HaproxyConfigRejected", "haproxy rejected config of the service, excluded it from haproxy: %s", output)
+		}
+	}
+	h.mu.Lock()
+	h.rejected = reported
+	h.desired = buf.Bytes()
+	h.mu.Unlock()
 	h.haproxy.ConfigChan <- buf
+	// rejected services are excluded from haproxy instead of failing the others, they are reported by events
+	// and the debug endpoint
+	return nil
+}
+
+// ready returns an error unless haproxy master is running
+func (h *HaproxyLB) ready() error {
+	if status := h.haproxy.Status(); status.State != haproxy.StateRunning {
+		return fmt.Errorf("haproxy is %s", status.State)
+	}
+	return nil
 }
 
 func (h *HaproxyLB) Run(stop struct{}) {
 	h.haproxy.Run()
 }
 
+// serviceStats reads stats from haproxy stats socket and maps them to services
+func (h *HaproxyLB) serviceStats() ([]*haproxyAdaptor.ServiceStats, error) {
+	if h.statsSocket == "" {
+		return nil, fmt.Errorf("haproxy stats socket is disabled")
+	}
+	stats, err := haproxy.ReadStats(h.statsSocket)
+	if err != nil {
+		return nil, err
+	}
+	return h.adaptor.ServiceStats(stats), nil
+}
+
+// collectStats returns haproxy stats of services to export on each scrape
+func (h *HaproxyLB) collectStats() []*haproxyAdaptor.ServiceStats {
+	svcStats, err := h.serviceStats()
+	h.mu.Lock()
+	failing := h.statsFailing
+	h.statsFailing = err != nil
+	h.mu.Unlock()
+	if err != nil {
+		// every scrape fails the same way if the template doesn't render the socket, warn once until it recovers
+		if !failing {
+			glog.Warningf("failed to read haproxy stats: %v", err)
+		} else {
+			glog.V(4).Infof("failed to read haproxy stats: %v", err)
+		}
+		return nil
+	}
+	if failing {
+		glog.Infof("read haproxy stats again")
+	}
+	return svcStats
+}
+
+// ServeStats serves haproxy stats of services in json
+func (h *HaproxyLB) ServeStats(w http.ResponseWriter, r *http.Request) {
+	svcStats, err := h.serviceStats()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, svcStats)
+}
+
+func (h *HaproxyLB) debugHandlers() map[string]http.HandlerFunc {
+	return map[string]http.HandlerFunc{
+		"/debug/haproxy/stats": h.ServeStats,
+		"/debug/haproxy/desired": func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, h.adaptor.Proxies())
+		},
+		"/debug/haproxy/rejected": func(w http.ResponseWriter, r *http.Request) {
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			writeJSON(w, h.rejected)
+		},
+		// credentials of the stats page are redacted as debug endpoints are not authenticated
+		"/debug/haproxy/config": func(w http.ResponseWriter, r *http.Request) {
+			writeText(w, haproxy.RedactConfig(h.haproxy.AppliedConfig()))
+		},
+		// diff is empty if haproxy runs with the config of the last Build
+		"/debug/haproxy/diff": func(w http.ResponseWriter, r *http.Request) {
+			h.mu.Lock()
+			desired := h.desired
+			h.mu.Unlock()
+			writeText(w, []byte(diff.Unified(haproxy.RedactConfig(h.haproxy.AppliedConfig()), haproxy.RedactConfig(desired), "applied", "desired", 3)))
+		},
+	}
+}
+
+// Cleanup does nothing as haproxy leaves nothing in kernel after it exits
+func (h *HaproxyLB) Cleanup() error {
+	return nil
+}
+
+// LVSLB has an adaptor of each bind address family
 type LVSLB struct {
-	adaptor *lvsAdaptor.LVSAdaptor
+	adaptors []*lvsAdaptor.LVSAdaptor
+	// families are address families of adaptors
+	families []string
+	// primary is the family of services which don't ask for families
+	primary string
 }
 
-func (h *LVSLB) Build(lbSvcs []*v1.Service, endpoints []*v1.Endpoints) {
-	h.adaptor.Build(lbSvcs, endpoints)
+func (h *LVSLB) Build(lbSvcs []*v1.Service, endpoints []*v1.Endpoints) error {
+	var errs []error
+	for i, adaptor := range h.adaptors {
+		if err := adaptor.Build(servicesOfFamily(lbSvcs, h.families[i], h.primary), endpoints); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return utilerrors.NewAggregate(errs)
 }
 
 func (h *LVSLB) Run(stop struct{}) {
+	for i := 1; i < len(h.adaptors); i++ {
+		go h.adaptors[i].Run()
+	}
+	h.adaptors[0].Run()
+}
+
+// ready returns an error if ipvs can't be reached
+func (h *LVSLB) ready() error {
+	return h.adaptors[0].Ping()
+}
+
+func (h *LVSLB) debugHandlers() map[string]http.HandlerFunc {
+	return map[string]http.HandlerFunc{
+		"/debug/lvs/desired": func(w http.ResponseWriter, r *http.Request) {
+			var desired []*lvsAdaptor.DesiredService
+			for _, adaptor := range h.adaptors {
+				desired = append(desired, adaptor.Desired()...)
+			}
+			writeJSON(w, desired)
+		},
+		// adaptors share ipvs of the node
+		"/debug/lvs/ipvs": func(w http.ResponseWriter, r *http.Request) {
+			str, err := h.adaptors[0].DumpIPVS()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			writeText(w, []byte(str))
+		},
+		"/debug/lvs/sets": func(w http.ResponseWriter, r *http.Request) {
+			buf := bytes.NewBuffer(nil)
+			for _, adaptor := range h.adaptors {
+				data, err := adaptor.DumpSets()
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				buf.Write(data)
+			}
+			writeText(w, buf.Bytes())
+		},
+	}
+}
+
+func (h *LVSLB) Cleanup() error {
+	var errs []string
+	for _, adaptor := range h.adaptors {
+		if err := adaptor.Cleanup(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// servicesOfFamily returns services having a VIP of family
+func servicesOfFamily(svcs []*v1.Service, family, primary string) []*v1.Service {
+	var filtered []*v1.Service
+	for _, svc := range svcs {
+		if api.HasIPFamily(svc, family, primary) {
+			filtered = append(filtered, svc)
+		}
+	}
+	return filtered
+}
+
+// RealServerLB runs on backend nodes of dr and tunnel services, it configures VIPs of these services
+// on a local dummy device instead of load balancing
+type RealServerLB struct {
+	realServer *realserver.RealServer
+}
+
+func (h *RealServerLB) Build(lbSvcs []*v1.Service, endpoints []*v1.Endpoints) error {
+	var vips []net.IP
+	var tunnel bool
+	for _, svc := range lbSvcs {
+		method, err := api.DecodeForwardMethod(svc.Annotations[api.ANForwardMethod])
+		if err != nil || method == api.ForwardMasq {
+			continue
+		}
+		if method == api.ForwardTunnel {
+			tunnel = true
+		}
+		for _, ingress := range svc.Status.LoadBalancer.Ingress {
+			if ip := net.ParseIP(ingress.IP); ip != nil {
+				vips = append(vips, ip)
+			}
+		}
+	}
+	if err := h.realServer.EnsureVIPs(vips, tunnel); err != nil {
+		return fmt.Errorf("failed to ensure vips: %v", err)
+	}
+	return nil
+}
+
+func (h *RealServerLB) Run(stop struct{}) {
+
+}
 
+func (h *RealServerLB) Cleanup() error {
+	return h.realServer.Cleanup()
 }
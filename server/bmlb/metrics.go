@@ -0,0 +1,23 @@
+package bmlb
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	syncDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "bmlb_sync_duration_seconds",
+		Help: "Duration of building load balance of all services."}, []string{"lbtype"})
+	syncErrors = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "bmlb_sync_errors_total",
+		Help: "Errors of syncing services by stage."}, []string{"stage"})
+	syncedServices = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "bmlb_services",
+		Help: "Number of load balancer services of the last sync."}, []string{"lbtype"})
+	// statusUpdateRetries is not labeled by service, otherwise counters of deleted services would be kept forever
+	statusUpdateRetries = prometheus.NewCounter(prometheus.CounterOpts{Name: "bmlb_status_update_retries_total",
+		Help: "Failed attempts of updating load balancer status of services."})
+	watchEvents = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "bmlb_watch_events_total",
+		Help: "Events of watched objects by resource and event."}, []string{"resource", "event"})
+	configReloads = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "bmlb_config_reloads_total",
+		Help: "Reloads of the config file by result."}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(syncDuration, syncErrors, syncedServices, statusUpdateRetries, watchEvents, configReloads)
+}
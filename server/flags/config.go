@@ -0,0 +1,246 @@
+package flags
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/ghodss/yaml"
+)
+
+const (
+	// ConfigAPIVersion and ConfigKind identify the config file format, they are required in the file
+	ConfigAPIVersion = "kube-bmlb/v1"
+	ConfigKind       = "Config"
+)
+
+// configOption maps a field of the config file to a field of ServerRunOptions
+type configOption struct {
+	// key is the path of the field in the config file, sections are separated by dot
+	key string
+	// flag is the name of the flag of the same option, flags set on command line override the file
+	flag string
+	// reloadable is true if the option takes effect without restarting kube-bmlb
+	reloadable bool
+	// field returns the pointer to the field of o
+	field func(o *ServerRunOptions) interface{}
+}
+
+// configOptions are options of the config file, e.g.
+//
+//	apiVersion: kube-bmlb/v1
+//	kind: Config
+//	lbtype: lvs
+//	bind: 10.0.0.2
+//	lvs:
+//	  dataPath: nftables
+//
+// Cleanup is not in the file as it is a one-off command.
+var configOptions = []configOption{
+	{key: "profiling", flag: "profiling", field: func(o *ServerRunOptions) interface{} { return &o.Profiling }},
+	{key: "bind", flag: "bind", field: func(o *ServerRunOptions) interface{} { return &o.Bind }},
+	{key: "port", flag: "port", field: func(o *ServerRunOptions) interface{} { return &o.Port }},
+	{key: "master", flag: "master", field: func(o *ServerRunOptions) interface{} { return &o.Master }},
+	{key: "kubeconfig", flag: "kubeconfig", field: func(o *ServerRunOptions) interface{} { return &o.KubeConf }},
+	{key: "lbtype", flag: "lbtype", field: func(o *ServerRunOptions) interface{} { return &o.LBType }},
+	{key: "haproxy.bin", flag: "haproxy-bin", field: func(o *ServerRunOptions) interface{} { return &o.HaproxyBin }},
+	{key: "haproxy.config", flag: "haproxy-config", field: func(o *ServerRunOptions) interface{} { return &o.HaproxyConfig }},
+	{key: "haproxy.pidFile", flag: "haproxy-pidfile", field: func(o *ServerRunOptions) interface{} { return &o.HaproxyPidFile }},
+	{key: "haproxy.template", flag: "haproxy-template", reloadable: true, field: func(o *ServerRunOptions) interface{} { return &o.HaproxyTemplate }},
+	{key: "haproxy.statsSecret", flag: "haproxy-stats-secret", reloadable: true, field: func(o *ServerRunOptions) interface{} { return &o.HaproxyStatsSecret }},
+	{key: "haproxy.statsSocket", flag: "haproxy-stats-socket", field: func(o *ServerRunOptions) interface{} { return &o.HaproxyStatsSocket }},
+	{key: "haproxy.uid", flag: "haproxy-uid", reloadable: true, field: func(o *ServerRunOptions) interface{} { return &o.HaproxyUID }},
+	{key: "haproxy.gid", flag: "haproxy-gid", reloadable: true, field: func(o *ServerRunOptions) interface{} { return &o.HaproxyGID }},
+	{key: "haproxy.chroot", flag: "haproxy-chroot", reloadable: true, field: func(o *ServerRunOptions) interface{} { return &o.HaproxyChroot }},
+	{key: "haproxy.nbthread", flag: "haproxy-nbthread", reloadable: true, field: func(o *ServerRunOptions) interface{} { return &o.HaproxyNbThread }},
+	{key: "lvs.ownershipFile", flag: "lvs-ownership-file", field: func(o *ServerRunOptions) interface{} { return &o.LVSOwnershipFile }},
+	{key: "lvs.ipsetBackend", flag: "ipset-backend", field: func(o *ServerRunOptions) interface{} { return &o.IPSetBackend }},
+	{key: "lvs.dataPath", flag: "lvs-datapath", field: func(o *ServerRunOptions) interface{} { return &o.LVSDataPath }},
+	{key: "webhook.port", flag: "webhook-port", field: func(o *ServerRunOptions) interface{} { return &o.WebhookPort }},
+	{key: "webhook.certFile", flag: "webhook-cert-file", field: func(o *ServerRunOptions) interface{} { return &o.WebhookCertFile }},
+	{key: "webhook.keyFile", flag: "webhook-key-file", field: func(o *ServerRunOptions) interface{} { return &o.WebhookKeyFile }},
+}
+
+// Config is a parsed config file, it has raw values of options by key
+type Config struct {
+	values map[string]json.RawMessage
+}
+
+// LoadConfig reads and parses a yaml or json config file
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config, err := ParseConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %v", path, err)
+	}
+	return config, nil
+}
+
+// ParseConfig parses a yaml or json config, unknown fields and values of wrong types are errors
+func ParseConfig(data []byte) (*Config, error) {
+	jsonData, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	var top map[string]json.RawMessage
+	if err := json.Unmarshal(jsonData, &top); err != nil {
+		return nil, fmt.Errorf("config should be an object: %v", err)
+	}
+	var apiVersion, kind string
+	json.Unmarshal(top["apiVersion"], &apiVersion)
+	json.Unmarshal(top["kind"], &kind)
+	if apiVersion != ConfigAPIVersion || kind != ConfigKind {
+		return nil, fmt.Errorf("apiVersion and kind should be %s and %s, got %q and %q", ConfigAPIVersion, ConfigKind, apiVersion, kind)
+	}
+	delete(top, "apiVersion")
+	delete(top, "kind")
+	values := map[string]json.RawMessage{}
+	for key, raw := range top {
+		if key != "haproxy" && key != "lvs" && key != "webhook" {
+			values[key] = raw
+			continue
+		}
+		var section map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &section); err != nil {
+			return nil, fmt.Errorf("%s should be an object: %v", key, err)
+		}
+		for name, value := range section {
+			values[key+"."+name] = value
+		}
+	}
+	var errs []string
+	options := map[string]configOption{}
+	for _, option := range configOptions {
+		options[option.key] = option
+	}
+	for _, key := range sortedKeys(values) {
+		option, ok := options[key]
+		if !ok {
+			errs = append(errs, fmt.Sprintf("unknown field %s", key))
+			continue
+		}
+		// decode into a scratch copy to check types
+		if err := json.Unmarshal(values[key], option.field(&ServerRunOptions{})); err != nil {
+			errs = append(errs, fmt.Sprintf("invalid %s: %v", key, err))
+		}
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return &Config{values: values}, nil
+}
+
+// Apply sets options in the config to o except those whose flags are set on command line, it returns keys
+// of options applied
+func (c *Config) Apply(o *ServerRunOptions, flagChanged func(name string) bool) []string {
+	var applied []string
+	for _, option := range configOptions {
+		raw, ok := c.values[option.key]
+		if !ok || flagChanged(option.flag) {
+			continue
+		}
+		// values are checked by ParseConfig
+		json.Unmarshal(raw, option.field(o))
+		applied = append(applied, option.key)
+	}
+	return applied
+}
+
+// reloadableKeys returns keys of reloadable options in the order of configOptions
+func reloadableKeys() []string {
+	var keys []string
+	for _, option := range configOptions {
+		if option.reloadable {
+			keys = append(keys, option.key)
+		}
+	}
+	return keys
+}
+
+// CopyReloadable copies reloadable options of src to dst
+func CopyReloadable(dst, src *ServerRunOptions) {
+	for _, option := range configOptions {
+		if option.reloadable {
+			value, _ := json.Marshal(option.field(src))
+			json.Unmarshal(value, option.field(dst))
+		}
+	}
+}
+
+// RestartRequired returns keys of options which differ between o and n but can't change at runtime
+func RestartRequired(o, n *ServerRunOptions) []string {
+	var keys []string
+	for _, option := range configOptions {
+		if option.reloadable {
+			continue
+		}
+		oldValue, _ := json.Marshal(option.field(o))
+		newValue, _ := json.Marshal(option.field(n))
+		if !bytes.Equal(oldValue, newValue) {
+			keys = append(keys, option.key)
+		}
+	}
+	return keys
+}
+
+// Validate checks values of options, the error has all invalid ones
+func (s *ServerRunOptions) Validate() error {
+	var errs []string
+	oneOf := func(key, value string, valid ...string) {
+		for _, v := range valid {
+			if value == v {
+				return
+			}
+		}
+		errs = append(errs, fmt.Sprintf("%s %q is invalid, it should be one of %s", key, value, strings.Join(valid, ", ")))
+	}
+	if s.Port <= 0 || s.Port > 65535 {
+		errs = append(errs, fmt.Sprintf("port %d is invalid, it should be in 1-65535", s.Port))
+	}
+	if strings.TrimSpace(s.Bind) == "" {
+		errs = append(errs, "bind is empty")
+	}
+	oneOf("lbtype", s.LBType, "haproxy", "lvs", "realserver")
+	oneOf("lvs.ipsetBackend", s.IPSetBackend, "exec", "netlink")
+	oneOf("lvs.dataPath", s.LVSDataPath, "auto", "iptables", "nftables")
+	if s.LBType == "haproxy" && s.HaproxyBin == "" {
+		errs = append(errs, "haproxy.bin is empty")
+	}
+	if s.LBType == "haproxy" && s.HaproxyConfig == "" {
+		errs = append(errs, "haproxy.config is empty")
+	}
+	if s.HaproxyStatsSecret != "" && strings.Count(s.HaproxyStatsSecret, "/") != 1 {
+		errs = append(errs, fmt.Sprintf("haproxy.statsSecret %q is invalid, it should be namespace/name", s.HaproxyStatsSecret))
+	}
+	if s.HaproxyUID < 0 || s.HaproxyGID < 0 {
+		errs = append(errs, fmt.Sprintf("haproxy.uid %d and haproxy.gid %d should not be negative", s.HaproxyUID, s.HaproxyGID))
+	}
+	if s.HaproxyNbThread < 0 {
+		errs = append(errs, fmt.Sprintf("haproxy.nbthread %d should not be negative", s.HaproxyNbThread))
+	}
+	if s.WebhookPort < 0 || s.WebhookPort > 65535 || s.WebhookPort != 0 && s.WebhookPort == s.Port {
+		errs = append(errs, fmt.Sprintf("webhook.port %d is invalid, it should be 0 or a port in 1-65535 other than port", s.WebhookPort))
+	}
+	if s.WebhookPort != 0 && (s.WebhookCertFile == "" || s.WebhookKeyFile == "") {
+		errs = append(errs, "webhook.certFile and webhook.keyFile are required by webhook.port")
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func sortedKeys(m map[string]json.RawMessage) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
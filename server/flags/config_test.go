@@ -0,0 +1,92 @@
+package flags
+
+import (
+	"flag"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseConfigErrors(t *testing.T) {
+	for i, test := range []struct {
+		config string
+		err    string
+	}{
+		{config: "lbtype: lvs", err: "apiVersion and kind should be"},
+		{config: "apiVersion: kube-bmlb/v2\nkind: Config", err: "apiVersion and kind should be"},
+		{config: "apiVersion: kube-bmlb/v1\nkind: Config\nlbtyp: lvs", err: "unknown field lbtyp"},
+		{config: "apiVersion: kube-bmlb/v1\nkind: Config\nlvs:\n  datapath: nftables", err: "unknown field lvs.datapath"},
+		{config: "apiVersion: kube-bmlb/v1\nkind: Config\nport: \"9010\"", err: "invalid port"},
+		{config: "apiVersion: kube-bmlb/v1\nkind: Config\nhaproxy: /usr/sbin/haproxy", err: "haproxy should be an object"},
+	} {
+		_, err := ParseConfig([]byte(test.config))
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("case %d: expect error %q, got %v", i, test.err, err)
+		}
+	}
+}
+
+func TestApply(t *testing.T) {
+	config, err := ParseConfig([]byte(`
+apiVersion: kube-bmlb/v1
+kind: Config
+lbtype: lvs
+port: 9011
+haproxy:
+  statsSecret: kube-system/haproxy-stats
+lvs:
+  dataPath: nftables
+webhook:
+  port: 9443
+  certFile: /etc/kube-bmlb/tls.crt
+  keyFile: /etc/kube-bmlb/tls.key
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := NewServerRunOptions()
+	o.Port = 9020
+	// port is set on command line
+	applied := config.Apply(o, func(name string) bool { return name == "port" })
+	if expect := []string{"lbtype", "haproxy.statsSecret", "lvs.dataPath", "webhook.port", "webhook.certFile", "webhook.keyFile"}; !reflect.DeepEqual(applied, expect) {
+		t.Errorf("expect applied %v, got %v", expect, applied)
+	}
+	if o.LBType != "lvs" || o.Port != 9020 || o.HaproxyStatsSecret != "kube-system/haproxy-stats" || o.LVSDataPath != "nftables" {
+		t.Errorf("unexpected options %+v", o)
+	}
+	if err := o.Validate(); err != nil {
+		t.Error(err)
+	}
+	n := NewServerRunOptions()
+	if keys := RestartRequired(o, n); !reflect.DeepEqual(keys, []string{"port", "lbtype", "lvs.dataPath", "webhook.port", "webhook.certFile", "webhook.keyFile"}) {
+		t.Errorf("unexpected restart required options %v", keys)
+	}
+	CopyReloadable(n, o)
+	if n.HaproxyStatsSecret != o.HaproxyStatsSecret || n.LBType != "haproxy" {
+		t.Errorf("unexpected reloaded options %+v", n)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	o := NewServerRunOptions()
+	o.Port = 0
+	o.LBType = "nginx"
+	o.HaproxyStatsSecret = "haproxy-stats"
+	o.WebhookPort = 9443
+	err := o.Validate()
+	if err == nil {
+		t.Fatal("expect an error")
+	}
+	for _, expect := range []string{"port 0 is invalid", `lbtype "nginx" is invalid`, `haproxy.statsSecret "haproxy-stats" is invalid`, "webhook.certFile and webhook.keyFile are required"} {
+		if !strings.Contains(err.Error(), expect) {
+			t.Errorf("expect %q in %v", expect, err)
+		}
+	}
+}
+
+func TestConfigUsage(t *testing.T) {
+	usage := flag.Lookup("config").Usage
+	if !strings.Contains(usage, "haproxy.template, haproxy.statsSecret, haproxy.uid, haproxy.gid, haproxy.chroot, haproxy.nbthread are reloaded") {
+		t.Fatal(usage)
+	}
+}
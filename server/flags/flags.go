@@ -2,7 +2,9 @@ package flags
 
 import (
 	"flag"
+	"strings"
 
+	"github.com/chenchun/kube-bmlb/lvs/adaptor"
 	"github.com/spf13/pflag"
 )
 
@@ -14,6 +16,39 @@ type ServerRunOptions struct {
 	Master    string
 	KubeConf  string
 	LBType    string
+
+	// HaproxyBin is the path of haproxy binary
+	HaproxyBin string
+	// HaproxyConfig is the path of the generated haproxy config
+	HaproxyConfig string
+	// HaproxyPidFile is the path of haproxy pid file
+	HaproxyPidFile string
+	// HaproxyTemplate is the path of a text/template file which renders global and defaults sections of haproxy config
+	HaproxyTemplate string
+	// HaproxyStatsSecret is the namespace/name of the secret which has username and password keys of haproxy stats page
+	HaproxyStatsSecret string
+	// HaproxyStatsSocket is the path of the haproxy stats socket kube-bmlb exports stats of services from
+	HaproxyStatsSocket string
+	// HaproxyUID, HaproxyGID, HaproxyChroot and HaproxyNbThread are rendered in global section of haproxy config
+	HaproxyUID      int
+	HaproxyGID      int
+	HaproxyChroot   string
+	HaproxyNbThread int
+
+	// LVSOwnershipFile records ipvs virtual servers created by kube-bmlb
+	LVSOwnershipFile string
+	// IPSetBackend is how lvs mode programs ipsets, exec runs the ipset command and netlink talks to kernel directly
+	IPSetBackend string
+	// LVSDataPath programs marks, masquerade and source allowlists of lvs mode by auto, iptables or nftables
+	LVSDataPath string
+	// Cleanup removes everything kube-bmlb created on the node and exits
+	Cleanup bool
+
+	// WebhookPort is the https port of the validating admission webhook of annotations, disabled if 0
+	WebhookPort int
+	// WebhookCertFile and WebhookKeyFile are the tls certificate and key of the webhook server
+	WebhookCertFile string
+	WebhookKeyFile  string
 }
 
 var (
@@ -21,7 +56,8 @@ var (
 )
 
 func init() {
-	flag.StringVar(&JsonConfigPath, "config", "/etc/sysconfig/kube-bmlb.conf", "The config file location of kube-bmlb")
+	flag.StringVar(&JsonConfigPath, "config", "/etc/sysconfig/kube-bmlb.conf", "The yaml or json config file of kube-bmlb, options set on command line override it. "+
+		strings.Join(reloadableKeys(), ", ")+" are reloaded when the file changes, other options need a restart")
 }
 
 func NewServerRunOptions() *ServerRunOptions {
@@ -30,15 +66,47 @@ func NewServerRunOptions() *ServerRunOptions {
 		Bind:      "0.0.0.0",
 		Port:      9010,
 		LBType:    "haproxy",
+
+		HaproxyBin:         "/usr/local/sbin/haproxy",
+		HaproxyConfig:      "/etc/haproxy/haproxy.cfg",
+		HaproxyPidFile:     "/var/run/haproxy.pid",
+		HaproxyStatsSocket: "/var/run/haproxy-stats.sock",
+		HaproxyUID:         200,
+		HaproxyGID:         200,
+		HaproxyChroot:      "/var/empty",
+		HaproxyNbThread:    4,
+
+		LVSOwnershipFile: adaptor.DefaultOwnershipFile,
+		IPSetBackend:     "exec",
+		LVSDataPath:      "auto",
 	}
 }
 
 // AddFlags add flags for a specific ASServer to the specified FlagSet
 func (s *ServerRunOptions) AddFlags(fs *pflag.FlagSet) {
 	fs.BoolVar(&s.Profiling, "profiling", s.Profiling, "Enable profiling via web interface host:port/debug/pprof/")
-	fs.StringVar(&s.Bind, "bind", s.Bind, "The ip address to bind")
+	fs.StringVar(&s.Bind, "bind", s.Bind, "The ip address to bind, an IPv4 and an IPv6 address separated by comma for dual-stack. "+
+		"Services without the v1.bmlb.l4/ip-families annotation are of the family of the first address")
 	fs.IntVar(&s.Port, "port", s.Port, "The port on which to serve")
 	fs.StringVar(&s.Master, "master", s.Master, "The address and port of the Kubernetes API server")
 	fs.StringVar(&s.KubeConf, "kubeconfig", s.KubeConf, "The kube config file location of APISwitch, used to support TLS")
-	fs.StringVar(&s.LBType, "lbtype", s.LBType, "The load balance type, currently supports haproxy and lvs")
+	fs.StringVar(&s.LBType, "lbtype", s.LBType, "The load balance type, currently supports haproxy, lvs and realserver which configures VIPs of lvs dr and tunnel services on backend nodes")
+	fs.StringVar(&s.HaproxyBin, "haproxy-bin", s.HaproxyBin, "The path of haproxy binary")
+	fs.StringVar(&s.HaproxyConfig, "haproxy-config", s.HaproxyConfig, "The path of the haproxy config generated by kube-bmlb")
+	fs.StringVar(&s.HaproxyPidFile, "haproxy-pidfile", s.HaproxyPidFile, "The path of haproxy pid file")
+	fs.StringVar(&s.HaproxyTemplate, "haproxy-template", s.HaproxyTemplate, "The path of a go template file which renders global and defaults sections of haproxy config, kube-bmlb uses a sample template if empty")
+	fs.StringVar(&s.LVSOwnershipFile, "lvs-ownership-file", s.LVSOwnershipFile, "The file recording ipvs virtual servers created by kube-bmlb, virtual servers not recorded are never deleted")
+	fs.StringVar(&s.IPSetBackend, "ipset-backend", s.IPSetBackend, "How lvs mode programs ipsets, exec runs the ipset command and netlink talks to kernel via netfilter netlink without the ipset command")
+	fs.StringVar(&s.LVSDataPath, "lvs-datapath", s.LVSDataPath, "How lvs mode programs packet marks, masquerade and source allowlists, one of iptables, nftables and auto which picks nftables if iptables is missing or is the nf_tables variant. Rules of the other one are left after switching, run with --cleanup and the old value to remove them")
+	fs.BoolVar(&s.Cleanup, "cleanup", s.Cleanup, "Remove ipvs virtual servers, iptables rules, ipsets and devices created by kube-bmlb of the lbtype and exit")
+	fs.StringVar(&s.HaproxyStatsSecret, "haproxy-stats-secret", s.HaproxyStatsSecret, "The namespace/name of the secret which has username and password keys of haproxy stats page, stats page is disabled if empty")
+	fs.StringVar(&s.HaproxyStatsSocket, "haproxy-stats-socket", s.HaproxyStatsSocket, "The path of the haproxy stats socket kube-bmlb reads stats of services from and exports them on /metrics and /debug/haproxy/stats, "+
+		"a custom --haproxy-template should render it by {{.StatsSocket}}. Stats are disabled if empty")
+	fs.IntVar(&s.HaproxyUID, "haproxy-uid", s.HaproxyUID, "The uid haproxy workers run as, unchanged if 0. Ignored by a custom --haproxy-template unless it renders {{.UID}}")
+	fs.IntVar(&s.HaproxyGID, "haproxy-gid", s.HaproxyGID, "The gid haproxy workers run as, unchanged if 0. Ignored by a custom --haproxy-template unless it renders {{.GID}}")
+	fs.StringVar(&s.HaproxyChroot, "haproxy-chroot", s.HaproxyChroot, "The directory haproxy workers chroot to, no chroot if empty. Ignored by a custom --haproxy-template unless it renders {{.Chroot}}")
+	fs.IntVar(&s.HaproxyNbThread, "haproxy-nbthread", s.HaproxyNbThread, "The number of threads of haproxy workers, decided by haproxy if 0. Ignored by a custom --haproxy-template unless it renders {{.NbThread}}")
+	fs.IntVar(&s.WebhookPort, "webhook-port", s.WebhookPort, "The https port of the validating admission webhook which rejects services with invalid kube-bmlb annotations on /validate, disabled if 0")
+	fs.StringVar(&s.WebhookCertFile, "webhook-cert-file", s.WebhookCertFile, "The tls certificate file of the webhook server")
+	fs.StringVar(&s.WebhookKeyFile, "webhook-key-file", s.WebhookKeyFile, "The tls private key file of the webhook server")
 }
@@ -0,0 +1,107 @@
+// Package webhook is a validating admission webhook of kube-bmlb annotations of services
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/chenchun/kube-bmlb/api"
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// maxRequestBytes limits the size of admission requests, the apiserver limits objects to 3MB
+const maxRequestBytes = 4 << 20
+
+// AdmissionReview is admission.k8s.io/v1 and v1beta1 AdmissionReview, the vendored api predates the
+// admission group. Only fields kube-bmlb uses are here.
+type AdmissionReview struct {
+	metav1.TypeMeta `json:",inline"`
+	Request         *AdmissionRequest  `json:"request,omitempty"`
+	Response        *AdmissionResponse `json:"response,omitempty"`
+}
+
+type AdmissionRequest struct {
+	UID       types.UID               `json:"uid"`
+	Kind      metav1.GroupVersionKind `json:"kind"`
+	Operation string                  `json:"operation"`
+	Namespace string                  `json:"namespace,omitempty"`
+	Name      string                  `json:"name,omitempty"`
+	Object    json.RawMessage         `json:"object,omitempty"`
+	OldObject json.RawMessage         `json:"oldObject,omitempty"`
+}
+
+type AdmissionResponse struct {
+	UID     types.UID      `json:"uid"`
+	Allowed bool           `json:"allowed"`
+	Result  *metav1.Status `json:"result,omitempty"`
+}
+
+// ServeValidate serves AdmissionReviews of services, it rejects services whose kube-bmlb annotations
+// adaptors can't parse
+func ServeValidate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBytes))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to read request: %v", err), http.StatusBadRequest)
+		return
+	}
+	var review AdmissionReview
+	if err := json.Unmarshal(data, &review); err != nil || review.Request == nil {
+		http.Error(w, fmt.Sprintf("invalid AdmissionReview: %v", err), http.StatusBadRequest)
+		return
+	}
+	// the response has the apiVersion of the request
+	response := AdmissionReview{TypeMeta: review.TypeMeta, Response: Validate(review.Request)}
+	response.Response.UID = review.Request.UID
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		glog.Warningf("failed to write admission response: %v", err)
+	}
+}
+
+// Validate validates kube-bmlb annotations and target ports of a service to be created or updated.
+// Annotations an update doesn't change are not validated so that services created before the webhook can
+// still be updated.
+func Validate(req *AdmissionRequest) *AdmissionResponse {
+	if req.Kind.Group != "" || req.Kind.Kind != "Service" || req.Operation != "CREATE" && req.Operation != "UPDATE" {
+		return &AdmissionResponse{Allowed: true}
+	}
+	var svc, old v1.Service
+	if err := json.Unmarshal(req.Object, &svc); err != nil {
+		return deny(metav1.StatusReasonBadRequest, http.StatusBadRequest, fmt.Sprintf("failed to decode service: %v", err))
+	}
+	annotations := svc.Annotations
+	if req.Operation == "UPDATE" {
+		if err := json.Unmarshal(req.OldObject, &old); err != nil {
+			return deny(metav1.StatusReasonBadRequest, http.StatusBadRequest, fmt.Sprintf("failed to decode old service: %v", err))
+		}
+		annotations = map[string]string{}
+		for key, value := range svc.Annotations {
+			if oldValue, ok := old.Annotations[key]; !ok || oldValue != value {
+				annotations[key] = value
+			}
+		}
+	}
+	errs := api.ValidateAnnotations(annotations)
+	// services whose target ports are already invalid are left to adaptors which skip their endpoints
+	if req.Operation == "CREATE" || len(api.ValidateTargetPorts(&old)) == 0 {
+		errs = append(errs, api.ValidateTargetPorts(&svc)...)
+	}
+	if len(errs) > 0 {
+		glog.V(3).Infof("rejected %s of svc %s/%s: %v", req.Operation, req.Namespace, req.Name, errs.ToAggregate())
+		return deny(metav1.StatusReasonInvalid, http.StatusUnprocessableEntity, errs.ToAggregate().Error())
+	}
+	return &AdmissionResponse{Allowed: true}
+}
+
+func deny(reason metav1.StatusReason, code int32, message string) *AdmissionResponse {
+	return &AdmissionResponse{Result: &metav1.Status{Status: metav1.StatusFailure, Reason: reason, Code: code, Message: message}}
+}
@@ -0,0 +1,144 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/chenchun/kube-bmlb/api"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func service(annotations map[string]string, ports ...v1.ServicePort) json.RawMessage {
+	data, _ := json.Marshal(&v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "svc", Annotations: annotations},
+		Spec: v1.ServiceSpec{Ports: ports}})
+	return data
+}
+
+func TestValidate(t *testing.T) {
+	kind := metav1.GroupVersionKind{Version: "v1", Kind: "Service"}
+	for i, test := range []struct {
+		req     *AdmissionRequest
+		allowed bool
+		message []string
+	}{
+		{
+			req:     &AdmissionRequest{Kind: kind, Operation: "CREATE", Object: service(map[string]string{api.ANWeight: `{"80":1}`, api.ANScheduler: "wrr", "foo": "bar"})},
+			allowed: true,
+		},
+		{
+			req: &AdmissionRequest{Kind: kind, Operation: "CREATE", Object: service(map[string]string{
+				api.ANWeight: `{"80":1`, api.ANScheduler: "wrrr", api.ANPortRanges: "9000-8000", api.ANSourceRanges: "10.0.0.0/33"})},
+			message: []string{
+				`metadata.annotations[v1.bmlb.l4/weight]: Invalid value: "{\"80\":1"`,
+				`metadata.annotations[v1.bmlb.l4/scheduler]: Invalid value: "wrrr": invalid scheduler "wrrr"`,
+				`metadata.annotations[v1.bmlb.l4/port-ranges]: Invalid value: "9000-8000": invalid port range "9000-8000"`,
+				`metadata.annotations[service.beta.kubernetes.io/load-balancer-source-ranges]: Invalid value: "10.0.0.0/33"`,
+			},
+		},
+		{
+			// unchanged annotations are not validated
+			req: &AdmissionRequest{Kind: kind, Operation: "UPDATE",
+				Object:    service(map[string]string{api.ANFWMark: "yes", api.ANMode: "http"}),
+				OldObject: service(map[string]string{api.ANFWMark: "yes"})},
+			allowed: true,
+		},
+		{
+			req: &AdmissionRequest{Kind: kind, Operation: "UPDATE",
+				Object:    service(map[string]string{api.ANFWMark: "yes", api.ANIPFamilies: "IPv4,IPv4"}),
+				OldObject: service(map[string]string{api.ANFWMark: "yes"})},
+			message: []string{`metadata.annotations[v1.bmlb.l4/ip-families]: Invalid value: "IPv4,IPv4": duplicated ip family "IPv4"`},
+		},
+		{
+			req: &AdmissionRequest{Kind: kind, Operation: "CREATE", Object: service(map[string]string{api.ANForwardMethod: "dr"},
+				v1.ServicePort{Port: 80, TargetPort: intstr.FromInt(80)}, v1.ServicePort{Port: 81}, v1.ServicePort{Port: 82, TargetPort: intstr.FromString("http")})},
+			allowed: true,
+		},
+		{
+			req: &AdmissionRequest{Kind: kind, Operation: "CREATE", Object: service(map[string]string{api.ANForwardMethod: "tunnel"},
+				v1.ServicePort{Port: 80, TargetPort: intstr.FromInt(80)}, v1.ServicePort{Port: 81, TargetPort: intstr.FromInt(8081)})},
+			message: []string{`spec.ports[1].targetPort: Invalid value: 8081: must be the same as port 81 of a tunnel service`},
+		},
+		{
+			req: &AdmissionRequest{Kind: kind, Operation: "CREATE", Object: service(map[string]string{api.ANPortRanges: "8000-9000"},
+				v1.ServicePort{Port: 80, TargetPort: intstr.FromInt(8080)})},
+			message: []string{`spec.ports[0].targetPort: Invalid value: 8080: must be the same as port 80 of a fwmark service`},
+		},
+		{
+			// adding port ranges to a service with translated ports
+			req: &AdmissionRequest{Kind: kind, Operation: "UPDATE",
+				Object:    service(map[string]string{api.ANPortRanges: "8000-9000"}, v1.ServicePort{Port: 80, TargetPort: intstr.FromInt(8080)}),
+				OldObject: service(nil, v1.ServicePort{Port: 80, TargetPort: intstr.FromInt(8080)})},
+			message: []string{`spec.ports[0].targetPort: Invalid value: 8080: must be the same as port 80 of a fwmark service`},
+		},
+		{
+			req:     &AdmissionRequest{Kind: kind, Operation: "CREATE", Object: service(nil, v1.ServicePort{Port: 81, TargetPort: intstr.FromInt(8081)})},
+			allowed: true,
+		},
+		{
+			// switching to dr requires target ports to be the same as ports
+			req: &AdmissionRequest{Kind: kind, Operation: "UPDATE",
+				Object:    service(map[string]string{api.ANForwardMethod: "dr"}, v1.ServicePort{Port: 81, TargetPort: intstr.FromInt(8081)}),
+				OldObject: service(nil, v1.ServicePort{Port: 81, TargetPort: intstr.FromInt(8081)})},
+			message: []string{`spec.ports[0].targetPort: Invalid value: 8081`},
+		},
+		{
+			// services with invalid target ports before the webhook can still be updated
+			req: &AdmissionRequest{Kind: kind, Operation: "UPDATE",
+				Object:    service(map[string]string{api.ANForwardMethod: "dr", "foo": "bar"}, v1.ServicePort{Port: 81, TargetPort: intstr.FromInt(8081)}),
+				OldObject: service(map[string]string{api.ANForwardMethod: "dr"}, v1.ServicePort{Port: 81, TargetPort: intstr.FromInt(8081)})},
+			allowed: true,
+		},
+		{
+			req:     &AdmissionRequest{Kind: kind, Operation: "DELETE", OldObject: service(map[string]string{api.ANMode: "udp"})},
+			allowed: true,
+		},
+	} {
+		resp := Validate(test.req)
+		if resp.Allowed != test.allowed {
+			t.Errorf("case %d: expect allowed %v, got %+v", i, test.allowed, resp)
+			continue
+		}
+		if test.allowed {
+			continue
+		}
+		if resp.Result == nil || resp.Result.Code != http.StatusUnprocessableEntity {
+			t.Errorf("case %d: unexpected result %+v", i, resp.Result)
+			continue
+		}
+		for _, message := range test.message {
+			if !strings.Contains(resp.Result.Message, message) {
+				t.Errorf("case %d: expect %q in %q", i, message, resp.Result.Message)
+			}
+		}
+	}
+}
+
+func TestServeValidate(t *testing.T) {
+	review := AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request: &AdmissionRequest{UID: "7f0b2d3c", Kind: metav1.GroupVersionKind{Version: "v1", Kind: "Service"},
+			Operation: "CREATE", Object: service(map[string]string{api.ANForwardMethod: "nat"})},
+	}
+	data, _ := json.Marshal(review)
+	w := httptest.NewRecorder()
+	ServeValidate(w, httptest.NewRequest(http.MethodPost, "/validate", bytes.NewReader(data)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected code %d: %s", w.Code, w.Body.String())
+	}
+	var response AdmissionReview
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.APIVersion != "admission.k8s.io/v1" || response.Kind != "AdmissionReview" || response.Request != nil {
+		t.Errorf("unexpected response %+v", response)
+	}
+	if response.Response == nil || response.Response.UID != "7f0b2d3c" || response.Response.Allowed {
+		t.Errorf("unexpected response %+v", response.Response)
+	}
+}
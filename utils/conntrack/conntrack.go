@@ -0,0 +1,152 @@
+// Package conntrack deletes connection tracking entries. ipvs keeps forwarding packets of a tracked flow
+// to the same real server, so udp flows like DNS queries keep going to a removed real server until their
+// entries expire unless they are deleted.
+package conntrack
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	utilexec "k8s.io/utils/exec"
+)
+
+// ConntrackCmd is the conntrack command of conntrack-tools
+const ConntrackCmd = "conntrack"
+
+const (
+	ProtocolTCP  = "tcp"
+	ProtocolUDP  = "udp"
+	ProtocolSCTP = "sctp"
+)
+
+// Flow is a tracked flow from a client to a virtual server forwarded to a real server
+type Flow struct {
+	Protocol string
+	// Src and SrcPort are the client
+	Src     net.IP
+	SrcPort uint16
+	// VIP and Port are the original destination
+	VIP  net.IP
+	Port uint16
+	// RealServer and RealPort are the reply source
+	RealServer net.IP
+	RealPort   uint16
+}
+
+// Filter selects flows, zero fields match everything. RealServer and RealPort match the reply source which
+// is only the real server of masquerading virtual servers, replies of direct routing and tunnel real servers
+// don't pass ipvs and their reply source is the vip, so their flows can only be matched by the original tuple.
+type Filter struct {
+	Protocol   string
+	VIP        net.IP
+	Port       uint16
+	RealServer net.IP
+	RealPort   uint16
+}
+
+// Match returns true if flow is selected by f
+func (f Filter) Match(flow Flow) bool {
+	if f.Protocol != "" && f.Protocol != flow.Protocol {
+		return false
+	}
+	if f.VIP != nil && !f.VIP.Equal(flow.VIP) {
+		return false
+	}
+	if f.Port != 0 && f.Port != flow.Port {
+		return false
+	}
+	if f.RealServer != nil && !f.RealServer.Equal(flow.RealServer) {
+		return false
+	}
+	return f.RealPort == 0 || f.RealPort == flow.RealPort
+}
+
+func (f Filter) String() string {
+	return fmt.Sprintf("%s %s:%d -> %s:%d", f.Protocol, f.VIP, f.Port, f.RealServer, f.RealPort)
+}
+
+// Interface deletes conntrack entries. Implementations must be goroutine-safe.
+type Interface interface {
+	// DeleteFlows deletes entries of flows matching any of filters, which must have VIP, and returns the number
+	// of deleted entries
+	DeleteFlows(filters ...Filter) (int, error)
+}
+
+// NewDefault talks to kernel via netfilter netlink, it falls back to exec conntrack if netlink is unavailable
+func NewDefault(exec utilexec.Interface) Interface {
+	nl, err := NewNetlink()
+	if err != nil {
+		glog.Warningf("falling back to exec %s: %v", ConntrackCmd, err)
+		return New(exec)
+	}
+	return nl
+}
+
+type runner struct {
+	exec utilexec.Interface
+}
+
+// New returns a new Interface which will exec conntrack
+func New(exec utilexec.Interface) Interface {
+	return &runner{exec: exec}
+}
+
+var deletedRe = regexp.MustCompile(`(\d+) flow entries have been deleted`)
+
+// DeleteFlows runs `conntrack -D` of each filter, conntrack filters entries in kernel
+func (r *runner) DeleteFlows(filters ...Filter) (int, error) {
+	var deleted int
+	var errs []error
+	for _, filter := range filters {
+		n, err := r.deleteFlows(filter)
+		deleted += n
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return deleted, utilerrors.NewAggregate(errs)
+}
+
+func (r *runner) deleteFlows(filter Filter) (int, error) {
+	if filter.VIP == nil {
+		return 0, fmt.Errorf("filter %s has no vip", filter)
+	}
+	args := []string{"-D", "--orig-dst", filter.VIP.String()}
+	if filter.VIP.To4() == nil {
+		args = append(args, "-f", "ipv6")
+	}
+	if filter.Protocol != "" {
+		args = append(args, "-p", filter.Protocol)
+		if filter.Port != 0 {
+			args = append(args, "--orig-port-dst", strconv.Itoa(int(filter.Port)))
+		}
+		if filter.RealPort != 0 {
+			args = append(args, "--reply-port-src", strconv.Itoa(int(filter.RealPort)))
+		}
+	}
+	if filter.RealServer != nil {
+		args = append(args, "--reply-src", filter.RealServer.String())
+	}
+	glog.V(5).Infof("running %s %s", ConntrackCmd, strings.Join(args, " "))
+	out, err := r.exec.Command(ConntrackCmd, args...).CombinedOutput()
+	match := deletedRe.FindSubmatch(out)
+	if match == nil {
+		if err == nil {
+			err = fmt.Errorf("unexpected output")
+		}
+		return 0, fmt.Errorf("error deleting conntrack entries of %s: %v (%s)", filter, err, out)
+	}
+	// conntrack exits with 1 if nothing is deleted
+	n, _ := strconv.Atoi(string(match[1]))
+	if err != nil && n != 0 {
+		return n, fmt.Errorf("error deleting conntrack entries of %s: %v (%s)", filter, err, out)
+	}
+	return n, nil
+}
+
+var _ = Interface(&runner{})
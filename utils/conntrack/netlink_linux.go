@@ -0,0 +1,180 @@
+// +build linux
+
+package conntrack
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/chenchun/kube-bmlb/utils/nlattr"
+	"github.com/golang/glog"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// conntrack netlink protocol, see include/uapi/linux/netfilter/nfnetlink_conntrack.h of linux
+const (
+	nfnlSubsysCTNetlink = 1
+)
+
+var protocolNames = map[uint8]string{unix.IPPROTO_TCP: ProtocolTCP, unix.IPPROTO_UDP: ProtocolUDP, unix.IPPROTO_SCTP: ProtocolSCTP}
+
+type netlinkRunner struct{}
+
+// NewNetlink returns a new Interface which talks to kernel via netfilter netlink instead of exec conntrack.
+// It fails if kernel doesn't support conntrack netlink or the process is not privileged.
+func NewNetlink() (Interface, error) {
+	if _, err := dump(unix.AF_INET); err != nil {
+		return nil, fmt.Errorf("conntrack netlink unavailable: %v", err)
+	}
+	return &netlinkRunner{}, nil
+}
+
+// DeleteFlows dumps entries of each family of filters once and deletes ones matching any filter by their
+// original tuples, so that deleting flows of many real servers doesn't dump the table for each of them
+func (r *netlinkRunner) DeleteFlows(filters ...Filter) (int, error) {
+	byFamily := map[uint8][]Filter{}
+	for _, filter := range filters {
+		if filter.VIP == nil {
+			return 0, fmt.Errorf("filter %s has no vip", filter)
+		}
+		family := uint8(unix.AF_INET)
+		if filter.VIP.To4() == nil {
+			family = unix.AF_INET6
+		}
+		byFamily[family] = append(byFamily[family], filter)
+	}
+	var deleted int
+	for family, filters := range byFamily {
+		n, err := deleteFlows(family, filters)
+		deleted += n
+		if err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
+
+func deleteFlows(family uint8, filters []Filter) (int, error) {
+	msgs, err := dump(family)
+	if err != nil {
+		return 0, fmt.Errorf("error listing conntrack entries: %v", err)
+	}
+	var deleted int
+	for _, msg := range msgs {
+		flow, orig, err := parseFlow(msg)
+		if err != nil {
+			glog.V(4).Infof("skip conntrack entry: %v", err)
+			continue
+		}
+		filter, ok := matchAny(filters, flow)
+		if !ok {
+			continue
+		}
+		req := newRequest(nl.IPCTNL_MSG_CT_DELETE, unix.NLM_F_ACK, family)
+		req.AddData(nl.NewRtAttr(nl.CTA_TUPLE_ORIG|nl.NLA_F_NESTED, orig))
+		if _, err := req.Execute(unix.NETLINK_NETFILTER, 0); err != nil {
+			if err == syscall.ENOENT {
+				// expired after dumping
+				continue
+			}
+			return deleted, fmt.Errorf("error deleting conntrack entries of %s: %v", filter, err)
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// matchAny returns the first filter matching flow
+func matchAny(filters []Filter, flow Flow) (Filter, bool) {
+	for _, filter := range filters {
+		if filter.Match(flow) {
+			return filter, true
+		}
+	}
+	return Filter{}, false
+}
+
+func newRequest(cmd, flags int, family uint8) *nl.NetlinkRequest {
+	req := nl.NewNetlinkRequest(nfnlSubsysCTNetlink<<8|cmd, flags)
+	req.AddData(&nl.Nfgenmsg{NfgenFamily: family, Version: nl.NFNETLINK_V0})
+	return req
+}
+
+func dump(family uint8) ([][]byte, error) {
+	return newRequest(nl.IPCTNL_MSG_CT_GET, unix.NLM_F_DUMP, family).Execute(unix.NETLINK_NETFILTER, 0)
+}
+
+// parseFlow parses a conntrack message, orig is the original tuple attribute to delete the entry
+func parseFlow(msg []byte) (flow Flow, orig []byte, err error) {
+	if len(msg) < nl.SizeofNfgenmsg {
+		return flow, nil, fmt.Errorf("short message of %d bytes", len(msg))
+	}
+	attrs, err := nlattr.ParseMap(msg[nl.SizeofNfgenmsg:])
+	if err != nil {
+		return flow, nil, err
+	}
+	orig = attrs[nl.CTA_TUPLE_ORIG]
+	origTuple, err := parseTuple(orig)
+	if err != nil {
+		return flow, nil, fmt.Errorf("invalid original tuple: %v", err)
+	}
+	replyTuple, err := parseTuple(attrs[nl.CTA_TUPLE_REPLY])
+	if err != nil {
+		return flow, nil, fmt.Errorf("invalid reply tuple: %v", err)
+	}
+	flow = Flow{
+		Protocol:   protocolNames[origTuple.proto],
+		Src:        origTuple.src,
+		SrcPort:    origTuple.srcPort,
+		VIP:        origTuple.dst,
+		Port:       origTuple.dstPort,
+		RealServer: replyTuple.src,
+		RealPort:   replyTuple.srcPort,
+	}
+	return flow, orig, nil
+}
+
+type tuple struct {
+	src, dst         net.IP
+	proto            uint8
+	srcPort, dstPort uint16
+}
+
+func parseTuple(data []byte) (*tuple, error) {
+	if data == nil {
+		return nil, fmt.Errorf("missing")
+	}
+	attrs, err := nlattr.ParseMap(data)
+	if err != nil {
+		return nil, err
+	}
+	ipAttrs, err := nlattr.ParseMap(attrs[nl.CTA_TUPLE_IP])
+	if err != nil {
+		return nil, err
+	}
+	protoAttrs, err := nlattr.ParseMap(attrs[nl.CTA_TUPLE_PROTO])
+	if err != nil {
+		return nil, err
+	}
+	t := &tuple{}
+	if src := ipAttrs[nl.CTA_IP_V4_SRC]; src != nil {
+		t.src, t.dst = net.IP(src), net.IP(ipAttrs[nl.CTA_IP_V4_DST])
+	} else {
+		t.src, t.dst = net.IP(ipAttrs[nl.CTA_IP_V6_SRC]), net.IP(ipAttrs[nl.CTA_IP_V6_DST])
+	}
+	if num := protoAttrs[nl.CTA_PROTO_NUM]; len(num) == 1 {
+		t.proto = num[0]
+	}
+	if port := protoAttrs[nl.CTA_PROTO_SRC_PORT]; len(port) == 2 {
+		t.srcPort = binary.BigEndian.Uint16(port)
+	}
+	if port := protoAttrs[nl.CTA_PROTO_DST_PORT]; len(port) == 2 {
+		t.dstPort = binary.BigEndian.Uint16(port)
+	}
+	return t, nil
+}
+
+var _ = Interface(&netlinkRunner{})
@@ -0,0 +1,67 @@
+// +build linux
+
+package conntrack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/chenchun/kube-bmlb/utils/nlattr"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+func tupleAttr(attrType int, src, dst string, proto uint8, srcPort, dstPort uint16) *nl.RtAttr {
+	srcType, dstType, ip := nl.CTA_IP_V4_SRC, nl.CTA_IP_V4_DST, func(s string) []byte { return net.ParseIP(s).To4() }
+	if net.ParseIP(src).To4() == nil {
+		srcType, dstType, ip = nl.CTA_IP_V6_SRC, nl.CTA_IP_V6_DST, func(s string) []byte { return net.ParseIP(s).To16() }
+	}
+	port := func(p uint16) []byte {
+		b := make([]byte, 2)
+		binary.BigEndian.PutUint16(b, p)
+		return b
+	}
+	t := nl.NewRtAttr(attrType|nl.NLA_F_NESTED, nil)
+	ipAttr := nl.NewRtAttrChild(t, nl.CTA_TUPLE_IP|nl.NLA_F_NESTED, nil)
+	nl.NewRtAttrChild(ipAttr, srcType, ip(src))
+	nl.NewRtAttrChild(ipAttr, dstType, ip(dst))
+	protoAttr := nl.NewRtAttrChild(t, nl.CTA_TUPLE_PROTO|nl.NLA_F_NESTED, nil)
+	nl.NewRtAttrChild(protoAttr, nl.CTA_PROTO_NUM, []byte{proto})
+	nl.NewRtAttrChild(protoAttr, nl.CTA_PROTO_SRC_PORT|nlattr.NetByteOrder, port(srcPort))
+	nl.NewRtAttrChild(protoAttr, nl.CTA_PROTO_DST_PORT|nlattr.NetByteOrder, port(dstPort))
+	return t
+}
+
+func TestParseFlow(t *testing.T) {
+	for _, c := range []struct {
+		vip, client, rs string
+	}{
+		{vip: "10.0.0.2", client: "172.16.0.1", rs: "192.168.0.2"},
+		{vip: "fd00::2", client: "fd01::1", rs: "fd02::2"},
+	} {
+		orig := tupleAttr(nl.CTA_TUPLE_ORIG, c.client, c.vip, unix.IPPROTO_UDP, 40000, 53)
+		reply := tupleAttr(nl.CTA_TUPLE_REPLY, c.rs, c.client, unix.IPPROTO_UDP, 5353, 40000)
+		msg := append((&nl.Nfgenmsg{NfgenFamily: unix.AF_INET}).Serialize(), orig.Serialize()...)
+		msg = append(msg, reply.Serialize()...)
+		flow, origData, err := parseFlow(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if flow.Protocol != ProtocolUDP || !flow.Src.Equal(net.ParseIP(c.client)) || flow.SrcPort != 40000 ||
+			!flow.VIP.Equal(net.ParseIP(c.vip)) || flow.Port != 53 || !flow.RealServer.Equal(net.ParseIP(c.rs)) || flow.RealPort != 5353 {
+			t.Fatalf("%+v", flow)
+		}
+		// the original tuple is sent back to delete the entry
+		if !bytes.Equal(origData, orig.Serialize()[unix.SizeofRtAttr:]) {
+			t.Fatalf("unexpected original tuple %v", origData)
+		}
+		if !(Filter{Protocol: ProtocolUDP, VIP: net.ParseIP(c.vip), Port: 53, RealServer: net.ParseIP(c.rs)}).Match(flow) {
+			t.Fatal("expect match")
+		}
+		if (Filter{Protocol: ProtocolUDP, VIP: net.ParseIP(c.vip), RealServer: net.ParseIP(c.client)}).Match(flow) {
+			t.Fatal("expect not match")
+		}
+	}
+}
@@ -0,0 +1,10 @@
+// +build !linux
+
+package conntrack
+
+import "fmt"
+
+// NewNetlink returns an error since netfilter netlink is only available on linux
+func NewNetlink() (Interface, error) {
+	return nil, fmt.Errorf("conntrack netlink unsupported on this platform")
+}
@@ -0,0 +1,54 @@
+package testing
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/chenchun/kube-bmlb/utils/conntrack"
+)
+
+// FakeConntrack keeps flows in memory
+type FakeConntrack struct {
+	mu    sync.Mutex
+	Flows []conntrack.Flow
+	// Filters are filters of all DeleteFlows calls
+	Filters []conntrack.Filter
+	// Calls is the number of DeleteFlows calls
+	Calls int
+}
+
+// NewFake creates a new fake conntrack interface
+func NewFake(flows ...conntrack.Flow) *FakeConntrack {
+	return &FakeConntrack{Flows: flows}
+}
+
+// DeleteFlows is part of interface
+func (f *FakeConntrack) DeleteFlows(filters ...conntrack.Filter) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, filter := range filters {
+		if filter.VIP == nil {
+			return 0, fmt.Errorf("filter %s has no vip", filter)
+		}
+	}
+	f.Calls++
+	f.Filters = append(f.Filters, filters...)
+	var kept []conntrack.Flow
+	for _, flow := range f.Flows {
+		matched := false
+		for _, filter := range filters {
+			if filter.Match(flow) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			kept = append(kept, flow)
+		}
+	}
+	deleted := len(f.Flows) - len(kept)
+	f.Flows = kept
+	return deleted, nil
+}
+
+var _ = conntrack.Interface(&FakeConntrack{})
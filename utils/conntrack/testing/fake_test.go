@@ -0,0 +1,32 @@
+package testing
+
+import (
+	"net"
+	"testing"
+
+	"github.com/chenchun/kube-bmlb/utils/conntrack"
+)
+
+func TestDeleteFlows(t *testing.T) {
+	vip, rs1, rs2 := net.ParseIP("10.0.0.2"), net.ParseIP("192.168.0.2"), net.ParseIP("192.168.0.3")
+	fake := NewFake(
+		conntrack.Flow{Protocol: conntrack.ProtocolUDP, VIP: vip, Port: 53, RealServer: rs1, RealPort: 53},
+		conntrack.Flow{Protocol: conntrack.ProtocolUDP, VIP: vip, Port: 54, RealServer: rs1, RealPort: 53},
+		conntrack.Flow{Protocol: conntrack.ProtocolUDP, VIP: vip, Port: 53, RealServer: rs2, RealPort: 53},
+	)
+	if _, err := fake.DeleteFlows(conntrack.Filter{Protocol: conntrack.ProtocolUDP}); err == nil {
+		t.Fatal("expect error without vip")
+	}
+	if n, err := fake.DeleteFlows(conntrack.Filter{Protocol: conntrack.ProtocolUDP, VIP: vip, Port: 53, RealServer: rs1}); err != nil || n != 1 {
+		t.Fatal(n, err)
+	}
+	if n, err := fake.DeleteFlows(conntrack.Filter{Protocol: conntrack.ProtocolTCP, VIP: vip}); err != nil || n != 0 {
+		t.Fatal(n, err)
+	}
+	if n, err := fake.DeleteFlows(conntrack.Filter{Protocol: conntrack.ProtocolUDP, VIP: vip}); err != nil || n != 2 {
+		t.Fatal(n, err)
+	}
+	if len(fake.Flows) != 0 || len(fake.Filters) != 3 {
+		t.Fatal(fake.Flows, fake.Filters)
+	}
+}
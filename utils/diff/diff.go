@@ -0,0 +1,156 @@
+// Package diff computes line based unified diffs.
+package diff
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// maxCells bounds the lcs table, changes larger than it are shown as removing and adding all changed lines
+const maxCells = 4 << 20
+
+// edit is an operation on a line, ' ' keeps it, '-' deletes it from a and '+' inserts it from b
+type edit struct {
+	op   byte
+	line string
+}
+
+// Unified returns the unified diff of lines of a and b with context lines around changes, it is empty if
+// they are equal
+func Unified(a, b []byte, aName, bName string, context int) string {
+	edits := lineEdits(splitLines(a), splitLines(b))
+	// aLines[k] and bLines[k] are 1-based line numbers of edits[k] in a and b
+	aLines, bLines := make([]int, len(edits)), make([]int, len(edits))
+	aLine, bLine := 1, 1
+	var changes []int
+	for k, e := range edits {
+		aLines[k], bLines[k] = aLine, bLine
+		if e.op != '+' {
+			aLine++
+		}
+		if e.op != '-' {
+			bLine++
+		}
+		if e.op != ' ' {
+			changes = append(changes, k)
+		}
+	}
+	buf := bytes.NewBuffer(nil)
+	for i := 0; i < len(changes); {
+		// changes closer than 2*context kept lines are in the same hunk
+		j := i
+		for j+1 < len(changes) && changes[j+1]-changes[j]-1 <= 2*context {
+			j++
+		}
+		start, end := changes[i]-context, changes[j]+1+context
+		if start < 0 {
+			start = 0
+		}
+		if end > len(edits) {
+			end = len(edits)
+		}
+		var aCount, bCount int
+		for _, e := range edits[start:end] {
+			if e.op != '+' {
+				aCount++
+			}
+			if e.op != '-' {
+				bCount++
+			}
+		}
+		if buf.Len() == 0 {
+			fmt.Fprintf(buf, "--- %s\n+++ %s\n", aName, bName)
+		}
+		fmt.Fprintf(buf, "@@ -%s +%s @@\n", hunkRange(aLines[start], aCount), hunkRange(bLines[start], bCount))
+		for _, e := range edits[start:end] {
+			fmt.Fprintf(buf, "%c%s\n", e.op, e.line)
+		}
+		i = j + 1
+	}
+	return buf.String()
+}
+
+func hunkRange(start, count int) string {
+	if count == 0 {
+		// an empty range starts at the line before it
+		return fmt.Sprintf("%d,0", start-1)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
+
+func splitLines(data []byte) []string {
+	if len(data) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+// lineEdits returns the edits turning a into b by the longest common subsequence of lines which are not
+// in the common prefix or suffix
+func lineEdits(a, b []string) []edit {
+	var prefix, suffix int
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	var edits []edit
+	for _, line := range a[:prefix] {
+		edits = append(edits, edit{' ', line})
+	}
+	edits = append(edits, lcsEdits(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	for _, line := range a[len(a)-suffix:] {
+		edits = append(edits, edit{' ', line})
+	}
+	return edits
+}
+
+func lcsEdits(a, b []string) []edit {
+	var edits []edit
+	if (len(a)+1)*(len(b)+1) > maxCells {
+		for _, line := range a {
+			edits = append(edits, edit{'-', line})
+		}
+		for _, line := range b {
+			edits = append(edits, edit{'+', line})
+		}
+		return edits
+	}
+	// lengths[i][j] is the lcs length of a[i:] and b[j:]
+	lengths := make([][]int32, len(a)+1)
+	for i := range lengths {
+		lengths[i] = make([]int32, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lengths[i][j] = lengths[i+1][j+1] + 1
+			} else if lengths[i+1][j] >= lengths[i][j+1] {
+				lengths[i][j] = lengths[i+1][j]
+			} else {
+				lengths[i][j] = lengths[i][j+1]
+			}
+		}
+	}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			edits = append(edits, edit{' ', a[i]})
+			i++
+			j++
+		case j == len(b) || i < len(a) && lengths[i+1][j] >= lengths[i][j+1]:
+			edits = append(edits, edit{'-', a[i]})
+			i++
+		default:
+			edits = append(edits, edit{'+', b[j]})
+			j++
+		}
+	}
+	return edits
+}
@@ -0,0 +1,75 @@
+package diff
+
+import "testing"
+
+func TestUnified(t *testing.T) {
+	a := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n"
+	for _, c := range []struct {
+		b, expect string
+	}{
+		{b: a, expect: ""},
+		{b: "1\n2\n3\n4\nfive\n6\n7\n8\n9\n10\n", expect: `--- a
++++ b
+@@ -3,5 +3,5 @@
+ 3
+ 4
+-5
++five
+ 6
+ 7
+`},
+		// changes close to each other are in one hunk
+		{b: "1\n2\nthree\n4\n5\n7\n8\n9\n10\n", expect: `--- a
++++ b
+@@ -1,8 +1,7 @@
+ 1
+ 2
+-3
++three
+ 4
+ 5
+-6
+ 7
+ 8
+`},
+		// changes far from each other are in separate hunks
+		{b: "0\n1\n2\n3\n4\n5\n6\n8\n9\n10\n", expect: `--- a
++++ b
+@@ -1,2 +1,3 @@
++0
+ 1
+ 2
+@@ -5,5 +6,4 @@
+ 5
+ 6
+-7
+ 8
+ 9
+`},
+		{b: "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n", expect: `--- a
++++ b
+@@ -9,2 +9,3 @@
+ 9
+ 10
++11
+`},
+		{b: "", expect: `--- a
++++ b
+@@ -1,10 +0,0 @@
+-1
+-2
+-3
+-4
+-5
+-6
+-7
+-8
+-9
+-10
+`},
+	} {
+		if got := Unified([]byte(a), []byte(c.b), "a", "b", 2); got != c.expect {
+			t.Fatalf("expect %q, got %q", c.expect, got)
+		}
+	}
+}
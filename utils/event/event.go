@@ -0,0 +1,96 @@
+package event
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/reference"
+)
+
+// Component is the source component of events recorded by kube-bmlb
+const Component = "kube-bmlb"
+
+// Recorder records events on behalf of kube-bmlb. It is a tiny subset of client-go's record.EventRecorder
+// so that we don't need to vendor its dependencies.
+type Recorder interface {
+	// Event constructs an event from the given information and puts it in the queue for sending.
+	Event(object runtime.Object, eventtype, reason, message string)
+	// Eventf is just like Event, but with Sprintf for the message field.
+	Eventf(object runtime.Object, eventtype, reason, messageFmt string, args ...interface{})
+}
+
+type recorder struct {
+	client corev1.EventsGetter
+	source v1.EventSource
+}
+
+// NewRecorder returns a Recorder which creates events through the kubernetes client
+func NewRecorder(client corev1.EventsGetter) Recorder {
+	host, err := os.Hostname()
+	if err != nil {
+		glog.Warningf("failed to get hostname: %v", err)
+	}
+	return &recorder{client: client, source: v1.EventSource{Component: Component, Host: host}}
+}
+
+func (r *recorder) Event(object runtime.Object, eventtype, reason, message string) {
+	ref, err := reference.GetReference(scheme.Scheme, object)
+	if err != nil {
+		glog.Warningf("could not construct reference to %#v, will not report event %s %s %s: %v", object, eventtype, reason, message, err)
+		return
+	}
+	now := metav1.NewTime(time.Now())
+	event := &v1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%v.%x", ref.Name, now.UnixNano()),
+			Namespace: ref.Namespace,
+		},
+		InvolvedObject: *ref,
+		Reason:         reason,
+		Message:        message,
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+		Type:           eventtype,
+		Source:         r.source,
+	}
+	// don't block syncing on apiserver
+	go func() {
+		if _, err := r.client.Events(event.Namespace).Create(event); err != nil {
+			glog.Warningf("failed to create event %s %s for %s/%s: %v", reason, message, ref.Namespace, ref.Name, err)
+		}
+	}()
+}
+
+func (r *recorder) Eventf(object runtime.Object, eventtype, reason, messageFmt string, args ...interface{}) {
+	r.Event(object, eventtype, reason, fmt.Sprintf(messageFmt, args...))
+}
+
+// FakeRecorder is used as a fake during tests. It is thread safe.
+type FakeRecorder struct {
+	Events chan string
+}
+
+// NewFakeRecorder creates new fake event recorder with event channel with buffer of given size.
+func NewFakeRecorder(bufferSize int) *FakeRecorder {
+	return &FakeRecorder{Events: make(chan string, bufferSize)}
+}
+
+func (f *FakeRecorder) Event(object runtime.Object, eventtype, reason, message string) {
+	if f.Events != nil {
+		f.Events <- fmt.Sprintf("%s %s %s", eventtype, reason, message)
+	}
+}
+
+func (f *FakeRecorder) Eventf(object runtime.Object, eventtype, reason, messageFmt string, args ...interface{}) {
+	f.Event(object, eventtype, reason, fmt.Sprintf(messageFmt, args...))
+}
+
+var _ = Recorder(&FakeRecorder{})
@@ -56,11 +56,32 @@ type Interface interface {
 	DelEntryWithOptions(set, entry string, options ...string) error
 
 	SaveAllSets() ([]byte, error)
+
+	// Restore runs an `ipset restore` script, e.g. built by RestoreScript, in a single exec.
+	Restore(script []byte) error
 }
 
 // IPSetCmd represents the ipset util.  We use ipset command for ipset execute.
 const IPSetCmd = "ipset"
 
+const (
+	// BackendExec runs the ipset command
+	BackendExec = "exec"
+	// BackendNetlink talks to kernel via netfilter netlink, the ipset command is not required
+	BackendNetlink = "netlink"
+)
+
+// NewBackend returns an Interface implemented by backend, exec is only used by BackendExec
+func NewBackend(backend string, exec utilexec.Interface) (Interface, error) {
+	switch backend {
+	case BackendExec, "":
+		return New(exec), nil
+	case BackendNetlink:
+		return NewNetlink()
+	}
+	return nil, fmt.Errorf("unknown ipset backend %s, supported backends are [%s, %s]", backend, BackendExec, BackendNetlink)
+}
+
 // EntryMemberPattern is the regular expression pattern of ipset member list.
 // The raw output of ipset command `ipset list {set}` is similar to,
 //Name: foobar
@@ -256,6 +277,72 @@ func (e *Entry) Validate(set *IPSet) bool {
 	return true
 }
 
+// ParseEntry parses entry of a set of setType. entry is in the format of Entry.String() which is what
+// `ipset add` accepts, options following the entry such as `timeout 10` are returned in Options.
+func ParseEntry(entry string, setType Type) (*Entry, error) {
+	fields := strings.Fields(entry)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty entry")
+	}
+	e := &Entry{SetType: setType}
+	if len(fields) > 1 {
+		e.Options = fields[1:]
+	}
+	parts := strings.Split(fields[0], ",")
+	expect := 1
+	switch setType {
+	case HashIPPort, HashNetPort:
+		expect = 2
+	case HashIPPortIP, HashIPPortNet:
+		expect = 3
+	}
+	if len(parts) != expect {
+		return nil, fmt.Errorf("entry %s of %s should have %d parts separated by comma", fields[0], setType, expect)
+	}
+	var err error
+	switch setType {
+	case HashIP:
+		e.IP = parts[0]
+	case HashIPPort, HashIPPortIP, HashIPPortNet:
+		e.IP = parts[0]
+		if e.Protocol, e.Port, err = parseProtocolPort(parts[1]); err != nil {
+			return nil, err
+		}
+		if setType == HashIPPortIP {
+			e.IP2 = parts[2]
+		} else if setType == HashIPPortNet {
+			e.Net = parts[2]
+		}
+	case HashNet:
+		e.Net = parts[0]
+	case HashNetPort:
+		e.Net = parts[0]
+		if e.Protocol, e.Port, err = parseProtocolPort(parts[1]); err != nil {
+			return nil, err
+		}
+	case BitmapPort:
+		if e.Port, err = strconv.Atoi(parts[0]); err != nil {
+			return nil, fmt.Errorf("invalid port %s: %v", parts[0], err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported set type %s", setType)
+	}
+	return e, nil
+}
+
+// parseProtocolPort parses `proto:port` or `port` whose protocol defaults to tcp
+func parseProtocolPort(str string) (string, int, error) {
+	protocol := ProtocolTCP
+	if i := strings.LastIndex(str, ":"); i >= 0 {
+		protocol, str = str[:i], str[i+1:]
+	}
+	port, err := strconv.Atoi(str)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid port %s: %v", str, err)
+	}
+	return protocol, port, nil
+}
+
 // String returns the string format for ipset entry.
 func (e *Entry) String() string {
 	switch e.SetType {
@@ -301,7 +388,14 @@ func New(exec utilexec.Interface) Interface {
 
 // CreateSet creates a new set,  it will ignore error when the set already exists if ignoreExistErr=true.
 func (runner *runner) CreateSet(set *IPSet, ignoreExistErr bool) error {
-	// Setting default values if not present
+	if err := setDefaults(set); err != nil {
+		return err
+	}
+	return runner.createSet(set, ignoreExistErr)
+}
+
+// setDefaults sets default values of set if not present and validates it
+func setDefaults(set *IPSet) error {
 	if set.HashSize == 0 {
 		set.HashSize = 1024
 	}
@@ -325,14 +419,27 @@ func (runner *runner) CreateSet(set *IPSet, ignoreExistErr bool) error {
 	if !valid {
 		return fmt.Errorf("error creating ipset since it's invalid")
 	}
-	return runner.createSet(set, ignoreExistErr)
+	return nil
 }
 
 // If ignoreExistErr is set to true, then the -exist option of ipset will be specified, ipset ignores the error
 // otherwise raised when the same set (setname and create parameters are identical) already exists.
 func (runner *runner) createSet(set *IPSet, ignoreExistErr bool) error {
-	args := []string{"create", set.Name, string(set.SetType)}
-	if set.SetType == HashIPPortIP || set.SetType == HashIPPort {
+	args := createArgs(set.Name, set)
+	if ignoreExistErr {
+		args = append(args, "-exist")
+	}
+	glog.V(5).Infof("running ipset %v", args)
+	if _, err := runner.exec.Command(IPSetCmd, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("error creating ipset %s, error: %v", set.Name, err)
+	}
+	return nil
+}
+
+// createArgs returns arguments of creating a set named name with the type and options of set
+func createArgs(name string, set *IPSet) []string {
+	args := []string{"create", name, string(set.SetType)}
+	if set.SetType != BitmapPort {
 		args = append(args,
 			"family", set.HashFamily,
 			"hashsize", strconv.Itoa(set.HashSize),
@@ -342,14 +449,7 @@ func (runner *runner) createSet(set *IPSet, ignoreExistErr bool) error {
 	if set.SetType == BitmapPort {
 		args = append(args, "range", set.PortRange)
 	}
-	if ignoreExistErr {
-		args = append(args, "-exist")
-	}
-	glog.V(5).Infof("running ipset %v", args)
-	if _, err := runner.exec.Command(IPSetCmd, args...).CombinedOutput(); err != nil {
-		return fmt.Errorf("error creating ipset %s, error: %v", set.Name, err)
-	}
-	return nil
+	return args
 }
 
 // AddEntry adds a new entry to the named set.
@@ -390,7 +490,7 @@ func (runner *runner) DelEntry(entry string, set string) error {
 
 func (runner *runner) DelEntryWithOptions(set, entry string, options ...string) error {
 	// ipset del should not add options
-	glog.V(5).Infof("running ipset %v", append([]string{"del", set, entry}))
+	glog.V(5).Infof("running ipset %v", []string{"del", set, entry})
 	if _, err := runner.exec.Command(IPSetCmd, "del", set, entry).CombinedOutput(); err != nil {
 		return fmt.Errorf("error deleting entry %s: from set: %s, error: %v", entry, set, err)
 	}
@@ -553,10 +653,10 @@ func IsNotFoundError(err error) bool {
 
 // checks if given protocol is supported in entry
 func validateProtocol(protocol string) bool {
-	if protocol == ProtocolTCP || protocol == ProtocolUDP {
+	if protocol == ProtocolTCP || protocol == ProtocolUDP || protocol == ProtocolSCTP {
 		return true
 	}
-	glog.Errorf("Invalid entry's protocol: %s, supported protocols are [%s, %s]", protocol, ProtocolTCP, ProtocolUDP)
+	glog.Errorf("Invalid entry's protocol: %s, supported protocols are [%s, %s, %s]", protocol, ProtocolTCP, ProtocolUDP, ProtocolSCTP)
 	return false
 }
 
@@ -605,4 +705,157 @@ func (runner *runner) SaveAllSets() ([]byte, error) {
 	return out, nil
 }
 
+// Restore runs `ipset restore` with script as stdin
+func (runner *runner) Restore(script []byte) error {
+	glog.V(5).Infof("running ipset restore with\n%s", string(script))
+	cmd := runner.exec.Command(IPSetCmd, "restore")
+	cmd.SetStdin(bytes.NewReader(script))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("error restoring ipset: %v (%s)", err, out)
+	}
+	return nil
+}
+
+// maxSetNameLength is the max length of ipset names
+const maxSetNameLength = 31
+
+// RestoreScript builds `ipset restore` scripts so that syncing sets takes one exec instead of one per entry
+type RestoreScript struct {
+	buf bytes.Buffer
+	err error
+}
+
+// Add adds entries to set without removing existing ones, set is created if not exists
+func (s *RestoreScript) Add(set *IPSet, entries []string) {
+	if err := setDefaults(set); err != nil {
+		s.err = fmt.Errorf("invalid set %s: %v", set.Name, err)
+		return
+	}
+	s.writeLine(append(createArgs(set.Name, set), "-exist")...)
+	for _, entry := range entries {
+		s.writeLine("add", set.Name, entry, "-exist")
+	}
+}
+
+// Replace replaces entries of set atomically. Entries are added to a temporary set which is swapped
+// with set afterwards, so that set is never seen partially synced.
+func (s *RestoreScript) Replace(set *IPSet, entries []string) {
+	if err := setDefaults(set); err != nil {
+		s.err = fmt.Errorf("invalid set %s: %v", set.Name, err)
+		return
+	}
+	tmp := TempSetName(set.Name)
+	s.writeLine(append(createArgs(set.Name, set), "-exist")...)
+	s.writeLine(append(createArgs(tmp, set), "-exist")...)
+	s.writeLine("flush", tmp)
+	for _, entry := range entries {
+		s.writeLine("add", tmp, entry, "-exist")
+	}
+	s.writeLine("swap", tmp, set.Name)
+	s.writeLine("destroy", tmp)
+}
+
+// Bytes returns the script or an error if any set is invalid
+func (s *RestoreScript) Bytes() ([]byte, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.buf.Bytes(), nil
+}
+
+func (s *RestoreScript) writeLine(args ...string) {
+	s.buf.WriteString(strings.Join(args, " "))
+	s.buf.WriteByte('\n')
+}
+
+// RestoreCommand is a command of an `ipset restore` script
+type RestoreCommand struct {
+	// Line is the line number in the script starting from 1
+	Line int
+	// Command is one of create, add, del, flush, swap and destroy
+	Command string
+	// Set is the name of the set the command operates on
+	Set string
+	// Args are arguments following the set name, e.g. the type and options of create, the entry of add
+	// and del, the other set of swap
+	Args []string
+	// Exist is true if the command has the -exist option
+	Exist bool
+}
+
+// ParseRestoreScript parses an `ipset restore` script into commands, empty lines and comments are skipped
+func ParseRestoreScript(script []byte) ([]RestoreCommand, error) {
+	var cmds []RestoreCommand
+	for i, line := range strings.Split(string(script), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		cmd := RestoreCommand{Line: i + 1, Command: fields[0]}
+		for _, field := range fields[1:] {
+			if field == "-exist" {
+				cmd.Exist = true
+			} else if cmd.Set == "" {
+				cmd.Set = field
+			} else {
+				cmd.Args = append(cmd.Args, field)
+			}
+		}
+		min := 0
+		switch cmd.Command {
+		case "create", "add", "del", "swap":
+			min = 1
+		case "flush", "destroy":
+		default:
+			return nil, fmt.Errorf("unknown command %s at line %d", cmd.Command, cmd.Line)
+		}
+		if cmd.Set == "" || len(cmd.Args) < min {
+			return nil, fmt.Errorf("missing arguments of %s at line %d", cmd.Command, cmd.Line)
+		}
+		cmds = append(cmds, cmd)
+	}
+	return cmds, nil
+}
+
+// ParseCreateArgs parses arguments of `ipset create` following the set name, i.e. the type and options
+func ParseCreateArgs(name string, args []string) (*IPSet, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("missing type of set %s", name)
+	}
+	set := &IPSet{Name: name, SetType: Type(args[0])}
+	opts := args[1:]
+	if len(opts)%2 != 0 {
+		return nil, fmt.Errorf("option %s of set %s has no value", opts[len(opts)-1], name)
+	}
+	for i := 0; i < len(opts); i += 2 {
+		key, value := opts[i], opts[i+1]
+		var err error
+		switch key {
+		case "family":
+			set.HashFamily = value
+		case "hashsize":
+			set.HashSize, err = strconv.Atoi(value)
+		case "maxelem":
+			set.MaxElem, err = strconv.Atoi(value)
+		case "range":
+			set.PortRange = value
+		default:
+			return nil, fmt.Errorf("unsupported option %s of set %s", key, name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %s of set %s: %v", key, value, name, err)
+		}
+	}
+	return set, nil
+}
+
+// TempSetName returns the name of the temporary set used to replace set atomically
+func TempSetName(set string) string {
+	const suffix = "-tmp"
+	if len(set)+len(suffix) > maxSetNameLength {
+		set = set[:maxSetNameLength-len(suffix)]
+	}
+	return set + suffix
+}
+
 var _ = Interface(&runner{})
@@ -0,0 +1,819 @@
+// +build linux
+
+package ipset
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/chenchun/kube-bmlb/utils/nlattr"
+	"github.com/golang/glog"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// ipset netlink protocol, see include/uapi/linux/netfilter/ipset/ip_set.h of linux
+const (
+	nfnlSubsysIPSet = 6
+	// ipsetProtocol is the minimum protocol version kernel accepts, all kernels supporting ipset talk it
+	ipsetProtocol = 6
+
+	cmdProtocol = 1
+	cmdCreate   = 2
+	cmdDestroy  = 3
+	cmdFlush    = 4
+	cmdSwap     = 6
+	cmdList     = 7
+	cmdAdd      = 9
+	cmdDel      = 10
+	cmdTest     = 11
+	cmdHeader   = 12
+	cmdType     = 13
+
+	attrProtocol = 1
+	attrSetName  = 2
+	attrTypeName = 3
+	attrSetName2 = attrTypeName
+	attrRevision = 4
+	attrFamily   = 5
+	attrFlags    = 6
+	attrData     = 7
+	attrADT      = 8
+	attrLineNo   = 9
+
+	attrIP       = 1
+	attrCIDR     = 3
+	attrPort     = 4
+	attrPortTo   = 5
+	attrTimeout  = 6
+	attrProto    = 7
+	attrHashSize = 18
+	attrMaxElem  = 19
+	attrIP2      = 20
+	attrCIDR2    = 21
+
+	attrIPAddrIPv4 = 1
+	attrIPAddrIPv6 = 2
+
+	flagListSetName = 1 << 1
+
+	nfprotoUnspec = 0
+	nfprotoIPv4   = 2
+	nfprotoIPv6   = 10
+)
+
+// ipset specific errnos, see include/uapi/linux/netfilter/ipset/ip_set.h of linux
+const (
+	errProtocol      = 4097
+	errFindType      = 4098
+	errMaxSets       = 4099
+	errBusy          = 4100
+	errExistSetName2 = 4101
+	errTypeMismatch  = 4102
+	errExist         = 4103
+	errInvalidCIDR   = 4104
+	errInvalidFamily = 4106
+	errTimeout       = 4107
+	errReferenced    = 4108
+	errHashFull      = 4352
+)
+
+var protocolNumbers = map[string]uint8{"icmp": 1, ProtocolTCP: 6, ProtocolUDP: 17, "icmpv6": 58, ProtocolSCTP: 132, "udplite": 136}
+
+type netlinkRunner struct {
+	// mu protects types
+	mu sync.Mutex
+	// types caches types of sets to encode entries of DelEntry and TestEntry which only know set names
+	types map[string]Type
+}
+
+// NewNetlink returns a new Interface which talks to kernel via netfilter netlink instead of exec ipset.
+// It fails if kernel doesn't support ipset or the process is not privileged.
+func NewNetlink() (Interface, error) {
+	r := &netlinkRunner{types: map[string]Type{}}
+	if _, err := r.GetVersion(); err != nil {
+		return nil, fmt.Errorf("ipset netlink unavailable: %v", err)
+	}
+	return r, nil
+}
+
+// netlinkError is an error replied by kernel
+type netlinkError struct {
+	cmd   int
+	errno syscall.Errno
+}
+
+// Error returns messages similar to the ipset command, IsNotFoundError depends on them
+func (e *netlinkError) Error() string {
+	switch e.errno {
+	case syscall.ENOENT:
+		return "The set with the given name does not exist"
+	case errExist:
+		switch e.cmd {
+		case cmdCreate:
+			return "Set cannot be created: set with the same name already exists"
+		case cmdAdd:
+			return "Element cannot be added to the set: it's already added"
+		case cmdDel:
+			return "Element cannot be deleted from the set: element is missing"
+		}
+	case errProtocol:
+		return "Kernel error received: ipset protocol error"
+	case errFindType:
+		return "Kernel error received: set type not supported"
+	case errMaxSets:
+		return "Kernel error received: maximal number of sets reached"
+	case errBusy:
+		return "Set cannot be swapped or renamed: it is in use by a kernel component"
+	case errExistSetName2:
+		return "Set cannot be swapped: the second set does not exist"
+	case errTypeMismatch:
+		return "The sets cannot be swapped: their type does not match"
+	case errInvalidCIDR:
+		return "The value of the CIDR parameter of the IP address is invalid"
+	case errInvalidFamily:
+		return "Protocol family not supported by the set type"
+	case errTimeout:
+		return "Timeout cannot be used: set was created without timeout support"
+	case errReferenced:
+		return "Set cannot be destroyed: it is in use by a kernel component"
+	case errHashFull:
+		return "Hash is full, cannot add more elements"
+	}
+	if e.errno > 4096 {
+		return fmt.Sprintf("Kernel error received: ipset errno %d", int(e.errno))
+	}
+	return e.errno.Error()
+}
+
+func newRequest(cmd, flags int) *nl.NetlinkRequest {
+	req := nl.NewNetlinkRequest(nfnlSubsysIPSet<<8|cmd, flags|unix.NLM_F_ACK)
+	req.AddData(&nl.Nfgenmsg{NfgenFamily: unix.AF_INET, Version: nl.NFNETLINK_V0})
+	req.AddData(nl.NewRtAttr(attrProtocol, nl.Uint8Attr(ipsetProtocol)))
+	return req
+}
+
+func execute(cmd int, req *nl.NetlinkRequest) ([][]byte, error) {
+	msgs, err := req.Execute(unix.NETLINK_NETFILTER, 0)
+	if errno, ok := err.(syscall.Errno); ok {
+		return nil, &netlinkError{cmd: cmd, errno: errno}
+	}
+	return msgs, err
+}
+
+// existFlags returns the flags of a request which fails if the set or entry exists
+func existFlags(ignoreExistErr bool) int {
+	if ignoreExistErr {
+		return 0
+	}
+	return unix.NLM_F_EXCL
+}
+
+func setNameAttr(set string) *nl.RtAttr {
+	return nl.NewRtAttr(attrSetName, nl.ZeroTerminated(set))
+}
+
+func netOrderAttr(attrType int, data []byte) *nl.RtAttr {
+	return nl.NewRtAttr(attrType|nlattr.NetByteOrder, data)
+}
+
+func be16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return b
+}
+
+func be32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func familyOf(set *IPSet) uint8 {
+	if set.SetType == BitmapPort {
+		return nfprotoUnspec
+	}
+	if set.HashFamily == ProtocolFamilyIPV6 {
+		return nfprotoIPv6
+	}
+	return nfprotoIPv4
+}
+
+// GetVersion returns the ipset netlink protocol version of kernel, e.g. "v7.0"
+func (r *netlinkRunner) GetVersion() (string, error) {
+	msgs, err := execute(cmdProtocol, newRequest(cmdProtocol, 0))
+	if err != nil {
+		return "", err
+	}
+	for _, msg := range msgs {
+		attrs, err := parseMessage(msg)
+		if err != nil {
+			return "", err
+		}
+		if v := attrs.Get(attrProtocol); len(v) == 1 {
+			return fmt.Sprintf("v%d.0", v[0]), nil
+		}
+	}
+	return "", fmt.Errorf("no protocol version in reply")
+}
+
+// CreateSet creates a new set, it will ignore error when the set already exists if ignoreExistErr=true.
+func (r *netlinkRunner) CreateSet(set *IPSet, ignoreExistErr bool) error {
+	if err := setDefaults(set); err != nil {
+		return err
+	}
+	if err := r.createSet(set.Name, set, ignoreExistErr); err != nil {
+		return fmt.Errorf("error creating ipset %s, error: %v", set.Name, err)
+	}
+	return nil
+}
+
+func (r *netlinkRunner) createSet(name string, set *IPSet, ignoreExistErr bool) error {
+	family := familyOf(set)
+	revision, err := r.revision(set.SetType, family)
+	if err != nil {
+		return err
+	}
+	req := newRequest(cmdCreate, existFlags(ignoreExistErr))
+	req.AddData(setNameAttr(name))
+	req.AddData(nl.NewRtAttr(attrTypeName, nl.ZeroTerminated(string(set.SetType))))
+	req.AddData(nl.NewRtAttr(attrRevision, nl.Uint8Attr(revision)))
+	req.AddData(nl.NewRtAttr(attrFamily, nl.Uint8Attr(family)))
+	data := nl.NewRtAttr(attrData|nl.NLA_F_NESTED, nil)
+	if set.SetType == BitmapPort {
+		begin, end, err := parsePortRange(set.PortRange)
+		if err != nil {
+			return err
+		}
+		nl.NewRtAttrChild(data, attrPort|nlattr.NetByteOrder, be16(uint16(begin)))
+		nl.NewRtAttrChild(data, attrPortTo|nlattr.NetByteOrder, be16(uint16(end)))
+	} else {
+		nl.NewRtAttrChild(data, attrHashSize|nlattr.NetByteOrder, be32(uint32(set.HashSize)))
+		nl.NewRtAttrChild(data, attrMaxElem|nlattr.NetByteOrder, be32(uint32(set.MaxElem)))
+	}
+	req.AddData(data)
+	if _, err := execute(cmdCreate, req); err != nil {
+		return err
+	}
+	r.setType(name, set.SetType)
+	return nil
+}
+
+// revision returns the max revision of setType kernel supports
+func (r *netlinkRunner) revision(setType Type, family uint8) (uint8, error) {
+	req := newRequest(cmdType, 0)
+	req.AddData(nl.NewRtAttr(attrTypeName, nl.ZeroTerminated(string(setType))))
+	req.AddData(nl.NewRtAttr(attrFamily, nl.Uint8Attr(family)))
+	msgs, err := execute(cmdType, req)
+	if err != nil {
+		return 0, err
+	}
+	for _, msg := range msgs {
+		attrs, err := parseMessage(msg)
+		if err != nil {
+			return 0, err
+		}
+		if v := attrs.Get(attrRevision); len(v) == 1 {
+			return v[0], nil
+		}
+	}
+	return 0, fmt.Errorf("no revision of %s in reply", setType)
+}
+
+func (r *netlinkRunner) setType(name string, setType Type) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if setType == "" {
+		delete(r.types, name)
+	} else {
+		r.types[name] = setType
+	}
+}
+
+// typeOf returns the type of the named set, it asks kernel if the type is unknown
+func (r *netlinkRunner) typeOf(name string) (Type, error) {
+	r.mu.Lock()
+	setType, ok := r.types[name]
+	r.mu.Unlock()
+	if ok {
+		return setType, nil
+	}
+	req := newRequest(cmdHeader, 0)
+	req.AddData(setNameAttr(name))
+	msgs, err := execute(cmdHeader, req)
+	if err != nil {
+		return "", err
+	}
+	for _, msg := range msgs {
+		attrs, err := parseMessage(msg)
+		if err != nil {
+			return "", err
+		}
+		if v := attrs.Get(attrTypeName); v != nil {
+			setType = Type(nl.BytesToString(v))
+			r.setType(name, setType)
+			return setType, nil
+		}
+	}
+	return "", fmt.Errorf("no type of set %s in reply", name)
+}
+
+// AddEntry adds a new entry to the named set, it will ignore error when the entry already exists if
+// ignoreExistErr=true.
+func (r *netlinkRunner) AddEntry(entry string, set *IPSet, ignoreExistErr bool) error {
+	if err := r.adt(cmdAdd, set.Name, set.SetType, entry, existFlags(ignoreExistErr)); err != nil {
+		return fmt.Errorf("error adding entry %s, error: %v", entry, err)
+	}
+	return nil
+}
+
+func (r *netlinkRunner) AddEntryWithOptions(entry *Entry, set *IPSet, ignoreExistErr bool) error {
+	e := *entry
+	if e.SetType == "" {
+		e.SetType = set.SetType
+	}
+	if err := r.adtEntry(cmdAdd, set.Name, &e, existFlags(ignoreExistErr)); err != nil {
+		return fmt.Errorf("error adding entry %s, error: %v", entry, err)
+	}
+	return nil
+}
+
+// DelEntry is used to delete the specified entry from the set.
+func (r *netlinkRunner) DelEntry(entry string, set string) error {
+	if err := r.adt(cmdDel, set, "", entry, existFlags(false)); err != nil {
+		return fmt.Errorf("error deleting entry %s: from set: %s, error: %v", entry, set, err)
+	}
+	return nil
+}
+
+func (r *netlinkRunner) DelEntryWithOptions(set, entry string, options ...string) error {
+	// ipset del should not add options
+	return r.DelEntry(entry, set)
+}
+
+// TestEntry is used to check whether the specified entry is in the set or not.
+func (r *netlinkRunner) TestEntry(entry string, set string) (bool, error) {
+	err := r.adt(cmdTest, set, "", entry, 0)
+	if err == nil {
+		return true, nil
+	}
+	if nlErr, ok := err.(*netlinkError); ok && nlErr.errno == errExist {
+		return false, nil
+	}
+	return false, fmt.Errorf("error testing entry %s: %v", entry, err)
+}
+
+// adt adds, deletes or tests entry of the named set, its type is looked up if setType is empty
+func (r *netlinkRunner) adt(cmd int, set string, setType Type, entry string, flags int) error {
+	if setType == "" {
+		var err error
+		if setType, err = r.typeOf(set); err != nil {
+			return err
+		}
+	}
+	e, err := ParseEntry(entry, setType)
+	if err != nil {
+		return err
+	}
+	return r.adtEntry(cmd, set, e, flags)
+}
+
+func (r *netlinkRunner) adtEntry(cmd int, set string, e *Entry, flags int) error {
+	data, err := entryAttr(e)
+	if err != nil {
+		return err
+	}
+	req := newRequest(cmd, flags)
+	req.AddData(setNameAttr(set))
+	req.AddData(data)
+	_, err = execute(cmd, req)
+	return err
+}
+
+// FlushSet deletes all entries from a named set.
+func (r *netlinkRunner) FlushSet(set string) error {
+	req := newRequest(cmdFlush, 0)
+	req.AddData(setNameAttr(set))
+	if _, err := execute(cmdFlush, req); err != nil {
+		return fmt.Errorf("error flushing set: %s, error: %v", set, err)
+	}
+	return nil
+}
+
+// DestroySet is used to destroy a named set.
+func (r *netlinkRunner) DestroySet(set string) error {
+	req := newRequest(cmdDestroy, 0)
+	req.AddData(setNameAttr(set))
+	if _, err := execute(cmdDestroy, req); err != nil {
+		return fmt.Errorf("error destroying set %s, error: %v", set, err)
+	}
+	r.setType(set, "")
+	return nil
+}
+
+// DestroyAllSets is used to destroy all sets.
+func (r *netlinkRunner) DestroyAllSets() error {
+	if _, err := execute(cmdDestroy, newRequest(cmdDestroy, 0)); err != nil {
+		return fmt.Errorf("error destroying all sets, error: %v", err)
+	}
+	r.mu.Lock()
+	r.types = map[string]Type{}
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *netlinkRunner) swapSets(from, to string) error {
+	req := newRequest(cmdSwap, 0)
+	req.AddData(setNameAttr(from))
+	req.AddData(nl.NewRtAttr(attrSetName2, nl.ZeroTerminated(to)))
+	if _, err := execute(cmdSwap, req); err != nil {
+		return err
+	}
+	// swapped sets may have different but compatible types
+	r.setType(from, "")
+	r.setType(to, "")
+	return nil
+}
+
+// ListSets list all set names from kernel
+func (r *netlinkRunner) ListSets() ([]string, error) {
+	req := newRequest(cmdList, unix.NLM_F_DUMP)
+	req.AddData(netOrderAttr(attrFlags, be32(flagListSetName)))
+	msgs, err := execute(cmdList, req)
+	if err != nil {
+		return nil, fmt.Errorf("error listing all sets, error: %v", err)
+	}
+	var names []string
+	for _, msg := range msgs {
+		attrs, err := parseMessage(msg)
+		if err != nil {
+			return nil, err
+		}
+		if v := attrs.Get(attrSetName); v != nil {
+			names = append(names, nl.BytesToString(v))
+		}
+	}
+	return names, nil
+}
+
+// listedSet is a set dumped by kernel
+type listedSet struct {
+	name    string
+	setType Type
+	entries []string
+}
+
+// list dumps the named set or all sets if set is empty
+func (r *netlinkRunner) list(set string) ([]*listedSet, error) {
+	req := newRequest(cmdList, unix.NLM_F_DUMP)
+	if set != "" {
+		req.AddData(setNameAttr(set))
+	}
+	msgs, err := execute(cmdList, req)
+	if err != nil {
+		return nil, err
+	}
+	var sets []*listedSet
+	byName := map[string]*listedSet{}
+	for _, msg := range msgs {
+		attrs, err := parseMessage(msg)
+		if err != nil {
+			return nil, err
+		}
+		name := nl.BytesToString(attrs.Get(attrSetName))
+		// a large set is dumped in several messages, only the first one has the header
+		s := byName[name]
+		if s == nil {
+			s = &listedSet{name: name}
+			byName[name] = s
+			sets = append(sets, s)
+		}
+		if v := attrs.Get(attrTypeName); v != nil {
+			s.setType = Type(nl.BytesToString(v))
+		}
+		adt := attrs.Get(attrADT)
+		if adt == nil {
+			continue
+		}
+		elems, err := nlattr.Parse(adt)
+		if err != nil {
+			return nil, err
+		}
+		for _, elem := range elems {
+			if elem.Type != attrData {
+				continue
+			}
+			entry, err := decodeEntry(elem.Data, s.setType)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode entry of set %s: %v", name, err)
+			}
+			s.entries = append(s.entries, entry)
+		}
+	}
+	return sets, nil
+}
+
+// ListEntries lists all the entries from a named set.
+func (r *netlinkRunner) ListEntries(set string) ([]string, error) {
+	if len(set) == 0 {
+		return nil, fmt.Errorf("set name can't be nil")
+	}
+	sets, err := r.list(set)
+	if err != nil {
+		return nil, fmt.Errorf("error listing set: %s, error: %v", set, err)
+	}
+	results := make([]string, 0)
+	for _, s := range sets {
+		results = append(results, s.entries...)
+	}
+	return results, nil
+}
+
+// SaveAllSets lists all sets in the format of `ipset list` with name, type and members only
+func (r *netlinkRunner) SaveAllSets() ([]byte, error) {
+	sets, err := r.list("")
+	if err != nil {
+		return nil, fmt.Errorf("error saving all sets, error: %v", err)
+	}
+	buf := bytes.NewBuffer(nil)
+	for i, s := range sets {
+		if i > 0 {
+			buf.WriteString("\n")
+		}
+		fmt.Fprintf(buf, "Name: %s\nType: %s\nMembers:\n", s.name, s.setType)
+		for _, entry := range s.entries {
+			buf.WriteString(entry + "\n")
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// Restore runs the commands of an `ipset restore` script one by one and stops at the first failing one
+func (r *netlinkRunner) Restore(script []byte) error {
+	glog.V(5).Infof("restoring ipset via netlink with\n%s", string(script))
+	cmds, err := ParseRestoreScript(script)
+	if err != nil {
+		return fmt.Errorf("error restoring ipset: %v", err)
+	}
+	for _, cmd := range cmds {
+		if err := r.restore(cmd); err != nil {
+			return fmt.Errorf("error restoring ipset at line %d %s %s: %v", cmd.Line, cmd.Command, cmd.Set, err)
+		}
+	}
+	return nil
+}
+
+func (r *netlinkRunner) restore(cmd RestoreCommand) error {
+	switch cmd.Command {
+	case "create":
+		set, err := ParseCreateArgs(cmd.Set, cmd.Args)
+		if err != nil {
+			return err
+		}
+		if err := setDefaults(set); err != nil {
+			return err
+		}
+		return r.createSet(set.Name, set, cmd.Exist)
+	case "add":
+		return r.adt(cmdAdd, cmd.Set, "", strings.Join(cmd.Args, " "), existFlags(cmd.Exist))
+	case "del":
+		return r.adt(cmdDel, cmd.Set, "", strings.Join(cmd.Args, " "), existFlags(cmd.Exist))
+	case "flush":
+		return r.FlushSet(cmd.Set)
+	case "destroy":
+		return r.DestroySet(cmd.Set)
+	case "swap":
+		return r.swapSets(cmd.Set, cmd.Args[0])
+	}
+	return fmt.Errorf("unknown command %s", cmd.Command)
+}
+
+// entryAttr encodes e as the data attribute of add, del and test requests
+func entryAttr(e *Entry) (*nl.RtAttr, error) {
+	data := nl.NewRtAttr(attrData|nl.NLA_F_NESTED, nil)
+	var err error
+	switch e.SetType {
+	case HashIP:
+		err = addIPAttr(data, attrIP, e.IP)
+	case HashIPPort, HashIPPortIP, HashIPPortNet:
+		if err = addIPAttr(data, attrIP, e.IP); err != nil {
+			break
+		}
+		if err = addProtocolPortAttrs(data, e.Protocol, e.Port); err != nil {
+			break
+		}
+		if e.SetType == HashIPPortIP {
+			err = addIPAttr(data, attrIP2, e.IP2)
+		} else if e.SetType == HashIPPortNet {
+			err = addNetAttrs(data, attrIP2, attrCIDR2, e.Net)
+		}
+	case HashNet:
+		err = addNetAttrs(data, attrIP, attrCIDR, e.Net)
+	case HashNetPort:
+		if err = addNetAttrs(data, attrIP, attrCIDR, e.Net); err != nil {
+			break
+		}
+		err = addProtocolPortAttrs(data, e.Protocol, e.Port)
+	case BitmapPort:
+		if e.Port < 0 || e.Port > 65535 {
+			return nil, fmt.Errorf("invalid port %d", e.Port)
+		}
+		nl.NewRtAttrChild(data, attrPort|nlattr.NetByteOrder, be16(uint16(e.Port)))
+	default:
+		return nil, fmt.Errorf("unsupported set type %s", e.SetType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	opts := e.Options
+	for len(opts) > 0 {
+		if opts[0] != "timeout" || len(opts) < 2 {
+			return nil, fmt.Errorf("unsupported option %s", strings.Join(opts, " "))
+		}
+		timeout, err := strconv.ParseUint(opts[1], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeout %s: %v", opts[1], err)
+		}
+		nl.NewRtAttrChild(data, attrTimeout|nlattr.NetByteOrder, be32(uint32(timeout)))
+		opts = opts[2:]
+	}
+	return data, nil
+}
+
+func addIPAttr(data *nl.RtAttr, attrType int, str string) error {
+	ip := net.ParseIP(str)
+	if ip == nil {
+		return fmt.Errorf("invalid ip %q", str)
+	}
+	attr := nl.NewRtAttrChild(data, attrType|nl.NLA_F_NESTED, nil)
+	if ip4 := ip.To4(); ip4 != nil {
+		nl.NewRtAttrChild(attr, attrIPAddrIPv4|nlattr.NetByteOrder, []byte(ip4))
+	} else {
+		nl.NewRtAttrChild(attr, attrIPAddrIPv6|nlattr.NetByteOrder, []byte(ip.To16()))
+	}
+	return nil
+}
+
+// addNetAttrs encodes a network address whose prefix defaults to a host one
+func addNetAttrs(data *nl.RtAttr, ipType, cidrType int, str string) error {
+	if !strings.Contains(str, "/") {
+		if err := addIPAttr(data, ipType, str); err != nil {
+			return err
+		}
+		bits := 32
+		if net.ParseIP(str).To4() == nil {
+			bits = 128
+		}
+		nl.NewRtAttrChild(data, cidrType, nl.Uint8Attr(uint8(bits)))
+		return nil
+	}
+	_, ipNet, err := net.ParseCIDR(str)
+	if err != nil {
+		return err
+	}
+	if err := addIPAttr(data, ipType, ipNet.IP.String()); err != nil {
+		return err
+	}
+	ones, _ := ipNet.Mask.Size()
+	nl.NewRtAttrChild(data, cidrType, nl.Uint8Attr(uint8(ones)))
+	return nil
+}
+
+func addProtocolPortAttrs(data *nl.RtAttr, protocol string, port int) error {
+	if protocol == "" {
+		protocol = ProtocolTCP
+	}
+	proto, ok := protocolNumbers[protocol]
+	if !ok {
+		n, err := strconv.ParseUint(protocol, 10, 8)
+		if err != nil {
+			return fmt.Errorf("unsupported protocol %s", protocol)
+		}
+		proto = uint8(n)
+	}
+	if port < 0 || port > 65535 {
+		return fmt.Errorf("invalid port %d", port)
+	}
+	nl.NewRtAttrChild(data, attrPort|nlattr.NetByteOrder, be16(uint16(port)))
+	nl.NewRtAttrChild(data, attrProto, nl.Uint8Attr(proto))
+	return nil
+}
+
+// decodeEntry decodes the data attribute of a listed entry into the format of `ipset list`
+func decodeEntry(b []byte, setType Type) (string, error) {
+	attrs, err := nlattr.Parse(b)
+	if err != nil {
+		return "", err
+	}
+	ip := func(attrType uint16) (string, error) {
+		nested, err := nlattr.Parse(attrs.Get(attrType))
+		if err != nil {
+			return "", err
+		}
+		for _, a := range nested {
+			if (a.Type == attrIPAddrIPv4 && len(a.Data) == net.IPv4len) || (a.Type == attrIPAddrIPv6 && len(a.Data) == net.IPv6len) {
+				return net.IP(a.Data).String(), nil
+			}
+		}
+		return "", fmt.Errorf("missing ip attribute %d", attrType)
+	}
+	ipNet := func(ipType, cidrType uint16) (string, error) {
+		addr, err := ip(ipType)
+		if err != nil {
+			return "", err
+		}
+		bits := 32
+		if strings.Contains(addr, ":") {
+			bits = 128
+		}
+		// ipset lists host networks without the prefix length
+		if v := attrs.Get(cidrType); len(v) == 1 && int(v[0]) != bits {
+			return fmt.Sprintf("%s/%d", addr, v[0]), nil
+		}
+		return addr, nil
+	}
+	port := func() (int, error) {
+		v := attrs.Get(attrPort)
+		if len(v) != 2 {
+			return 0, fmt.Errorf("missing port attribute")
+		}
+		return int(binary.BigEndian.Uint16(v)), nil
+	}
+	protoPort := func() (string, error) {
+		p, err := port()
+		if err != nil {
+			return "", err
+		}
+		protocol := "tcp"
+		if v := attrs.Get(attrProto); len(v) == 1 {
+			protocol = strconv.Itoa(int(v[0]))
+			for name, n := range protocolNumbers {
+				if n == v[0] {
+					protocol = name
+				}
+			}
+		}
+		return fmt.Sprintf("%s:%d", protocol, p), nil
+	}
+	var parts []string
+	add := func(part string, err error) error {
+		if err == nil {
+			parts = append(parts, part)
+		}
+		return err
+	}
+	switch setType {
+	case HashIP:
+		err = add(ip(attrIP))
+	case HashIPPort, HashIPPortIP, HashIPPortNet:
+		if err = add(ip(attrIP)); err != nil {
+			break
+		}
+		if err = add(protoPort()); err != nil {
+			break
+		}
+		if setType == HashIPPortIP {
+			err = add(ip(attrIP2))
+		} else if setType == HashIPPortNet {
+			err = add(ipNet(attrIP2, attrCIDR2))
+		}
+	case HashNet:
+		err = add(ipNet(attrIP, attrCIDR))
+	case HashNetPort:
+		if err = add(ipNet(attrIP, attrCIDR)); err != nil {
+			break
+		}
+		err = add(protoPort())
+	case BitmapPort:
+		var p int
+		if p, err = port(); err == nil {
+			parts = append(parts, strconv.Itoa(p))
+		}
+	default:
+		return "", fmt.Errorf("unsupported set type %s", setType)
+	}
+	if err != nil {
+		return "", err
+	}
+	entry := strings.Join(parts, ",")
+	if v := attrs.Get(attrTimeout); len(v) == 4 {
+		entry += fmt.Sprintf(" timeout %d", binary.BigEndian.Uint32(v))
+	}
+	return entry, nil
+}
+
+// parseMessage parses attributes of a reply following the nfgenmsg header
+func parseMessage(msg []byte) (nlattr.List, error) {
+	if len(msg) < nl.SizeofNfgenmsg {
+		return nil, fmt.Errorf("short message of %d bytes", len(msg))
+	}
+	return nlattr.Parse(msg[nl.SizeofNfgenmsg:])
+}
+
+var _ = Interface(&netlinkRunner{})
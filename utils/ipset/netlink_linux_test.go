@@ -0,0 +1,67 @@
+// +build linux
+
+package ipset
+
+import (
+	"testing"
+)
+
+func TestEncodeDecodeEntry(t *testing.T) {
+	for _, c := range []struct {
+		setType Type
+		entry   string
+		expect  string
+	}{
+		{setType: HashIP, entry: "10.0.0.1"},
+		{setType: HashIP, entry: "fd00::1"},
+		{setType: HashIPPort, entry: "10.0.0.1,udp:53"},
+		{setType: HashIPPort, entry: "10.0.0.1,80", expect: "10.0.0.1,tcp:80"},
+		{setType: HashIPPortIP, entry: "10.0.0.1,tcp:80,10.0.0.2"},
+		{setType: HashIPPortNet, entry: "10.0.0.1,sctp:80,10.0.0.0/8"},
+		{setType: HashIPPortNet, entry: "10.0.0.1,tcp:80,10.0.0.2/32", expect: "10.0.0.1,tcp:80,10.0.0.2"},
+		{setType: HashNet, entry: "192.168.1.0/24"},
+		{setType: HashNet, entry: "192.168.1.1"},
+		{setType: HashNetPort, entry: "fd00::/64,udp:53"},
+		{setType: BitmapPort, entry: "8080"},
+		{setType: HashIP, entry: "10.0.0.1 timeout 10"},
+	} {
+		if c.expect == "" {
+			c.expect = c.entry
+		}
+		e, err := ParseEntry(c.entry, c.setType)
+		if err != nil {
+			t.Fatalf("entry %s: %v", c.entry, err)
+		}
+		data, err := entryAttr(e)
+		if err != nil {
+			t.Fatalf("entry %s: %v", c.entry, err)
+		}
+		b := data.Serialize()
+		got, err := decodeEntry(b[4:], c.setType)
+		if err != nil {
+			t.Fatalf("entry %s: %v", c.entry, err)
+		}
+		if got != c.expect {
+			t.Errorf("entry %s: expect %s, got %s", c.entry, c.expect, got)
+		}
+	}
+	for _, c := range []struct {
+		setType Type
+		entry   string
+	}{
+		{setType: HashIP, entry: "10.0.0"},
+		{setType: HashIPPort, entry: "10.0.0.1"},
+		{setType: HashIPPort, entry: "10.0.0.1,foo:80"},
+		{setType: HashNet, entry: "10.0.0.0/33"},
+		{setType: BitmapPort, entry: "65536"},
+		{setType: HashIP, entry: "10.0.0.1 comment foo"},
+	} {
+		e, err := ParseEntry(c.entry, c.setType)
+		if err == nil {
+			_, err = entryAttr(e)
+		}
+		if err == nil {
+			t.Errorf("entry %s: expect error", c.entry)
+		}
+	}
+}
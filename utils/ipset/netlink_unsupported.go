@@ -0,0 +1,10 @@
+// +build !linux
+
+package ipset
+
+import "fmt"
+
+// NewNetlink returns an error since netfilter netlink is only available on linux
+func NewNetlink() (Interface, error) {
+	return nil, fmt.Errorf("ipset netlink unsupported on this platform")
+}
@@ -180,4 +180,58 @@ func (f *FakeIPSet) SaveAllSets() ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+// Restore is part of interface. It runs create, add, del, flush, swap and destroy commands of the script the
+// same way `ipset restore` does and stops at the first failing command.
+func (f *FakeIPSet) Restore(script []byte) error {
+	cmds, err := ipset.ParseRestoreScript(script)
+	if err != nil {
+		return err
+	}
+	for _, cmd := range cmds {
+		if err := f.restore(cmd); err != nil {
+			return fmt.Errorf("ipset restore failed at line %d %s %s: %v", cmd.Line, cmd.Command, cmd.Set, err)
+		}
+	}
+	return nil
+}
+
+func (f *FakeIPSet) restore(cmd ipset.RestoreCommand) error {
+	name := cmd.Set
+	if cmd.Command != "create" && f.Sets[name] == nil {
+		return fmt.Errorf("set %s does not exist", name)
+	}
+	switch cmd.Command {
+	case "create":
+		set, err := ipset.ParseCreateArgs(name, cmd.Args)
+		if err != nil {
+			return err
+		}
+		return f.CreateSet(set, cmd.Exist)
+	case "add":
+		return f.AddEntry(strings.Join(cmd.Args, " "), f.Sets[name], cmd.Exist)
+	case "del":
+		entry := strings.Join(cmd.Args, " ")
+		if !f.Entries[name].Has(entry) && !cmd.Exist {
+			return fmt.Errorf("element %s is not in set %s", entry, name)
+		}
+		return f.DelEntry(entry, name)
+	case "flush":
+		return f.FlushSet(name)
+	case "destroy":
+		return f.DestroySet(name)
+	case "swap":
+		other := cmd.Args[0]
+		if f.Sets[other] == nil {
+			return fmt.Errorf("swap needs two existing sets")
+		}
+		if f.Sets[name].SetType != f.Sets[other].SetType {
+			return fmt.Errorf("sets %s and %s have different types", name, other)
+		}
+		// sets have the same type, so exchanging names is the same as exchanging entries
+		f.Entries[name], f.Entries[other] = f.Entries[other], f.Entries[name]
+		return nil
+	}
+	return fmt.Errorf("unknown command %s", cmd.Command)
+}
+
 var _ = ipset.Interface(&FakeIPSet{})
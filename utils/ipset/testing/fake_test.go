@@ -149,4 +149,52 @@ func TestSetEntry(t *testing.T) {
 	}
 }
 
+func TestRestore(t *testing.T) {
+	fake := NewFake(testVersion)
+	set := &ipset.IPSet{Name: "foo", SetType: ipset.HashIPPort}
+	if err := fake.CreateSet(set, true); err != nil {
+		t.Fatal(err)
+	}
+	fake.AddEntry("192.168.1.1,tcp:8080", set, true)
+	fake.AddEntry("192.168.1.2,tcp:8081", set, true)
+
+	script := &ipset.RestoreScript{}
+	script.Replace(set, []string{"192.168.1.2,tcp:8081", "192.168.1.3,tcp:8082"})
+	script.Add(&ipset.IPSet{Name: "bar", SetType: ipset.HashIPPortNet}, []string{"192.168.1.3,tcp:8082,10.0.0.0/8"})
+	data, err := script.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.Restore(data); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := fake.ListEntries(set.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedEntries := sets.NewString("192.168.1.2,tcp:8081", "192.168.1.3,tcp:8082")
+	if !expectedEntries.Equal(sets.NewString(entries...)) {
+		t.Errorf("Unexpected entries mismatch, expected: %v, got: %v", expectedEntries, entries)
+	}
+	setList, err := fake.ListSets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the temporary set is destroyed
+	if expectedSets := sets.NewString("foo", "bar"); !expectedSets.Equal(sets.NewString(setList...)) {
+		t.Errorf("Unexpected sets mismatch, expected: %v, got: %v", expectedSets, setList)
+	}
+	if found, _ := fake.TestEntry("192.168.1.3,tcp:8082,10.0.0.0/8", "bar"); !found {
+		t.Errorf("Unexpected entry not found in set bar")
+	}
+
+	// invalid commands fail
+	if err := fake.Restore([]byte("add nonexist 192.168.1.1,tcp:8080\n")); err == nil {
+		t.Errorf("Expected error adding entry to nonexistent set")
+	}
+	if err := fake.Restore([]byte("create foo hash:ip,port\n")); err == nil {
+		t.Errorf("Expected error creating existing set without -exist")
+	}
+}
+
 // TODO: Test ignoreExistErr=false
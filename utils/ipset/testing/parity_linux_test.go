@@ -0,0 +1,154 @@
+// +build linux
+
+package testing
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/chenchun/kube-bmlb/utils/ipset"
+)
+
+// parityCase runs the same operations against the netlink runner and the fake and expects same results
+type parityCase struct {
+	set     *ipset.IPSet
+	entries []string
+	absent  string
+	// replace are entries replacing entries via a restore script
+	replace []string
+}
+
+var parityCases = []parityCase{
+	{set: &ipset.IPSet{SetType: ipset.HashIP}, entries: []string{"10.0.0.1", "10.0.0.2"}, absent: "10.0.0.3", replace: []string{"10.0.0.3"}},
+	{set: &ipset.IPSet{SetType: ipset.HashIPPort}, entries: []string{"10.0.0.1,tcp:80", "10.0.0.1,udp:53", "10.0.0.2,sctp:9000"}, absent: "10.0.0.1,udp:80", replace: []string{"10.0.0.2,tcp:443"}},
+	{set: &ipset.IPSet{SetType: ipset.HashIPPortIP}, entries: []string{"10.0.0.1,tcp:80,10.0.0.1"}, absent: "10.0.0.1,tcp:80,10.0.0.2", replace: []string{"10.0.0.1,udp:53,10.0.0.3"}},
+	{set: &ipset.IPSet{SetType: ipset.HashIPPortNet}, entries: []string{"10.0.0.1,tcp:80,192.168.0.0/16", "10.0.0.1,tcp:80,172.16.0.1"}, absent: "10.0.0.2,tcp:80,192.168.0.0/16", replace: nil},
+	{set: &ipset.IPSet{SetType: ipset.HashNet}, entries: []string{"192.168.0.0/24", "10.0.0.1"}, absent: "192.168.1.0/24", replace: []string{"172.16.0.0/12"}},
+	{set: &ipset.IPSet{SetType: ipset.HashNetPort}, entries: []string{"192.168.0.0/24,tcp:80"}, absent: "192.168.0.0/24,udp:80", replace: []string{"10.0.0.0/8,udp:53"}},
+	{set: &ipset.IPSet{SetType: ipset.BitmapPort, PortRange: "1-1024"}, entries: []string{"22", "80"}, absent: "443", replace: []string{"443"}},
+	{set: &ipset.IPSet{SetType: ipset.HashIP, HashFamily: ipset.ProtocolFamilyIPV6}, entries: []string{"fd00::1", "2001:db8::2"}, absent: "fd00::2", replace: []string{"fd00::3"}},
+}
+
+func TestNetlinkParity(t *testing.T) {
+	runner, err := ipset.NewNetlink()
+	if err != nil {
+		t.Skipf("skip as %v", err)
+	}
+	for i, c := range parityCases {
+		c.set.Name = fmt.Sprintf("bmlb-parity-%d-%d", os.Getpid(), i)
+		fake := NewFake(testVersion)
+		func() {
+			defer runner.DestroySet(ipset.TempSetName(c.set.Name))
+			defer runner.DestroySet(c.set.Name)
+			checkParity(t, c, runner, fake)
+		}()
+	}
+}
+
+func checkParity(t *testing.T, c parityCase, runner, fake ipset.Interface) {
+	name := fmt.Sprintf("%s %s", c.set.SetType, c.set.HashFamily)
+	impls := []ipset.Interface{runner, fake}
+	for _, impl := range impls {
+		set := *c.set
+		if err := impl.CreateSet(&set, false); err != nil {
+			t.Fatalf("case %s: %v", name, err)
+		}
+		if err := impl.CreateSet(&set, false); err == nil {
+			t.Errorf("case %s: expect error creating existing set", name)
+		}
+		if err := impl.CreateSet(&set, true); err != nil {
+			t.Errorf("case %s: %v", name, err)
+		}
+		for _, entry := range c.entries {
+			if err := impl.AddEntry(entry, &set, false); err != nil {
+				t.Fatalf("case %s: %v", name, err)
+			}
+		}
+		if err := impl.AddEntry(c.entries[0], &set, false); err == nil {
+			t.Errorf("case %s: expect error adding existing entry", name)
+		}
+		if err := impl.AddEntry(c.entries[0], &set, true); err != nil {
+			t.Errorf("case %s: %v", name, err)
+		}
+	}
+	compare := func(step string, f func(ipset.Interface) (interface{}, error)) {
+		var results []interface{}
+		for _, impl := range impls {
+			result, err := f(impl)
+			if err != nil {
+				t.Fatalf("case %s %s: %v", name, step, err)
+			}
+			results = append(results, result)
+		}
+		if !reflect.DeepEqual(results[0], results[1]) {
+			t.Errorf("case %s %s: netlink got %v, fake got %v", name, step, results[0], results[1])
+		}
+	}
+	list := func(impl ipset.Interface) (interface{}, error) {
+		entries, err := impl.ListEntries(c.set.Name)
+		sort.Strings(entries)
+		return entries, err
+	}
+	compare("list", list)
+	compare("test", func(impl ipset.Interface) (interface{}, error) {
+		var found []bool
+		for _, entry := range append(c.entries, c.absent) {
+			ok, err := impl.TestEntry(entry, c.set.Name)
+			if err != nil {
+				return nil, err
+			}
+			found = append(found, ok)
+		}
+		return found, nil
+	})
+	compare("del", func(impl ipset.Interface) (interface{}, error) {
+		if err := impl.DelEntry(c.entries[0], c.set.Name); err != nil {
+			return nil, err
+		}
+		return list(impl)
+	})
+	compare("restore", func(impl ipset.Interface) (interface{}, error) {
+		var script ipset.RestoreScript
+		set := *c.set
+		script.Replace(&set, c.replace)
+		data, err := script.Bytes()
+		if err != nil {
+			return nil, err
+		}
+		if err := impl.Restore(data); err != nil {
+			return nil, err
+		}
+		return list(impl)
+	})
+	compare("sets", func(impl ipset.Interface) (interface{}, error) {
+		sets, err := impl.ListSets()
+		var found []string
+		for _, s := range sets {
+			if s == c.set.Name || s == ipset.TempSetName(c.set.Name) {
+				found = append(found, s)
+			}
+		}
+		return found, err
+	})
+	compare("flush", func(impl ipset.Interface) (interface{}, error) {
+		if err := impl.FlushSet(c.set.Name); err != nil {
+			return nil, err
+		}
+		return list(impl)
+	})
+	compare("destroy", func(impl ipset.Interface) (interface{}, error) {
+		if err := impl.DestroySet(c.set.Name); err != nil {
+			return nil, err
+		}
+		sets, err := impl.ListSets()
+		for _, s := range sets {
+			if s == c.set.Name {
+				return true, err
+			}
+		}
+		return false, err
+	})
+}
@@ -0,0 +1,75 @@
+// Package nftables runs nft scripts. A script is applied by a single `nft -f` which is one transaction, so
+// either all commands of it take effect or none does.
+package nftables
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/golang/glog"
+	utilexec "k8s.io/utils/exec"
+)
+
+// Family is the address family of a table
+type Family string
+
+const (
+	FamilyIPv4 Family = "ip"
+	FamilyIPv6 Family = "ip6"
+	FamilyInet Family = "inet"
+)
+
+// NftCmd is the nft command
+const NftCmd = "nft"
+
+// Interface is an injectable interface for running nft commands. Implementations must be goroutine-safe.
+type Interface interface {
+	// Apply runs script atomically
+	Apply(script []byte) error
+	// ListTable returns the ruleset of table in the format of `nft list table`, exist is false if there is
+	// no such table
+	ListTable(family Family, table string) (data []byte, exist bool, err error)
+	// Present returns true if the nft command is available
+	Present() bool
+}
+
+type runner struct {
+	exec utilexec.Interface
+}
+
+// New returns a new Interface which will exec nft.
+func New(exec utilexec.Interface) Interface {
+	return &runner{exec: exec}
+}
+
+// Apply runs `nft -f -` with script as stdin
+func (r *runner) Apply(script []byte) error {
+	glog.V(5).Infof("running nft -f - with\n%s", string(script))
+	cmd := r.exec.Command(NftCmd, "-f", "-")
+	cmd.SetStdin(bytes.NewReader(script))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("error applying nft script: %v (%s)", err, out)
+	}
+	return nil
+}
+
+// ListTable runs `nft list table`
+func (r *runner) ListTable(family Family, table string) ([]byte, bool, error) {
+	out, err := r.exec.Command(NftCmd, "list", "table", string(family), table).CombinedOutput()
+	if err != nil {
+		if strings.Contains(string(out), "No such file or directory") {
+			return nil, false, nil
+		}
+		return nil, false, fmt.Errorf("error listing table %s %s: %v (%s)", family, table, err, out)
+	}
+	return out, true, nil
+}
+
+// Present checks if nft is in PATH
+func (r *runner) Present() bool {
+	_, err := r.exec.LookPath(NftCmd)
+	return err == nil
+}
+
+var _ = Interface(&runner{})
@@ -0,0 +1,97 @@
+package testing
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/chenchun/kube-bmlb/utils/nftables"
+)
+
+// FakeNftables keeps tables defined by `table <family> <name> { ... }` blocks of applied scripts. It supports
+// add, delete and flush table commands and table blocks which replace the content of tables.
+type FakeNftables struct {
+	// Tables maps "<family> <name>" to the listing of the table
+	Tables map[string]string
+}
+
+// NewFake creates a new fake nftables interface
+func NewFake() *FakeNftables {
+	return &FakeNftables{Tables: map[string]string{}}
+}
+
+// Apply is part of interface. Like nft, nothing changes if any command fails.
+func (f *FakeNftables) Apply(script []byte) error {
+	tables := map[string]string{}
+	for k, v := range f.Tables {
+		tables[k] = v
+	}
+	lines := strings.Split(string(script), "\n")
+	for i := 0; i < len(lines); i++ {
+		fields := strings.Fields(lines[i])
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if fields[0] == "table" {
+			if len(fields) != 4 || fields[3] != "{" {
+				return fmt.Errorf("line %d: invalid table block %q", i+1, lines[i])
+			}
+			// the block ends at the line closing the brace of the table
+			depth, block := 0, []string{}
+			j := i
+			for ; j < len(lines); j++ {
+				depth += strings.Count(lines[j], "{") - strings.Count(lines[j], "}")
+				block = append(block, lines[j])
+				if depth == 0 {
+					break
+				}
+			}
+			if depth != 0 {
+				return fmt.Errorf("line %d: unclosed table block", i+1)
+			}
+			tables[fields[1]+" "+fields[2]] = strings.Join(block, "\n") + "\n"
+			i = j
+			continue
+		}
+		if len(fields) != 4 || fields[1] != "table" {
+			return fmt.Errorf("line %d: unsupported command %q", i+1, lines[i])
+		}
+		key := fields[2] + " " + fields[3]
+		_, exist := tables[key]
+		switch fields[0] {
+		case "add":
+			if !exist {
+				tables[key] = fmt.Sprintf("table %s {\n}\n", key)
+			}
+		case "delete":
+			if !exist {
+				return fmt.Errorf("line %d: table %s does not exist", i+1, key)
+			}
+			delete(tables, key)
+		case "flush":
+			if !exist {
+				return fmt.Errorf("line %d: table %s does not exist", i+1, key)
+			}
+			tables[key] = fmt.Sprintf("table %s {\n}\n", key)
+		default:
+			return fmt.Errorf("line %d: unsupported command %q", i+1, lines[i])
+		}
+	}
+	f.Tables = tables
+	return nil
+}
+
+// ListTable is part of interface
+func (f *FakeNftables) ListTable(family nftables.Family, table string) ([]byte, bool, error) {
+	data, exist := f.Tables[string(family)+" "+table]
+	if !exist {
+		return nil, false, nil
+	}
+	return []byte(data), true, nil
+}
+
+// Present is part of interface
+func (f *FakeNftables) Present() bool {
+	return true
+}
+
+var _ = nftables.Interface(&FakeNftables{})
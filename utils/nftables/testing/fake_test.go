@@ -0,0 +1,43 @@
+package testing
+
+import (
+	"testing"
+
+	"github.com/chenchun/kube-bmlb/utils/nftables"
+)
+
+func TestApply(t *testing.T) {
+	fake := NewFake()
+	script := `add table ip foo
+delete table ip foo
+table ip foo {
+	chain input {
+		type filter hook input priority 0; policy accept;
+		ip daddr { 10.0.0.1, 10.0.0.2 } drop
+	}
+}
+`
+	if err := fake.Apply([]byte(script)); err != nil {
+		t.Fatal(err)
+	}
+	data, exist, err := fake.ListTable(nftables.FamilyIPv4, "foo")
+	if err != nil || !exist {
+		t.Fatal(exist, err)
+	}
+	if string(data) != script[len("add table ip foo\ndelete table ip foo\n"):] {
+		t.Fatal(string(data))
+	}
+	// a failing command leaves tables untouched
+	if err := fake.Apply([]byte("delete table ip foo\ndelete table ip bar\n")); err == nil {
+		t.Fatal("expect error deleting a missing table")
+	}
+	if _, exist, _ := fake.ListTable(nftables.FamilyIPv4, "foo"); !exist {
+		t.Fatal("expect table foo")
+	}
+	if err := fake.Apply([]byte("delete table ip foo\n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, exist, _ := fake.ListTable(nftables.FamilyIPv4, "foo"); exist {
+		t.Fatal("unexpected table foo")
+	}
+}
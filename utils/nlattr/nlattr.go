@@ -0,0 +1,79 @@
+// Package nlattr parses attributes of netlink messages shared by ipvs, ipset and conntrack netlink clients
+package nlattr
+
+import (
+	"encoding/binary"
+	"fmt"
+	"unsafe"
+)
+
+const (
+	// Nested is NLA_F_NESTED of attribute types
+	Nested = 1 << 15
+	// NetByteOrder is NLA_F_NET_BYTEORDER of attribute types, netfilter sets it on big endian values
+	NetByteOrder = 1 << 14
+	typeMask     = ^uint16(Nested | NetByteOrder)
+
+	headerLen = 4
+	alignTo   = 4
+)
+
+// Attr is a netlink attribute whose type has flags cleared
+type Attr struct {
+	Type uint16
+	Data []byte
+}
+
+// List is attributes in the order of a message
+type List []Attr
+
+// Get returns data of the first attribute of attrType or nil
+func (l List) Get(attrType uint16) []byte {
+	for _, a := range l {
+		if a.Type == attrType {
+			return a.Data
+		}
+	}
+	return nil
+}
+
+// Parse parses netlink attributes, nested and byte order flags are cleared from types
+func Parse(b []byte) (List, error) {
+	native := nativeEndian()
+	var attrs List
+	for len(b) >= headerLen {
+		length := int(native.Uint16(b[0:2]))
+		if length < headerLen || length > len(b) {
+			return nil, fmt.Errorf("invalid attribute length %d", length)
+		}
+		attrs = append(attrs, Attr{Type: native.Uint16(b[2:4]) & typeMask, Data: b[headerLen:length]})
+		aligned := (length + alignTo - 1) &^ (alignTo - 1)
+		if aligned > len(b) {
+			break
+		}
+		b = b[aligned:]
+	}
+	return attrs, nil
+}
+
+// ParseMap parses netlink attributes by type, the last one of a type wins
+func ParseMap(b []byte) (map[uint16][]byte, error) {
+	attrs, err := Parse(b)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[uint16][]byte, len(attrs))
+	for _, a := range attrs {
+		m[a.Type] = a.Data
+	}
+	return m, nil
+}
+
+// nativeEndian returns the byte order of attribute headers which is the byte order of the host
+func nativeEndian() binary.ByteOrder {
+	var x uint16 = 1
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}
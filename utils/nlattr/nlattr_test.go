@@ -0,0 +1,50 @@
+package nlattr
+
+import (
+	"bytes"
+	"testing"
+)
+
+// attr encodes an attribute in the byte order of the host
+func attr(attrType uint16, data []byte) []byte {
+	b := make([]byte, headerLen, headerLen+len(data)+alignTo)
+	nativeEndian().PutUint16(b[0:2], uint16(headerLen+len(data)))
+	nativeEndian().PutUint16(b[2:4], attrType)
+	b = append(b, data...)
+	for len(b)%alignTo != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func TestParse(t *testing.T) {
+	nested := attr(2|Nested, attr(1|NetByteOrder, []byte{0, 80}))
+	msg := append(append(attr(1, []byte("abc")), nested...), attr(1, []byte("d"))...)
+	attrs, err := Parse(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attrs) != 3 || attrs[0].Type != 1 || attrs[1].Type != 2 || attrs[2].Type != 1 {
+		t.Fatalf("unexpected attrs %+v", attrs)
+	}
+	if data := attrs.Get(1); string(data) != "abc" {
+		t.Fatalf("expect the first attribute, got %q", data)
+	}
+	inner, err := ParseMap(attrs.Get(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(inner[1], []byte{0, 80}) {
+		t.Fatalf("unexpected nested attrs %v", inner)
+	}
+	m, err := ParseMap(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(m[1]) != "d" {
+		t.Fatalf("expect the last attribute, got %q", m[1])
+	}
+	if _, err := Parse([]byte{100, 0, 1, 0}); err == nil {
+		t.Fatal("expect an error of invalid length")
+	}
+}
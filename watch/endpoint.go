@@ -14,6 +14,8 @@ type EndpointsWatcher struct {
 	EndpointsController cache.Controller
 	EndpointsLister     cache.Indexer
 	endpointsHandler    EndpointsHandler
+	// done is closed when the informer stops
+	done chan struct{}
 }
 
 func (w *EndpointsWatcher) endpointsAddEventHandler(obj interface{}) {
@@ -60,6 +62,16 @@ func (ew *EndpointsWatcher) HasSynced() bool {
 	return ew.EndpointsController.HasSynced()
 }
 
+// Running returns false once the informer stops
+func (ew *EndpointsWatcher) Running() bool {
+	select {
+	case <-ew.done:
+		return false
+	default:
+		return true
+	}
+}
+
 var endpointsStopCh chan struct{}
 
 func StartEndpointsWatcher(clientset *kubernetes.Clientset, resyncPeriod time.Duration, h EndpointsHandler) *EndpointsWatcher {
@@ -77,7 +89,11 @@ func StartEndpointsWatcher(clientset *kubernetes.Clientset, resyncPeriod time.Du
 		cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc},
 	)
 	endpointsStopCh = make(chan struct{})
-	go ew.EndpointsController.Run(endpointsStopCh)
+	ew.done = make(chan struct{})
+	go func() {
+		defer close(ew.done)
+		ew.EndpointsController.Run(endpointsStopCh)
+	}()
 	return &ew
 }
 
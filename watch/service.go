@@ -14,6 +14,8 @@ type ServiceWatcher struct {
 	ServiceController cache.Controller
 	ServiceLister     cache.Indexer
 	eventHandler      ServiceHandler
+	// done is closed when the informer stops
+	done chan struct{}
 }
 
 func (w *ServiceWatcher) serviceAddEventHandler(obj interface{}) {
@@ -66,6 +68,16 @@ func (svcw *ServiceWatcher) HasSynced() bool {
 	return svcw.ServiceController.HasSynced()
 }
 
+// Running returns false once the informer stops
+func (svcw *ServiceWatcher) Running() bool {
+	select {
+	case <-svcw.done:
+		return false
+	default:
+		return true
+	}
+}
+
 var servicesStopCh chan struct{}
 
 func StartServiceWatcher(client *kubernetes.Clientset, resyncPeriod time.Duration, sh ServiceHandler) *ServiceWatcher {
@@ -83,7 +95,11 @@ func StartServiceWatcher(client *kubernetes.Clientset, resyncPeriod time.Duratio
 		cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc},
 	)
 	servicesStopCh = make(chan struct{})
-	go w.ServiceController.Run(servicesStopCh)
+	w.done = make(chan struct{})
+	go func() {
+		defer close(w.done)
+		w.ServiceController.Run(servicesStopCh)
+	}()
 	return &w
 }
 